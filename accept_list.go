@@ -0,0 +1,17 @@
+package gatt
+
+import "fmt"
+
+// An AcceptListFullError is returned by Device.AddToAcceptList when the
+// Filter Accept List of the controller has no room left for Addr.
+type AcceptListFullError struct {
+	Addr Address
+	Size int // devices the list holds at most, 0 if unknown
+}
+
+func (e *AcceptListFullError) Error() string {
+	if e.Size == 0 {
+		return fmt.Sprintf("gatt: accept list full, cannot add %s", e.Addr)
+	}
+	return fmt.Sprintf("gatt: accept list full (%d devices), cannot add %s", e.Size, e.Addr)
+}
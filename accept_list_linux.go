@@ -0,0 +1,20 @@
+package gatt
+
+import "github.com/PayRange/gatt/linux"
+
+func (d *device) AddToAcceptList(a Address) error {
+	err := d.hci.AddToAcceptList(a.hciType(), a.Addr)
+	if err == linux.ErrAcceptListFull {
+		n, _ := d.hci.AcceptListSize()
+		return &AcceptListFullError{Addr: a, Size: n}
+	}
+	return err
+}
+
+func (d *device) RemoveFromAcceptList(a Address) error {
+	return d.hci.RemoveFromAcceptList(a.hciType(), a.Addr)
+}
+
+func (d *device) ClearAcceptList() error {
+	return d.hci.ClearAcceptList()
+}
@@ -0,0 +1,22 @@
+package gatt
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestAcceptListFullError(t *testing.T) {
+	a := Address{Addr: [6]byte{0xC0, 0x26, 0xDF, 0x00, 0x10, 0x01}, Type: StaticRandomAddress}
+	var err error = fmt.Errorf("adding kiosk: %w", &AcceptListFullError{Addr: a, Size: 16})
+	var e *AcceptListFullError
+	if !errors.As(err, &e) || e.Addr != a || e.Size != 16 {
+		t.Fatalf("got %v", err)
+	}
+	if got, want := e.Error(), "gatt: accept list full (16 devices), cannot add C0:26:DF:00:10:01"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := (&AcceptListFullError{Addr: a}).Error(), "gatt: accept list full, cannot add C0:26:DF:00:10:01"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,114 @@
+package gatt
+
+import (
+	"crypto/rand"
+	"net"
+	"strings"
+)
+
+// An AddressType is the type of a Bluetooth device address.
+type AddressType int
+
+const (
+	PublicAddress            AddressType = iota // assigned to the controller
+	StaticRandomAddress                         // random, kept until changed
+	ResolvablePrivateAddress                    // random, resolvable with an IRK
+)
+
+func (t AddressType) String() string {
+	switch t {
+	case PublicAddress:
+		return "public"
+	case StaticRandomAddress:
+		return "static random"
+	case ResolvablePrivateAddress:
+		return "resolvable private"
+	}
+	return "unknown"
+}
+
+// An Address is a Bluetooth device address, with its type.
+type Address struct {
+	Addr [6]byte // most significant octet first
+	Type AddressType
+}
+
+// String returns the address as Peripheral.ID formats them.
+func (a Address) String() string {
+	return strings.ToUpper(net.HardwareAddr(a.Addr[:]).String())
+}
+
+// hciType returns the type of a as HCI commands take it: 0x00 public,
+// 0x01 random.
+func (a Address) hciType() uint8 {
+	if a.Type == PublicAddress {
+		return 0x00
+	}
+	return 0x01
+}
+
+// newStaticRandomAddress returns a static random address: the two most
+// significant bits set, the others random, but neither all zeros nor all
+// ones.
+func newStaticRandomAddress() ([6]byte, error) {
+	var a [6]byte
+	for {
+		if _, err := rand.Read(a[:]); err != nil {
+			return a, err
+		}
+		a[0] |= 0xC0
+		if !randomPartUniform(a[:]) {
+			return a, nil
+		}
+	}
+}
+
+// newResolvablePrivateAddress returns a resolvable private address for
+// the identity resolving key irk: a random part, prand, with the two most
+// significant bits 01, followed by its hash with irk.
+func newResolvablePrivateAddress(irk [16]byte) ([6]byte, error) {
+	var a [6]byte
+	for {
+		if _, err := rand.Read(a[:3]); err != nil {
+			return a, err
+		}
+		a[0] = a[0]&0x3F | 0x40
+		if !randomPartUniform(a[:3]) {
+			break
+		}
+	}
+	h := smpAh(irk, [3]byte{a[2], a[1], a[0]})
+	a[3], a[4], a[5] = h[2], h[1], h[0]
+	return a, nil
+}
+
+// resolvesTo reports whether a is a resolvable private address of irk.
+func resolvesTo(a [6]byte, irk [16]byte) bool {
+	if a[0]&0xC0 != 0x40 {
+		return false
+	}
+	h := smpAh(irk, [3]byte{a[2], a[1], a[0]})
+	return h == [3]byte{a[5], a[4], a[3]}
+}
+
+// randomPartUniform reports whether the bits of b below the two most
+// significant ones, which give the type of a random address, are all
+// zeros or all ones.
+func randomPartUniform(b []byte) bool {
+	zeros, ones := b[0]&0x3F == 0, b[0]&0x3F == 0x3F
+	for _, c := range b[1:] {
+		zeros = zeros && c == 0
+		ones = ones && c == 0xFF
+	}
+	return zeros || ones
+}
+
+// smpAh is the random address hash function ah, of the key k and the 24
+// bits r. As the values of the protocol, both and the hash are least
+// significant octet first.
+func smpAh(k [16]byte, r [3]byte) [3]byte {
+	var b [16]byte
+	copy(b[:], r[:])
+	e := smpE(k, b)
+	return [3]byte{e[0], e[1], e[2]}
+}
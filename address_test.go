@@ -0,0 +1,46 @@
+package gatt
+
+import "testing"
+
+func TestStaticRandomAddress(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		a, err := newStaticRandomAddress()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a[0]&0xC0 != 0xC0 || randomPartUniform(a[:]) {
+			t.Fatalf("% X is not a static random address", a)
+		}
+	}
+}
+
+func TestResolvablePrivateAddress(t *testing.T) {
+	var irk, other [16]byte
+	copy(irk[:], lsb(t, "ec0234a357c8ad05341010a60a397d9b"))
+	other[0] = 0x01
+	a, err := newResolvablePrivateAddress(irk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a[0]&0xC0 != 0x40 {
+		t.Errorf("% X is not a resolvable private address", a)
+	}
+	if !resolvesTo(a, irk) {
+		t.Errorf("% X does not resolve to its IRK", a)
+	}
+	if resolvesTo(a, other) {
+		t.Errorf("% X resolves to another IRK", a)
+	}
+}
+
+func TestSMPAh(t *testing.T) {
+	// The sample data of the specification.
+	var k [16]byte
+	var r [3]byte
+	copy(k[:], lsb(t, "ec0234a357c8ad05341010a60a397d9b"))
+	copy(r[:], lsb(t, "708194"))
+	got := smpAh(k, r)
+	if want := lsb(t, "0dfbaa"); string(got[:]) != string(want) {
+		t.Errorf("ah: got % X, want % X", got, want)
+	}
+}
@@ -87,13 +87,13 @@ func (a *Advertisement) unmarshall(b []byte) error {
 		return u
 	}
 
-	for len(b) > 0 {
-		if len(b) < 2 {
-			return errors.New("invalid advertise data")
-		}
+	// Stop at a zero length, which ends the significant part of a packet,
+	// and at a structure running past the end of b, as garbage in the
+	// padding after the last structure does: keep what came before.
+	for len(b) > 1 {
 		l, t := b[0], b[1]
-		if len(b) < int(1+l) {
-			return errors.New("invalid advertise data")
+		if l == 0 || len(b) < int(1+l) {
+			break
 		}
 		d := b[2 : 1+l]
 		switch t {
@@ -116,7 +116,9 @@ func (a *Advertisement) unmarshall(b []byte) error {
 		case typeCompleteName:
 			a.LocalName = string(d)
 		case typeTxPower:
-			a.TxPowerLevel = int(d[0])
+			if len(d) > 0 {
+				a.TxPowerLevel = int(d[0])
+			}
 		case typeServiceSol16:
 			a.SolicitedService = uuidList(a.SolicitedService, d, 2)
 		case typeServiceSol128:
@@ -126,9 +128,12 @@ func (a *Advertisement) unmarshall(b []byte) error {
 		case typeManufacturerData:
 			a.ManufacturerData = make([]byte, len(d))
 			copy(a.ManufacturerData, d)
-		// case typeServiceData16,
-		// case typeServiceData32,
-		// case typeServiceData128:
+		case typeServiceData16:
+			a.ServiceData = serviceData(a.ServiceData, d, 2)
+		case typeServiceData32:
+			a.ServiceData = serviceData(a.ServiceData, d, 4)
+		case typeServiceData128:
+			a.ServiceData = serviceData(a.ServiceData, d, 16)
 		default:
 			log.Printf("DATA: [ % X ]", d)
 		}
@@ -137,6 +142,16 @@ func (a *Advertisement) unmarshall(b []byte) error {
 	return nil
 }
 
+// serviceData appends the service data in d, for a UUID of w bytes, to sd.
+func serviceData(sd []ServiceData, d []byte, w int) []ServiceData {
+	if len(d) < w {
+		return sd
+	}
+	b := make([]byte, len(d))
+	copy(b, d)
+	return append(sd, ServiceData{UUID: UUID{b[:w]}, Data: b[w:]})
+}
+
 // AdvPacket is an utility to help crafting advertisment or scan response data.
 type AdvPacket struct {
 	b []byte
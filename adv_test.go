@@ -1,6 +1,9 @@
 package gatt
 
-import "testing"
+import (
+	"bytes"
+	"testing"
+)
 
 // TODO:
 func TestAppendField(t *testing.T) {}
@@ -108,3 +111,24 @@ func TestAppendUUIDFit(t *testing.T) {
 	// 	}
 	// }
 }
+
+func TestUnmarshallPadding(t *testing.T) {
+	// A whole 31-byte buffer as a CSR dongle reports it, with a stray
+	// byte in the padding that would claim more bytes than are left.
+	b := []byte{
+		0x02, typeFlags, 0x06,
+		0x03, typeCompleteName, 'P', 'R',
+		0x05, typeManufacturerData, 0xc9, 0x02, 0x00, 0x01,
+		0x02, typeTxPower, 0xf4,
+		0x1e, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	}
+	for _, raw := range [][]byte{b, b[:16], append(b[:16:16], 0x00, 0x5a)} {
+		a := &Advertisement{}
+		if err := a.unmarshall(raw); err != nil {
+			t.Errorf("unmarshall(% x): %v", raw, err)
+		}
+		if a.LocalName != "PR" || !bytes.Equal(a.ManufacturerData, []byte{0xc9, 0x02, 0x00, 0x01}) || a.TxPowerLevel != 0xf4 {
+			t.Errorf("unmarshall(% x): got %+v", raw, a)
+		}
+	}
+}
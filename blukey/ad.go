@@ -0,0 +1,250 @@
+package blukey
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// AD types used by the helpers below.
+const (
+	ADFlags            = 0x01
+	ADSomeUUID128      = 0x06 // incomplete list of 128-bit service UUIDs
+	ADAllUUID128       = 0x07 // complete list of 128-bit service UUIDs
+	ADShortName        = 0x08
+	ADCompleteName     = 0x09
+	ADTxPower          = 0x0a
+	ADManufacturerData = 0xff
+)
+
+// An ADStructure is one element of advertising data: its AD type and the
+// data following it.
+type ADStructure struct {
+	Type byte
+	Data []byte
+}
+
+// ParseADStructures splits raw advertising data into its AD structures.
+// It stops at a zero length, which ends the significant part of a packet,
+// and at a structure running past the end of raw, so malformed data
+// yields the structures before the damage. Data slices share raw.
+func ParseADStructures(raw []byte) []ADStructure {
+	var ads []ADStructure
+	it := adIter{raw}
+	for ad, ok := it.next(); ok; ad, ok = it.next() {
+		ads = append(ads, ad)
+	}
+	return ads
+}
+
+// adIter steps through the AD structures of raw as ParseADStructures
+// splits them, without allocating.
+type adIter struct {
+	raw []byte
+}
+
+func (it *adIter) next() (ADStructure, bool) {
+	if len(it.raw) == 0 {
+		return ADStructure{}, false
+	}
+	n := int(it.raw[0])
+	if n == 0 || n+1 > len(it.raw) {
+		it.raw = nil
+		return ADStructure{}, false
+	}
+	ad := ADStructure{Type: it.raw[1], Data: it.raw[2 : n+1]}
+	it.raw = it.raw[n+1:]
+	return ad, true
+}
+
+// DiscoveryFlags are the bits of the Flags AD structure.
+type DiscoveryFlags byte
+
+const (
+	FlagLimitedDiscoverable DiscoveryFlags = 0x01 // LE Limited Discoverable Mode
+	FlagGeneralDiscoverable DiscoveryFlags = 0x02 // LE General Discoverable Mode
+	FlagBREDRNotSupported   DiscoveryFlags = 0x04 // BR/EDR Not Supported
+)
+
+// Flags returns the flags in raw.
+func Flags(raw []byte) (DiscoveryFlags, bool) {
+	it := adIter{raw}
+	for ad, ok := it.next(); ok; ad, ok = it.next() {
+		if ad.Type == ADFlags && len(ad.Data) >= 1 {
+			return DiscoveryFlags(ad.Data[0]), true
+		}
+	}
+	return 0, false
+}
+
+// ADInfo holds the standard AD structures sent along with an
+// advertisement, which tell how to reach the device. Whether the device
+// accepts connections is not among them: it is given by the type of the
+// advertising PDU, reported by gatt as Advertisement.Connectable.
+type ADInfo struct {
+	Flags      DiscoveryFlags
+	HasFlags   bool
+	TxPower    int8 // dBm
+	HasTxPower bool
+}
+
+// ParseADInfo returns the flags and TX power level in raw.
+func ParseADInfo(raw []byte) ADInfo {
+	var i ADInfo
+	i.Flags, i.HasFlags = Flags(raw)
+	i.TxPower, i.HasTxPower = TxPower(raw)
+	return i
+}
+
+// Discoverable reports whether the device is in the limited or general
+// discoverable mode.
+func (i ADInfo) Discoverable() bool {
+	return i.Flags&(FlagLimitedDiscoverable|FlagGeneralDiscoverable) != 0
+}
+
+// PathLoss returns the attenuation of the signal between the device and
+// the receiver, in dB, from the TX power level and the rssi measured. It
+// grows with the distance to the device. It fails without a TX power
+// level.
+func (i ADInfo) PathLoss(rssi int) (int, bool) {
+	if !i.HasTxPower {
+		return 0, false
+	}
+	return int(i.TxPower) - rssi, true
+}
+
+// LocalName returns the complete local name in raw, or the shortened one
+// if there is no complete name.
+func LocalName(raw []byte) (string, bool) {
+	var short []byte
+	found := false
+	it := adIter{raw}
+	for ad, ok := it.next(); ok; ad, ok = it.next() {
+		switch ad.Type {
+		case ADCompleteName:
+			return string(ad.Data), true
+		case ADShortName:
+			if !found {
+				short, found = ad.Data, true
+			}
+		}
+	}
+	return string(short), found
+}
+
+// TxPower returns the TX power level in raw, in dBm.
+func TxPower(raw []byte) (int8, bool) {
+	it := adIter{raw}
+	for ad, ok := it.next(); ok; ad, ok = it.next() {
+		if ad.Type == ADTxPower && len(ad.Data) == 1 {
+			return int8(ad.Data[0]), true
+		}
+	}
+	return 0, false
+}
+
+// ManufacturerData returns the data following the company ID of the
+// first manufacturer specific data in raw with the given company ID.
+func ManufacturerData(raw []byte, companyID uint16) ([]byte, bool) {
+	it := adIter{raw}
+	for ad, ok := it.next(); ok; ad, ok = it.next() {
+		if ad.Type == ADManufacturerData && len(ad.Data) >= 2 && binary.LittleEndian.Uint16(ad.Data) == companyID {
+			return ad.Data[2:], true
+		}
+	}
+	return nil, false
+}
+
+// An MSD is a manufacturer specific data structure, split into the
+// company ID, the sub-type byte following it and the rest.
+type MSD struct {
+	CompanyID uint16 `json:"companyId"`
+	SubType   byte   `json:"subType"`
+	Payload   []byte `json:"payload"`
+}
+
+func (m MSD) String() string {
+	return fmt.Sprintf("%#04x/%#02x: % x", m.CompanyID, m.SubType, m.Payload)
+}
+
+// parseMSD splits ad if it is manufacturer specific data. The Payload
+// shares ad.Data.
+func parseMSD(ad ADStructure) (MSD, bool) {
+	d := ad.Data
+	if ad.Type != ADManufacturerData || len(d) < 2 {
+		return MSD{}, false
+	}
+	m := MSD{CompanyID: binary.LittleEndian.Uint16(d)}
+	if len(d) > 2 {
+		m.SubType, m.Payload = d[2], d[3:]
+	}
+	return m, true
+}
+
+func cloneMSDs(ms []MSD) []MSD {
+	if ms == nil {
+		return nil
+	}
+	c := make([]MSD, len(ms))
+	for i, m := range ms {
+		c[i] = MSD{CompanyID: m.CompanyID, SubType: m.SubType, Payload: cloneBytes(m.Payload)}
+	}
+	return c
+}
+
+// ExtractMSD returns the data following the company ID of every
+// manufacturer specific data structure in raw with the given company ID,
+// in order. The slices share raw.
+func ExtractMSD(raw []byte, companyID uint16) [][]byte {
+	var ds [][]byte
+	it := adIter{raw}
+	for ad, ok := it.next(); ok; ad, ok = it.next() {
+		if ad.Type == ADManufacturerData && len(ad.Data) >= 2 && binary.LittleEndian.Uint16(ad.Data) == companyID {
+			ds = append(ds, ad.Data[2:])
+		}
+	}
+	return ds
+}
+
+// PeekVersion returns the version of the BluKey advertisement raw looks
+// like from its manufacturer specific data, or 0 if none. It is cheaper
+// than parsing but does not check the advertisement is valid.
+func PeekVersion(raw []byte) int {
+	v, _ := peekMSD(raw)
+	return v
+}
+
+// PeekDeviceId returns the device ID of the BluKey advertisement raw looks
+// like, without parsing the rest of it or checking it is valid, so known
+// devices can be skipped cheaply.
+func PeekDeviceId(raw []byte) (uint64, bool) {
+	switch v, d := peekMSD(raw); {
+	case v == 1 && 1+len(d) == v1MSDLen:
+		return uint64(binary.LittleEndian.Uint32(d[3:7])), true
+	case v == 2 && 1+len(d) == v2MSD1Len:
+		return uint64(binary.LittleEndian.Uint32(d[3:7])), true
+	case v == 3 && 1+len(d) == v3MSD1Len:
+		return binary.LittleEndian.Uint64(d[3:11]), true
+	}
+	return 0, false
+}
+
+// peekMSD returns the version and data of the first BluKey manufacturer
+// specific data structure in raw that holds the device ID.
+func peekMSD(raw []byte) (int, []byte) {
+	it := adIter{raw}
+	for ad, ok := it.next(); ok; ad, ok = it.next() {
+		d := ad.Data
+		if ad.Type != ADManufacturerData || len(d) < 3 {
+			continue
+		}
+		switch {
+		case d[0] == 0x85 && d[1] == 0x00:
+			return 1, d
+		case d[0] == 0xc9 && d[1] == 0x02 && d[2] == 0x00:
+			return 2, d
+		case d[0] == 0xc9 && d[1] == 0x03 && d[2] == 0x00:
+			return 3, d
+		}
+	}
+	return 0, nil
+}
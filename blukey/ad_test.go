@@ -0,0 +1,133 @@
+package blukey
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestParseADStructures(t *testing.T) {
+	for _, tt := range []struct {
+		raw  []byte
+		want []ADStructure
+	}{
+		{nil, nil},
+		{[]byte{2, 0x01, 0x06}, []ADStructure{{0x01, []byte{0x06}}}},
+		{[]byte{1, 0x01, 2, 0x0a, 0xf4}, []ADStructure{{0x01, []byte{}}, {0x0a, []byte{0xf4}}}},
+		{[]byte{2, 0x01, 0x06, 0, 2, 0x0a, 0xf4}, []ADStructure{{0x01, []byte{0x06}}}},
+		{[]byte{2, 0x01, 0x06, 5, 0x09, 'a'}, []ADStructure{{0x01, []byte{0x06}}}},
+		{[]byte{2, 0x01, 0x06, 1}, []ADStructure{{0x01, []byte{0x06}}}},
+	} {
+		if got := ParseADStructures(tt.raw); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseADStructures(% x): got %v want %v", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestADHelpers(t *testing.T) {
+	raw := []byte{
+		2, 0x01, 0x06,
+		4, ADShortName, 'k', 'i', 'o',
+		6, ADCompleteName, 'k', 'i', 'o', 's', 'k',
+		2, ADTxPower, 0xf4,
+		5, ADManufacturerData, 0x4c, 0x00, 1, 2,
+		4, ADManufacturerData, 0xc9, 0x02, 3,
+	}
+	if name, ok := LocalName(raw); !ok || name != "kiosk" {
+		t.Errorf("LocalName: got %q, %t want %q", name, ok, "kiosk")
+	}
+	if name, ok := LocalName(raw[:8]); !ok || name != "kio" {
+		t.Errorf("LocalName of short name: got %q, %t want %q", name, ok, "kio")
+	}
+	if p, ok := TxPower(raw); !ok || p != -12 {
+		t.Errorf("TxPower: got %d, %t want -12", p, ok)
+	}
+	if d, ok := ManufacturerData(raw, 0x02c9); !ok || !bytes.Equal(d, []byte{3}) {
+		t.Errorf("ManufacturerData(0x02c9): got % x, %t", d, ok)
+	}
+	if d, ok := ManufacturerData(raw, 0x004c); !ok || !bytes.Equal(d, []byte{1, 2}) {
+		t.Errorf("ManufacturerData(0x004c): got % x, %t", d, ok)
+	}
+
+	empty := []byte{2, 0x01, 0x06}
+	if _, ok := LocalName(empty); ok {
+		t.Errorf("LocalName: found a name in % x", empty)
+	}
+	if _, ok := TxPower(empty); ok {
+		t.Errorf("TxPower: found a power level in % x", empty)
+	}
+	if _, ok := ManufacturerData(raw, 0x0085); ok {
+		t.Errorf("ManufacturerData(0x0085): found data")
+	}
+}
+
+// FuzzParseADStructures checks that the structures found are laid out
+// back to back from the start of the data.
+func FuzzParseADStructures(f *testing.F) {
+	f.Add(v1AdData)
+	f.Add(v2AdData)
+	f.Add([]byte{0xff, 0x01})
+	f.Add([]byte{1, 0x01, 0, 3})
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		off := 0
+		for _, ad := range ParseADStructures(raw) {
+			want := raw[off : off+2+len(ad.Data)]
+			if int(want[0]) != 1+len(ad.Data) || want[1] != ad.Type || !bytes.Equal(want[2:], ad.Data) {
+				t.Fatalf("structure at %d: got %v in % x", off, ad, raw)
+			}
+			off += len(want)
+		}
+		LocalName(raw)
+		Flags(raw)
+		TxPower(raw)
+		ManufacturerData(raw, 0x02c9)
+		PeekDeviceId(raw)
+	})
+}
+
+func TestParseADInfo(t *testing.T) {
+	flags := []byte{2, ADFlags, byte(FlagGeneralDiscoverable | FlagBREDRNotSupported)}
+	tx := []byte{2, ADTxPower, 0xfc}
+
+	a, info := ParseAdDataInfo(bytes.Join([][]byte{flags, v2AdData, tx}, nil))
+	if want := ParseAdData(v2AdData); !reflect.DeepEqual(a, want) {
+		t.Errorf("ParseAdDataInfo: got %#v want %#v", a, want)
+	}
+	if info != (ADInfo{Flags: 0x06, HasFlags: true, TxPower: -4, HasTxPower: true}) || !info.Discoverable() {
+		t.Errorf("ParseAdDataInfo: got %+v", info)
+	}
+	if loss, ok := info.PathLoss(-70); !ok || loss != 66 {
+		t.Errorf("PathLoss(-70): got %d, %t want 66", loss, ok)
+	}
+
+	a, info = ParseAdDataInfo(v1AdData)
+	if a == nil || info != (ADInfo{}) || info.Discoverable() {
+		t.Errorf("ParseAdDataInfo of V1: got %#v, %+v", a, info)
+	}
+	if _, ok := info.PathLoss(-70); ok {
+		t.Errorf("PathLoss without TX power: got ok")
+	}
+
+	if info := ParseADInfo([]byte{2, ADFlags, byte(FlagLimitedDiscoverable)}); !info.Discoverable() || info.HasTxPower {
+		t.Errorf("ParseADInfo: got %+v", info)
+	}
+}
+
+func TestExtractMSD(t *testing.T) {
+	raw := []byte{
+		5, ADManufacturerData, 0xc9, 0x02, 0x04, 1,
+		3, ADManufacturerData, 0x4c, 0x00,
+		4, ADManufacturerData, 0xc9, 0x02, 2,
+		2, ADManufacturerData, 0xc9,
+	}
+	want := [][]byte{{0x04, 1}, {2}}
+	if got := ExtractMSD(raw, 0x02c9); !reflect.DeepEqual(got, want) {
+		t.Errorf("ExtractMSD(0x02c9): got % x want % x", got, want)
+	}
+	if got := ExtractMSD(raw, 0x004c); len(got) != 1 || len(got[0]) != 0 {
+		t.Errorf("ExtractMSD(0x004c): got % x", got)
+	}
+	if got := ExtractMSD(raw, 0x0085); got != nil {
+		t.Errorf("ExtractMSD(0x0085): got % x", got)
+	}
+}
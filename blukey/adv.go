@@ -1,15 +1,130 @@
 package blukey
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
 )
 
+// Reasons for ParseAdDataStrict to reject an advertisement.
+var (
+	ErrNoName              = errors.New("no PayRange name")
+	ErrNoService           = errors.New("no BRSP service UUID")
+	ErrNoManufacturerData  = errors.New("no manufacturer specific data")
+	ErrBadManufacturerData = errors.New("malformed manufacturer specific data")
+	ErrUnknownVersion      = errors.New("blukey: not a BluKey advertisement")
+)
+
+// ErrPacketTooLong is returned by the Marshal methods when an advertisement
+// does not fit in a legacy advertising packet and its scan response.
+var ErrPacketTooLong = errors.New("blukey: advertising packet longer than 31 bytes")
+
+// maxPacketLen is the length limit of a legacy advertising packet or scan
+// response.
+const maxPacketLen = 31
+
+// An AdvError reports why an advertisement that looked like the given
+// BluKey version was rejected.
+type AdvError struct {
+	Version int
+	Err     error
+}
+
+func (e *AdvError) Error() string {
+	return fmt.Sprintf("blukey: V%d advertisement: %v", e.Version, e.Err)
+}
+
+func (e *AdvError) Unwrap() error {
+	return e.Err
+}
+
+// A LengthError reports a field of an advertisement with the wrong
+// length, counting its AD type byte.
+type LengthError struct {
+	Field     string
+	Got, Want int
+}
+
+func (e *LengthError) Error() string {
+	return fmt.Sprintf("%s is %d bytes, want %d", e.Field, e.Got, e.Want)
+}
+
 type Adv interface {
+	// DeviceId returns the ID of the device, truncated to 32 bits for
+	// devices with longer IDs; DeviceId64 returns it in full.
 	DeviceId() uint32
+	DeviceId64() uint64
 	AuthKey() uint32
 	CanTransact() bool
 	SupportsMaintenance() bool
 	NeedsMaintenance() bool
+
+	// FirmwareVersion returns the firmware version of the device, packed
+	// as a FwVersion, or 0 if the advertisement does not carry it.
+	FirmwareVersion() uint16
+	DeviceStatus() Status
+	Alarms() []Alarm
+}
+
+// Status is the state of a device, common to all advertisement versions.
+type Status int
+
+const (
+	StatusUnknown Status = iota
+	StatusReady
+	StatusReadyMaintenance
+	StatusBusy
+	StatusDisabled
+	StatusOffline
+)
+
+var statusNames = map[Status]string{
+	StatusUnknown:          "unknown",
+	StatusReady:            "ready",
+	StatusReadyMaintenance: "readyMaintenance",
+	StatusBusy:             "busy",
+	StatusDisabled:         "disabled",
+	StatusOffline:          "offline",
+}
+
+func (s Status) String() string {
+	if n, ok := statusNames[s]; ok {
+		return n
+	}
+	return fmt.Sprintf("Status(%d)", int(s))
+}
+
+// Alarm is a condition of a device that needs attention, common to all
+// advertisement versions.
+type Alarm int
+
+const (
+	AlarmClockNotSet Alarm = iota + 1
+	AlarmInactivity
+	AlarmCashPending
+	AlarmCashlessPending
+	AlarmDebugPending
+	AlarmFwUpdateNeeded
+	AlarmConnectRequest
+)
+
+var alarmNames = map[Alarm]string{
+	AlarmClockNotSet:     "clockNotSet",
+	AlarmInactivity:      "inactivity",
+	AlarmCashPending:     "cashPending",
+	AlarmCashlessPending: "cashlessPending",
+	AlarmDebugPending:    "debugPending",
+	AlarmFwUpdateNeeded:  "fwUpdateNeeded",
+	AlarmConnectRequest:  "connectRequest",
+}
+
+func (a Alarm) String() string {
+	if n, ok := alarmNames[a]; ok {
+		return n
+	}
+	return fmt.Sprintf("Alarm(%d)", int(a))
 }
 
 type AdvV1Flags byte
@@ -23,6 +138,26 @@ const (
 	AdvV1connectReq      AdvV1Flags = 13
 )
 
+func (f AdvV1Flags) String() string {
+	switch f {
+	case 0:
+		return "noMaintenance"
+	case AdvV1none:
+		return "none"
+	case AdvV1clock:
+		return "clock"
+	case AdvV1inactivity:
+		return "inactivity"
+	case AdvV1cashlessPending:
+		return "cashlessPending"
+	case AdvV1cashPending:
+		return "cashPending"
+	case AdvV1connectReq:
+		return "connectReq"
+	}
+	return fmt.Sprintf("AdvV1Flags(%#02x)", byte(f))
+}
+
 type AdvV1Status byte
 
 const (
@@ -32,11 +167,70 @@ const (
 	AdvV1offline  AdvV1Status = 0xff
 )
 
+func (s AdvV1Status) String() string {
+	switch s {
+	case AdvV1ready:
+		return "ready"
+	case AdvV1busy:
+		return "busy"
+	case AdvV1disabled:
+		return "disabled"
+	case AdvV1offline:
+		return "offline"
+	}
+	return fmt.Sprintf("AdvV1Status(%#02x)", byte(s))
+}
+
 type AdvV1 struct {
 	Id     uint32
 	Key    uint32
 	Flags  AdvV1Flags
 	Status AdvV1Status
+	Name   string // advertised local name, "PayRange" or longer
+}
+
+// String describes v1 for logs, leaving out its AuthKey. WithAuthKey
+// includes it.
+func (v1 AdvV1) String() string {
+	return fmt.Sprintf("AdvV1{Id: %d, Flags: %v, Status: %v}", v1.Id, v1.Flags, v1.Status)
+}
+
+// GoString formats v1 for %#v with its AuthKey zeroed.
+func (v1 AdvV1) GoString() string {
+	type plain AdvV1
+	v1.Key = 0
+	return strings.Replace(fmt.Sprintf("%#v", plain(v1)), "blukey.plain", "blukey.AdvV1", 1)
+}
+
+var v1Statuses = map[AdvV1Status]Status{
+	AdvV1ready:    StatusReady,
+	AdvV1busy:     StatusBusy,
+	AdvV1disabled: StatusDisabled,
+	AdvV1offline:  StatusOffline,
+}
+
+var v1Alarms = map[AdvV1Flags]Alarm{
+	AdvV1clock:           AlarmClockNotSet,
+	AdvV1inactivity:      AlarmInactivity,
+	AdvV1cashlessPending: AlarmCashlessPending,
+	AdvV1cashPending:     AlarmCashPending,
+	AdvV1connectReq:      AlarmConnectRequest,
+}
+
+// FirmwareVersion returns 0, as V1 advertisements do not carry it.
+func (v1 *AdvV1) FirmwareVersion() uint16 {
+	return 0
+}
+
+func (v1 *AdvV1) DeviceStatus() Status {
+	return v1Statuses[v1.Status]
+}
+
+func (v1 *AdvV1) Alarms() []Alarm {
+	if a, ok := v1Alarms[v1.Flags]; ok {
+		return []Alarm{a}
+	}
+	return nil
 }
 
 func (v1 *AdvV1) AuthKey() uint32 {
@@ -51,6 +245,10 @@ func (v1 *AdvV1) DeviceId() uint32 {
 	return v1.Id
 }
 
+func (v1 *AdvV1) DeviceId64() uint64 {
+	return uint64(v1.Id)
+}
+
 func (v1 *AdvV1) NeedsMaintenance() bool {
 	return v1.Flags != AdvV1none
 }
@@ -59,54 +257,160 @@ func (v1 *AdvV1) SupportsMaintenance() bool {
 	return v1.Flags != 0
 }
 
-var v1Name = []byte{0x09, 'P', 'a', 'y', 'R', 'a', 'n', 'g', 'e'}
-var v1BRSP = []byte{0x07, 0x79, 0x60, 0x22, 0xa0, 0xbe, 0xaf, 0xc0, 0xbd, 0xde, 0x48, 0x79, 0x62, 0xf1, 0x84, 0x2b, 0xda}
+// Lengths of the manufacturer specific data fields, including the AD type
+// and company ID, and of the data decoded from them.
+const (
+	v1MSDLen     = 16
+	v1MSDData    = 11
+	v2MSD1Len    = 17
+	v2MSD1Data   = 12
+	v2MSD2MinLen = 6
+	v3MSD1Len    = 26
+	v3MSD1Data   = 22
+)
 
-func parseBlukeyV1Adv(raw []byte) *AdvV1 {
-	var brsp, name bool
-	var msd []byte
+// The local names of V1 and of V2 and V3 devices start with these. The
+// name may be complete or shortened.
+const (
+	v1NamePrefix = "PayRange"
+	v2NamePrefix = "PR"
+)
 
-	cmp := func(a, b []byte) bool {
-		if len(a) != len(b) {
-			return false
-		}
+// matchName returns the local name in ad if it starts with prefix.
+func matchName(ad ADStructure, prefix string) ([]byte, bool) {
+	if ad.Type != ADCompleteName && ad.Type != ADShortName {
+		return nil, false
+	}
+	if len(ad.Data) < len(prefix) || string(ad.Data[:len(prefix)]) != prefix {
+		return nil, false
+	}
+	return ad.Data, true
+}
 
-		for i, v := range a {
-			if v != b[i] {
-				return false
-			}
-		}
+// nameString returns name as a string, without allocating for the usual
+// name def.
+func nameString(name []byte, def string) string {
+	if string(name) == def {
+		return def
+	}
+	return string(name)
+}
 
-		return true
+// marshalName returns the AD structure of the complete local name, or of
+// def if name is empty. The name must start with def.
+func marshalName(name, def string) ([]byte, error) {
+	if name == "" {
+		name = def
+	}
+	if !strings.HasPrefix(name, def) {
+		return nil, fmt.Errorf("blukey: name %q does not start with %q", name, def)
 	}
+	return appendAD(nil, append([]byte{ADCompleteName}, name...)), nil
+}
 
-	for len(raw) > 1 {
-		chunkLen := int(raw[0])
-		if chunkLen == 0 || chunkLen+1 > len(raw) {
-			break
-		}
-		chunk := raw[1 : chunkLen+1]
-		raw = raw[chunkLen+1:]
+var v1BRSP = []byte{0x07, 0x79, 0x60, 0x22, 0xa0, 0xbe, 0xaf, 0xc0, 0xbd, 0xde, 0x48, 0x79, 0x62, 0xf1, 0x84, 0x2b, 0xda}
+
+// parseBlukeyV1Adv parses raw into a if it is a V1 advertisement. It
+// returns false and a nil error if raw does not look like one.
+func parseBlukeyV1Adv(raw []byte, a *AdvV1) (bool, error) {
+	var brsp, seen bool
+	var name, msd []byte
+	var msdErr error
 
-		if cmp(chunk, v1Name) {
-			name = true
-		} else if cmp(chunk, v1BRSP) {
+	it := adIter{raw}
+	for ad, ok := it.next(); ok; ad, ok = it.next() {
+		d := ad.Data
+		if n, ok := matchName(ad, v1NamePrefix); ok {
+			if name == nil || ad.Type == ADCompleteName {
+				name = n
+			}
+		} else if (ad.Type == ADSomeUUID128 || ad.Type == ADAllUUID128) && hasUUID128(d, v1BRSP[1:]) {
 			brsp = true
-		} else if chunkLen == 16 && chunk[0] == 0xff && chunk[1] == 0x85 && chunk[2] == 0x00 && chunk[3] == 0xff && chunk[8] == 0x01 && chunk[15] == 0x01 {
-			msd = chunk[4:]
+		} else if ad.Type == ADManufacturerData && len(d) >= 2 && d[0] == 0x85 && d[1] == 0x00 {
+			seen = true
+			if 1+len(d) != v1MSDLen {
+				msdErr = &LengthError{Field: "manufacturer data", Got: 1 + len(d), Want: v1MSDLen}
+			} else if d[2] != 0xff || d[7] != 0x01 || d[14] != 0x01 {
+				msdErr = ErrBadManufacturerData
+			} else {
+				msd = d[3:]
+			}
 		}
 	}
 
-	if name && brsp && msd != nil {
-		return &AdvV1{
-			Id:     binary.LittleEndian.Uint32(msd[0:4]),
-			Key:    binary.LittleEndian.Uint32(msd[7:11]),
-			Flags:  AdvV1Flags(msd[5]),
-			Status: AdvV1Status(msd[6]),
+	var err error
+	switch {
+	case name == nil && !brsp && !seen:
+		return false, nil
+	case len(msd) < v1MSDData && msdErr != nil:
+		err = msdErr
+	case len(msd) < v1MSDData:
+		err = ErrNoManufacturerData
+	case name == nil:
+		err = ErrNoName
+	case !brsp:
+		err = ErrNoService
+	}
+	if err != nil {
+		return false, &AdvError{Version: 1, Err: err}
+	}
+
+	*a = AdvV1{
+		Id:     binary.LittleEndian.Uint32(msd[0:4]),
+		Key:    binary.LittleEndian.Uint32(msd[7:11]),
+		Flags:  AdvV1Flags(msd[5]),
+		Status: AdvV1Status(msd[6]),
+		Name:   nameString(name, v1NamePrefix),
+	}
+	return true, nil
+}
+
+// hasUUID128 reports whether the list of 128-bit UUIDs d holds uuid. A
+// partial UUID at the end of d is ignored.
+func hasUUID128(d, uuid []byte) bool {
+	for ; len(d) >= 16; d = d[16:] {
+		if bytes.Equal(d[:16], uuid) {
+			return true
 		}
 	}
+	return false
+}
 
-	return nil
+// MarshalPackets returns the advertising packet and scan response of v1:
+// the name and manufacturer specific data are advertised, and the BRSP
+// service UUID, which does not fit as well, is in the scan response. The
+// name is "PayRange" unless Name is set; it fails with ErrPacketTooLong
+// if Name is too long.
+func (v1 *AdvV1) MarshalPackets() (adv, scanResp []byte, err error) {
+	msd := make([]byte, v1MSDLen)
+	copy(msd, []byte{0xff, 0x85, 0x00, 0xff})
+	binary.LittleEndian.PutUint32(msd[4:8], v1.Id)
+	msd[8] = 0x01
+	msd[9] = byte(v1.Flags)
+	msd[10] = byte(v1.Status)
+	binary.LittleEndian.PutUint32(msd[11:15], v1.Key)
+	msd[15] = 0x01
+
+	adv, err = marshalName(v1.Name, v1NamePrefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	adv = appendAD(adv, msd)
+	if len(adv) > maxPacketLen {
+		return nil, nil, ErrPacketTooLong
+	}
+	scanResp = appendAD(nil, v1BRSP)
+	return adv, scanResp, nil
+}
+
+// Marshal returns the advertising data of v1 as ParseAdData expects it:
+// the advertising packet followed by the scan response.
+func (v1 *AdvV1) Marshal() ([]byte, error) {
+	adv, scanResp, err := v1.MarshalPackets()
+	if err != nil {
+		return nil, err
+	}
+	return append(adv, scanResp...), nil
 }
 
 type AdvV2Flags uint16
@@ -131,12 +435,136 @@ const (
 	AdvV2statusOffline           AdvV2Flags = 0x0007
 )
 
+// String lists the set flags, the alarms and the status separated by "|",
+// e.g. "cashlessPending|connAlarmClockNotSet|statusBusy". Unknown bits and
+// values are shown in hex.
+func (f AdvV2Flags) String() string {
+	var s []string
+	if f&AdvV2canTransact != 0 {
+		s = append(s, "canTransact")
+	}
+	if f&AdvV2cashPending != 0 {
+		s = append(s, "cashPending")
+	}
+	if f&AdvV2cashlessPending != 0 {
+		s = append(s, "cashlessPending")
+	}
+
+	switch a := f & AdvV2machAlarmMask; a {
+	case AdvV2machAlarmNone:
+	case AdvV2machAlarmInactivity:
+		s = append(s, "machAlarmInactivity")
+	default:
+		s = append(s, fmt.Sprintf("machAlarm(%#04x)", uint16(a)))
+	}
+
+	switch a := f & AdvV2connAlarmMask; a {
+	case AdvV2connAlarmNone:
+	case AdvV2connAlarmClockNotSet:
+		s = append(s, "connAlarmClockNotSet")
+	case AdvV2connAlarmDebugPending:
+		s = append(s, "connAlarmDebugPending")
+	case AdvV2connAlarmFwUpdateNeeded:
+		s = append(s, "connAlarmFwUpdateNeeded")
+	default:
+		s = append(s, fmt.Sprintf("connAlarm(%#04x)", uint16(a)))
+	}
+
+	switch st := f & AdvV2statusMask; st {
+	case AdvV2statusReady:
+		s = append(s, "statusReady")
+	case AdvV2statusBusy:
+		s = append(s, "statusBusy")
+	case AdvV2statusDisabled:
+		s = append(s, "statusDisabled")
+	case AdvV2statusReadyMaint:
+		s = append(s, "statusReadyMaint")
+	case AdvV2statusOffline:
+		s = append(s, "statusOffline")
+	default:
+		s = append(s, fmt.Sprintf("status(%#04x)", uint16(st)))
+	}
+
+	known := AdvV2canTransact | AdvV2cashPending | AdvV2cashlessPending |
+		AdvV2machAlarmMask | AdvV2connAlarmMask | AdvV2statusMask
+	if rest := f &^ known; rest != 0 {
+		s = append(s, fmt.Sprintf("%#04x", uint16(rest)))
+	}
+	return strings.Join(s, "|")
+}
+
 type AdvV2 struct {
 	Id          uint32
 	Key         uint32
 	Flags       AdvV2Flags
-	FwVersion   uint16
+	FwVersion   FwVersion
 	PartnerData []byte
+	Name        string // advertised local name, "PR" or longer
+
+	// UnknownMSD holds the manufacturer specific data sent along that
+	// the parser did not recognize, such as sub-types added by newer
+	// firmware. Marshal does not send it.
+	UnknownMSD []MSD
+}
+
+// String describes v2 for logs, leaving out its AuthKey. WithAuthKey
+// includes it.
+func (v2 AdvV2) String() string {
+	s := fmt.Sprintf("AdvV2{Id: %d, Flags: %v, FwVersion: %v", v2.Id, v2.Flags, v2.FwVersion)
+	if len(v2.PartnerData) > 0 {
+		s += fmt.Sprintf(", PartnerData: % x", v2.PartnerData)
+	}
+	if len(v2.UnknownMSD) > 0 {
+		s += fmt.Sprintf(", UnknownMSD: %v", v2.UnknownMSD)
+	}
+	return s + "}"
+}
+
+// GoString formats v2 for %#v with its AuthKey zeroed.
+func (v2 AdvV2) GoString() string {
+	type plain AdvV2
+	v2.Key = 0
+	return strings.Replace(fmt.Sprintf("%#v", plain(v2)), "blukey.plain", "blukey.AdvV2", 1)
+}
+
+var v2Statuses = map[AdvV2Flags]Status{
+	AdvV2statusReady:      StatusReady,
+	AdvV2statusReadyMaint: StatusReadyMaintenance,
+	AdvV2statusBusy:       StatusBusy,
+	AdvV2statusDisabled:   StatusDisabled,
+	AdvV2statusOffline:    StatusOffline,
+}
+
+// v2Alarms maps the alarm flags, alone or as a value of their mask, to
+// alarms, in the order Alarms reports them.
+var v2Alarms = []struct {
+	mask, value AdvV2Flags
+	alarm       Alarm
+}{
+	{AdvV2connAlarmMask, AdvV2connAlarmClockNotSet, AlarmClockNotSet},
+	{AdvV2machAlarmMask, AdvV2machAlarmInactivity, AlarmInactivity},
+	{AdvV2cashPending, AdvV2cashPending, AlarmCashPending},
+	{AdvV2cashlessPending, AdvV2cashlessPending, AlarmCashlessPending},
+	{AdvV2connAlarmMask, AdvV2connAlarmDebugPending, AlarmDebugPending},
+	{AdvV2connAlarmMask, AdvV2connAlarmFwUpdateNeeded, AlarmFwUpdateNeeded},
+}
+
+func (v2 *AdvV2) FirmwareVersion() uint16 {
+	return uint16(v2.FwVersion)
+}
+
+func (v2 *AdvV2) DeviceStatus() Status {
+	return v2Statuses[v2.Flags&AdvV2statusMask]
+}
+
+func (v2 *AdvV2) Alarms() []Alarm {
+	var alarms []Alarm
+	for _, m := range v2Alarms {
+		if v2.Flags&m.mask == m.value {
+			alarms = append(alarms, m.alarm)
+		}
+	}
+	return alarms
 }
 
 func (v2 *AdvV2) AuthKey() uint32 {
@@ -158,6 +586,10 @@ func (v2 *AdvV2) DeviceId() uint32 {
 	return v2.Id
 }
 
+func (v2 *AdvV2) DeviceId64() uint64 {
+	return uint64(v2.Id)
+}
+
 func (v2 *AdvV2) NeedsMaintenance() bool {
 	if v2.Flags&(AdvV2cashPending|AdvV2cashlessPending) != 0 {
 		return true
@@ -168,58 +600,430 @@ func (v2 *AdvV2) NeedsMaintenance() bool {
 	return false
 }
 
+// NeedsFwUpdate reports whether the device raises the firmware update
+// alarm or runs a firmware older than latest.
+func (v2 *AdvV2) NeedsFwUpdate(latest FwVersion) bool {
+	return v2.Flags&AdvV2connAlarmMask == AdvV2connAlarmFwUpdateNeeded || v2.FwVersion.Compare(latest) < 0
+}
+
 func (v2 *AdvV2) SupportsMaintenance() bool {
 	return true
 }
 
-func parseBlukeyV2Adv(raw []byte) *AdvV2 {
-	var name bool
-	var msd1, msd2 []byte
+// parseBlukeyV2Adv is like parseBlukeyV1Adv for V2. The PartnerData of a
+// shares raw.
+func parseBlukeyV2Adv(raw []byte, a *AdvV2) (bool, error) {
+	var seen bool
+	var name, msd1, msd2 []byte
+	var msdErr error
+	var unknown []MSD
 
-	for len(raw) > 1 {
-		chunkLen := int(raw[0])
-		if chunkLen == 0 || chunkLen+1 > len(raw) {
-			break
-		}
-		chunk := raw[1 : chunkLen+1]
-		raw = raw[chunkLen+1:]
-
-		if chunkLen == 3 && chunk[0] == 0x09 && chunk[1] == 'P' && chunk[2] == 'R' {
-			name = true
-		} else if chunkLen == 17 && chunk[0] == 0xff && chunk[1] == 0xc9 && chunk[2] == 0x02 && chunk[3] == 0x00 {
-			msd1 = chunk[4:]
-		} else if chunkLen > 5 && chunk[0] == 0xff && chunk[1] == 0xc9 && chunk[2] == 0x02 && chunk[3] == 0x01 {
-			msd2 = chunk[4:]
+	it := adIter{raw}
+	for ad, ok := it.next(); ok; ad, ok = it.next() {
+		d := ad.Data
+		if n, ok := matchName(ad, v2NamePrefix); ok {
+			if name == nil || ad.Type == ADCompleteName {
+				name = n
+			}
+		} else if ad.Type == ADManufacturerData && len(d) >= 3 && d[0] == 0xc9 && d[1] == 0x02 && d[2] == 0x00 {
+			seen = true
+			if 1+len(d) != v2MSD1Len {
+				msdErr = &LengthError{Field: "manufacturer data", Got: 1 + len(d), Want: v2MSD1Len}
+			} else {
+				msd1 = d[3:]
+			}
+		} else if ad.Type == ADManufacturerData && 1+len(d) >= v2MSD2MinLen && d[0] == 0xc9 && d[1] == 0x02 && d[2] == 0x01 {
+			msd2 = d[3:]
+		} else if m, ok := parseMSD(ad); ok {
+			unknown = append(unknown, m)
 		}
 	}
 
-	if name && msd1 != nil {
-		a := &AdvV2{
-			Id:        binary.LittleEndian.Uint32(msd1[0:4]),
-			Key:       binary.LittleEndian.Uint32(msd1[4:8]),
-			Flags:     AdvV2Flags(binary.LittleEndian.Uint16(msd1[8:10])),
-			FwVersion: binary.LittleEndian.Uint16(msd1[10:12]),
-		}
+	var err error
+	switch {
+	case name == nil && !seen && msd2 == nil:
+		return false, nil
+	case len(msd1) < v2MSD1Data && msdErr != nil:
+		err = msdErr
+	case len(msd1) < v2MSD1Data:
+		err = ErrNoManufacturerData
+	case name == nil:
+		err = ErrNoName
+	}
+	if err != nil {
+		return false, &AdvError{Version: 2, Err: err}
+	}
+
+	*a = AdvV2{
+		Id:          binary.LittleEndian.Uint32(msd1[0:4]),
+		Key:         binary.LittleEndian.Uint32(msd1[4:8]),
+		Flags:       AdvV2Flags(binary.LittleEndian.Uint16(msd1[8:10])),
+		FwVersion:   FwVersion(binary.LittleEndian.Uint16(msd1[10:12])),
+		PartnerData: msd2,
+		Name:        nameString(name, v2NamePrefix),
+		UnknownMSD:  unknown,
+	}
+	return true, nil
+}
+
+// MarshalPackets returns the advertising packet and scan response of v2:
+// the name and manufacturer specific data are advertised, and the
+// PartnerData, if any, follows in a second manufacturer specific data
+// structure in the scan response. The name is "PR" unless Name is set. It
+// fails with ErrPacketTooLong if the Name or PartnerData does not fit.
+func (v2 *AdvV2) MarshalPackets() (adv, scanResp []byte, err error) {
+	msd1 := make([]byte, v2MSD1Len)
+	copy(msd1, []byte{0xff, 0xc9, 0x02, 0x00})
+	binary.LittleEndian.PutUint32(msd1[4:8], v2.Id)
+	binary.LittleEndian.PutUint32(msd1[8:12], v2.Key)
+	binary.LittleEndian.PutUint16(msd1[12:14], uint16(v2.Flags))
+	binary.LittleEndian.PutUint16(msd1[14:16], uint16(v2.FwVersion))
+
+	adv, err = marshalName(v2.Name, v2NamePrefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	adv = appendAD(adv, msd1)
+	if len(adv) > maxPacketLen {
+		return nil, nil, ErrPacketTooLong
+	}
+	scanResp, err = marshalPartnerData(0x02, v2.PartnerData)
+	if err != nil {
+		return nil, nil, err
+	}
+	return adv, scanResp, nil
+}
+
+// marshalPartnerData returns the scan response carrying the PartnerData
+// of a V2 or V3 advertisement, none if p is empty.
+func marshalPartnerData(version byte, p []byte) ([]byte, error) {
+	if len(p) == 0 {
+		return nil, nil
+	}
+	msd2 := append([]byte{0xff, 0xc9, version, 0x01}, p...)
+	if 1+len(msd2) > maxPacketLen {
+		return nil, ErrPacketTooLong
+	}
+	return appendAD(nil, msd2), nil
+}
+
+// Marshal returns the advertising data of v2 as ParseAdData expects it:
+// the advertising packet followed by the scan response.
+func (v2 *AdvV2) Marshal() ([]byte, error) {
+	adv, scanResp, err := v2.MarshalPackets()
+	if err != nil {
+		return nil, err
+	}
+	return append(adv, scanResp...), nil
+}
+
+// AdvV3 is the advertisement of firmware 3.x devices. It carries the
+// flags of V2 along with a 64-bit device ID, the battery voltage and the
+// time since the device started.
+type AdvV3 struct {
+	Id                uint64
+	Key               uint32
+	Flags             AdvV2Flags
+	FwVersion         FwVersion
+	BatteryMillivolts uint16
+	Uptime            uint32 // seconds
+	PartnerData       []byte
+	Name              string // advertised local name, "PR" or longer
+	UnknownMSD        []MSD  // see AdvV2
+}
+
+// String describes v3 for logs, leaving out its AuthKey. WithAuthKey
+// includes it.
+func (v3 AdvV3) String() string {
+	s := fmt.Sprintf("AdvV3{Id: %d, Flags: %v, FwVersion: %v, BatteryMillivolts: %d, Uptime: %d",
+		v3.Id, v3.Flags, v3.FwVersion, v3.BatteryMillivolts, v3.Uptime)
+	if len(v3.PartnerData) > 0 {
+		s += fmt.Sprintf(", PartnerData: % x", v3.PartnerData)
+	}
+	if len(v3.UnknownMSD) > 0 {
+		s += fmt.Sprintf(", UnknownMSD: %v", v3.UnknownMSD)
+	}
+	return s + "}"
+}
+
+// GoString formats v3 for %#v with its AuthKey zeroed.
+func (v3 AdvV3) GoString() string {
+	type plain AdvV3
+	v3.Key = 0
+	return strings.Replace(fmt.Sprintf("%#v", plain(v3)), "blukey.plain", "blukey.AdvV3", 1)
+}
+
+// v2 returns the V2 advertisement with the flags of v3, which the flag
+// based methods share.
+func (v3 *AdvV3) v2() *AdvV2 {
+	return &AdvV2{Flags: v3.Flags}
+}
+
+func (v3 *AdvV3) FirmwareVersion() uint16 {
+	return uint16(v3.FwVersion)
+}
+
+func (v3 *AdvV3) DeviceStatus() Status {
+	return v3.v2().DeviceStatus()
+}
+
+func (v3 *AdvV3) Alarms() []Alarm {
+	return v3.v2().Alarms()
+}
+
+func (v3 *AdvV3) AuthKey() uint32 {
+	return v3.Key
+}
+
+func (v3 *AdvV3) CanTransact() bool {
+	return v3.v2().CanTransact()
+}
+
+// DeviceId returns the low 32 bits of the device ID.
+func (v3 *AdvV3) DeviceId() uint32 {
+	return uint32(v3.Id)
+}
+
+func (v3 *AdvV3) DeviceId64() uint64 {
+	return v3.Id
+}
+
+func (v3 *AdvV3) NeedsMaintenance() bool {
+	return v3.v2().NeedsMaintenance()
+}
+
+// NeedsFwUpdate is like AdvV2.NeedsFwUpdate.
+func (v3 *AdvV3) NeedsFwUpdate(latest FwVersion) bool {
+	return (&AdvV2{Flags: v3.Flags, FwVersion: v3.FwVersion}).NeedsFwUpdate(latest)
+}
+
+func (v3 *AdvV3) SupportsMaintenance() bool {
+	return true
+}
 
-		if msd2 != nil {
-			a.PartnerData = make([]byte, len(msd2))
-			copy(a.PartnerData, msd2)
+// parseBlukeyV3Adv parses the V3 layout, which follows V2 with a version
+// byte of 3 after the company ID: the "PR" name and a manufacturer
+// specific data structure with packet index 0 are advertised, and the
+// PartnerData, with packet index 1, is in the scan response. The
+// PartnerData of a shares raw.
+func parseBlukeyV3Adv(raw []byte, a *AdvV3) (bool, error) {
+	var seen bool
+	var name, msd1, msd2 []byte
+	var msdErr error
+	var unknown []MSD
+
+	it := adIter{raw}
+	for ad, ok := it.next(); ok; ad, ok = it.next() {
+		d := ad.Data
+		if n, ok := matchName(ad, v2NamePrefix); ok {
+			if name == nil || ad.Type == ADCompleteName {
+				name = n
+			}
+		} else if ad.Type == ADManufacturerData && len(d) >= 3 && d[0] == 0xc9 && d[1] == 0x03 && d[2] == 0x00 {
+			seen = true
+			if 1+len(d) != v3MSD1Len {
+				msdErr = &LengthError{Field: "manufacturer data", Got: 1 + len(d), Want: v3MSD1Len}
+			} else {
+				msd1 = d[3:]
+			}
+		} else if ad.Type == ADManufacturerData && 1+len(d) >= v2MSD2MinLen && d[0] == 0xc9 && d[1] == 0x03 && d[2] == 0x01 {
+			msd2 = d[3:]
+		} else if m, ok := parseMSD(ad); ok {
+			unknown = append(unknown, m)
 		}
+	}
 
-		return a
+	var err error
+	switch {
+	case !seen && msd2 == nil:
+		// The "PR" name alone is V2 until shown otherwise.
+		return false, nil
+	case len(msd1) < v3MSD1Data && msdErr != nil:
+		err = msdErr
+	case len(msd1) < v3MSD1Data:
+		err = ErrNoManufacturerData
+	case name == nil:
+		err = ErrNoName
+	}
+	if err != nil {
+		return false, &AdvError{Version: 3, Err: err}
 	}
 
-	return nil
+	*a = AdvV3{
+		Id:                binary.LittleEndian.Uint64(msd1[0:8]),
+		Key:               binary.LittleEndian.Uint32(msd1[8:12]),
+		Flags:             AdvV2Flags(binary.LittleEndian.Uint16(msd1[12:14])),
+		FwVersion:         FwVersion(binary.LittleEndian.Uint16(msd1[14:16])),
+		BatteryMillivolts: binary.LittleEndian.Uint16(msd1[16:18]),
+		Uptime:            binary.LittleEndian.Uint32(msd1[18:22]),
+		PartnerData:       msd2,
+		Name:              nameString(name, v2NamePrefix),
+		UnknownMSD:        unknown,
+	}
+	return true, nil
+}
+
+// MarshalPackets returns the advertising packet and scan response of v3,
+// laid out as those of V2. There is no room for a Name longer than "PR".
+// It fails with ErrPacketTooLong if the Name or PartnerData does not fit.
+func (v3 *AdvV3) MarshalPackets() (adv, scanResp []byte, err error) {
+	msd1 := make([]byte, v3MSD1Len)
+	copy(msd1, []byte{0xff, 0xc9, 0x03, 0x00})
+	binary.LittleEndian.PutUint64(msd1[4:12], v3.Id)
+	binary.LittleEndian.PutUint32(msd1[12:16], v3.Key)
+	binary.LittleEndian.PutUint16(msd1[16:18], uint16(v3.Flags))
+	binary.LittleEndian.PutUint16(msd1[18:20], uint16(v3.FwVersion))
+	binary.LittleEndian.PutUint16(msd1[20:22], v3.BatteryMillivolts)
+	binary.LittleEndian.PutUint32(msd1[22:26], v3.Uptime)
+
+	adv, err = marshalName(v3.Name, v2NamePrefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	adv = appendAD(adv, msd1)
+	if len(adv) > maxPacketLen {
+		return nil, nil, ErrPacketTooLong
+	}
+	scanResp, err = marshalPartnerData(0x03, v3.PartnerData)
+	if err != nil {
+		return nil, nil, err
+	}
+	return adv, scanResp, nil
+}
+
+// Marshal returns the advertising data of v3 as ParseAdData expects it:
+// the advertising packet followed by the scan response.
+func (v3 *AdvV3) Marshal() ([]byte, error) {
+	adv, scanResp, err := v3.MarshalPackets()
+	if err != nil {
+		return nil, err
+	}
+	return append(adv, scanResp...), nil
+}
+
+// appendAD appends an AD structure holding data, which starts with the
+// AD type, to b.
+func appendAD(b, data []byte) []byte {
+	b = append(b, byte(len(data)))
+	return append(b, data...)
 }
 
+// ParseAdData parses raw advertising data, as received off the air, into
+// a BluKey advertisement. It returns nil if raw is not one, including when
+// it is malformed or truncated. ParseAdDataStrict tells why.
 func ParseAdData(raw []byte) Adv {
-	if v1 := parseBlukeyV1Adv(raw); v1 != nil {
-		return v1
+	a, _ := ParseAdDataStrict(raw)
+	return a
+}
+
+// ParseAdDataInfo is like ParseAdData but also returns the flags and TX
+// power level sent with the advertisement, see ParseADInfo.
+func ParseAdDataInfo(raw []byte) (Adv, ADInfo) {
+	return ParseAdData(raw), ParseADInfo(raw)
+}
+
+// ParseAdvAndScanResponse parses an advertising packet together with the
+// scan response of the same device, which carries part of the data: the
+// BRSP service UUID of V1 and the PartnerData of V2 and V3. The AD
+// structures of both are merged, so padding at the end of adv does not
+// hide rsp.
+func ParseAdvAndScanResponse(adv, rsp []byte) Adv {
+	var raw []byte
+	for _, ad := range append(ParseADStructures(adv), ParseADStructures(rsp)...) {
+		raw = append(raw, byte(1+len(ad.Data)), ad.Type)
+		raw = append(raw, ad.Data...)
 	}
+	return ParseAdData(raw)
+}
 
-	if v2 := parseBlukeyV2Adv(raw); v2 != nil {
-		return v2
+// ParseAdDataStrict is like ParseAdData but returns an error saying why
+// raw was rejected. The error is an *AdvError naming the version raw
+// looked like, wrapping ErrNoName, ErrNoService, ErrNoManufacturerData,
+// ErrBadManufacturerData or a *LengthError, or ErrUnknownVersion if
+// nothing in raw belongs to a BluKey advertisement.
+func ParseAdDataStrict(raw []byte) (Adv, error) {
+	var v1 AdvV1
+	var v2 AdvV2
+	var v3 AdvV3
+	switch version, err := parseAdDataInto(raw, &v1, &v2, &v3); version {
+	case 1:
+		a := v1
+		return &a, nil
+	case 2:
+		a := v2
+		a.PartnerData = cloneBytes(a.PartnerData)
+		a.UnknownMSD = cloneMSDs(a.UnknownMSD)
+		return &a, nil
+	case 3:
+		a := v3
+		a.PartnerData = cloneBytes(a.PartnerData)
+		a.UnknownMSD = cloneMSDs(a.UnknownMSD)
+		return &a, nil
+	default:
+		return nil, err
 	}
+}
 
-	return nil
+// ParseAdDataInto is like ParseAdData but stores the advertisement in v1,
+// v2 or v3, according to its version, and returns that one. It does not
+// allocate for BluKey advertisements without UnknownMSD, so scanners
+// receiving many can reuse the same three. The PartnerData and UnknownMSD
+// payloads it sets share raw; copy them to keep them past the next reuse
+// of raw.
+func ParseAdDataInto(raw []byte, v1 *AdvV1, v2 *AdvV2, v3 *AdvV3) (Adv, bool) {
+	switch version, _ := parseAdDataInto(raw, v1, v2, v3); version {
+	case 1:
+		return v1, true
+	case 2:
+		return v2, true
+	case 3:
+		return v3, true
+	}
+	return nil, false
+}
+
+// parseAdDataInto does the work of ParseAdDataStrict and ParseAdDataInto,
+// returning the version of the advertisement stored, or 0 and the error.
+// The outcome is counted by the Metrics.
+func parseAdDataInto(raw []byte, v1 *AdvV1, v2 *AdvV2, v3 *AdvV3) (int, error) {
+	version, err := parseVersions(raw, v1, v2, v3)
+	countParse(version, err)
+	return version, err
+}
+
+func parseVersions(raw []byte, v1 *AdvV1, v2 *AdvV2, v3 *AdvV3) (int, error) {
+	ok, err1 := parseBlukeyV1Adv(raw, v1)
+	if ok {
+		return 1, nil
+	}
+
+	ok, err3 := parseBlukeyV3Adv(raw, v3)
+	if ok {
+		return 3, nil
+	}
+
+	ok, err2 := parseBlukeyV2Adv(raw, v2)
+	if ok {
+		return 2, nil
+	}
+
+	if err1 != nil {
+		return 0, err1
+	}
+	if err3 != nil {
+		return 0, err3
+	}
+	if err2 != nil {
+		return 0, err2
+	}
+	return 0, ErrUnknownVersion
+}
+
+func cloneBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
 }
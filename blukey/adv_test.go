@@ -0,0 +1,539 @@
+package blukey
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var v1Name = []byte{ADCompleteName, 'P', 'a', 'y', 'R', 'a', 'n', 'g', 'e'}
+
+// v1AdData is a V1 advertisement with its scan response.
+var v1AdData = bytes.Join([][]byte{
+	{byte(len(v1Name))}, v1Name,
+	{byte(len(v1BRSP))}, v1BRSP,
+	{16, 0xff, 0x85, 0x00, 0xff, 0x78, 0x56, 0x34, 0x12, 0x01, byte(AdvV1clock), byte(AdvV1ready), 0xdd, 0xcc, 0xbb, 0xaa, 0x01},
+}, nil)
+
+// v2AdData is a V2 advertisement with partner data.
+var v2AdData = bytes.Join([][]byte{
+	{3, 0x09, 'P', 'R'},
+	{17, 0xff, 0xc9, 0x02, 0x00, 0x78, 0x56, 0x34, 0x12, 0xdd, 0xcc, 0xbb, 0xaa, 0x00, 0x20, 0x02, 0x01, 0x00},
+	{6, 0xff, 0xc9, 0x02, 0x01, 'h', 'i'},
+}, nil)
+
+// v3AdData is a V3 advertisement with partner data.
+var v3AdData = bytes.Join([][]byte{
+	{3, 0x09, 'P', 'R'},
+	{26, 0xff, 0xc9, 0x03, 0x00,
+		0xef, 0xcd, 0xab, 0x89, 0x67, 0x45, 0x23, 0x01, // id
+		0xdd, 0xcc, 0xbb, 0xaa, // key
+		0x00, 0x20, // flags
+		0x01, 0x03, // firmware
+		0xb8, 0x0b, // battery
+		0x80, 0x51, 0x01, 0x00, // uptime
+	},
+	{6, 0xff, 0xc9, 0x03, 0x01, 'h', 'i'},
+}, nil)
+
+var v3Adv = &AdvV3{Id: 0x0123456789abcdef, Key: 0xaabbccdd, Flags: AdvV2canTransact, FwVersion: 0x0301,
+	BatteryMillivolts: 3000, Uptime: 86400, PartnerData: []byte("hi"), Name: "PR"}
+
+func TestParseAdData(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		raw  []byte
+		want Adv
+	}{
+		{"V1", v1AdData, &AdvV1{Id: 0x12345678, Key: 0xaabbccdd, Flags: AdvV1clock, Status: AdvV1ready, Name: "PayRange"}},
+		{"V2", v2AdData, &AdvV2{Id: 0x12345678, Key: 0xaabbccdd, Flags: AdvV2canTransact, FwVersion: 0x0102, PartnerData: []byte("hi"), Name: "PR"}},
+		{"V3", v3AdData, v3Adv},
+		{"V3 without partner data", v3AdData[:31], &AdvV3{Id: 0x0123456789abcdef, Key: 0xaabbccdd, Flags: AdvV2canTransact,
+			FwVersion: 0x0301, BatteryMillivolts: 3000, Uptime: 86400, Name: "PR"}},
+		{"V3 with V2 partner data", append(v3AdData[:31:31], v2AdData[22:]...), &AdvV3{Id: 0x0123456789abcdef, Key: 0xaabbccdd,
+			Flags: AdvV2canTransact, FwVersion: 0x0301, BatteryMillivolts: 3000, Uptime: 86400, Name: "PR",
+			UnknownMSD: []MSD{{CompanyID: 0x02c9, SubType: 0x01, Payload: []byte("hi")}}}},
+		{"unknown version", bytes.Join([][]byte{v3AdData[:4], {26, 0xff, 0xc9, 0x04, 0x00}, v3AdData[9:31]}, nil), nil},
+		{"unknown packet", bytes.Join([][]byte{v3AdData[:4], {26, 0xff, 0xc9, 0x03, 0x02}, v3AdData[9:31]}, nil), nil},
+		{"empty", nil, nil},
+		{"other", []byte{2, 0x01, 0x06, 5, 0x09, 'a', 'b', 'c', 'd'}, nil},
+	} {
+		if got := ParseAdData(tt.raw); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %#v want %#v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParseAdDataStrict(t *testing.T) {
+	name1 := []byte{9, 0x09, 'P', 'a', 'y', 'R', 'a', 'n', 'g', 'e'}
+	brsp1 := append([]byte{17}, v1BRSP...)
+	msd1 := []byte{16, 0xff, 0x85, 0x00, 0xff, 0x78, 0x56, 0x34, 0x12, 0x01, 0x09, 0x00, 0xdd, 0xcc, 0xbb, 0xaa, 0x01}
+	name2 := []byte{3, 0x09, 'P', 'R'}
+	msd2 := []byte{17, 0xff, 0xc9, 0x02, 0x00, 0x78, 0x56, 0x34, 0x12, 0xdd, 0xcc, 0xbb, 0xaa, 0x00, 0x20, 0x02, 0x01, 0x00}
+	msd3 := v3AdData[4:31]
+	join := func(b ...[]byte) []byte { return bytes.Join(b, nil) }
+
+	for _, tt := range []struct {
+		name    string
+		raw     []byte
+		version int
+		err     error
+	}{
+		{"V1 no name", join(brsp1, msd1), 1, ErrNoName},
+		{"V1 no service", join(name1, msd1), 1, ErrNoService},
+		{"V1 no MSD", join(name1, brsp1), 1, ErrNoManufacturerData},
+		{"V1 short MSD", join(name1, brsp1, []byte{10, 0xff, 0x85, 0x00, 0xff, 0x78, 0x56, 0x34, 0x12, 0x01, 0x09}), 1,
+			&LengthError{Field: "manufacturer data", Got: 10, Want: 16}},
+		{"V1 bad marker", join(name1, brsp1, []byte{16, 0xff, 0x85, 0x00, 0xff, 0x78, 0x56, 0x34, 0x12, 0x02, 0x09, 0x00, 0xdd, 0xcc, 0xbb, 0xaa, 0x01}), 1,
+			ErrBadManufacturerData},
+		{"V2 no name", join(msd2), 2, ErrNoName},
+		{"V2 no MSD", join(name2), 2, ErrNoManufacturerData},
+		{"V2 long MSD", join(name2, []byte{18}, msd2[1:], []byte{0}), 2,
+			&LengthError{Field: "manufacturer data", Got: 18, Want: 17}},
+		{"V3 no name", join(msd3), 3, ErrNoName},
+		{"V3 partner data only", join(name2, v3AdData[31:]), 3, ErrNoManufacturerData},
+		{"V3 short MSD", join(name2, []byte{22}, msd3[1:23]), 3,
+			&LengthError{Field: "manufacturer data", Got: 22, Want: 26}},
+		{"other", []byte{2, 0x01, 0x06, 5, 0x09, 'a', 'b', 'c', 'd'}, 0, ErrUnknownVersion},
+		{"empty", nil, 0, ErrUnknownVersion},
+	} {
+		a, err := ParseAdDataStrict(tt.raw)
+		if a != nil {
+			t.Errorf("%s: got %#v want nil", tt.name, a)
+		}
+		if tt.version == 0 {
+			if err != tt.err {
+				t.Errorf("%s: got %v want %v", tt.name, err, tt.err)
+			}
+			continue
+		}
+		var ae *AdvError
+		if !errors.As(err, &ae) || ae.Version != tt.version || !reflect.DeepEqual(ae.Err, tt.err) {
+			t.Errorf("%s: got %v want V%d %v", tt.name, err, tt.version, tt.err)
+		}
+	}
+
+	if a, err := ParseAdDataStrict(join(name1, brsp1, msd1)); a == nil || err != nil {
+		t.Errorf("V1: got %#v, %v", a, err)
+	}
+	if a, err := ParseAdDataStrict(join(name2, msd2)); a == nil || err != nil {
+		t.Errorf("V2: got %#v, %v", a, err)
+	}
+	if a, err := ParseAdDataStrict(join(name2, msd3)); a == nil || err != nil {
+		t.Errorf("V3: got %#v, %v", a, err)
+	}
+}
+
+// TestParseAdDataTruncated cuts the advertisements at every byte and
+// makes each length byte claim every possible length.
+func TestParseAdDataTruncated(t *testing.T) {
+	for _, tt := range []struct {
+		raw  []byte
+		need int // bytes needed to parse; V2 partner data is optional
+	}{
+		{v1AdData, len(v1AdData)},
+		{v2AdData, len(v2AdData) - 7},
+		{v3AdData, len(v3AdData) - 7},
+	} {
+		raw := tt.raw
+		for i := 0; i < len(raw); i++ {
+			if got := ParseAdData(raw[:i]); (got != nil) != (i >= tt.need) {
+				t.Errorf("ParseAdData(% x): got %#v", raw[:i], got)
+			}
+		}
+
+		for i := 0; i < len(raw); i += int(raw[i]) + 1 {
+			bad := append([]byte(nil), raw...)
+			for n := 0; n < 256; n++ {
+				bad[i] = byte(n)
+				ParseAdData(bad)
+			}
+		}
+	}
+}
+
+func TestAdvMarshal(t *testing.T) {
+	for _, a := range []interface {
+		Adv
+		Marshal() ([]byte, error)
+		MarshalPackets() ([]byte, []byte, error)
+	}{
+		&AdvV1{Id: 0x12345678, Key: 0xaabbccdd, Flags: AdvV1cashPending, Status: AdvV1busy, Name: "PayRange"},
+		&AdvV1{Name: "PayRange 123"},
+		&AdvV2{Id: 0x12345678, Key: 0xaabbccdd, Flags: AdvV2cashPending | AdvV2statusBusy, FwVersion: 0x0203, Name: "PR"},
+		&AdvV2{Id: 1, Key: 2, PartnerData: []byte("partner"), Name: "PR 2"},
+		&AdvV2{Id: 1, Key: 2, PartnerData: bytes.Repeat([]byte{0xee}, 26), Name: "PR"},
+		v3Adv,
+		&AdvV3{Id: 1<<64 - 1, Key: 2, Flags: AdvV2statusOffline, BatteryMillivolts: 0xffff, Uptime: 1<<32 - 1, Name: "PR"},
+		&AdvV3{Id: 1, PartnerData: bytes.Repeat([]byte{0xee}, 26), Name: "PR"},
+	} {
+		adv, scanResp, err := a.MarshalPackets()
+		if err != nil {
+			t.Fatalf("MarshalPackets(%#v): %s", a, err)
+		}
+		if len(adv) > 31 || len(scanResp) > 31 {
+			t.Errorf("MarshalPackets(%#v): got %d and %d bytes, want at most 31", a, len(adv), len(scanResp))
+		}
+
+		raw, err := a.Marshal()
+		if err != nil {
+			t.Fatalf("Marshal(%#v): %s", a, err)
+		}
+		if !bytes.Equal(raw, append(adv, scanResp...)) {
+			t.Errorf("Marshal(%#v): got % x want % x", a, raw, append(adv, scanResp...))
+		}
+		if got := ParseAdData(raw); !reflect.DeepEqual(got, a) {
+			t.Errorf("ParseAdData(Marshal(%#v)): got %#v", a, got)
+		}
+	}
+
+	if raw, _ := (&AdvV2{Id: 0x12345678, Key: 0xaabbccdd, Flags: AdvV2canTransact, FwVersion: 0x0102, PartnerData: []byte("hi")}).Marshal(); !bytes.Equal(raw, v2AdData) {
+		t.Errorf("Marshal: got % x want % x", raw, v2AdData)
+	}
+	if raw, _ := v3Adv.Marshal(); !bytes.Equal(raw, v3AdData) {
+		t.Errorf("Marshal: got % x want % x", raw, v3AdData)
+	}
+
+	long := &AdvV2{PartnerData: bytes.Repeat([]byte{0xee}, 27)}
+	if _, err := long.Marshal(); err != ErrPacketTooLong {
+		t.Errorf("Marshal with 27 bytes of partner data: got %v want %v", err, ErrPacketTooLong)
+	}
+	long3 := &AdvV3{PartnerData: bytes.Repeat([]byte{0xee}, 27)}
+	if _, err := long3.Marshal(); err != ErrPacketTooLong {
+		t.Errorf("Marshal of V3 with 27 bytes of partner data: got %v want %v", err, ErrPacketTooLong)
+	}
+	for _, a := range []interface{ Marshal() ([]byte, error) }{
+		&AdvV1{Name: "PayRange 12345"},
+		&AdvV2{Name: "PR 4567890123"},
+		&AdvV3{Name: "PR2"},
+	} {
+		if _, err := a.Marshal(); err != ErrPacketTooLong {
+			t.Errorf("Marshal(%v): got %v want %v", a, err, ErrPacketTooLong)
+		}
+	}
+	for _, a := range []interface{ Marshal() ([]byte, error) }{&AdvV1{Name: "PR"}, &AdvV2{Name: "PayRange"}} {
+		if _, err := a.Marshal(); err == nil {
+			t.Errorf("Marshal(%v): got nil error for a name without the prefix", a)
+		}
+	}
+}
+
+func TestParseAdDataNames(t *testing.T) {
+	v1 := func(typ byte, name string) []byte {
+		return bytes.Join([][]byte{{byte(len(name) + 1), typ}, []byte(name), v1AdData[len(v1Name)+1:]}, nil)
+	}
+	v2 := func(typ byte, name string) []byte {
+		return bytes.Join([][]byte{{byte(len(name) + 1), typ}, []byte(name), v2AdData[4:]}, nil)
+	}
+	for _, tt := range []struct {
+		name string
+		raw  []byte
+		want string // "" if rejected
+	}{
+		{"V1 complete", v1(ADCompleteName, "PayRange"), "PayRange"},
+		{"V1 shortened", v1(ADShortName, "PayRange"), "PayRange"},
+		{"V1 longer", v1(ADCompleteName, "PayRange 2"), "PayRange 2"},
+		{"V1 shortened longer", v1(ADShortName, "PayRange-K"), "PayRange-K"},
+		{"V1 truncated", v1(ADShortName, "PayRan"), ""},
+		{"V1 other", v1(ADCompleteName, "Acme"), ""},
+		{"V1 wrong case", v1(ADCompleteName, "payrange"), ""},
+		{"V1 other AD type", v1(0x0a, "PayRange"), ""},
+		{"V2 complete", v2(ADCompleteName, "PR"), "PR"},
+		{"V2 shortened", v2(ADShortName, "PR"), "PR"},
+		{"V2 longer", v2(ADCompleteName, "PR-1234"), "PR-1234"},
+		{"V2 other", v2(ADCompleteName, "P"), ""},
+		{"V2 V1 name", v2(ADCompleteName, "PayRange"), ""},
+		{"V2 complete wins", bytes.Join([][]byte{{4, ADShortName, 'P', 'R', 'x'}, v2(ADCompleteName, "PR-1")}, nil), "PR-1"},
+		{"V2 complete wins first", append(v2(ADCompleteName, "PR-1"), 4, ADShortName, 'P', 'R', 'x'), "PR-1"},
+	} {
+		a := ParseAdData(tt.raw)
+		var got string
+		switch a := a.(type) {
+		case *AdvV1:
+			got = a.Name
+		case *AdvV2:
+			got = a.Name
+		}
+		if got != tt.want || (tt.want == "") != (a == nil) {
+			t.Errorf("%s: got %#v want name %q", tt.name, a, tt.want)
+		}
+	}
+}
+
+func TestAdvString(t *testing.T) {
+	for _, tt := range []struct {
+		s    fmt.Stringer
+		want string
+	}{
+		{AdvV1clock, "clock"},
+		{AdvV1Flags(0), "noMaintenance"},
+		{AdvV1Flags(0x0e), "AdvV1Flags(0x0e)"},
+		{AdvV1offline, "offline"},
+		{AdvV1Status(3), "AdvV1Status(0x03)"},
+		{AdvV2Flags(0), "statusReady"},
+		{AdvV2cashlessPending | AdvV2connAlarmClockNotSet | AdvV2statusBusy, "cashlessPending|connAlarmClockNotSet|statusBusy"},
+		{AdvV2canTransact | AdvV2machAlarmInactivity | AdvV2statusReadyMaint, "canTransact|machAlarmInactivity|statusReadyMaint"},
+		{AdvV2Flags(0x8000 | 0x0080 | 0x0020 | 0x0003), "machAlarm(0x0080)|connAlarm(0x0020)|status(0x0003)|0x8000"},
+		{&AdvV1{Id: 42, Key: 7, Flags: AdvV1none, Status: AdvV1busy}, "AdvV1{Id: 42, Flags: none, Status: busy}"},
+		{&AdvV2{Id: 42, Key: 7, Flags: AdvV2statusOffline, FwVersion: 0x0102}, "AdvV2{Id: 42, Flags: statusOffline, FwVersion: 1.0.2}"},
+		{&AdvV2{Id: 42, PartnerData: []byte{1, 2}}, "AdvV2{Id: 42, Flags: statusReady, FwVersion: 0.0.0, PartnerData: 01 02}"},
+		{v3Adv, "AdvV3{Id: 81985529216486895, Flags: canTransact|statusReady, FwVersion: 3.0.1, BatteryMillivolts: 3000, Uptime: 86400, PartnerData: 68 69}"},
+	} {
+		if got := tt.s.String(); got != tt.want {
+			t.Errorf("got %q want %q", got, tt.want)
+		}
+	}
+}
+
+func TestAdvStatusAndAlarms(t *testing.T) {
+	for _, tt := range []struct {
+		a      Adv
+		fw     uint16
+		status Status
+		alarms []Alarm
+	}{
+		{&AdvV1{Flags: AdvV1none, Status: AdvV1ready}, 0, StatusReady, nil},
+		{&AdvV1{Flags: AdvV1clock, Status: AdvV1busy}, 0, StatusBusy, []Alarm{AlarmClockNotSet}},
+		{&AdvV1{Flags: AdvV1inactivity, Status: AdvV1disabled}, 0, StatusDisabled, []Alarm{AlarmInactivity}},
+		{&AdvV1{Flags: AdvV1cashlessPending, Status: AdvV1offline}, 0, StatusOffline, []Alarm{AlarmCashlessPending}},
+		{&AdvV1{Flags: AdvV1cashPending, Status: 7}, 0, StatusUnknown, []Alarm{AlarmCashPending}},
+		{&AdvV1{Flags: AdvV1connectReq}, 0, StatusReady, []Alarm{AlarmConnectRequest}},
+		{&AdvV2{FwVersion: 0x0102}, 0x0102, StatusReady, nil},
+		{&AdvV2{Flags: AdvV2statusReadyMaint | AdvV2connAlarmClockNotSet | AdvV2machAlarmInactivity}, 0,
+			StatusReadyMaintenance, []Alarm{AlarmClockNotSet, AlarmInactivity}},
+		{&AdvV2{Flags: AdvV2statusBusy | AdvV2cashPending | AdvV2cashlessPending | AdvV2connAlarmDebugPending}, 0,
+			StatusBusy, []Alarm{AlarmCashPending, AlarmCashlessPending, AlarmDebugPending}},
+		{&AdvV2{Flags: AdvV2statusDisabled | AdvV2connAlarmFwUpdateNeeded}, 0, StatusDisabled, []Alarm{AlarmFwUpdateNeeded}},
+		{&AdvV2{Flags: AdvV2statusOffline}, 0, StatusOffline, nil},
+		{&AdvV2{Flags: 0x0003 | 0x0020 | 0x0080}, 0, StatusUnknown, nil},
+		{&AdvV3{Flags: AdvV2statusBusy | AdvV2cashPending, FwVersion: 0x0301}, 0x0301, StatusBusy, []Alarm{AlarmCashPending}},
+	} {
+		if fw := tt.a.FirmwareVersion(); fw != tt.fw {
+			t.Errorf("%v: FirmwareVersion: got %#04x want %#04x", tt.a, fw, tt.fw)
+		}
+		if s := tt.a.DeviceStatus(); s != tt.status {
+			t.Errorf("%v: DeviceStatus: got %v want %v", tt.a, s, tt.status)
+		}
+		if a := tt.a.Alarms(); !reflect.DeepEqual(a, tt.alarms) {
+			t.Errorf("%v: Alarms: got %v want %v", tt.a, a, tt.alarms)
+		}
+	}
+}
+
+func TestParseAdvAndScanResponse(t *testing.T) {
+	// A V2 advertisement whose partner data is in the scan response, with
+	// the advertising packet padded to 31 bytes.
+	adv := append(v2AdData[:22:22], make([]byte, 9)...)
+	rsp := v2AdData[22:]
+	want := &AdvV2{Id: 0x12345678, Key: 0xaabbccdd, Flags: AdvV2canTransact, FwVersion: 0x0102, PartnerData: []byte("hi"), Name: "PR"}
+
+	if got := ParseAdvAndScanResponse(adv, rsp); !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseAdvAndScanResponse: got %#v want %#v", got, want)
+	}
+	if got := ParseAdData(append(adv, rsp...)); got.(*AdvV2).PartnerData != nil {
+		t.Errorf("ParseAdData of padded packets: got partner data %q", got.(*AdvV2).PartnerData)
+	}
+	if got := ParseAdvAndScanResponse(adv, nil); got == nil || got.(*AdvV2).PartnerData != nil {
+		t.Errorf("ParseAdvAndScanResponse without scan response: got %#v", got)
+	}
+
+	// V1 needs its scan response for the BRSP service UUID.
+	v1 := &AdvV1{Id: 7, Flags: AdvV1none, Name: "PayRange"}
+	adv, rsp, _ = v1.MarshalPackets()
+	if got := ParseAdvAndScanResponse(adv, rsp); !reflect.DeepEqual(got, v1) {
+		t.Errorf("ParseAdvAndScanResponse of V1: got %#v want %#v", got, v1)
+	}
+	if got := ParseAdData(adv); got != nil {
+		t.Errorf("ParseAdData of V1 without scan response: got %#v", got)
+	}
+}
+
+// csrV1Adv and csrV1Rsp are a V1 advertising packet and scan response as
+// a CSR dongle reports them: the whole 31-byte buffers, with stray bytes
+// in the padding after the last AD structure.
+var (
+	csrV1Adv = []byte{
+		9, 0x09, 'P', 'a', 'y', 'R', 'a', 'n', 'g', 'e',
+		16, 0xff, 0x85, 0x00, 0xff, 0x07, 0x00, 0x00, 0x00, 0x01, byte(AdvV1none), 0x00, 0x00, 0x00, 0x00, 0x00, 0x01,
+		0xe3, 0x00, 0x00, 0x00,
+	}
+	csrV1Rsp = append(append([]byte{17}, v1BRSP...),
+		0x00, 0x00, 0x41, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x08, 0x00, 0x00)
+)
+
+func TestParseAdDataPadding(t *testing.T) {
+	v1 := &AdvV1{Id: 7, Flags: AdvV1none, Name: "PayRange"}
+	if got := ParseAdvAndScanResponse(csrV1Adv, csrV1Rsp); !reflect.DeepEqual(got, v1) {
+		t.Errorf("ParseAdvAndScanResponse of CSR V1 packets: got %#v want %#v", got, v1)
+	}
+
+	// Garbage running past the end of the buffer ends the packet.
+	v2 := &AdvV2{Id: 0x12345678, Key: 0xaabbccdd, Flags: AdvV2canTransact, FwVersion: 0x0102, Name: "PR"}
+	for _, pad := range [][]byte{
+		{0x00, 0x00, 0x00, 0x00, 0x5a, 0x00, 0x00, 0x00, 0x00},
+		{0x1e, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00},
+		{0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xff, 0x00},
+	} {
+		raw := append(v2AdData[:22:22], pad...)
+		if got := ParseAdData(raw); !reflect.DeepEqual(got, v2) {
+			t.Errorf("ParseAdData(% x): got %#v want %#v", raw, got, v2)
+		}
+	}
+}
+
+func FuzzParseAdData(f *testing.F) {
+	f.Add(v1AdData)
+	f.Add(v2AdData)
+	f.Add(v3AdData)
+	f.Add([]byte{17, 0xff, 0xc9, 0x02, 0x00})
+	f.Add([]byte{16, 0xff, 0x85, 0x00, 0xff, 0x01})
+	f.Fuzz(func(t *testing.T, raw []byte) {
+		ParseAdData(raw)
+	})
+}
+
+func TestParseAdDataInto(t *testing.T) {
+	var v1 AdvV1
+	var v2 AdvV2
+	var v3 AdvV3
+	for _, raw := range [][]byte{v1AdData, v2AdData, v3AdData, nil, v2AdData[:4]} {
+		want := ParseAdData(raw)
+		got, ok := ParseAdDataInto(raw, &v1, &v2, &v3)
+		if ok != (want != nil) || (ok && !reflect.DeepEqual(got, want)) {
+			t.Errorf("ParseAdDataInto(% x): got %#v, %t want %#v", raw, got, ok, want)
+		}
+	}
+	if got, _ := ParseAdDataInto(v2AdData, &v1, &v2, &v3); got != &v2 {
+		t.Errorf("ParseAdDataInto: got %p want %p", got, &v2)
+	}
+
+	// PartnerData shares raw for ParseAdDataInto only.
+	raw := append([]byte(nil), v2AdData...)
+	a := ParseAdData(raw).(*AdvV2)
+	ParseAdDataInto(raw, &v1, &v2, &v3)
+	raw[len(raw)-1] = 'o'
+	if string(a.PartnerData) != "hi" || string(v2.PartnerData) != "ho" {
+		t.Errorf("PartnerData: got %q from ParseAdData and %q from ParseAdDataInto", a.PartnerData, v2.PartnerData)
+	}
+}
+
+func TestPeek(t *testing.T) {
+	for _, tt := range []struct {
+		raw     []byte
+		version int
+		id      uint64
+		ok      bool
+	}{
+		{v1AdData, 1, 0x12345678, true},
+		{v2AdData, 2, 0x12345678, true},
+		{v3AdData, 3, 0x0123456789abcdef, true},
+		{v2AdData[22:], 0, 0, false},
+		{append(v2AdData[:4:4], 5, 0xff, 0xc9, 0x02, 0x00, 1), 2, 0, false},
+		{nil, 0, 0, false},
+	} {
+		if v := PeekVersion(tt.raw); v != tt.version {
+			t.Errorf("PeekVersion(% x): got %d want %d", tt.raw, v, tt.version)
+		}
+		if id, ok := PeekDeviceId(tt.raw); id != tt.id || ok != tt.ok {
+			t.Errorf("PeekDeviceId(% x): got %#x, %t want %#x, %t", tt.raw, id, ok, tt.id, tt.ok)
+		}
+	}
+}
+
+func BenchmarkParseAdData(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ParseAdData(v2AdData)
+	}
+}
+
+func BenchmarkParseAdDataInto(b *testing.B) {
+	var v1 AdvV1
+	var v2 AdvV2
+	var v3 AdvV3
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		ParseAdDataInto(v2AdData, &v1, &v2, &v3)
+	}
+}
+
+func BenchmarkPeekDeviceId(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		PeekDeviceId(v2AdData)
+	}
+}
+
+func TestParseAdDataV1ServiceList(t *testing.T) {
+	name := append([]byte{byte(len(v1Name))}, v1Name...)
+	msd := v1AdData[len(v1Name)+len(v1BRSP)+2:]
+	uuid := v1BRSP[1:]
+	other := bytes.Repeat([]byte{0x42}, 16)
+	want := &AdvV1{Id: 0x12345678, Key: 0xaabbccdd, Flags: AdvV1clock, Status: AdvV1ready, Name: "PayRange"}
+
+	for _, tt := range []struct {
+		name string
+		list []byte
+		ok   bool
+	}{
+		{"complete", bytes.Join([][]byte{{17, ADAllUUID128}, uuid}, nil), true},
+		{"incomplete", bytes.Join([][]byte{{17, ADSomeUUID128}, uuid}, nil), true},
+		{"BRSP second", bytes.Join([][]byte{{33, ADAllUUID128}, other, uuid}, nil), true},
+		{"BRSP first", bytes.Join([][]byte{{33, ADSomeUUID128}, uuid, other}, nil), true},
+		{"other only", bytes.Join([][]byte{{17, ADAllUUID128}, other}, nil), false},
+		{"partial BRSP", bytes.Join([][]byte{{17, ADAllUUID128}, other[:8], uuid[:8]}, nil), false},
+		{"trailing bytes", bytes.Join([][]byte{{20, ADAllUUID128}, uuid, {1, 2, 3}}, nil), true},
+		{"16-bit list", bytes.Join([][]byte{{17, 0x03}, uuid}, nil), false},
+	} {
+		raw := bytes.Join([][]byte{name, tt.list, msd}, nil)
+		a, err := ParseAdDataStrict(raw)
+		if tt.ok && (err != nil || !reflect.DeepEqual(a, want)) {
+			t.Errorf("%s: got %#v, %v want %#v", tt.name, a, err, want)
+		}
+		if !tt.ok && !errors.Is(err, ErrNoService) {
+			t.Errorf("%s: got %#v, %v want %v", tt.name, a, err, ErrNoService)
+		}
+	}
+}
+
+func TestParseAdDataUnknownMSD(t *testing.T) {
+	future := []byte{6, ADManufacturerData, 0xc9, 0x02, 0x04, 0xaa, 0xbb}
+	other := []byte{4, ADManufacturerData, 0x4c, 0x00, 0x10}
+	raw := bytes.Join([][]byte{v2AdData[:22], future, other, v2AdData[22:]}, nil)
+
+	want := []MSD{
+		{CompanyID: 0x02c9, SubType: 0x04, Payload: []byte{0xaa, 0xbb}},
+		{CompanyID: 0x004c, SubType: 0x10, Payload: []byte{}},
+	}
+	a, ok := ParseAdData(raw).(*AdvV2)
+	if !ok || !reflect.DeepEqual(a.UnknownMSD, want) || string(a.PartnerData) != "hi" || a.Id != 0x12345678 {
+		t.Fatalf("ParseAdData: got %#v", ParseAdData(raw))
+	}
+	if s := a.String(); !strings.HasSuffix(s, "UnknownMSD: [0x02c9/0x04: aa bb 0x004c/0x10: ]}") {
+		t.Errorf("String: got %q", s)
+	}
+
+	// The payloads are copied.
+	raw[len(v2AdData[:22])+5] = 0
+	if a.UnknownMSD[0].Payload[0] != 0xaa {
+		t.Errorf("UnknownMSD shares raw")
+	}
+
+	// V1 is recognized alongside, and V3 reports them too.
+	if a := ParseAdData(append(future, v1AdData...)); a == nil {
+		t.Errorf("ParseAdData of V1 with unknown MSD: got nil")
+	}
+	a3, ok := ParseAdData(append(v3AdData[:31:31], future...)).(*AdvV3)
+	if !ok || len(a3.UnknownMSD) != 1 || a3.UnknownMSD[0].SubType != 0x04 {
+		t.Errorf("ParseAdData of V3 with unknown MSD: got %#v", a3)
+	}
+
+	b, err := json.Marshal(a)
+	if err != nil || !strings.Contains(string(b), `"unknownMsd":[{"companyId":713,"subType":4,"payload":"qrs="},{"companyId":76,"subType":16,"payload":""}]`) {
+		t.Errorf("json.Marshal: got %s, %v", b, err)
+	}
+}
@@ -0,0 +1,41 @@
+package blukey
+
+import "time"
+
+// ParseStats tells what ParseBatch found.
+type ParseStats struct {
+	Packets  int            // advertisements given
+	Parsed   int            // BluKey advertisements among them
+	Rejected map[string]int // the others, by reason, see Metrics.IncRejected
+	Devices  int            // distinct devices, the length of the result
+}
+
+// ParseBatch parses raws, the advertisements collected over a scan window
+// in the order received, as ParseAdDataStrict does, and returns the latest
+// advertisement of each device, ordered by DeviceId, as a Registry
+// snapshot would.
+func ParseBatch(raws [][]byte) ([]Adv, ParseStats) {
+	stats := ParseStats{Packets: len(raws), Rejected: make(map[string]int)}
+	r := NewRegistry(0, nil)
+	defer r.Close()
+
+	// The Registry keeps the latest advertisement by time; the position
+	// in raws stands for it.
+	for i, raw := range raws {
+		a, err := ParseAdDataStrict(raw)
+		if err != nil {
+			stats.Rejected[rejectReason(err)]++
+			continue
+		}
+		stats.Parsed++
+		r.Update(a, 0, time.Unix(0, int64(i)))
+	}
+
+	entries := r.Snapshot()
+	advs := make([]Adv, len(entries))
+	for i, e := range entries {
+		advs[i] = e.Adv
+	}
+	stats.Devices = len(advs)
+	return advs, stats
+}
@@ -0,0 +1,59 @@
+package blukey
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseBatch(t *testing.T) {
+	busy := &AdvV2{Id: 0x12345678, Key: 0xaabbccdd, Flags: AdvV2statusBusy, FwVersion: 0x0102, Name: "PR"}
+	busyData, err := busy.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := &AdvV2{Id: 42, Name: "PR"}
+	otherData, err := other.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	advs, stats := ParseBatch([][]byte{
+		v3AdData,
+		v2AdData,
+		otherData,
+		busyData, // replaces v2AdData, of the same device
+		{2, 0x01, 0x06},
+		v2AdData[:4],
+		nil,
+	})
+	want := []Adv{other, busy, ParseAdData(v3AdData)}
+	if !reflect.DeepEqual(advs, want) {
+		t.Errorf("ParseBatch: got %v want %v", advs, want)
+	}
+	wantStats := ParseStats{
+		Packets:  7,
+		Parsed:   4,
+		Rejected: map[string]int{RejectNotBlukey: 2, RejectNoManufacturerData: 1},
+		Devices:  3,
+	}
+	if !reflect.DeepEqual(stats, wantStats) {
+		t.Errorf("ParseBatch stats: got %+v want %+v", stats, wantStats)
+	}
+
+	if advs, stats := ParseBatch(nil); len(advs) != 0 || stats.Packets != 0 || stats.Devices != 0 {
+		t.Errorf("ParseBatch(nil): got %v, %+v", advs, stats)
+	}
+}
+
+func BenchmarkParseBatch(b *testing.B) {
+	raws := make([][]byte, 20000)
+	for i := range raws {
+		a := &AdvV2{Id: uint32(i % 5000), Name: "PR"}
+		raws[i], _ = a.Marshal()
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ParseBatch(raws)
+	}
+}
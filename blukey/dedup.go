@@ -0,0 +1,103 @@
+package blukey
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// A Deduper suppresses repeated advertisements of the same device, which
+// kiosks send several times a second. It lets an advertisement through
+// when its DeviceId is first seen, when Diff reports a change from the
+// last one let through, and when that one is older than the refresh
+// interval.
+// It can be used as the filter of a gatt.BlukeyScanner.
+type Deduper struct {
+	refresh    time.Duration
+	maxAge     time.Duration
+	maxDevices int
+
+	mu      sync.Mutex
+	devices map[uint64]*list.Element // of *dedupEntry
+	lru     list.List                // most recently seen first
+	stats   DeduperStats
+}
+
+// DeduperStats holds the counters of a Deduper.
+type DeduperStats struct {
+	Emitted    uint64 // advertisements let through
+	Suppressed uint64 // advertisements suppressed as duplicates
+	Evicted    uint64 // devices forgotten to bound memory
+	Devices    int    // devices remembered now
+}
+
+type dedupEntry struct {
+	id       uint64
+	last     Adv // last let through
+	lastSeen time.Time
+	lastEmit time.Time
+}
+
+// NewDeduper returns a Deduper that lets unchanged advertisements through
+// again after refresh, or never if refresh is 0. It forgets devices not
+// seen for maxAge, if positive, and the least recently seen devices
+// beyond maxDevices, if positive; a forgotten device is new again.
+func NewDeduper(refresh, maxAge time.Duration, maxDevices int) *Deduper {
+	return &Deduper{
+		refresh:    refresh,
+		maxAge:     maxAge,
+		maxDevices: maxDevices,
+		devices:    make(map[uint64]*list.Element),
+	}
+}
+
+// Allow reports whether a, received at now, should be passed on.
+func (d *Deduper) Allow(a Adv, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	defer d.evict(now)
+
+	el := d.devices[a.DeviceId64()]
+	if el == nil {
+		e := &dedupEntry{id: a.DeviceId64(), last: a, lastSeen: now, lastEmit: now}
+		d.devices[e.id] = d.lru.PushFront(e)
+		d.stats.Emitted++
+		return true
+	}
+
+	e := el.Value.(*dedupEntry)
+	e.lastSeen = now
+	d.lru.MoveToFront(el)
+	if len(Diff(e.last, a)) > 0 || (d.refresh > 0 && now.Sub(e.lastEmit) >= d.refresh) {
+		e.last = a
+		e.lastEmit = now
+		d.stats.Emitted++
+		return true
+	}
+	d.stats.Suppressed++
+	return false
+}
+
+// Stats returns the counters of d.
+func (d *Deduper) Stats() DeduperStats {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s := d.stats
+	s.Devices = len(d.devices)
+	return s
+}
+
+// evict forgets the devices that are too old or too many.
+func (d *Deduper) evict(now time.Time) {
+	for el := d.lru.Back(); el != nil; el = d.lru.Back() {
+		e := el.Value.(*dedupEntry)
+		old := d.maxAge > 0 && now.Sub(e.lastSeen) > d.maxAge
+		many := d.maxDevices > 0 && d.lru.Len() > d.maxDevices
+		if !old && !many {
+			return
+		}
+		d.lru.Remove(el)
+		delete(d.devices, e.id)
+		d.stats.Evicted++
+	}
+}
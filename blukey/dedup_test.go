@@ -0,0 +1,73 @@
+package blukey
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeduper(t *testing.T) {
+	d := NewDeduper(time.Second, 0, 0)
+	t0 := time.Unix(1000, 0)
+	at := func(ms int) time.Time { return t0.Add(time.Duration(ms) * time.Millisecond) }
+
+	for _, tt := range []struct {
+		a    Adv
+		ms   int
+		want bool
+	}{
+		{&AdvV2{Id: 1, Flags: AdvV2statusReady}, 0, true},
+		{&AdvV2{Id: 1, Flags: AdvV2statusReady}, 100, false},
+		{&AdvV2{Id: 2, Flags: AdvV2statusReady}, 150, true},
+		{&AdvV2{Id: 1, Flags: AdvV2statusBusy}, 200, true},
+		{&AdvV2{Id: 1, Flags: AdvV2statusBusy}, 300, false},
+		{&AdvV2{Id: 1, Flags: AdvV2statusBusy}, 1199, false},
+		{&AdvV2{Id: 1, Flags: AdvV2statusBusy}, 1200, true},
+		{&AdvV1{Id: 3, Status: AdvV1ready}, 1300, true},
+		{&AdvV1{Id: 3, Status: AdvV1ready, Flags: AdvV1clock}, 1400, true},
+		{&AdvV1{Id: 3, Status: AdvV1busy, Flags: AdvV1clock}, 1500, true},
+		{&AdvV1{Id: 3, Status: AdvV1busy, Flags: AdvV1clock}, 1600, false},
+		{&AdvV3{Id: 1<<32 | 2}, 1700, true},
+		{&AdvV3{Id: 1<<32 | 2, Uptime: 1}, 1800, false},
+	} {
+		if got := d.Allow(tt.a, at(tt.ms)); got != tt.want {
+			t.Errorf("Allow(%v) at %dms: got %t want %t", tt.a, tt.ms, got, tt.want)
+		}
+	}
+	if st := d.Stats(); st != (DeduperStats{Emitted: 8, Suppressed: 5, Devices: 4}) {
+		t.Errorf("Stats: got %+v", st)
+	}
+}
+
+func TestDeduperEviction(t *testing.T) {
+	t0 := time.Unix(1000, 0)
+
+	// Devices not seen for maxAge are forgotten.
+	d := NewDeduper(0, time.Minute, 0)
+	d.Allow(&AdvV2{Id: 1}, t0)
+	d.Allow(&AdvV2{Id: 2}, t0.Add(50*time.Second))
+	if d.Allow(&AdvV2{Id: 2}, t0.Add(90*time.Second)) {
+		t.Errorf("device 2 let through again")
+	}
+	if st := d.Stats(); st.Devices != 1 || st.Evicted != 1 {
+		t.Errorf("Stats: got %+v want 1 device, 1 evicted", st)
+	}
+	if !d.Allow(&AdvV2{Id: 1}, t0.Add(91*time.Second)) {
+		t.Errorf("forgotten device 1 not let through")
+	}
+
+	// Beyond maxDevices the least recently seen device is forgotten.
+	d = NewDeduper(0, 0, 2)
+	d.Allow(&AdvV2{Id: 1}, t0)
+	d.Allow(&AdvV2{Id: 2}, t0)
+	d.Allow(&AdvV2{Id: 1}, t0)
+	d.Allow(&AdvV2{Id: 3}, t0)
+	if st := d.Stats(); st.Devices != 2 || st.Evicted != 1 {
+		t.Errorf("Stats: got %+v want 2 devices, 1 evicted", st)
+	}
+	if d.Allow(&AdvV2{Id: 1}, t0) {
+		t.Errorf("recently seen device 1 was forgotten")
+	}
+	if !d.Allow(&AdvV2{Id: 2}, t0) {
+		t.Errorf("least recently seen device 2 was not forgotten")
+	}
+}
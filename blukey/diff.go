@@ -0,0 +1,81 @@
+package blukey
+
+import "fmt"
+
+// A Change is a field that differs between two advertisements of a
+// device, with its old and new values.
+type Change struct {
+	// Field is "version", "status", "canTransact", "fwVersion" or the
+	// name of an Alarm, e.g. "cashlessPending".
+	Field string
+
+	// Old and New are an int for the version, a Status, a uint16 for
+	// the firmware version and bools otherwise. A field of a nil Adv is
+	// nil.
+	Old, New interface{}
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("%s: %v -> %v", c.Field, c.Old, c.New)
+}
+
+// Diff returns the meaningful changes from old to new, which may be of
+// different versions: the fields compared are those common to all
+// versions, so a V1 device upgraded to V2 only shows changes in its
+// state. Other differences, such as the AuthKey or the V3 uptime, are not
+// reported. A nil old or new is a device without fields, e.g. Diff(nil,
+// a) reports every field of a.
+func Diff(old, new Adv) []Change {
+	o, n := diffFields(old), diffFields(new)
+	var changes []Change
+	for i, name := range diffFieldNames {
+		var ov, nv interface{}
+		if o != nil {
+			ov = o[i]
+		}
+		if n != nil {
+			nv = n[i]
+		}
+		if ov != nv {
+			changes = append(changes, Change{Field: name, Old: ov, New: nv})
+		}
+	}
+	return changes
+}
+
+// diffFieldNames are the fields Diff compares, in the order diffFields
+// returns them and Diff reports them.
+var diffFieldNames = []string{
+	"version", "status", "canTransact", "fwVersion",
+	AlarmClockNotSet.String(),
+	AlarmInactivity.String(),
+	AlarmCashPending.String(),
+	AlarmCashlessPending.String(),
+	AlarmDebugPending.String(),
+	AlarmFwUpdateNeeded.String(),
+	AlarmConnectRequest.String(),
+}
+
+func diffFields(a Adv) []interface{} {
+	if a == nil {
+		return nil
+	}
+	version := 0
+	switch a.(type) {
+	case *AdvV1:
+		version = 1
+	case *AdvV2:
+		version = 2
+	case *AdvV3:
+		version = 3
+	}
+	f := []interface{}{version, a.DeviceStatus(), a.CanTransact(), a.FirmwareVersion()}
+	alarms := make(map[Alarm]bool)
+	for _, al := range a.Alarms() {
+		alarms[al] = true
+	}
+	for al := AlarmClockNotSet; al <= AlarmConnectRequest; al++ {
+		f = append(f, alarms[al])
+	}
+	return f
+}
@@ -0,0 +1,79 @@
+package blukey
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		old, new Adv
+		want     []Change
+	}{
+		{"V1 same", &AdvV1{Id: 1, Key: 1, Flags: AdvV1none}, &AdvV1{Id: 1, Key: 2, Flags: AdvV1none}, nil},
+		{"V1 status", &AdvV1{Status: AdvV1ready}, &AdvV1{Status: AdvV1busy}, []Change{
+			{"status", StatusReady, StatusBusy},
+			{"canTransact", true, false},
+		}},
+		{"V1 alarm", &AdvV1{Flags: AdvV1none}, &AdvV1{Flags: AdvV1clock}, []Change{
+			{"clockNotSet", false, true},
+		}},
+		{"V1 alarm replaced", &AdvV1{Flags: AdvV1cashlessPending}, &AdvV1{Flags: AdvV1connectReq}, []Change{
+			{"cashlessPending", true, false},
+			{"connectRequest", false, true},
+		}},
+		{"V2 same", &AdvV2{Flags: AdvV2statusBusy | 0x8000}, &AdvV2{Flags: AdvV2statusBusy, PartnerData: []byte{1}}, nil},
+		{"V2 status", &AdvV2{Flags: AdvV2statusReady}, &AdvV2{Flags: AdvV2statusReadyMaint}, []Change{
+			{"status", StatusReady, StatusReadyMaintenance},
+			{"canTransact", true, false},
+		}},
+		{"V2 canTransact", &AdvV2{Flags: AdvV2statusBusy}, &AdvV2{Flags: AdvV2statusBusy | AdvV2canTransact}, []Change{
+			{"canTransact", false, true},
+		}},
+		{"V2 cash", &AdvV2{Flags: AdvV2cashPending}, &AdvV2{Flags: AdvV2cashlessPending}, []Change{
+			{"cashPending", true, false},
+			{"cashlessPending", false, true},
+		}},
+		{"V2 machine alarm", &AdvV2{}, &AdvV2{Flags: AdvV2machAlarmInactivity}, []Change{
+			{"inactivity", false, true},
+		}},
+		{"V2 connection alarm", &AdvV2{Flags: AdvV2connAlarmDebugPending}, &AdvV2{Flags: AdvV2connAlarmFwUpdateNeeded}, []Change{
+			{"debugPending", true, false},
+			{"fwUpdateNeeded", false, true},
+		}},
+		{"V2 firmware", &AdvV2{FwVersion: 0x0102}, &AdvV2{FwVersion: 0x0200}, []Change{
+			{"fwVersion", uint16(0x0102), uint16(0x0200)},
+		}},
+		{"V1 to V2", &AdvV1{Id: 1, Flags: AdvV1cashlessPending, Status: AdvV1ready}, &AdvV2{Id: 1, Flags: AdvV2cashlessPending, FwVersion: 0x0200}, []Change{
+			{"version", 1, 2},
+			{"fwVersion", uint16(0), uint16(0x0200)},
+		}},
+		{"V2 to V3", &AdvV2{Flags: AdvV2statusBusy}, &AdvV3{Flags: AdvV2statusBusy, Uptime: 10}, []Change{
+			{"version", 2, 3},
+		}},
+		{"new", nil, &AdvV2{Flags: AdvV2cashPending}, []Change{
+			{"version", nil, 2},
+			{"status", nil, StatusReady},
+			{"canTransact", nil, true},
+			{"fwVersion", nil, uint16(0)},
+			{"clockNotSet", nil, false},
+			{"inactivity", nil, false},
+			{"cashPending", nil, true},
+			{"cashlessPending", nil, false},
+			{"debugPending", nil, false},
+			{"fwUpdateNeeded", nil, false},
+			{"connectRequest", nil, false},
+		}},
+		{"nil", nil, nil, nil},
+	} {
+		if got := Diff(tt.old, tt.new); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v want %v", tt.name, got, tt.want)
+		}
+	}
+
+	c := Change{"status", StatusReady, StatusBusy}
+	if s := c.String(); s != "status: ready -> busy" {
+		t.Errorf("String: got %q", s)
+	}
+}
@@ -0,0 +1,137 @@
+package blukey
+
+import "bytes"
+
+// Equal reports whether a and b are the same advertisement: of the same
+// version, with equal fields. PartnerData and MSD payloads are compared
+// by content, so nil and empty ones are equal. Unlike reflect.DeepEqual,
+// it does not allocate.
+func Equal(a, b Adv) bool {
+	switch a := a.(type) {
+	case *AdvV1:
+		b, ok := b.(*AdvV1)
+		return ok && (a == b || a != nil && b != nil && *a == *b)
+	case *AdvV2:
+		b, ok := b.(*AdvV2)
+		if !ok || a == nil || b == nil {
+			return ok && a == b
+		}
+		return a.Id == b.Id && a.Key == b.Key && a.Flags == b.Flags && a.FwVersion == b.FwVersion &&
+			a.Name == b.Name && bytes.Equal(a.PartnerData, b.PartnerData) && equalMSDs(a.UnknownMSD, b.UnknownMSD)
+	case *AdvV3:
+		b, ok := b.(*AdvV3)
+		if !ok || a == nil || b == nil {
+			return ok && a == b
+		}
+		return a.Id == b.Id && a.Key == b.Key && a.Flags == b.Flags && a.FwVersion == b.FwVersion &&
+			a.BatteryMillivolts == b.BatteryMillivolts && a.Uptime == b.Uptime &&
+			a.Name == b.Name && bytes.Equal(a.PartnerData, b.PartnerData) && equalMSDs(a.UnknownMSD, b.UnknownMSD)
+	}
+	return a == nil && b == nil
+}
+
+func equalMSDs(a, b []MSD) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].CompanyID != b[i].CompanyID || a[i].SubType != b[i].SubType || !bytes.Equal(a[i].Payload, b[i].Payload) {
+			return false
+		}
+	}
+	return true
+}
+
+// Fingerprint returns a hash of a, equal for advertisements that are
+// Equal, for use as a map key. It is a 64-bit FNV-1a hash of the version
+// and fields of a, so it is the same across processes and can be stored.
+// The fingerprint of nil is 0.
+func Fingerprint(a Adv) uint64 {
+	var h fnv64a
+	switch a := a.(type) {
+	case *AdvV1:
+		if a == nil {
+			return 0
+		}
+		h = newFNV64a()
+		h.byte(1)
+		h.uint64(uint64(a.Id))
+		h.uint64(uint64(a.Key))
+		h.uint64(uint64(a.Flags))
+		h.uint64(uint64(a.Status))
+		h.string(a.Name)
+	case *AdvV2:
+		if a == nil {
+			return 0
+		}
+		h = newFNV64a()
+		h.byte(2)
+		h.uint64(uint64(a.Id))
+		h.uint64(uint64(a.Key))
+		h.uint64(uint64(a.Flags))
+		h.uint64(uint64(a.FwVersion))
+		h.bytes(a.PartnerData)
+		h.string(a.Name)
+		h.msds(a.UnknownMSD)
+	case *AdvV3:
+		if a == nil {
+			return 0
+		}
+		h = newFNV64a()
+		h.byte(3)
+		h.uint64(a.Id)
+		h.uint64(uint64(a.Key))
+		h.uint64(uint64(a.Flags))
+		h.uint64(uint64(a.FwVersion))
+		h.uint64(uint64(a.BatteryMillivolts))
+		h.uint64(uint64(a.Uptime))
+		h.bytes(a.PartnerData)
+		h.string(a.Name)
+		h.msds(a.UnknownMSD)
+	}
+	return uint64(h)
+}
+
+// fnv64a is a 64-bit FNV-1a hash, which hash/fnv only offers behind an
+// interface that allocates.
+type fnv64a uint64
+
+func newFNV64a() fnv64a {
+	return 14695981039346656037
+}
+
+func (h *fnv64a) byte(b byte) {
+	*h ^= fnv64a(b)
+	*h *= 1099511628211
+}
+
+func (h *fnv64a) uint64(v uint64) {
+	for i := 0; i < 8; i++ {
+		h.byte(byte(v >> (8 * i)))
+	}
+}
+
+// bytes hashes the length of b before its content, so that consecutive
+// fields cannot trade bytes without changing the hash.
+func (h *fnv64a) bytes(b []byte) {
+	h.uint64(uint64(len(b)))
+	for _, c := range b {
+		h.byte(c)
+	}
+}
+
+func (h *fnv64a) string(s string) {
+	h.uint64(uint64(len(s)))
+	for i := 0; i < len(s); i++ {
+		h.byte(s[i])
+	}
+}
+
+func (h *fnv64a) msds(ms []MSD) {
+	h.uint64(uint64(len(ms)))
+	for _, m := range ms {
+		h.uint64(uint64(m.CompanyID))
+		h.byte(m.SubType)
+		h.bytes(m.Payload)
+	}
+}
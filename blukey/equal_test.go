@@ -0,0 +1,69 @@
+package blukey
+
+import "testing"
+
+func TestEqual(t *testing.T) {
+	v1 := &AdvV1{Id: 42, Key: 7, Flags: AdvV1clock, Status: AdvV1busy, Name: "PayRange"}
+	v2 := &AdvV2{Id: 42, Key: 7, Flags: AdvV2canTransact, FwVersion: 0x0102, PartnerData: []byte("hi"), Name: "PR"}
+	v3 := &AdvV3{Id: 42, Key: 7, Flags: AdvV2canTransact, FwVersion: 0x0102, PartnerData: []byte("hi"), Name: "PR"}
+
+	copy2 := *v2
+	copy2.PartnerData = []byte("hi")
+	other2 := *v2
+	other2.PartnerData = []byte("ho")
+	empty2 := *v2
+	empty2.PartnerData = nil
+	emptier2 := *v2
+	emptier2.PartnerData = []byte{}
+	msd2 := *v2
+	msd2.UnknownMSD = []MSD{{CompanyID: 0x004c, SubType: 2, Payload: []byte{1}}}
+	copy1 := *v1
+	ready1 := *v1
+	ready1.Status = AdvV1ready
+	copy3 := *v3
+	copy3.Uptime = 60
+
+	for _, tt := range []struct {
+		name string
+		a, b Adv
+		want bool
+	}{
+		{"same V1", v1, v1, true},
+		{"copied V1", v1, &copy1, true},
+		{"V1 status", v1, &ready1, false},
+		{"copied V2", v2, &copy2, true},
+		{"V2 partner data", v2, &other2, false},
+		{"V2 nil and empty partner data", &empty2, &emptier2, true},
+		{"V2 unknown MSD", v2, &msd2, false},
+		{"V1 and V2 of the same device", v1, v2, false},
+		{"V2 and V3 of the same device", v2, v3, false},
+		{"V3 uptime", v3, &copy3, false},
+		{"nil", nil, nil, true},
+		{"nil and V1", nil, v1, false},
+		{"nil V1", (*AdvV1)(nil), (*AdvV1)(nil), true},
+		{"nil V2 and V2", (*AdvV2)(nil), v2, false},
+	} {
+		if got := Equal(tt.a, tt.b); got != tt.want {
+			t.Errorf("%s: Equal got %t want %t", tt.name, got, tt.want)
+		}
+		if got := Equal(tt.b, tt.a); got != tt.want {
+			t.Errorf("%s: Equal reversed got %t want %t", tt.name, got, tt.want)
+		}
+		if fa, fb := Fingerprint(tt.a), Fingerprint(tt.b); (fa == fb) != tt.want {
+			t.Errorf("%s: Fingerprint got %#x and %#x", tt.name, fa, fb)
+		}
+	}
+
+	if n := testing.AllocsPerRun(10, func() { Equal(v2, &copy2); Fingerprint(v2) }); n != 0 {
+		t.Errorf("Equal and Fingerprint: got %v allocations", n)
+	}
+}
+
+// TestFingerprintStable checks that fingerprints do not change, since they
+// may be stored.
+func TestFingerprintStable(t *testing.T) {
+	a := &AdvV2{Id: 42, Key: 7, Flags: AdvV2canTransact, FwVersion: 0x0102, PartnerData: []byte("hi"), Name: "PR"}
+	if got, want := Fingerprint(a), uint64(0xdf95e6af32cbf668); got != want {
+		t.Errorf("Fingerprint(%v): got %#x want %#x", a, got, want)
+	}
+}
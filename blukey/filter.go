@@ -0,0 +1,100 @@
+package blukey
+
+// A Filter selects advertisements. Filters built by this package reject a
+// nil Adv, so the result of ParseAdData can be passed directly.
+type Filter func(Adv) bool
+
+// Transactable selects devices that can take a transaction now, see
+// Adv.CanTransact. A V2 device reporting a busy status still can if it
+// sets AdvV2canTransact.
+func Transactable() Filter {
+	return func(a Adv) bool {
+		return a != nil && a.CanTransact()
+	}
+}
+
+// NeedsMaintenance selects devices with pending maintenance, see
+// Adv.NeedsMaintenance.
+func NeedsMaintenance() Filter {
+	return func(a Adv) bool {
+		return a != nil && a.NeedsMaintenance()
+	}
+}
+
+// HasDeviceId selects the devices with one of ids. The 64-bit IDs of V3
+// devices only match if they fit in 32 bits.
+func HasDeviceId(ids ...uint32) Filter {
+	set := make(map[uint64]bool, len(ids))
+	for _, id := range ids {
+		set[uint64(id)] = true
+	}
+	return func(a Adv) bool {
+		return a != nil && set[a.DeviceId64()]
+	}
+}
+
+// MinFwVersion selects devices running firmware version v or later. V1
+// devices do not advertise their version and are never selected.
+func MinFwVersion(v FwVersion) Filter {
+	return func(a Adv) bool {
+		if a == nil {
+			return false
+		}
+		if _, ok := a.(*AdvV1); ok {
+			return false
+		}
+		return FwVersion(a.FirmwareVersion()).Compare(v) >= 0
+	}
+}
+
+// StatusIn selects devices whose DeviceStatus is one of statuses.
+func StatusIn(statuses ...Status) Filter {
+	return func(a Adv) bool {
+		if a == nil {
+			return false
+		}
+		s := a.DeviceStatus()
+		for _, st := range statuses {
+			if s == st {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// And selects advertisements that all of filters select, and any if there
+// are no filters.
+func And(filters ...Filter) Filter {
+	return func(a Adv) bool {
+		if a == nil {
+			return false
+		}
+		for _, f := range filters {
+			if !f(a) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// Or selects advertisements that any of filters selects, and none if
+// there are no filters.
+func Or(filters ...Filter) Filter {
+	return func(a Adv) bool {
+		for _, f := range filters {
+			if f(a) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// Not selects the advertisements f rejects, other than nil.
+func Not(f Filter) Filter {
+	return func(a Adv) bool {
+		return a != nil && !f(a)
+	}
+}
@@ -0,0 +1,58 @@
+package blukey
+
+import "testing"
+
+func TestFilters(t *testing.T) {
+	v1Ready := &AdvV1{Id: 1, Status: AdvV1ready, Flags: AdvV1none}
+	v1Busy := &AdvV1{Id: 2, Status: AdvV1busy, Flags: AdvV1cashPending}
+	v1Old := &AdvV1{Id: 7, Status: AdvV1ready, Flags: 0}
+	v2Ready := &AdvV2{Id: 3, Flags: AdvV2statusReady, FwVersion: 0x0200}
+	v2BusyCan := &AdvV2{Id: 4, Flags: AdvV2statusBusy | AdvV2canTransact, FwVersion: 0x0105}
+	v2Busy := &AdvV2{Id: 5, Flags: AdvV2statusBusy | AdvV2connAlarmClockNotSet, FwVersion: 0x0300}
+	v2Maint := &AdvV2{Id: 6, Flags: AdvV2statusReadyMaint}
+	v3 := &AdvV3{Id: 1<<32 | 3, Flags: AdvV2statusOffline | AdvV2cashlessPending, FwVersion: 0x0301}
+	all := []Adv{v1Ready, v1Busy, v1Old, v2Ready, v2BusyCan, v2Busy, v2Maint, v3, nil}
+
+	for _, tt := range []struct {
+		name string
+		f    Filter
+		want []Adv
+	}{
+		// AdvV2canTransact overrides a busy status; a V2 ready for
+		// maintenance only cannot transact.
+		{"Transactable", Transactable(), []Adv{v1Ready, v1Old, v2Ready, v2BusyCan}},
+		// V1 devices without maintenance support report AdvV1Flags(0),
+		// which is not AdvV1none.
+		{"NeedsMaintenance", NeedsMaintenance(), []Adv{v1Busy, v1Old, v2Busy, v3}},
+		{"HasDeviceId", HasDeviceId(1, 3, 4, 99), []Adv{v1Ready, v2Ready, v2BusyCan}},
+		{"HasDeviceId none", HasDeviceId(), nil},
+		// V1 advertises no firmware version.
+		{"MinFwVersion", MinFwVersion(0x0200), []Adv{v2Ready, v2Busy, v3}},
+		{"MinFwVersion 0", MinFwVersion(0), []Adv{v2Ready, v2BusyCan, v2Busy, v2Maint, v3}},
+		{"StatusIn", StatusIn(StatusBusy, StatusOffline), []Adv{v1Busy, v2BusyCan, v2Busy, v3}},
+		{"StatusIn ReadyMaintenance", StatusIn(StatusReadyMaintenance), []Adv{v2Maint}},
+		{"And", And(Transactable(), MinFwVersion(0x0100)), []Adv{v2Ready, v2BusyCan}},
+		{"And none", And(), []Adv{v1Ready, v1Busy, v1Old, v2Ready, v2BusyCan, v2Busy, v2Maint, v3}},
+		{"Or", Or(HasDeviceId(1), StatusIn(StatusOffline)), []Adv{v1Ready, v3}},
+		{"Or none", Or(), nil},
+		{"Not", Not(Transactable()), []Adv{v1Busy, v2Busy, v2Maint, v3}},
+		{"Not And", Not(And(StatusIn(StatusBusy), Not(Transactable()))), []Adv{v1Ready, v1Old, v2Ready, v2BusyCan, v2Maint, v3}},
+	} {
+		var got []Adv
+		for _, a := range all {
+			if tt.f(a) {
+				got = append(got, a)
+			}
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %v want %v", tt.name, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("%s: got %v want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package blukey
+
+import "fmt"
+
+// FwVersion is a firmware version as advertised by V2 and V3 devices:
+// the major version in the high byte, then the minor and patch versions
+// in a nibble each. Versions compare in numeric order.
+type FwVersion uint16
+
+// Major returns the major version of v.
+func (v FwVersion) Major() int {
+	return int(v >> 8)
+}
+
+// Minor returns the minor version of v.
+func (v FwVersion) Minor() int {
+	return int(v>>4) & 0xf
+}
+
+// Patch returns the patch version of v.
+func (v FwVersion) Patch() int {
+	return int(v) & 0xf
+}
+
+// String returns v as "major.minor.patch".
+func (v FwVersion) String() string {
+	return fmt.Sprintf("%d.%d.%d", v.Major(), v.Minor(), v.Patch())
+}
+
+// Compare returns -1, 0 or 1 as v is older than, the same as or newer
+// than w.
+func (v FwVersion) Compare(w FwVersion) int {
+	switch {
+	case v < w:
+		return -1
+	case v > w:
+		return 1
+	}
+	return 0
+}
+
+// MakeFwVersion returns the version major.minor.patch. It panics if a
+// part does not fit its field.
+func MakeFwVersion(major, minor, patch int) FwVersion {
+	if major < 0 || major > 0xff || minor < 0 || minor > 0xf || patch < 0 || patch > 0xf {
+		panic(fmt.Sprintf("blukey: firmware version %d.%d.%d out of range", major, minor, patch))
+	}
+	return FwVersion(major<<8 | minor<<4 | patch)
+}
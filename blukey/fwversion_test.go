@@ -0,0 +1,66 @@
+package blukey
+
+import "testing"
+
+func TestFwVersion(t *testing.T) {
+	for _, tt := range []struct {
+		v                   FwVersion
+		major, minor, patch int
+		s                   string
+	}{
+		{0x0000, 0, 0, 0, "0.0.0"},
+		{0x0102, 1, 0, 2, "1.0.2"},
+		{0x0321, 3, 2, 1, "3.2.1"},
+		{0xffff, 255, 15, 15, "255.15.15"},
+	} {
+		if tt.v.Major() != tt.major || tt.v.Minor() != tt.minor || tt.v.Patch() != tt.patch || tt.v.String() != tt.s {
+			t.Errorf("%#04x: got %d %d %d %q want %d %d %d %q", uint16(tt.v),
+				tt.v.Major(), tt.v.Minor(), tt.v.Patch(), tt.v.String(), tt.major, tt.minor, tt.patch, tt.s)
+		}
+		if v := MakeFwVersion(tt.major, tt.minor, tt.patch); v != tt.v {
+			t.Errorf("MakeFwVersion(%d, %d, %d): got %v want %v", tt.major, tt.minor, tt.patch, v, tt.v)
+		}
+	}
+
+	for _, tt := range []struct {
+		v, w FwVersion
+		want int
+	}{
+		{MakeFwVersion(1, 0, 2), MakeFwVersion(1, 0, 2), 0},
+		{MakeFwVersion(1, 0, 15), MakeFwVersion(1, 1, 0), -1},
+		{MakeFwVersion(2, 0, 0), MakeFwVersion(1, 15, 15), 1},
+	} {
+		if got := tt.v.Compare(tt.w); got != tt.want {
+			t.Errorf("%v.Compare(%v): got %d want %d", tt.v, tt.w, got, tt.want)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("MakeFwVersion(1, 16, 0): no panic")
+		}
+	}()
+	MakeFwVersion(1, 16, 0)
+}
+
+func TestNeedsFwUpdate(t *testing.T) {
+	latest := MakeFwVersion(2, 1, 0)
+	for _, tt := range []struct {
+		a interface {
+			NeedsFwUpdate(FwVersion) bool
+		}
+		want bool
+	}{
+		{&AdvV2{FwVersion: MakeFwVersion(2, 1, 0)}, false},
+		{&AdvV2{FwVersion: MakeFwVersion(2, 2, 0)}, false},
+		{&AdvV2{FwVersion: MakeFwVersion(2, 0, 9)}, true},
+		{&AdvV2{FwVersion: MakeFwVersion(3, 0, 0), Flags: AdvV2connAlarmFwUpdateNeeded}, true},
+		{&AdvV2{FwVersion: MakeFwVersion(3, 0, 0), Flags: AdvV2connAlarmDebugPending}, false},
+		{&AdvV3{FwVersion: MakeFwVersion(1, 0, 0)}, true},
+		{&AdvV3{FwVersion: MakeFwVersion(3, 0, 0), Flags: AdvV2connAlarmFwUpdateNeeded}, true},
+	} {
+		if got := tt.a.NeedsFwUpdate(latest); got != tt.want {
+			t.Errorf("%v: got %t want %t", tt.a, got, tt.want)
+		}
+	}
+}
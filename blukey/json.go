@@ -0,0 +1,186 @@
+package blukey
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// advJSON is the JSON form of all advertisement versions. Fields derived
+// from others, like flagNames, are only written.
+type advJSON struct {
+	Version           int      `json:"version"`
+	DeviceId          uint64   `json:"deviceId"`
+	AuthKey           *uint32  `json:"authKey,omitempty"`
+	Flags             uint16   `json:"flags"`
+	FlagNames         []string `json:"flagNames"`
+	Status            *byte    `json:"status,omitempty"`
+	StatusName        string   `json:"statusName"`
+	FwVersion         *uint16  `json:"fwVersion,omitempty"`
+	BatteryMillivolts *uint16  `json:"batteryMillivolts,omitempty"`
+	Uptime            *uint32  `json:"uptime,omitempty"`
+	PartnerData       []byte   `json:"partnerData,omitempty"`
+	Name              string   `json:"name,omitempty"`
+	UnknownMSD        []MSD    `json:"unknownMsd,omitempty"`
+}
+
+// MarshalAdvJSON returns the JSON form of a, as its MarshalJSON method
+// does, but includes the AuthKey if withKey is set. The key is left out by
+// default, since scan results often end up in logs.
+func MarshalAdvJSON(a Adv, withKey bool) ([]byte, error) {
+	var j advJSON
+	switch a := a.(type) {
+	case *AdvV1:
+		status := byte(a.Status)
+		j = advJSON{
+			Version:   1,
+			DeviceId:  uint64(a.Id),
+			Flags:     uint16(a.Flags),
+			FlagNames: []string{a.Flags.String()},
+			Status:    &status,
+			Name:      a.Name,
+		}
+	case *AdvV2:
+		fw := uint16(a.FwVersion)
+		j = advJSON{
+			Version:     2,
+			DeviceId:    uint64(a.Id),
+			Flags:       uint16(a.Flags),
+			FlagNames:   strings.Split(a.Flags.String(), "|"),
+			FwVersion:   &fw,
+			PartnerData: a.PartnerData,
+			Name:        a.Name,
+			UnknownMSD:  a.UnknownMSD,
+		}
+	case *AdvV3:
+		fw, battery, uptime := uint16(a.FwVersion), a.BatteryMillivolts, a.Uptime
+		j = advJSON{
+			Version:           3,
+			DeviceId:          a.Id,
+			Flags:             uint16(a.Flags),
+			FlagNames:         strings.Split(a.Flags.String(), "|"),
+			FwVersion:         &fw,
+			BatteryMillivolts: &battery,
+			Uptime:            &uptime,
+			PartnerData:       a.PartnerData,
+			Name:              a.Name,
+			UnknownMSD:        a.UnknownMSD,
+		}
+	default:
+		return nil, fmt.Errorf("blukey: cannot marshal %T", a)
+	}
+	j.StatusName = a.DeviceStatus().String()
+	if withKey {
+		key := a.AuthKey()
+		j.AuthKey = &key
+	}
+	return json.Marshal(j)
+}
+
+// UnmarshalAdvJSON returns the advertisement encoded by MarshalAdvJSON or
+// the MarshalJSON methods, of the version the data names.
+func UnmarshalAdvJSON(data []byte) (Adv, error) {
+	var j advJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return nil, err
+	}
+	switch j.Version {
+	case 1:
+		a := &AdvV1{}
+		return a, a.fromJSON(j)
+	case 2:
+		a := &AdvV2{}
+		return a, a.fromJSON(j)
+	case 3:
+		a := &AdvV3{}
+		return a, a.fromJSON(j)
+	}
+	return nil, fmt.Errorf("blukey: unknown advertisement version %d", j.Version)
+}
+
+// MarshalJSON encodes v1 without its AuthKey, see MarshalAdvJSON.
+func (v1 AdvV1) MarshalJSON() ([]byte, error) {
+	return MarshalAdvJSON(&v1, false)
+}
+
+func (v1 *AdvV1) UnmarshalJSON(data []byte) error {
+	var j advJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	return v1.fromJSON(j)
+}
+
+func (v1 *AdvV1) fromJSON(j advJSON) error {
+	if j.Version != 1 {
+		return fmt.Errorf("blukey: version %d advertisement is not V1", j.Version)
+	}
+	*v1 = AdvV1{Id: uint32(j.DeviceId), Flags: AdvV1Flags(j.Flags), Name: j.Name}
+	if j.AuthKey != nil {
+		v1.Key = *j.AuthKey
+	}
+	if j.Status != nil {
+		v1.Status = AdvV1Status(*j.Status)
+	}
+	return nil
+}
+
+// MarshalJSON encodes v2 without its AuthKey, see MarshalAdvJSON.
+func (v2 AdvV2) MarshalJSON() ([]byte, error) {
+	return MarshalAdvJSON(&v2, false)
+}
+
+func (v2 *AdvV2) UnmarshalJSON(data []byte) error {
+	var j advJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	return v2.fromJSON(j)
+}
+
+func (v2 *AdvV2) fromJSON(j advJSON) error {
+	if j.Version != 2 {
+		return fmt.Errorf("blukey: version %d advertisement is not V2", j.Version)
+	}
+	*v2 = AdvV2{Id: uint32(j.DeviceId), Flags: AdvV2Flags(j.Flags), PartnerData: j.PartnerData, Name: j.Name, UnknownMSD: j.UnknownMSD}
+	if j.AuthKey != nil {
+		v2.Key = *j.AuthKey
+	}
+	if j.FwVersion != nil {
+		v2.FwVersion = FwVersion(*j.FwVersion)
+	}
+	return nil
+}
+
+// MarshalJSON encodes v3 without its AuthKey, see MarshalAdvJSON.
+func (v3 AdvV3) MarshalJSON() ([]byte, error) {
+	return MarshalAdvJSON(&v3, false)
+}
+
+func (v3 *AdvV3) UnmarshalJSON(data []byte) error {
+	var j advJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	return v3.fromJSON(j)
+}
+
+func (v3 *AdvV3) fromJSON(j advJSON) error {
+	if j.Version != 3 {
+		return fmt.Errorf("blukey: version %d advertisement is not V3", j.Version)
+	}
+	*v3 = AdvV3{Id: j.DeviceId, Flags: AdvV2Flags(j.Flags), PartnerData: j.PartnerData, Name: j.Name, UnknownMSD: j.UnknownMSD}
+	if j.AuthKey != nil {
+		v3.Key = *j.AuthKey
+	}
+	if j.FwVersion != nil {
+		v3.FwVersion = FwVersion(*j.FwVersion)
+	}
+	if j.BatteryMillivolts != nil {
+		v3.BatteryMillivolts = *j.BatteryMillivolts
+	}
+	if j.Uptime != nil {
+		v3.Uptime = *j.Uptime
+	}
+	return nil
+}
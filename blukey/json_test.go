@@ -0,0 +1,59 @@
+package blukey
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestAdvJSON(t *testing.T) {
+	for _, tt := range []struct {
+		a       Adv
+		json    string
+		withKey string
+	}{
+		{
+			&AdvV1{Id: 305419896, Key: 0xaabbccdd, Flags: AdvV1clock, Status: AdvV1busy},
+			`{"version":1,"deviceId":305419896,"flags":9,"flagNames":["clock"],"status":1,"statusName":"busy"}`,
+			`{"version":1,"deviceId":305419896,"authKey":2864434397,"flags":9,"flagNames":["clock"],"status":1,"statusName":"busy"}`,
+		},
+		{
+			&AdvV2{Id: 42, Key: 7, Flags: AdvV2cashlessPending | AdvV2connAlarmClockNotSet | AdvV2statusBusy, FwVersion: 0x0102, PartnerData: []byte("hi"), Name: "PR-42"},
+			`{"version":2,"deviceId":42,"flags":1033,"flagNames":["cashlessPending","connAlarmClockNotSet","statusBusy"],"statusName":"busy","fwVersion":258,"partnerData":"aGk=","name":"PR-42"}`,
+			`{"version":2,"deviceId":42,"authKey":7,"flags":1033,"flagNames":["cashlessPending","connAlarmClockNotSet","statusBusy"],"statusName":"busy","fwVersion":258,"partnerData":"aGk=","name":"PR-42"}`,
+		},
+		{
+			&AdvV3{Id: 1 << 40, Key: 7, Flags: AdvV2statusOffline, FwVersion: 0x0301, BatteryMillivolts: 3000, Uptime: 86400},
+			`{"version":3,"deviceId":1099511627776,"flags":7,"flagNames":["statusOffline"],"statusName":"offline","fwVersion":769,"batteryMillivolts":3000,"uptime":86400}`,
+			`{"version":3,"deviceId":1099511627776,"authKey":7,"flags":7,"flagNames":["statusOffline"],"statusName":"offline","fwVersion":769,"batteryMillivolts":3000,"uptime":86400}`,
+		},
+	} {
+		b, err := json.Marshal(tt.a)
+		if err != nil || string(b) != tt.json {
+			t.Errorf("Marshal(%v):\ngot  %s, %v\nwant %s", tt.a, b, err, tt.json)
+		}
+		b, err = MarshalAdvJSON(tt.a, true)
+		if err != nil || string(b) != tt.withKey {
+			t.Errorf("MarshalAdvJSON(%v, true):\ngot  %s, %v\nwant %s", tt.a, b, err, tt.withKey)
+		}
+
+		a, err := UnmarshalAdvJSON([]byte(tt.withKey))
+		if err != nil || !reflect.DeepEqual(a, tt.a) {
+			t.Errorf("UnmarshalAdvJSON(%s): got %#v, %v want %#v", tt.withKey, a, err, tt.a)
+		}
+
+		// Without the key, everything else survives.
+		a, err = UnmarshalAdvJSON([]byte(tt.json))
+		if err != nil || a.DeviceId64() != tt.a.DeviceId64() || a.AuthKey() != 0 || a.DeviceStatus() != tt.a.DeviceStatus() {
+			t.Errorf("UnmarshalAdvJSON(%s): got %#v, %v", tt.json, a, err)
+		}
+	}
+
+	var v1 AdvV1
+	if err := json.Unmarshal([]byte(`{"version":2,"deviceId":1}`), &v1); err == nil {
+		t.Errorf("Unmarshal of V2 into AdvV1: got nil error")
+	}
+	if _, err := UnmarshalAdvJSON([]byte(`{"version":4}`)); err == nil {
+		t.Errorf("UnmarshalAdvJSON of version 4: got nil error")
+	}
+}
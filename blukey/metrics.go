@@ -0,0 +1,118 @@
+package blukey
+
+import (
+	"expvar"
+	"sync/atomic"
+)
+
+// Metrics counts the advertisements the parsers see: those parsed, by
+// version, and those rejected, by reason. Its methods are called on the
+// goroutines parsing, so they must be safe for concurrent use, and should
+// be cheap.
+//
+// Every advertisement passed to ParseAdData, ParseAdDataStrict or
+// ParseAdDataInto is counted, including those received by a gatt
+// BlukeyScanner, which parses through ParseAdData.
+type Metrics interface {
+	IncParsedV1()
+	IncParsedV2()
+	IncParsedV3()
+	// IncRejected counts an advertisement rejected for reason, one of
+	// the Reject constants.
+	IncRejected(reason string)
+}
+
+// Reasons passed to Metrics.IncRejected. All but RejectNotBlukey are near
+// misses: advertisements that looked like a BluKey version but were
+// malformed.
+const (
+	RejectNotBlukey           = "notBlukey"
+	RejectNoName              = "noName"
+	RejectNoService           = "noService"
+	RejectNoManufacturerData  = "noManufacturerData"
+	RejectBadManufacturerData = "badManufacturerData"
+	RejectBadLength           = "badLength"
+)
+
+// metricsHolder wraps a Metrics for storage in an atomic.Value.
+type metricsHolder struct {
+	m Metrics
+}
+
+var metrics atomic.Value // metricsHolder
+
+func init() {
+	metrics.Store(metricsHolder{nopMetrics{}})
+}
+
+// SetMetrics makes the parsers report to m from now on. A nil m stops
+// the reports, as is the default.
+func SetMetrics(m Metrics) {
+	if m == nil {
+		m = nopMetrics{}
+	}
+	metrics.Store(metricsHolder{m})
+}
+
+type nopMetrics struct{}
+
+func (nopMetrics) IncParsedV1()       {}
+func (nopMetrics) IncParsedV2()       {}
+func (nopMetrics) IncParsedV3()       {}
+func (nopMetrics) IncRejected(string) {}
+
+// countParse reports the outcome of parseAdDataInto to the Metrics.
+func countParse(version int, err error) {
+	m := metrics.Load().(metricsHolder).m
+	switch version {
+	case 1:
+		m.IncParsedV1()
+	case 2:
+		m.IncParsedV2()
+	case 3:
+		m.IncParsedV3()
+	default:
+		m.IncRejected(rejectReason(err))
+	}
+}
+
+// rejectReason returns the Reject constant for an error of
+// parseAdDataInto.
+func rejectReason(err error) string {
+	ae, ok := err.(*AdvError)
+	if !ok {
+		return RejectNotBlukey
+	}
+	if _, ok := ae.Err.(*LengthError); ok {
+		return RejectBadLength
+	}
+	switch ae.Err {
+	case ErrNoName:
+		return RejectNoName
+	case ErrNoService:
+		return RejectNoService
+	case ErrNoManufacturerData:
+		return RejectNoManufacturerData
+	}
+	return RejectBadManufacturerData
+}
+
+// ExpvarMetrics is a Metrics publishing its counts with expvar, under
+// parsedV1, parsedV2, parsedV3 and a map of rejected counts by reason.
+type ExpvarMetrics struct {
+	m        *expvar.Map
+	rejected *expvar.Map
+}
+
+// NewExpvarMetrics publishes the counts as the expvar map name. Like
+// expvar.Publish, it panics if name is already in use.
+func NewExpvarMetrics(name string) *ExpvarMetrics {
+	e := &ExpvarMetrics{m: expvar.NewMap(name), rejected: new(expvar.Map).Init()}
+	e.m.Set("rejected", e.rejected)
+	return e
+}
+
+func (e *ExpvarMetrics) IncParsedV1()              { e.m.Add("parsedV1", 1) }
+func (e *ExpvarMetrics) IncParsedV2()              { e.m.Add("parsedV2", 1) }
+func (e *ExpvarMetrics) IncParsedV3()              { e.m.Add("parsedV3", 1) }
+func (e *ExpvarMetrics) IncRejected(reason string) { e.rejected.Add(reason, 1) }
@@ -0,0 +1,84 @@
+package blukey
+
+import (
+	"expvar"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+type countMetrics struct {
+	parsed   [4]int
+	rejected map[string]int
+}
+
+func (c *countMetrics) IncParsedV1()              { c.parsed[1]++ }
+func (c *countMetrics) IncParsedV2()              { c.parsed[2]++ }
+func (c *countMetrics) IncParsedV3()              { c.parsed[3]++ }
+func (c *countMetrics) IncRejected(reason string) { c.rejected[reason]++ }
+
+func TestMetrics(t *testing.T) {
+	c := &countMetrics{rejected: map[string]int{}}
+	SetMetrics(c)
+	defer SetMetrics(nil)
+
+	ParseAdData(v1AdData)
+	ParseAdData(v2AdData)
+	ParseAdData(v2AdData)
+	var v1 AdvV1
+	var v2 AdvV2
+	var v3 AdvV3
+	ParseAdDataInto(v3AdData, &v1, &v2, &v3)
+	ParseAdData([]byte{2, 0x01, 0x06})
+	ParseAdDataStrict(v2AdData[:4])
+	ParseAdDataStrict(v1AdData[10:])
+
+	if want := [4]int{0, 1, 2, 1}; c.parsed != want {
+		t.Errorf("parsed: got %v want %v", c.parsed, want)
+	}
+	want := map[string]int{RejectNotBlukey: 1, RejectNoManufacturerData: 1, RejectNoName: 1}
+	if !reflect.DeepEqual(c.rejected, want) {
+		t.Errorf("rejected: got %v want %v", c.rejected, want)
+	}
+
+	SetMetrics(nil)
+	ParseAdData(v1AdData)
+	if c.parsed[1] != 1 {
+		t.Errorf("parsed V1 after SetMetrics(nil): got %d want 1", c.parsed[1])
+	}
+}
+
+func TestRejectReason(t *testing.T) {
+	for _, tt := range []struct {
+		err  error
+		want string
+	}{
+		{ErrUnknownVersion, RejectNotBlukey},
+		{&AdvError{1, ErrNoName}, RejectNoName},
+		{&AdvError{1, ErrNoService}, RejectNoService},
+		{&AdvError{2, ErrNoManufacturerData}, RejectNoManufacturerData},
+		{&AdvError{2, ErrBadManufacturerData}, RejectBadManufacturerData},
+		{&AdvError{3, &LengthError{"manufacturer data", 22, 26}}, RejectBadLength},
+	} {
+		if got := rejectReason(tt.err); got != tt.want {
+			t.Errorf("rejectReason(%v): got %q want %q", tt.err, got, tt.want)
+		}
+	}
+}
+
+// expvarRuns makes the expvar name of each run of TestExpvarMetrics
+// unique, since expvar names cannot be reused.
+var expvarRuns int
+
+func TestExpvarMetrics(t *testing.T) {
+	expvarRuns++
+	name := fmt.Sprintf("blukeyTestMetrics%d", expvarRuns)
+	m := NewExpvarMetrics(name)
+	m.IncParsedV2()
+	m.IncParsedV2()
+	m.IncRejected(RejectBadLength)
+	want := `{"parsedV2": 2, "rejected": {"badLength": 1}}`
+	if got := expvar.Get(name).String(); got != want {
+		t.Errorf("expvar: got %s want %s", got, want)
+	}
+}
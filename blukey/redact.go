@@ -0,0 +1,46 @@
+package blukey
+
+import "fmt"
+
+// Redacted returns a copy of a with its AuthKey zeroed, for handing
+// advertisements to code that has no use for the key, such as telemetry.
+// The String, GoString and MarshalJSON methods of the advertisements
+// already leave the key out.
+func Redacted(a Adv) Adv {
+	switch a := a.(type) {
+	case *AdvV1:
+		r := *a
+		r.Key = 0
+		return &r
+	case *AdvV2:
+		r := *a
+		r.Key = 0
+		return &r
+	case *AdvV3:
+		r := *a
+		r.Key = 0
+		return &r
+	}
+	return a
+}
+
+// WithAuthKey returns a Stringer describing a along with its AuthKey, for
+// the rare logs that need it.
+func WithAuthKey(a Adv) fmt.Stringer {
+	return withAuthKey{a}
+}
+
+type withAuthKey struct {
+	a Adv
+}
+
+func (w withAuthKey) String() string {
+	if w.a == nil {
+		return "<nil>"
+	}
+	s := fmt.Sprint(w.a)
+	if i := len(s) - 1; i >= 0 && s[i] == '}' {
+		return fmt.Sprintf("%s, AuthKey: %#08x}", s[:i], w.a.AuthKey())
+	}
+	return fmt.Sprintf("%s AuthKey: %#08x", s, w.a.AuthKey())
+}
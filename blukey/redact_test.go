@@ -0,0 +1,65 @@
+package blukey
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+const secretKey = 0xdeadbeef
+
+// leaksKey reports whether s shows secretKey in any of the forms fmt and
+// encoding/json print numbers in.
+func leaksKey(s string) bool {
+	s = strings.ToLower(s)
+	return strings.Contains(s, "deadbeef") || strings.Contains(s, fmt.Sprint(uint32(secretKey))) ||
+		strings.Contains(s, "ef be ad de")
+}
+
+func TestRedaction(t *testing.T) {
+	advs := []Adv{
+		&AdvV1{Id: 1, Key: secretKey, Flags: AdvV1clock, Status: AdvV1busy},
+		&AdvV2{Id: 2, Key: secretKey, Flags: AdvV2statusBusy, PartnerData: []byte("hi")},
+		&AdvV3{Id: 3, Key: secretKey, BatteryMillivolts: 3000},
+	}
+	for _, a := range advs {
+		var values []interface{}
+		switch a := a.(type) {
+		case *AdvV1:
+			values = []interface{}{a, *a}
+		case *AdvV2:
+			values = []interface{}{a, *a}
+		case *AdvV3:
+			values = []interface{}{a, *a}
+		}
+		values = append(values, struct{ Adv Adv }{a}, []Adv{a})
+
+		for _, v := range values {
+			for _, verb := range []string{"%v", "%+v", "%#v", "%s"} {
+				if s := fmt.Sprintf(verb, v); leaksKey(s) {
+					t.Errorf("%s of %T leaks the key: %s", verb, v, s)
+				}
+			}
+			b, err := json.Marshal(v)
+			if err != nil || leaksKey(string(b)) {
+				t.Errorf("json.Marshal of %T: got %s, %v", v, b, err)
+			}
+		}
+
+		r := Redacted(a)
+		if r.AuthKey() != 0 || a.AuthKey() != secretKey || r.DeviceId() != a.DeviceId() || r.DeviceStatus() != a.DeviceStatus() {
+			t.Errorf("Redacted(%v): got %v with key %#x", a, r, r.AuthKey())
+		}
+		if s := WithAuthKey(a).String(); !strings.HasSuffix(s, ", AuthKey: 0xdeadbeef}") {
+			t.Errorf("WithAuthKey(%v): got %q", a, s)
+		}
+	}
+
+	if s := fmt.Sprintf("%#v", advs[0]); s != "blukey.AdvV1{Id:0x1, Key:0x0, Flags:0x9, Status:0x1, Name:\"\"}" {
+		t.Errorf("%%#v: got %q", s)
+	}
+	if Redacted(nil) != nil {
+		t.Errorf("Redacted(nil): got non-nil")
+	}
+}
@@ -0,0 +1,145 @@
+package blukey
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// An Entry is what a Registry knows about one device.
+type Entry struct {
+	Adv      Adv       // latest advertisement
+	RSSI     int       // signal strength of the latest advertisement
+	LastSeen time.Time // when the latest advertisement was received
+	Offline  bool      // nothing was received for the registry's timeout
+}
+
+// A Registry tracks the devices in range by DeviceId: their latest
+// advertisement, and whether they went silent. Its methods may be called
+// concurrently, e.g. Update from a scan handler and Snapshot from an HTTP
+// handler.
+type Registry struct {
+	timeout   time.Duration
+	onOffline func(Entry)
+
+	mu      sync.Mutex
+	entries map[uint64]*Entry
+
+	closeOnce sync.Once
+	closed    chan struct{}
+	done      chan struct{}
+}
+
+// NewRegistry returns a Registry that marks devices Offline once nothing
+// was received from them for timeout, calling onOffline, if not nil, with
+// the entry. A timeout of 0 disables this. Close stops the goroutine
+// checking for silent devices.
+func NewRegistry(timeout time.Duration, onOffline func(Entry)) *Registry {
+	r := &Registry{
+		timeout:   timeout,
+		onOffline: onOffline,
+		entries:   make(map[uint64]*Entry),
+		closed:    make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	if timeout > 0 {
+		go r.loop()
+	} else {
+		close(r.done)
+	}
+	return r
+}
+
+// Update records adv, received at t with the given RSSI, and returns its
+// changes from the previous advertisement of the device, see Diff. An
+// offline device is back online. Advertisements older than the latest are
+// ignored and have no changes.
+func (r *Registry) Update(adv Adv, rssi int, t time.Time) []Change {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	e := r.entries[adv.DeviceId64()]
+	if e == nil {
+		e = &Entry{}
+		r.entries[adv.DeviceId64()] = e
+	} else if t.Before(e.LastSeen) {
+		return nil
+	}
+	changes := Diff(e.Adv, adv)
+	*e = Entry{Adv: adv, RSSI: rssi, LastSeen: t}
+	return changes
+}
+
+// Get returns the entry of the device with the given id, if it was seen.
+// Devices with IDs beyond 32 bits are only found by Get64.
+func (r *Registry) Get(id uint32) (Entry, bool) {
+	return r.Get64(uint64(id))
+}
+
+// Get64 is like Get for the 64-bit IDs of V3 devices.
+func (r *Registry) Get64(id uint64) (Entry, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e := r.entries[id]; e != nil {
+		return *e, true
+	}
+	return Entry{}, false
+}
+
+// Snapshot returns the entries of all devices seen, ordered by DeviceId.
+func (r *Registry) Snapshot() []Entry {
+	r.mu.Lock()
+	entries := make([]Entry, 0, len(r.entries))
+	for _, e := range r.entries {
+		entries = append(entries, *e)
+	}
+	r.mu.Unlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Adv.DeviceId64() < entries[j].Adv.DeviceId64()
+	})
+	return entries
+}
+
+// Close stops checking for silent devices. The registry can still be
+// updated and read.
+func (r *Registry) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.closed)
+	})
+	<-r.done
+	return nil
+}
+
+func (r *Registry) loop() {
+	defer close(r.done)
+	t := time.NewTicker(r.timeout / 4)
+	defer t.Stop()
+	for {
+		select {
+		case now := <-t.C:
+			r.expire(now)
+		case <-r.closed:
+			return
+		}
+	}
+}
+
+// expire marks the devices silent since before now-timeout offline and
+// reports them to onOffline.
+func (r *Registry) expire(now time.Time) {
+	var gone []Entry
+	r.mu.Lock()
+	for _, e := range r.entries {
+		if !e.Offline && now.Sub(e.LastSeen) >= r.timeout {
+			e.Offline = true
+			gone = append(gone, *e)
+		}
+	}
+	r.mu.Unlock()
+
+	if r.onOffline != nil {
+		for _, e := range gone {
+			r.onOffline(e)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package blukey
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRegistry(t *testing.T) {
+	var offline []uint32
+	r := NewRegistry(time.Minute, func(e Entry) {
+		offline = append(offline, e.Adv.DeviceId())
+	})
+	defer r.Close()
+	t0 := time.Unix(1000, 0)
+
+	r.Update(&AdvV2{Id: 2}, -60, t0)
+	r.Update(&AdvV1{Id: 1}, -50, t0.Add(time.Second))
+	c := r.Update(&AdvV2{Id: 2, Flags: AdvV2statusBusy}, -70, t0.Add(30*time.Second))
+	if want := []Change{{"status", StatusReady, StatusBusy}, {"canTransact", true, false}}; !reflect.DeepEqual(c, want) {
+		t.Errorf("Update: got changes %v want %v", c, want)
+	}
+	if c := r.Update(&AdvV2{Id: 2}, -40, t0.Add(20*time.Second)); c != nil {
+		t.Errorf("Update with older data: got changes %v", c)
+	}
+
+	if _, ok := r.Get(3); ok {
+		t.Errorf("Get(3): found unseen device")
+	}
+	e, ok := r.Get(2)
+	if !ok || e.RSSI != -70 || !e.LastSeen.Equal(t0.Add(30*time.Second)) || e.Adv.DeviceStatus() != StatusBusy {
+		t.Errorf("Get(2): got %+v, %t", e, ok)
+	}
+
+	r.expire(t0.Add(80 * time.Second))
+	snap := r.Snapshot()
+	if len(snap) != 2 || snap[0].Adv.DeviceId() != 1 || !snap[0].Offline || snap[1].Offline {
+		t.Errorf("Snapshot: got %+v", snap)
+	}
+	r.expire(t0.Add(90 * time.Second))
+	if len(offline) != 2 || offline[0] != 1 || offline[1] != 2 {
+		t.Errorf("offline: got %v want [1 2]", offline)
+	}
+
+	r.Update(&AdvV1{Id: 1}, -50, t0.Add(100*time.Second))
+	if e, _ := r.Get(1); e.Offline {
+		t.Errorf("Get(1): still offline after an update")
+	}
+
+	// V3 devices with IDs sharing their low 32 bits are kept apart.
+	r.Update(&AdvV3{Id: 1<<32 | 1}, -50, t0.Add(100*time.Second))
+	if e, ok := r.Get64(1<<32 | 1); !ok || e.Adv.DeviceId64() != 1<<32|1 {
+		t.Errorf("Get64: got %+v, %t", e, ok)
+	}
+	if e, _ := r.Get(1); e.Adv.DeviceId64() != 1 {
+		t.Errorf("Get(1): got %+v", e)
+	}
+}
+
+func TestRegistryConcurrent(t *testing.T) {
+	offline := make(chan Entry, 10)
+	r := NewRegistry(20*time.Millisecond, func(e Entry) { offline <- e })
+	defer r.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(id uint32) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				r.Update(&AdvV2{Id: id}, -j, time.Now())
+				r.Snapshot()
+			}
+		}(uint32(i))
+	}
+	wg.Wait()
+	if n := len(r.Snapshot()); n != 4 {
+		t.Errorf("Snapshot: got %d entries want 4", n)
+	}
+
+	seen := make(map[uint32]bool)
+	for len(seen) < 4 {
+		select {
+		case e := <-offline:
+			seen[e.Adv.DeviceId()] = true
+		case <-time.After(time.Second):
+			t.Fatalf("offline: got %v, want all 4 devices", seen)
+		}
+	}
+}
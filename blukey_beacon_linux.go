@@ -0,0 +1,150 @@
+package gatt
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/PayRange/gatt/blukey"
+	"github.com/PayRange/gatt/linux/cmd"
+)
+
+// Advertising types of LE Set Advertising Parameters.
+const (
+	advTypeInd        = 0x00 // connectable and scannable
+	advTypeScanInd    = 0x02 // scannable only
+	advTypeNonConnInd = 0x03 // neither
+)
+
+// A BlukeyBeaconOption configures AdvertiseBlukey.
+type BlukeyBeaconOption func(*blukeyBeaconConfig)
+
+type blukeyBeaconConfig struct {
+	interval    time.Duration
+	connectable bool
+}
+
+// BlukeyBeaconInterval sets the advertising interval, between 20ms and
+// 10.24s. The default is 100ms.
+func BlukeyBeaconInterval(d time.Duration) BlukeyBeaconOption {
+	return func(c *blukeyBeaconConfig) { c.interval = d }
+}
+
+// BlukeyBeaconConnectable sets whether centrals may connect, as they may
+// by default. A beacon that is not connectable only answers scans.
+func BlukeyBeaconConnectable(connectable bool) BlukeyBeaconOption {
+	return func(c *blukeyBeaconConfig) { c.connectable = connectable }
+}
+
+// A BlukeyBeacon advertises as a BluKey device, for testing apps against
+// a fake kiosk.
+type BlukeyBeacon struct {
+	d           Device
+	connectable bool
+
+	mu sync.Mutex
+}
+
+// AdvertiseBlukey programs the advertising data and scan response of d to
+// those of a, as encoded by its MarshalPackets method, and starts
+// advertising. The advertisement can be changed with Update while
+// advertising goes on.
+//
+// AdvertiseBlukey is only available on Linux. It replaces any advertising
+// set up on d by other means.
+func AdvertiseBlukey(d Device, a blukey.Adv, opts ...BlukeyBeaconOption) (*BlukeyBeacon, error) {
+	c := blukeyBeaconConfig{interval: 100 * time.Millisecond, connectable: true}
+	for _, o := range opts {
+		o(&c)
+	}
+	units := c.interval / (625 * time.Microsecond)
+	if units < 0x20 || units > 0x4000 {
+		return nil, fmt.Errorf("blukey beacon: interval %v out of range", c.interval)
+	}
+
+	advData, scanResp, err := blukeyBeaconData(a, c.connectable)
+	if err != nil {
+		return nil, err
+	}
+	typ := uint8(advTypeInd)
+	if !c.connectable {
+		// A scan response is only sent if the advertisement is scannable.
+		typ = advTypeNonConnInd
+		if scanResp.ScanResponseDataLength > 0 {
+			typ = advTypeScanInd
+		}
+	}
+	err = d.Option(
+		LnxSetAdvertisingParameters(&cmd.LESetAdvertisingParameters{
+			AdvertisingIntervalMin: uint16(units),
+			AdvertisingIntervalMax: uint16(units),
+			AdvertisingType:        typ,
+			AdvertisingChannelMap:  0x7,
+		}),
+		LnxSetScanResponseData(scanResp),
+		LnxSetAdvertisingData(advData),
+		LnxSetAdvertisingEnable(true),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &BlukeyBeacon{d: d, connectable: c.connectable}, nil
+}
+
+// Update replaces the advertisement, e.g. to report the device busy,
+// without stopping advertising.
+func (b *BlukeyBeacon) Update(a blukey.Adv) error {
+	advData, scanResp, err := blukeyBeaconData(a, b.connectable)
+	if err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.d.Option(sendAdvCommand(scanResp), sendAdvCommand(advData))
+}
+
+// Stop stops advertising.
+func (b *BlukeyBeacon) Stop() error {
+	return b.d.StopAdvertising()
+}
+
+// sendAdvCommand returns an Option sending c while advertising goes on.
+func sendAdvCommand(c cmd.CmdParam) Option {
+	return func(d Device) error {
+		rsp, err := d.(*device).SendHCIRawCommand(c)
+		if err != nil {
+			return err
+		}
+		if len(rsp) > 0 && rsp[0] != 0x00 {
+			return fmt.Errorf("blukey beacon: command %#04x failed with status %#02x", c.Opcode(), rsp[0])
+		}
+		return nil
+	}
+}
+
+// blukeyBeaconData returns the HCI commands setting the advertising data
+// and scan response of a. The advertising data starts with the flags of
+// a discoverable LE only device if the beacon is connectable and there is
+// room for them.
+func blukeyBeaconData(a blukey.Adv, connectable bool) (*cmd.LESetAdvertisingData, *cmd.LESetScanResponseData, error) {
+	m, ok := a.(interface {
+		MarshalPackets() ([]byte, []byte, error)
+	})
+	if !ok {
+		return nil, nil, errors.New("blukey beacon: advertisement cannot be marshaled")
+	}
+	adv, rsp, err := m.MarshalPackets()
+	if err != nil {
+		return nil, nil, err
+	}
+	if connectable && len(adv)+3 <= MaxEIRPacketLength {
+		adv = append([]byte{2, typeFlags, flagGeneralDiscoverable | flagLEOnly}, adv...)
+	}
+
+	advData := &cmd.LESetAdvertisingData{AdvertisingDataLength: uint8(len(adv))}
+	copy(advData.AdvertisingData[:], adv)
+	scanResp := &cmd.LESetScanResponseData{ScanResponseDataLength: uint8(len(rsp))}
+	copy(scanResp.ScanResponseData[:], rsp)
+	return advData, scanResp, nil
+}
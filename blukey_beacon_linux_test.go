@@ -0,0 +1,45 @@
+package gatt
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/PayRange/gatt/blukey"
+)
+
+func TestBlukeyBeaconData(t *testing.T) {
+	for _, a := range []blukey.Adv{
+		&blukey.AdvV1{Id: 305419896, Key: 0xaabbccdd, Flags: blukey.AdvV1clock, Status: blukey.AdvV1busy, Name: "PayRange"},
+		&blukey.AdvV2{Id: 42, Key: 7, Flags: blukey.AdvV2canTransact, FwVersion: 0x0102, PartnerData: []byte("hi"), Name: "PR"},
+		&blukey.AdvV3{Id: 1 << 40, Key: 7, Flags: blukey.AdvV2statusBusy, FwVersion: 0x0301, BatteryMillivolts: 3000, Uptime: 86400, Name: "PR"},
+	} {
+		for _, connectable := range []bool{true, false} {
+			advData, scanResp, err := blukeyBeaconData(a, connectable)
+			if err != nil {
+				t.Errorf("blukeyBeaconData(%v, %t): %v", a, connectable, err)
+				continue
+			}
+			adv := advData.AdvertisingData[:advData.AdvertisingDataLength]
+			rsp := scanResp.ScanResponseData[:scanResp.ScanResponseDataLength]
+			if got := blukey.ParseAdvAndScanResponse(adv, rsp); !reflect.DeepEqual(got, a) {
+				t.Errorf("blukeyBeaconData(%v, %t): parsed back as %#v", a, connectable, got)
+			}
+			if _, ok := blukey.Flags(adv); ok && !connectable {
+				t.Errorf("blukeyBeaconData(%v, false): got flags in % x", a, adv)
+			}
+		}
+	}
+}
+
+func TestAdvertiseBlukeyOptions(t *testing.T) {
+	v2 := &blukey.AdvV2{Id: 42, Name: "PR"}
+	for _, d := range []time.Duration{0, 19 * time.Millisecond, 11 * time.Second} {
+		if _, err := AdvertiseBlukey(nil, v2, BlukeyBeaconInterval(d)); err == nil {
+			t.Errorf("AdvertiseBlukey with interval %v: got nil error", d)
+		}
+	}
+	if _, err := AdvertiseBlukey(nil, &blukey.AdvV2{Id: 42, Name: "too long a name for the packet"}); err == nil {
+		t.Errorf("AdvertiseBlukey with a long name: got nil error")
+	}
+}
@@ -0,0 +1,129 @@
+package gatt
+
+import (
+	"sync"
+	"time"
+
+	"github.com/PayRange/gatt/blukey"
+)
+
+// blukeyScanQueue is the number of results a BlukeyScanner holds for a
+// slow reader before it drops new ones.
+const blukeyScanQueue = 64
+
+// A BlukeyScanResult is a BluKey advertisement found by a BlukeyScanner.
+type BlukeyScanResult struct {
+	Adv        blukey.Adv
+	Peripheral Peripheral
+	RSSI       int
+	Time       time.Time // when the advertisement was received
+}
+
+// A BlukeyScanner scans for BluKey devices and delivers their
+// advertisements on a channel.
+type BlukeyScanner struct {
+	d       Device
+	filter  func(BlukeyScanResult) bool
+	results chan BlukeyScanResult
+	restore func()
+
+	mu      sync.Mutex
+	closed  bool
+	dropped uint64
+}
+
+// NewBlukeyScanner starts scanning with d and returns a scanner delivering
+// the BluKey advertisements for which filter, if not nil, returns true.
+// dup is passed on to Scan. Results the reader does not keep up with are
+// dropped rather than stalling the stack. To suppress the repeated
+// advertisements of each device, filter with a blukey.Deduper.
+//
+// The scanner takes over the BlukeyDiscovered handler of d until it is
+// closed, and the previous handler is restored then.
+func NewBlukeyScanner(d Device, filter func(BlukeyScanResult) bool, dup bool) *BlukeyScanner {
+	var restore func()
+	if dev, ok := d.(*device); ok {
+		prev := dev.blukeyDiscovered
+		restore = func() { d.Handle(BlukeyDiscovered(prev)) }
+	}
+	return newBlukeyScanner(d, filter, dup, func(f func(Peripheral, blukey.Adv, int)) {
+		d.Handle(BlukeyDiscovered(f))
+	}, restore)
+}
+
+// newBlukeyScanner does the work of NewBlukeyScanner, using handle to
+// install the discovery handler and restore, if not nil, to remove it.
+func newBlukeyScanner(d Device, filter func(BlukeyScanResult) bool, dup bool,
+	handle func(func(Peripheral, blukey.Adv, int)), restore func()) *BlukeyScanner {
+	s := &BlukeyScanner{
+		d:       d,
+		filter:  filter,
+		results: make(chan BlukeyScanResult, blukeyScanQueue),
+		restore: restore,
+	}
+	handle(s.discovered)
+	d.Scan(nil, dup)
+	return s
+}
+
+// BlukeyAdvFilter returns a BlukeyScanner filter applying f, such as a
+// blukey.Filter, to the advertisement of each result.
+func BlukeyAdvFilter(f func(blukey.Adv) bool) func(BlukeyScanResult) bool {
+	return func(r BlukeyScanResult) bool {
+		return f(r.Adv)
+	}
+}
+
+// Results returns the channel delivering the advertisements found. It is
+// closed by Close.
+func (s *BlukeyScanner) Results() <-chan BlukeyScanResult {
+	return s.results
+}
+
+// Dropped returns the number of results dropped because the reader of
+// Results did not keep up.
+func (s *BlukeyScanner) Dropped() uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dropped
+}
+
+// Close stops scanning and closes the Results channel. It is safe to call
+// more than once.
+func (s *BlukeyScanner) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	s.d.StopScanning()
+	if s.restore != nil {
+		s.restore()
+	}
+	close(s.results)
+	return nil
+}
+
+func (s *BlukeyScanner) discovered(p Peripheral, a blukey.Adv, rssi int) {
+	r := BlukeyScanResult{
+		Adv:        a,
+		Peripheral: p,
+		RSSI:       rssi,
+		Time:       time.Now(),
+	}
+	if s.filter != nil && !s.filter(r) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	select {
+	case s.results <- r:
+	default:
+		s.dropped++
+	}
+}
@@ -0,0 +1,91 @@
+package gatt
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/PayRange/gatt/blukey"
+)
+
+func TestBlukeyScanner(t *testing.T) {
+	d := &dialDevice{}
+	var found func(Peripheral, blukey.Adv, int)
+	restored := false
+	s := newBlukeyScanner(d, func(r BlukeyScanResult) bool {
+		return r.Adv.DeviceId() != 2
+	}, false, func(f func(Peripheral, blukey.Adv, int)) {
+		found = f
+	}, func() {
+		restored = true
+	})
+	if !d.scanning {
+		t.Fatalf("not scanning")
+	}
+
+	p := newBRSPPeripheral()
+	for id := uint32(1); id <= 3; id++ {
+		found(p, &blukey.AdvV2{Id: id}, -40-int(id))
+	}
+	for _, id := range []uint32{1, 3} {
+		r := <-s.Results()
+		if r.Adv.DeviceId() != id || r.Peripheral != p || r.RSSI != -40-int(id) || r.Time.IsZero() {
+			t.Errorf("got %+v want device %d", r, id)
+		}
+	}
+
+	s.Close()
+	if d.scanning || !restored {
+		t.Errorf("after Close: scanning %t, restored %t", d.scanning, restored)
+	}
+	found(p, &blukey.AdvV2{Id: 4}, -40)
+	if r, ok := <-s.Results(); ok {
+		t.Errorf("after Close: got %+v", r)
+	}
+	s.Close()
+}
+
+func TestBlukeyScannerSlowReader(t *testing.T) {
+	var found func(Peripheral, blukey.Adv, int)
+	s := newBlukeyScanner(&dialDevice{}, nil, true, func(f func(Peripheral, blukey.Adv, int)) {
+		found = f
+	}, nil)
+	defer s.Close()
+
+	for i := 0; i < blukeyScanQueue+5; i++ {
+		found(newBRSPPeripheral(), &blukey.AdvV1{Id: uint32(i)}, -50)
+	}
+	if n := s.Dropped(); n != 5 {
+		t.Errorf("Dropped: got %d want 5", n)
+	}
+	if r := <-s.Results(); r.Adv.DeviceId() != 0 {
+		t.Errorf("first result: got device %d want 0", r.Adv.DeviceId())
+	}
+}
+
+func TestBlukeyAdvFilter(t *testing.T) {
+	var found func(Peripheral, blukey.Adv, int)
+	s := newBlukeyScanner(&dialDevice{}, BlukeyAdvFilter(blukey.Transactable()), false, func(f func(Peripheral, blukey.Adv, int)) {
+		found = f
+	}, nil)
+	defer s.Close()
+
+	found(newBRSPPeripheral(), &blukey.AdvV2{Id: 1, Flags: blukey.AdvV2statusBusy}, -50)
+	found(newBRSPPeripheral(), &blukey.AdvV2{Id: 2}, -50)
+	if r := <-s.Results(); r.Adv.DeviceId() != 2 {
+		t.Errorf("got device %d want 2", r.Adv.DeviceId())
+	}
+}
+
+func TestBlukeyScanResultRedacted(t *testing.T) {
+	r := BlukeyScanResult{Adv: &blukey.AdvV2{Id: 1, Key: 0xdeadbeef}, RSSI: -50}
+	for _, verb := range []string{"%v", "%+v", "%#v"} {
+		if s := fmt.Sprintf(verb, r); strings.Contains(s, "deadbeef") || strings.Contains(s, "3735928559") {
+			t.Errorf("%s leaks the key: %s", verb, s)
+		}
+	}
+	if b, err := json.Marshal(r.Adv); err != nil || strings.Contains(string(b), "3735928559") {
+		t.Errorf("json.Marshal leaks the key: %s, %v", b, err)
+	}
+}
@@ -1,225 +1,2323 @@
 package gatt
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var (
 	ErrNotBRSP = errors.New("Peripheral does not implement BRSP")
-	ErrTimeout = errors.New("BRSP timeout")
-	ErrClosed  = errors.New("BRSP was closed")
+	ErrTimeout = error(brspTimeoutError{})
 
-	brspService = MustParseUUID("DA2B84F1-6279-48DE-BDC0-AFBEA0226079")
-	brspMode    = MustParseUUID("A87988B9-694C-479C-900E-95DFA6C00A24")
-	brspRx      = MustParseUUID("BF03260C-7205-4C25-AF43-93B1C299D159")
-	brspTx      = MustParseUUID("18CDA784-4BD3-4370-85BB-BFED91EC86AF")
+	// ErrClosed is returned once the session was closed locally, by Close
+	// or CloseGracefully. It never reports the peripheral going away.
+	ErrClosed = errors.New("BRSP was closed")
+
+	// ErrDisconnected is returned by Write and Flush once the peripheral
+	// has gone away. Read returns io.EOF instead, after any buffered data.
+	// Neither is ErrClosed until the session is closed locally as well.
+	ErrDisconnected = errors.New("BRSP peripheral disconnected")
+
+	// ErrNotResumable is returned by Reattach on a session that was not
+	// opened with the Resumable option.
+	ErrNotResumable = errors.New("BRSP session is not resumable")
+
+	// ErrSubscriptionLost is returned by Read, after any buffered data,
+	// when the peripheral reported a change of its GATT database and the
+	// session could not subscribe to BRSPTxUUID again.
+	ErrSubscriptionLost = errors.New("BRSP subscription lost")
+
+	// ErrIdle is returned by Read, after any buffered data, once the
+	// session was shut down by the IdleTimeout option. It is a timeout
+	// that wraps ErrTimeout.
+	ErrIdle = error(brspIdleError{})
+
+	// ErrWriteBufferFull is returned by Write when the session has a
+	// MaxWriteBuffer limit, does not block when full, and p does not fit.
+	ErrWriteBufferFull = errors.New("BRSP write buffer is full")
+
+	// ErrDataLoss matches, with errors.Is, the *BRSPDataLossError that Read
+	// returns where the CheckSequence option found PDUs missing.
+	ErrDataLoss = errors.New("BRSP data lost")
+
+	// ErrFrameTooLarge is returned by ReadLine when no delimiter arrives
+	// within the maximum line length.
+	ErrFrameTooLarge = errors.New("BRSP frame too large")
+
+	// ErrProbeMismatch is returned by Probe when the data echoed by the
+	// peripheral differs from the payload.
+	ErrProbeMismatch = errors.New("BRSP probe echo mismatch")
+
+	// UUIDs of the standard BRSP service and its characteristics.
+	BRSPServiceUUID = MustParseUUID("DA2B84F1-6279-48DE-BDC0-AFBEA0226079")
+	BRSPModeUUID    = MustParseUUID("A87988B9-694C-479C-900E-95DFA6C00A24")
+	BRSPRxUUID      = MustParseUUID("BF03260C-7205-4C25-AF43-93B1C299D159")
+	BRSPTxUUID      = MustParseUUID("18CDA784-4BD3-4370-85BB-BFED91EC86AF")
+)
+
+// brspDefaultMTU is the ATT MTU assumed when none is configured.
+const brspDefaultMTU = 23
+
+// BRSPOptions configures a BRSP session opened with OpenBRSPWithOptions.
+// The zero value selects the same behavior as OpenBRSP.
+type BRSPOptions struct {
+	// ServiceUUID, ModeUUID, RxUUID and TxUUID identify the BRSP service
+	// and its characteristics, for firmware that serves BRSP under other
+	// UUIDs. Each defaults to the standard BRSP UUID.
+	ServiceUUID UUID
+	ModeUUID    UUID
+	RxUUID      UUID
+	TxUUID      UUID
+
+	// FlowUUID, if set, identifies an optional flow control characteristic
+	// in the BRSP service. While the peripheral indicates or notifies a
+	// nonzero value on it, its buffers are full and no data is written to
+	// RX. Peripherals without the characteristic are used as usual.
+	FlowUUID UUID
+
+	// ModeValue is written to the mode characteristic when the session is
+	// opened, e.g. 2 for firmware that requires security. If zero, 1 (data
+	// mode) is written.
+	ModeValue byte
+
+	// MTU is the negotiated ATT MTU of the connection. Outgoing data is
+	// written in chunks of MTU-3 bytes. If zero, the MTU of the peripheral
+	// is used, see Peripheral.ExchangeMTU, by default 23, giving 20-byte
+	// chunks.
+	MTU uint16
+
+	// CheckSequence makes the session expect a one-byte rolling sequence
+	// number at the start of every PDU received on TX. It is removed from
+	// the input, and where the numbering skips, Read returns a
+	// *BRSPDataLossError after the data before the gap. ReadAtLeast and
+	// ReadLine read across gaps without reporting them.
+	CheckSequence bool
+
+	// SendSequence makes the session start every PDU it writes to RX with
+	// a one-byte rolling sequence number, counting from 0 on each
+	// connection. Each PDU carries one byte less of data.
+	SendSequence bool
+
+	// MaxChunkSize, if set, caps the size of each write of outgoing data
+	// below the MTU-3 bytes the MTU allows, for firmware that drops
+	// larger writes. It must be between 1 and MTU-3.
+	MaxChunkSize int
+
+	// SyncWrite makes Write block until its bytes have been written to the
+	// peripheral and return the error of the underlying characteristic
+	// write, if any. By default Write returns as soon as the bytes are
+	// queued and write errors are reported by a later Write or Flush.
+	SyncWrite bool
+
+	// WriteWithResponse makes each chunk written to the RX characteristic
+	// an ATT Write Request that waits for the peripheral's response. By
+	// default chunks are sent as Write Commands (write without response),
+	// which are only paced by the controller's own buffer flow control; in
+	// that mode Flush returns once all chunks were handed to the stack,
+	// not when the peripheral received them.
+	WriteWithResponse bool
+
+	// WriteBatch, if greater than 1, lets the writer take up to this many
+	// chunks of queued data at once and write them back to back, instead
+	// of handing over one chunk at a time. With write commands this keeps
+	// the controller's buffers full while the session catches up; chunks
+	// are still written one by one and in order.
+	WriteBatch int
+
+	// CoalesceDelay, if positive, holds back data written while the session
+	// is idle for up to this long, so that a burst of small Writes goes out
+	// in full-size chunks rather than one characteristic write each. Data
+	// is sent early once a full chunk is queued or on Flush.
+	CoalesceDelay time.Duration
+
+	// MaxWriteBuffer, if positive, limits how many bytes accepted by Write
+	// may be waiting to be written to the peripheral. When the limit is
+	// reached, Write either blocks until there is room, if BlockWhenFull
+	// is set, or fails with ErrWriteBufferFull.
+	MaxWriteBuffer int
+	BlockWhenFull  bool
+
+	// Notify subscribes to the TX characteristic with notifications rather
+	// than indications when the peripheral supports them. Notifications
+	// need no ATT confirmation per PDU, which roughly doubles throughput.
+	// Indications are used if TX does not support notifications.
+	Notify bool
+
+	// CloseWriteMode, if set, is written to the mode characteristic by
+	// CloseWrite once all output has been flushed, to tell the peripheral
+	// that no more data follows.
+	CloseWriteMode []byte
+
+	// Resumable keeps the session alive when the peripheral disconnects.
+	// Output stays queued and pending Reads keep waiting until the session
+	// is given a new connection with Reattach, or closed.
+	Resumable bool
+
+	// ReadBufferSize, if positive, is the initial size of the buffer
+	// holding received data until it is read. The buffer grows as needed;
+	// sizing it for the expected backlog avoids growing it at run time.
+	ReadBufferSize int
+
+	// WriteBufferSize, if positive, is the initial size of the buffer
+	// holding written data until it is sent, like ReadBufferSize. Size it
+	// for large transfers, such as firmware images, written in one go.
+	WriteBufferSize int
+
+	// MaxBufferGrowth, if positive, limits how many bytes the read and
+	// write buffers grow by at a time. They double in size by default,
+	// which may overshoot a large backlog by as much again.
+	MaxBufferGrowth int
+
+	// Timeouts limits how long individual operations may take.
+	Timeouts BRSPTimeouts
+
+	// Keepalive, if its Interval is set, generates GATT traffic on an
+	// otherwise idle session, for peripherals that drop silent
+	// connections.
+	Keepalive BRSPKeepalive
+
+	// Retry makes failed writes of data to the RX characteristic be
+	// repeated before the error is reported. By default a failed chunk is
+	// not resent.
+	Retry BRSPRetryPolicy
+
+	// Logger, if set, is called for every PDU exchanged with the
+	// peripheral. By default nothing is logged.
+	Logger BRSPLogger
+
+	// Name, if set, labels the session to tell it apart from others: it
+	// prefixes the errors returned by reads, writes and flushes, which
+	// still match the usual errors with errors.Is, and is passed to a
+	// BRSPNamedLogger. Taps set with SetTap know their session already.
+	Name string
+
+	// OnResubscribe, if set, is called whenever the session subscribed to
+	// the peripheral again after it indicated Service Changed, with the
+	// error if that failed. The peripheral's GATT database may have
+	// changed, which resets subscriptions, so the session rediscovers the
+	// BRSP characteristics, subscribes and writes the mode again; as on
+	// Reattach, the chunk being written at the time may be sent twice.
+	OnResubscribe func(err error)
+}
+
+// BRSPTimeouts limits how long a single Read, Write or Flush may block
+// before it fails with ErrTimeout. The session stays usable after a
+// timeout. A zero duration means no limit. The limits apply in addition
+// to any deadline set with SetDeadline and friends.
+type BRSPTimeouts struct {
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	FlushTimeout time.Duration
+
+	// IdleTimeout, if set, shuts the session down once no PDU has been
+	// received or written for that long, as if the peripheral had gone
+	// away, except that Read returns ErrIdle. Close must still be called.
+	IdleTimeout time.Duration
+}
+
+// BRSPKeepalive configures the keepalive of a BRSP session. A keepalive is
+// sent once neither data nor mode changes have been sent or received for
+// Interval. It is only sent between Writes, never in the middle of the
+// chunks of one. A failed keepalive is reported by the next Write or
+// Flush like a failed data write.
+type BRSPKeepalive struct {
+	Interval time.Duration
+
+	// Payload is written to the RX characteristic as the keepalive. It is
+	// seen by the peripheral as stream data, so it must be something the
+	// firmware ignores. If empty, a zero-length write is used.
+	Payload []byte
+
+	// ReadMode makes the keepalive a read of the mode characteristic
+	// rather than a write to RX, for firmware that mishandles empty
+	// writes.
+	ReadMode bool
+}
+
+// BRSPRetryPolicy controls how often a chunk of outgoing data is written
+// to the peripheral before a failure is reported. The chunk is resent
+// before any later data, so retries never reorder or skip output.
+type BRSPRetryPolicy struct {
+	// MaxAttempts is the total number of writes tried per chunk. Values
+	// below 2 disable retries.
+	MaxAttempts int
+
+	// Backoff is the delay before the first retry. It doubles for each
+	// further retry. Zero means retry immediately.
+	Backoff time.Duration
+}
+
+// BRSPStats holds traffic counters of a BRSP session.
+type BRSPStats struct {
+	BytesRead    uint64    // bytes received from the peripheral
+	BytesWritten uint64    // bytes sent to the peripheral
+	PDUsIn       uint64    // indications or notifications received
+	PDUsOut      uint64    // characteristic writes of data, failed or not
+	WriteErrors  uint64    // characteristic writes that failed
+	WriteRetries uint64    // characteristic writes repeated after a failure
+	LastActivity time.Time // when a PDU was last received or written
+
+	// Queue high-water marks and allocations, counting the first.
+	MaxInQueued     int    // most unread bytes buffered at once
+	MaxOutQueued    int    // most unsent bytes buffered at once
+	InQueueGrowths  uint64 // times the input buffer was enlarged
+	OutQueueGrowths uint64 // times the output buffer was enlarged
+
+	// Writes affected by the MaxWriteBuffer limit.
+	WritesRejected uint64 // Writes failed with ErrWriteBufferFull
+	BytesRejected  uint64 // bytes of the rejected Writes
+	WritesBlocked  uint64 // Writes that had to wait for buffer space
+
+	LastProbeRTT time.Duration // round trip of the last successful Probe
+}
+
+// A BRSPDataLossError reports a gap in the sequence numbers of the PDUs
+// received with the CheckSequence option.
+type BRSPDataLossError struct {
+	Missing int // number of PDUs missing
+}
+
+func (e *BRSPDataLossError) Error() string {
+	return fmt.Sprintf("BRSP data lost: %d PDUs missing", e.Missing)
+}
+
+// Is reports whether target is ErrDataLoss.
+func (e *BRSPDataLossError) Is(target error) bool {
+	return target == ErrDataLoss
+}
+
+// brspLoss marks where PDUs were found missing in the input.
+type brspLoss struct {
+	offset  uint64 // bytes received before the gap
+	missing int
+}
+
+// brspStatsReq asks the loop for its counters, resetting them if reset
+// is set.
+type brspStatsReq struct {
+	c     chan BRSPStats
+	reset bool
+}
+
+// BRSPDirection tells which way a BRSP PDU travelled.
+type BRSPDirection int
+
+const (
+	BRSPIn  BRSPDirection = 0 // Indication received on the TX characteristic.
+	BRSPOut BRSPDirection = 1 // Write to the RX characteristic.
 )
 
+func (d BRSPDirection) String() string {
+	if d == BRSPIn {
+		return "in"
+	}
+	return "out"
+}
+
+// A BRSPLogger is notified of each PDU exchanged by a BRSP session, along
+// with the error reported for it, if any. data is only valid for the
+// duration of the call.
+type BRSPLogger interface {
+	LogPDU(dir BRSPDirection, data []byte, err error)
+}
+
+// BRSPLoggerFunc is an adapter to allow the use of ordinary functions as
+// BRSPLoggers.
+type BRSPLoggerFunc func(dir BRSPDirection, data []byte, err error)
+
+// LogPDU calls f(dir, data, err).
+func (f BRSPLoggerFunc) LogPDU(dir BRSPDirection, data []byte, err error) {
+	f(dir, data, err)
+}
+
+// A BRSPNamedLogger is a BRSPLogger that is also told the Name of the
+// session, so that one logger can tell many sessions apart. Sessions call
+// LogNamedPDU rather than LogPDU.
+type BRSPNamedLogger interface {
+	BRSPLogger
+	LogNamedPDU(name string, dir BRSPDirection, data []byte, err error)
+}
+
+// NewBRSPWriterLogger returns a BRSPLogger that prints each PDU to w, e.g.
+// os.Stdout, in the same format BRSP used to print unconditionally. The
+// lines of a session with a Name start with it.
+func NewBRSPWriterLogger(w io.Writer) BRSPLogger {
+	return brspWriterLogger{w}
+}
+
+type brspWriterLogger struct {
+	w io.Writer
+}
+
+func (l brspWriterLogger) LogPDU(dir BRSPDirection, data []byte, err error) {
+	l.LogNamedPDU("", dir, data, err)
+}
+
+func (l brspWriterLogger) LogNamedPDU(name string, dir BRSPDirection, data []byte, err error) {
+	if name != "" {
+		fmt.Fprintf(l.w, "%s: ", name)
+	}
+	if dir == BRSPIn {
+		fmt.Fprintf(l.w, "brspTx %v: % x\n", err, data)
+	} else {
+		fmt.Fprintf(l.w, "brspRx % x (%s)\n", data, string(data))
+	}
+}
+
+// A BRSPTap is called for each PDU exchanged by a BRSP session, as it is
+// received or right after it was written, along with the error reported
+// for it, if any. data is only valid for the duration of the call, so
+// taps that keep it must copy it. Taps run on the session's goroutines and
+// should return quickly; the time of the call is the time of the PDU.
+type BRSPTap func(dir BRSPDirection, data []byte, err error)
+
+// brspTap wraps a BRSPTap for storage in an atomic.Value.
+type brspTap struct {
+	f BRSPTap
+}
+
 type BRSP struct {
-	p            Peripheral
-	readReq      chan brspRequest
-	writeReq     chan []byte
-	flushReq     chan chan error
-	incomingData chan brspIncoming
-	outgoingData chan brspOutgoing
-	writeErrors  chan error
-	closed       chan struct{}
-	brspService  *Service
-	brspMode     *Characteristic
-	brspRx       *Characteristic
-	brspTx       *Characteristic
-	inQueue      brspQueue
-	outQueue     brspQueue
-	txMode       bool
-	outData      brspOutgoing
-	readReqs     []brspRequest
-	flushReqs    []chan error
-	readError    error
-	writeError   error
+	writeSeq      uint64 // number of Write calls; first for atomic alignment
+	retries       uint64 // chunks resent by the writer, accessed atomically
+	lastRead      int64  // UnixNano of the last PDU received, atomically
+	lastWrite     int64  // UnixNano of the last PDU written, atomically
+	probeRTT      int64  // round trip of the last Probe, atomically
+	profile       brspProfile
+	mu            sync.Mutex // guards link
+	link          *brspLink
+	attachMu      sync.Mutex // serializes Reattach
+	attachGen     int
+	attachReq     chan *brspLink
+	readReq       chan brspRequest
+	writeReq      chan brspRequest
+	flushReq      chan brspFlush
+	flushCancel   chan chan error
+	cancelReq     chan brspCancel
+	closeWriteReq chan brspFlush
+	modeReq       chan brspModeChange
+	modeChanges   chan byte
+	deadlineReq   chan brspDeadline
+	countReq      chan chan brspCounts
+	drainReq      chan chan int
+	statsReq      chan brspStatsReq
+	loopDone      chan struct{}
+	stats         BRSPStats
+	incomingData  chan brspIncoming
+	outgoingData  chan brspOutgoing
+	writeErrors   chan brspWriteError
+	closed        chan struct{}
+	closeOnce     sync.Once
+	inQueue       brspQueue
+	outQueue      brspQueue
+	txMode        bool
+	outData       brspOutgoing
+	outSpare      []byte
+	chunkSize     int
+	batchSize     int // bytes handed to the writer at once
+	syncWrite     bool
+	writeRsp      bool
+	coalesceDelay time.Duration
+	notify        bool
+	closeMode     []byte
+	maxWrite      int
+	blockWhenFull bool
+	logger        BRSPLogger
+	name          string
+	tap           atomic.Value // brspTap
+	timeouts      BRSPTimeouts
+	onResubscribe func(error)
+	retry         BRSPRetryPolicy
+	keepaliveOpts BRSPKeepalive
+	enqueued      uint64
+	written       uint64
+	inFlight      int
+	received      uint64
+	inModes       []brspModeChange
+	inLosses      []brspLoss
+	checkSeq      bool
+	sendSeq       bool
+	inSeq         byte // next sequence number expected
+	inSeqValid    bool // whether inSeq is known on this link
+	outModes      []brspModeChange
+	modeEvents    []byte
+	readReqs      []brspRequest
+	writeReqs     []brspPendingWrite
+	blockedWrites []brspPendingWrite
+	flushReqs     []brspFlush
+	writesDone    uint64          // all writes up to this sequence were handled
+	writesAhead   map[uint64]bool // writes handled out of sequence
+	resumable     bool
+	detached      bool
+	disconnected  bool
+	inErr         error // returned by Read once disconnected and drained
+	writeClosed   bool
+	writeErrs     []brspWriteError
+	readDeadline  time.Time
+	writeDeadline time.Time
+	timer         *time.Timer
+	timeout       <-chan time.Time
+	coalesceTimer *time.Timer
+	coalesce      <-chan time.Time
+	keepTimer     *time.Timer
+	keepalive     <-chan time.Time
+	lastKeepalive time.Time
+	idleTimer     *time.Timer
+	idle          <-chan time.Time
+	idleSince     time.Time // when the loop started
+}
+
+// Close shuts down the BRSP session. It is safe to call Close more than
+// once and concurrently with Read, Write and Flush; those return ErrClosed
+// once the session is closed.
+func (b *BRSP) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.closed)
+	})
+
+	return nil
+}
+
+// CloseWrite shuts down the writing side of the session, like
+// net.TCPConn.CloseWrite. It waits until all output has been written,
+// writes the CloseWriteMode option, if any, and from then on Write returns
+// ErrClosed. Reading continues to work until Close is called.
+func (b *BRSP) CloseWrite() error {
+	return b.wrapErr(b.closeWrite(context.Background()))
+}
+
+// CloseGracefully closes the session like Close, but first shuts down the
+// writing side like CloseWrite: it waits until all queued output,
+// including the chunk being written, has reached the peripheral and
+// writes the CloseWriteMode option, if any. If ctx is done before then,
+// the remaining output is discarded and ctx.Err() is returned. The session
+// is closed in any case. Close itself does not wait.
+func (b *BRSP) CloseGracefully(ctx context.Context) error {
+	defer b.Close()
+
+	err := b.closeWrite(ctx)
+	if err == ErrClosed && !b.isClosed() {
+		// CloseWrite was called already; wait for the output after all.
+		err = b.flush(ctx)
+	}
+	return b.wrapErr(err)
+}
+
+func (b *BRSP) closeWrite(ctx context.Context) error {
+	if b.isClosed() {
+		return ErrClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := b.sendFlush(ctx, b.closeWriteReq); err != nil {
+		return err
+	}
+
+	if b.closeMode != nil {
+		l := b.currentLink()
+		return l.p.WriteCharacteristic(l.mode, b.closeMode, true)
+	}
+	return nil
+}
+
+// Reattach resumes a session opened with the Resumable option over p, a
+// new connection to the same peripheral. Queued output is sent from where
+// the previous connection left off; the chunk that was being written when
+// it was lost is sent again, since there is no telling whether it arrived.
+// Unread input and pending Reads are kept.
+func (b *BRSP) Reattach(p Peripheral) error {
+	if !b.resumable {
+		return ErrNotResumable
+	}
+	if b.isClosed() {
+		return ErrClosed
+	}
+
+	b.attachMu.Lock()
+	defer b.attachMu.Unlock()
+	return b.attach(p)
+}
+
+// attach sets up a new link over p and hands it to the loop. The caller
+// must hold attachMu.
+func (b *BRSP) attach(p Peripheral) error {
+	b.attachGen++
+	l := &brspLink{
+		p:      p,
+		gen:    b.attachGen,
+		notify: b.notify,
+		gone:   make(chan struct{}),
+	}
+	if err := b.init(context.Background(), l); err != nil {
+		return err
+	}
+
+	select {
+	case b.attachReq <- l:
+		return nil
+	case <-b.closed:
+		l.unsubscribe()
+		return ErrClosed
+	}
+}
+
+// resubscribe replaces l, which the peripheral reported a change of its
+// GATT database on, by a newly set up link to the same peripheral. If
+// that fails, the session loses l as if the peripheral disconnected.
+func (b *BRSP) resubscribe(l *brspLink) {
+	if b.isClosed() {
+		return
+	}
+
+	b.attachMu.Lock()
+	if b.currentLink() != l {
+		// Already replaced, e.g. by an earlier Service Changed.
+		b.attachMu.Unlock()
+		return
+	}
+	err := b.attach(l.p)
+	b.attachMu.Unlock()
+	if err == ErrClosed {
+		return
+	}
+
+	if err != nil {
+		select {
+		case b.incomingData <- brspIncoming{err: ErrSubscriptionLost, gen: l.gen}:
+		case <-b.closed:
+		}
+	}
+	if b.onResubscribe != nil {
+		b.onResubscribe(err)
+	}
+}
+
+var _ net.Conn = (*BRSP)(nil)
+
+// LocalAddr returns the local end of the session. The central's own
+// address is not known to BRSP, so it is empty.
+func (b *BRSP) LocalAddr() net.Addr {
+	return brspAddr("")
+}
+
+// RemoteAddr returns the address of the peripheral the session is
+// currently attached to, which is the peripheral's ID.
+func (b *BRSP) RemoteAddr() net.Addr {
+	return brspAddr(b.currentLink().p.ID())
+}
+
+// Peripheral returns the peripheral the session is currently attached to.
+// Other GATT requests may be issued on it while the session is active:
+// the stack serializes them with the session's own requests, so they
+// don't disturb the BRSP stream.
+func (b *BRSP) Peripheral() Peripheral {
+	return b.currentLink().p
+}
+
+// Name returns the Name option the session was opened with.
+func (b *BRSP) Name() string {
+	return b.name
+}
+
+// Service returns the BRSP service discovered on the current peripheral.
+func (b *BRSP) Service() *Service {
+	return b.currentLink().service
+}
+
+// ModeCharacteristic, RxCharacteristic and TxCharacteristic return the
+// BRSP characteristics discovered on the current peripheral, e.g. to log
+// their handles.
+func (b *BRSP) ModeCharacteristic() *Characteristic { return b.currentLink().mode }
+func (b *BRSP) RxCharacteristic() *Characteristic   { return b.currentLink().rx }
+func (b *BRSP) TxCharacteristic() *Characteristic   { return b.currentLink().tx }
+
+func (b *BRSP) currentLink() *brspLink {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.link
+}
+
+// SetMode writes m to the BRSP mode characteristic once all data written
+// before it has been sent, and waits for the write to complete.
+func (b *BRSP) SetMode(m byte) error {
+	if b.isClosed() {
+		return ErrClosed
+	}
+
+	c := brspModeChange{
+		mode: m,
+		r:    make(chan error, 1),
+	}
+	select {
+	case b.modeReq <- c:
+	case <-b.closed:
+		return ErrClosed
+	}
+	select {
+	case err := <-c.r:
+		return err
+	case <-b.closed:
+		return ErrClosed
+	}
+}
+
+// SetTap installs f to be called for every PDU the session receives on
+// TX or writes to RX from now on, replacing any previous tap. Unlike the
+// Logger option it can be changed while the session is open, e.g. to
+// capture a stretch of traffic. A nil f removes the tap.
+func (b *BRSP) SetTap(f BRSPTap) {
+	b.tap.Store(brspTap{f})
+}
+
+// ModeChanges returns a channel that receives the new value whenever the
+// peripheral changes its BRSP mode, if the mode characteristic supports
+// notifications or indications. A change is delivered once all data the
+// peripheral sent before it has been read, and Read does not return data
+// from both sides of a change at once. Changes are queued until received.
+func (b *BRSP) ModeChanges() <-chan byte {
+	return b.modeChanges
+}
+
+func (b *BRSP) Flush() error {
+	return b.FlushContext(context.Background())
+}
+
+// FlushContext is like Flush but gives up waiting and returns ctx.Err()
+// when ctx is done before all buffered data has been written.
+func (b *BRSP) FlushContext(ctx context.Context) error {
+	return b.wrapErr(b.flush(ctx))
+}
+
+func (b *BRSP) flush(ctx context.Context) error {
+	if b.isClosed() {
+		return ErrClosed
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if b.timeouts.FlushTimeout > 0 {
+		parent := ctx
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(parent, b.timeouts.FlushTimeout)
+		defer cancel()
+		err := b.sendFlush(ctx, b.flushReq)
+		if err == context.DeadlineExceeded && parent.Err() == nil {
+			err = ErrTimeout
+		}
+		return err
+	}
+	return b.sendFlush(ctx, b.flushReq)
+}
+
+// sendFlush sends a flush to the loop on req and waits for its answer,
+// withdrawing it if ctx is done first.
+func (b *BRSP) sendFlush(ctx context.Context, req chan brspFlush) error {
+	f := b.newFlush()
+	c := f.c
+	select {
+	case req <- f:
+	case <-b.closed:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	select {
+	case err := <-c:
+		return err
+	case <-b.closed:
+		return b.wait(c)
+	case <-ctx.Done():
+	}
+
+	// Withdraw the request so that the write errors, if any, are left for
+	// the next Flush. If the loop answered in the meantime, report that
+	// instead.
+	select {
+	case b.flushCancel <- c:
+	case <-b.closed:
+	}
+	select {
+	case err := <-c:
+		return err
+	default:
+		return ctx.Err()
+	}
+}
+
+// result waits for the loop's answer to req. The loop answers the
+// requests it accepted even when it is closing, but don't depend on it:
+// once the session is closed, only an answer already given is returned.
+func (b *BRSP) result(req brspRequest) brspResult {
+	select {
+	case res := <-req.r:
+		return res
+	case <-b.closed:
+	}
+	select {
+	case res := <-req.r:
+		return res
+	default:
+		return brspResult{err: ErrClosed}
+	}
+}
+
+// resultContext is like result, but once ctx is done it withdraws req
+// and returns ctx.Err(), unless the loop answered req in the meantime.
+func (b *BRSP) resultContext(ctx context.Context, req brspRequest) brspResult {
+	select {
+	case res := <-req.r:
+		return res
+	case <-b.closed:
+		return b.result(req)
+	case <-ctx.Done():
+	}
+
+	// The loop answers the withdrawn request with ctx.Err() unless it
+	// already had.
+	b.cancel(brspCancel{r: req.r, err: ctx.Err()})
+	return b.result(req)
+}
+
+func (b *BRSP) cancel(c brspCancel) {
+	select {
+	case b.cancelReq <- c:
+	case <-b.closed:
+	}
+}
+
+// wait is like result, for requests answered with an error.
+func (b *BRSP) wait(c chan error) error {
+	select {
+	case err := <-c:
+		return err
+	case <-b.closed:
+	}
+	select {
+	case err := <-c:
+		return err
+	default:
+		return ErrClosed
+	}
+}
+
+// newFlush returns a flush request covering all Writes called so far.
+func (b *BRSP) newFlush() brspFlush {
+	return brspFlush{
+		c:   make(chan error, 1),
+		seq: atomic.LoadUint64(&b.writeSeq),
+	}
+}
+
+func (b *BRSP) Read(p []byte) (int, error) {
+	return b.ReadContext(context.Background(), p)
+}
+
+// ReadContext is like Read but gives up when ctx is done, returning
+// ctx.Err(). Input that arrives later is left for the next read.
+func (b *BRSP) ReadContext(ctx context.Context, p []byte) (int, error) {
+	return b.read(ctx, brspRequest{p: p})
+}
+
+// ReadAtLeast reads into p until it has read at least min bytes, like
+// io.ReadAtLeast. The session collects the input until min bytes are
+// available and only then consumes them, so a timeout or deadline leaves
+// partial input buffered for the next read. Unlike Read, it does not stop
+// at mode changes. If the peripheral disconnects first, ReadAtLeast
+// returns the remaining input with io.ErrUnexpectedEOF. If len(p) is less
+// than min, it returns io.ErrShortBuffer.
+func (b *BRSP) ReadAtLeast(p []byte, min int) (int, error) {
+	if len(p) < min {
+		return 0, io.ErrShortBuffer
+	}
+	if min <= 0 {
+		return 0, nil
+	}
+	return b.read(context.Background(), brspRequest{p: p, min: min})
+}
+
+// ReadLine reads input up to and including the first delim byte, waiting
+// until the delimiter arrives however the input is split into PDUs. The
+// line, delimiter included, is at most max bytes long; if max bytes
+// arrive without a delimiter, ReadLine returns ErrFrameTooLarge and leaves
+// them unread, e.g. for Discard. Like ReadAtLeast, it does not stop at
+// mode changes, leaves partial lines buffered when it times out, and
+// returns the partial line with io.ErrUnexpectedEOF if the peripheral
+// disconnects. The returned slice is the caller's to keep.
+func (b *BRSP) ReadLine(delim byte, max int) ([]byte, error) {
+	if max <= 0 {
+		return nil, io.ErrShortBuffer
+	}
+	p := make([]byte, max)
+	n, err := b.read(context.Background(), brspRequest{p: p, line: true, delim: delim})
+	return p[:n], err
+}
+
+// Peek returns up to n bytes of input without consuming them, waiting
+// for at least one byte to arrive as Read does. Like Read, it returns
+// no data beyond the next mode change. The returned slice is the
+// caller's to keep.
+func (b *BRSP) Peek(n int) ([]byte, error) {
+	if n <= 0 {
+		return nil, nil
+	}
+	p := make([]byte, n)
+	m, err := b.read(context.Background(), brspRequest{p: p, peek: true})
+	return p[:m], err
+}
+
+// Discard skips the next n bytes of input, waiting for them to arrive as
+// Read does, and returns the number of bytes discarded. If that is less
+// than n, it also returns the error that stopped it.
+func (b *BRSP) Discard(n int) (int, error) {
+	var discarded int
+	for discarded < n {
+		m, err := b.read(context.Background(), brspRequest{discard: n - discarded})
+		discarded += m
+		if err != nil {
+			return discarded, err
+		}
+	}
+	return discarded, nil
+}
+
+// DrainInput throws away all received data waiting to be read and
+// returns the number of bytes dropped. Mode changes in the dropped data
+// are still reported on ModeChanges.
+func (b *BRSP) DrainInput() int {
+	c := make(chan int, 1)
+	select {
+	case b.drainReq <- c:
+		return <-c
+	case <-b.closed:
+		return 0
+	}
+}
+
+func (b *BRSP) read(ctx context.Context, req brspRequest) (int, error) {
+	if b.isClosed() {
+		return 0, b.wrapErr(ErrClosed)
+	}
+
+	req.r = make(chan brspResult, 1)
+	req.expires = after(b.timeouts.ReadTimeout)
+	select {
+	case b.readReq <- req:
+	case <-b.closed:
+		return 0, b.wrapErr(ErrClosed)
+	case <-ctx.Done():
+		return 0, b.wrapErr(ctx.Err())
+	}
+	res := b.resultContext(ctx, req)
+
+	return res.n, b.wrapErr(res.err)
+}
+
+// Write queues p for transmission to the peripheral's RX characteristic.
+// The bytes are copied into the outgoing queue before Write returns, so
+// the caller may reuse p immediately.
+// The bytes of one Write are contiguous in the stream sent to the
+// peripheral, even when other goroutines write concurrently, so each call
+// may carry a whole frame. Only a Write that fails or times out partway
+// can leave a prefix of p, whose length it returns, in the stream.
+// If an earlier characteristic write failed and the error has not been
+// reported by Flush yet, Write returns that error without queuing p.
+func (b *BRSP) Write(p []byte) (int, error) {
+	return b.WriteContext(context.Background(), p)
+}
+
+// WriteContext is like Write but gives up when ctx is done, returning
+// ctx.Err() and the number of bytes of p queued by then. Bytes queued
+// before ctx was done are still sent.
+func (b *BRSP) WriteContext(ctx context.Context, p []byte) (int, error) {
+	if b.isClosed() {
+		return 0, b.wrapErr(ErrClosed)
+	}
+
+	req := brspRequest{
+		p:       p,
+		r:       make(chan brspResult, 1),
+		expires: after(b.timeouts.WriteTimeout),
+		seq:     atomic.AddUint64(&b.writeSeq, 1),
+	}
+	select {
+	case b.writeReq <- req:
+	case <-b.closed:
+		return 0, b.wrapErr(ErrClosed)
+	case <-ctx.Done():
+		// Flushes issued after this write wait for its sequence number.
+		b.cancel(brspCancel{seq: req.seq})
+		return 0, b.wrapErr(ctx.Err())
+	}
+	res := b.resultContext(ctx, req)
+
+	return res.n, b.wrapErr(res.err)
+}
+
+// WriteSome queues as much of p as fits in the write buffer limited by
+// MaxWriteBuffer and returns how many bytes that was, without waiting for
+// room. If not all of p fits it returns ErrWriteBufferFull with the count,
+// which is 0 while blocked Writes are waiting for room. The queued prefix
+// is chunked and ordered with other writes like the bytes of a Write, but
+// WriteSome does not wait for it to be sent even with SyncWrite. Without
+// MaxWriteBuffer it queues all of p.
+func (b *BRSP) WriteSome(p []byte) (int, error) {
+	if b.isClosed() {
+		return 0, b.wrapErr(ErrClosed)
+	}
+
+	req := brspRequest{
+		p:       p,
+		r:       make(chan brspResult, 1),
+		expires: after(b.timeouts.WriteTimeout),
+		seq:     atomic.AddUint64(&b.writeSeq, 1),
+		some:    true,
+	}
+	select {
+	case b.writeReq <- req:
+	case <-b.closed:
+		return 0, b.wrapErr(ErrClosed)
+	}
+	res := b.result(req)
+
+	return res.n, b.wrapErr(res.err)
+}
+
+// Probe checks a peripheral in a loopback mode, which echoes the data it
+// receives, and measures the round trip time of the session. It writes
+// payload, waits until as many bytes have come back and returns how long
+// that took, which Stats also reports as LastProbeRTT. The session must
+// be otherwise idle: any input buffered or arriving meanwhile is taken
+// for the echo, and an echo that differs from payload fails with
+// ErrProbeMismatch. If ctx is done first, Probe returns ctx.Err() and a
+// partial echo is left buffered.
+func (b *BRSP) Probe(ctx context.Context, payload []byte) (time.Duration, error) {
+	start := time.Now()
+	if _, err := b.WriteContext(ctx, payload); err != nil {
+		return 0, err
+	}
+	// Flush sends data held back by CoalesceDelay at once.
+	if err := b.FlushContext(ctx); err != nil {
+		return 0, err
+	}
+	echo := make([]byte, len(payload))
+	if len(echo) > 0 {
+		if _, err := b.read(ctx, brspRequest{p: echo, min: len(echo)}); err != nil {
+			return 0, err
+		}
+	}
+	rtt := time.Since(start)
+	if !bytes.Equal(echo, payload) {
+		return rtt, b.wrapErr(ErrProbeMismatch)
+	}
+	atomic.StoreInt64(&b.probeRTT, int64(rtt))
+	return rtt, nil
+}
+
+// brspCopyChunks is the number of characteristic-sized chunks ReadFrom
+// reads from its source per Write.
+const brspCopyChunks = 64
+
+// ReadFrom implements io.ReaderFrom. It reads r until EOF and queues the
+// data for transmission as Write does, several chunks per request to the
+// session, so io.Copy to a BRSP avoids a round trip per small write.
+// It returns the number of bytes queued and the first error other than
+// io.EOF from r or from the session.
+func (b *BRSP) ReadFrom(r io.Reader) (int64, error) {
+	buf := make([]byte, brspCopyChunks*b.chunkSize)
+	var total int64
+	for {
+		n, rerr := r.Read(buf)
+		if n > 0 {
+			m, err := b.Write(buf[:n])
+			total += int64(m)
+			if err != nil {
+				return total, err
+			}
+		}
+		if rerr == io.EOF {
+			return total, nil
+		}
+		if rerr != nil {
+			return total, rerr
+		}
+	}
+}
+
+// WriteTo implements io.WriterTo. It writes incoming data to w until the
+// peripheral disconnects, which ends the copy without an error. Any
+// other error from Read, including ErrClosed and ErrTimeout, or from w
+// is returned along with the number of bytes written.
+func (b *BRSP) WriteTo(w io.Writer) (int64, error) {
+	buf := make([]byte, brspCopyChunks*b.chunkSize)
+	var total int64
+	for {
+		n, rerr := b.Read(buf)
+		if n > 0 {
+			m, err := w.Write(buf[:n])
+			total += int64(m)
+			if err == nil && m < n {
+				err = io.ErrShortWrite
+			}
+			if err != nil {
+				return total, err
+			}
+		}
+		if rerr == io.EOF {
+			return total, nil
+		}
+		if rerr != nil {
+			return total, rerr
+		}
+	}
+}
+
+// SetDeadline sets the read and write deadlines of the BRSP session.
+// It is equivalent to calling both SetReadDeadline and SetWriteDeadline.
+func (b *BRSP) SetDeadline(t time.Time) error {
+	return b.setDeadline(brspDeadline{t: t, read: true, write: true})
+}
+
+// SetReadDeadline sets the deadline for pending and future Read calls.
+// A Read that is blocked when the deadline passes returns ErrTimeout, but
+// the session stays usable and a later Read with a fresh deadline can
+// still receive data. A zero value for t means Read will not time out.
+func (b *BRSP) SetReadDeadline(t time.Time) error {
+	return b.setDeadline(brspDeadline{t: t, read: true})
+}
+
+// SetWriteDeadline sets the deadline for future Write calls.
+// A Write issued after the deadline has passed returns ErrTimeout.
+// A zero value for t means Write will not time out.
+func (b *BRSP) SetWriteDeadline(t time.Time) error {
+	return b.setDeadline(brspDeadline{t: t, write: true})
+}
+
+// Stats returns a snapshot of the session's traffic counters. After the
+// session is closed it returns the final counts.
+func (b *BRSP) Stats() BRSPStats {
+	var s BRSPStats
+	c := make(chan BRSPStats, 1)
+	select {
+	case b.statsReq <- brspStatsReq{c: c}:
+		s = <-c
+	case <-b.loopDone:
+		s = b.stats
+	}
+	s.WriteRetries = atomic.LoadUint64(&b.retries)
+	s.LastProbeRTT = time.Duration(atomic.LoadInt64(&b.probeRTT))
+	return s
+}
+
+// ResetStats zeroes the session's traffic counters. The high-water marks
+// start again from the bytes buffered now, and LastActivity is kept. It
+// has no effect once the session is closed.
+func (b *BRSP) ResetStats() {
+	c := make(chan BRSPStats, 1)
+	select {
+	case b.statsReq <- brspStatsReq{c: c, reset: true}:
+		<-c
+		atomic.StoreUint64(&b.retries, 0)
+	case <-b.loopDone:
+	}
+}
+
+// LastRead returns when a PDU was last received from the peripheral, or
+// the zero time if none was. Unlike Stats it does not wait for the loop.
+func (b *BRSP) LastRead() time.Time {
+	return brspTime(atomic.LoadInt64(&b.lastRead))
+}
+
+// LastWrite returns when a PDU of data was last written to the
+// peripheral, or the zero time if none was.
+func (b *BRSP) LastWrite() time.Time {
+	return brspTime(atomic.LoadInt64(&b.lastWrite))
+}
+
+func brspTime(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+// Buffered returns the number of received bytes waiting to be returned by
+// Read.
+func (b *BRSP) Buffered() int {
+	return b.counts().buffered
+}
+
+// Pending returns the number of bytes accepted by Write that have not been
+// written to the peripheral yet, including the chunk currently being
+// written.
+func (b *BRSP) Pending() int {
+	return b.counts().pending
+}
+
+func (b *BRSP) counts() brspCounts {
+	c := make(chan brspCounts, 1)
+	select {
+	case b.countReq <- c:
+		return <-c
+	case <-b.closed:
+		return brspCounts{}
+	}
+}
+
+// isClosed reports whether Close has been called. Requests accepted by the
+// loop before it exits are always answered, so callers only need to check
+// this before submitting a new one.
+func (b *BRSP) isClosed() bool {
+	select {
+	case <-b.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (b *BRSP) setDeadline(d brspDeadline) error {
+	select {
+	case b.deadlineReq <- d:
+		return nil
+	case <-b.closed:
+		return ErrClosed
+	}
+}
+
+func (l *brspLink) discover(ctx context.Context, pr brspProfile) error {
+	// The GATT service too, for the peripheral to subscribe to Service
+	// Changed; see OnServicesChanged.
+	svcs, err := l.p.DiscoverServices([]UUID{pr.service, attrGATTUUID})
+	if err != nil {
+		return err
+	}
+
+	for _, s := range svcs {
+		if s.UUID().Equal(pr.service) {
+			l.service = s
+			break
+		}
+	}
+	if l.service == nil {
+		return ErrNotBRSP
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	uuids := []UUID{pr.mode, pr.rx, pr.tx}
+	if pr.flow.Len() > 0 {
+		uuids = append(uuids, pr.flow)
+	}
+	chars, err := l.p.DiscoverCharacteristics(uuids, l.service)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range chars {
+		u := c.UUID()
+		if u.Equal(pr.mode) {
+			l.mode = c
+		} else if u.Equal(pr.rx) {
+			l.rx = c
+		} else if u.Equal(pr.tx) {
+			l.tx = c
+		} else if pr.flow.Len() > 0 && u.Equal(pr.flow) && c.Properties()&(CharNotify|CharIndicate) != 0 {
+			l.flow = c
+		}
+	}
+	if l.mode == nil || l.rx == nil || l.tx == nil {
+		return ErrNotBRSP
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if _, err := l.p.DiscoverDescriptors(nil, l.tx); err != nil {
+		return err
+	}
+	if l.flow != nil {
+		if _, err := l.p.DiscoverDescriptors(nil, l.flow); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *BRSP) handleStatsReq(r brspStatsReq) {
+	r.c <- b.stats
+	if r.reset {
+		b.stats = BRSPStats{
+			LastActivity: b.stats.LastActivity,
+			MaxInQueued:  b.inQueue.queued(),
+			MaxOutQueued: b.outQueue.queued(),
+		}
+	}
+}
+
+func (b *BRSP) handleDrainReq(c chan int) {
+	n := b.inQueue.discard(b.inQueue.queued())
+	b.releaseModes()
+	c <- n
+}
+
+func (b *BRSP) handleCountReq(c chan brspCounts) {
+	c <- brspCounts{
+		buffered: b.inQueue.queued(),
+		pending:  int(b.enqueued - b.written),
+	}
+}
+
+func (b *BRSP) handleDeadlineReq(d brspDeadline) {
+	if d.read {
+		b.readDeadline = d.t
+	}
+	if d.write {
+		b.writeDeadline = d.t
+	}
+	b.resetTimer()
+}
+
+func (b *BRSP) handleFlushReq(f brspFlush) {
+	if b.disconnected {
+		f.c <- ErrDisconnected
+		return
+	}
+	b.flushReqs = append(b.flushReqs, f)
+	b.checkFlushes()
+}
+
+func (b *BRSP) handleCloseWrite(f brspFlush) {
+	if b.writeClosed {
+		f.c <- ErrClosed
+		return
+	}
+	b.writeClosed = true
+	b.handleFlushReq(f)
+}
+
+// checkFlushes completes the pending flushes whose writes have all been
+// written. A flush waits until the loop has handled every Write called
+// before it, and then for the output up to the end of those writes.
+func (b *BRSP) checkFlushes() {
+	if len(b.flushReqs) == 0 {
+		return
+	}
+
+	start := false
+	flushes := b.flushReqs[:0]
+	for _, f := range b.flushReqs {
+		if !f.ready && f.seq <= b.writesDone {
+			f.end = b.flushEnd(f.seq)
+			f.ready = true
+		}
+		if f.ready && b.written >= f.end {
+			f.c <- b.takeWriteError(f.end)
+			continue
+		}
+		start = start || f.ready
+		flushes = append(flushes, f)
+	}
+	b.flushReqs = flushes
+
+	// Don't wait for the coalescing delay.
+	if start && !b.txMode && !b.detached && b.outQueue.queued() > 0 {
+		b.startTx()
+	}
+}
+
+// flushEnd returns the stream offset at which all data of the writes up
+// to seq, including blocked ones, has been queued.
+func (b *BRSP) flushEnd(seq uint64) uint64 {
+	end := b.enqueued
+	var blocked uint64
+	for _, w := range b.blockedWrites {
+		blocked += uint64(len(w.r.p) - w.accepted)
+		if w.r.seq <= seq {
+			end = b.enqueued + blocked
+		}
+	}
+	return end
+}
+
+// writeDone records that the loop has handled the write with sequence seq.
+func (b *BRSP) writeDone(seq uint64) {
+	if seq != b.writesDone+1 {
+		if b.writesAhead == nil {
+			b.writesAhead = make(map[uint64]bool)
+		}
+		b.writesAhead[seq] = true
+		return
+	}
+	b.writesDone = seq
+	for b.writesAhead[b.writesDone+1] {
+		delete(b.writesAhead, b.writesDone+1)
+		b.writesDone++
+	}
+	b.checkFlushes()
+}
+
+// takeWriteError returns the first write error for output before end, and
+// forgets about all of those.
+func (b *BRSP) takeWriteError(end uint64) error {
+	var err error
+	i := 0
+	for ; i < len(b.writeErrs); i++ {
+		// A keepalive covers no data, so one failing at end precedes it.
+		e := b.writeErrs[i]
+		if e.offset > end || e.offset == end && !e.keepalive {
+			break
+		}
+		if err == nil {
+			err = e.err
+		}
+	}
+	b.writeErrs = b.writeErrs[i:]
+	return err
+}
+
+func (b *BRSP) handleModeReq(m brspModeChange) {
+	if b.disconnected {
+		m.r <- ErrDisconnected
+		return
+	}
+	m.offset = b.enqueued
+	b.outModes = append(b.outModes, m)
+	if !b.txMode && !b.detached {
+		b.startTx()
+	}
+}
+
+func (b *BRSP) handleCancel(c brspCancel) {
+	if c.seq != 0 {
+		b.writeDone(c.seq)
+		return
+	}
+
+	for i, r := range b.readReqs {
+		if r.r == c.r {
+			b.readReqs = append(b.readReqs[:i], b.readReqs[i+1:]...)
+			r.r <- brspResult{err: c.err}
+			b.serveReads()
+			b.resetTimer()
+			return
+		}
+	}
+	for i, w := range b.writeReqs {
+		if w.r.r == c.r {
+			b.writeReqs = append(b.writeReqs[:i], b.writeReqs[i+1:]...)
+			b.failWrite(w, c.err)
+			b.resetTimer()
+			return
+		}
+	}
+	for i, w := range b.blockedWrites {
+		if w.r.r == c.r {
+			b.dropBlockedWrite(i, c.err)
+			b.resetTimer()
+			return
+		}
+	}
+}
+
+// dropBlockedWrite fails the blocked write at index i with err. The part
+// of it that was not accepted will never be written, so flushes that
+// were waiting for it are moved back.
+func (b *BRSP) dropBlockedWrite(i int, err error) {
+	w := b.blockedWrites[i]
+	before := b.enqueued
+	for _, v := range b.blockedWrites[:i] {
+		before += uint64(len(v.r.p) - v.accepted)
+	}
+	rest := uint64(len(w.r.p) - w.accepted)
+	for j := range b.flushReqs {
+		if f := &b.flushReqs[j]; f.ready && f.end > before {
+			f.end -= rest
+		}
+	}
+
+	b.blockedWrites = append(b.blockedWrites[:i], b.blockedWrites[i+1:]...)
+	b.failWrite(w, err)
+	b.checkFlushes()
+}
+
+func (b *BRSP) handleFlushCancel(c chan error) {
+	for i, f := range b.flushReqs {
+		if f.c == c {
+			b.flushReqs = append(b.flushReqs[:i], b.flushReqs[i+1:]...)
+			break
+		}
+	}
+}
+
+func (b *BRSP) handleIncomingData(i brspIncoming) {
+	if i.flow {
+		// The loop checks the link's flow state before each chunk.
+		return
+	}
+	if !i.mode {
+		data := i.data
+		if b.checkSeq && i.err == nil && len(data) > 0 {
+			data = b.checkSequence(data)
+		}
+		size := len(b.inQueue.data)
+		b.inQueue.write(data)
+		if len(b.inQueue.data) > size {
+			b.stats.InQueueGrowths++
+		}
+		if n := b.inQueue.queued(); n > b.stats.MaxInQueued {
+			b.stats.MaxInQueued = n
+		}
+		if i.buf != nil {
+			brspBufPool.Put(i.buf)
+		}
+		b.received += uint64(len(data))
+		if i.err == nil {
+			b.stats.BytesRead += uint64(len(data))
+			b.stats.PDUsIn++
+			b.stats.LastActivity = time.Now()
+			atomic.StoreInt64(&b.lastRead, b.stats.LastActivity.UnixNano())
+		}
+	} else if len(i.data) > 0 {
+		b.inModes = append(b.inModes, brspModeChange{
+			mode:   i.data[len(i.data)-1],
+			offset: b.received,
+		})
+		b.releaseModes()
+	}
+	if i.err != nil && i.gen == b.link.gen && !b.detached && !b.disconnected {
+		if b.resumable {
+			b.handleDetach()
+		} else {
+			b.handleDisconnect(i.err)
+		}
+	}
+
+	if len(b.readReqs) > 0 {
+		b.serveReads()
+		b.resetTimer()
+	}
+}
+
+// serveReads answers pending reads, in order, as far as the input allows.
+func (b *BRSP) serveReads() {
+	for len(b.readReqs) > 0 && b.readReady(b.readReqs[0]) {
+		r := b.readReqs[0]
+		b.readReqs = b.readReqs[1:]
+		b.serveRead(r)
+	}
+}
+
+// readReady reports whether r can be answered without waiting for input.
+func (b *BRSP) readReady(r brspRequest) bool {
+	n := b.inQueue.queued()
+	if r.min == 0 && !r.line && b.lossPending() {
+		return true
+	}
+	if r.line {
+		return b.disconnected || n >= len(r.p) || b.inQueue.index(r.delim, len(r.p)) >= 0
+	}
+	return b.disconnected || n > 0 && n >= r.min
+}
+
+// consumed returns how many bytes of input have been read.
+func (b *BRSP) consumed() uint64 {
+	return b.received - uint64(b.inQueue.queued())
+}
+
+// releaseModes makes the mode changes that all read data preceded
+// available on ModeChanges. It also forgets the data losses that reads
+// went past.
+func (b *BRSP) releaseModes() {
+	for len(b.inModes) > 0 && b.inModes[0].offset <= b.consumed() {
+		b.modeEvents = append(b.modeEvents, b.inModes[0].mode)
+		b.inModes = b.inModes[1:]
+	}
+	for len(b.inLosses) > 0 && b.inLosses[0].offset < b.consumed() {
+		b.inLosses = b.inLosses[1:]
+	}
+}
+
+// checkSequence removes the sequence number from the PDU data and records
+// a loss if it is not the one expected.
+func (b *BRSP) checkSequence(data []byte) []byte {
+	seq := data[0]
+	if b.inSeqValid && seq != b.inSeq {
+		b.inLosses = append(b.inLosses, brspLoss{
+			offset:  b.received,
+			missing: int(seq - b.inSeq),
+		})
+	}
+	b.inSeq = seq + 1
+	b.inSeqValid = true
+	return data[1:]
+}
+
+// lossPending reports whether the next input to read follows a loss.
+func (b *BRSP) lossPending() bool {
+	return len(b.inLosses) > 0 && b.inLosses[0].offset == b.consumed()
+}
+
+func (b *BRSP) handleModeEvent() {
+	b.modeEvents = b.modeEvents[1:]
+}
+
+// handleDetach leaves the current link, keeping all state so that
+// handleAttach can resume the session on a new one.
+func (b *BRSP) handleDetach() {
+	b.detached = true
+	close(b.link.gone)
+	b.stopCoalesce()
+
+	if b.txMode {
+		// The old writer may still hold the chunk it was writing, so requeue
+		// it and the rest in fresh buffers.
+		rest := make([]byte, b.outQueue.queued())
+		b.outQueue.read(rest)
+		b.outQueue.reset()
+		b.outQueue.write(b.outSpare[:b.inFlight])
+		b.outQueue.write(b.outData.data[:b.outData.n])
+		b.outQueue.write(rest)
+		if b.outData.mode != nil {
+			b.outModes = append([]brspModeChange{*b.outData.mode}, b.outModes...)
+		}
+
+		b.outData = brspOutgoing{data: make([]byte, b.batchSize)}
+		b.outSpare = make([]byte, b.batchSize)
+		b.inFlight = 0
+		b.txMode = false
+	}
+}
+
+func (b *BRSP) handleAttach(l *brspLink) {
+	if b.disconnected {
+		// Lost the race with a disconnect while resubscribing.
+		close(l.gone)
+		go l.unsubscribe()
+		return
+	}
+	if !b.detached {
+		b.handleDetach()
+	}
+
+	b.mu.Lock()
+	b.link = l
+	b.mu.Unlock()
+	b.detached = false
+	b.inSeqValid = false
+
+	b.outgoingData = make(chan brspOutgoing)
+	b.writeErrors = make(chan brspWriteError)
+	go b.writer(l, b.outgoingData, b.writeErrors)
+
+	if b.outPending() {
+		b.startTx()
+	}
+}
+
+// handleDisconnect moves the session into its disconnected state: queued
+// outgoing data is dropped, pending writes and flushes fail with
+// ErrDisconnected and reads return io.EOF, or ErrSubscriptionLost or
+// ErrIdle if that was the cause, once the input is drained.
+func (b *BRSP) handleDisconnect(err error) {
+	b.disconnected = true
+	b.inErr = io.EOF
+	if err == ErrSubscriptionLost || err == ErrIdle {
+		b.inErr = err
+	}
+
+	for _, f := range b.flushReqs {
+		f.c <- ErrDisconnected
+	}
+	b.flushReqs = nil
+	b.failWrites(ErrDisconnected)
+	b.failModes(ErrDisconnected)
+
+	b.stopCoalesce()
+	b.txMode = false
+	b.outQueue.reset()
+	b.outData.n = 0
+	b.inFlight = 0
+	b.written = b.enqueued
+}
+
+func (b *BRSP) handleOutgoingData() {
+	// The writer accepting a chunk means it is done with the previous one.
+	b.written += uint64(b.inFlight)
+	b.inFlight = b.outData.n
+	if b.outData.n > 0 {
+		b.stats.BytesWritten += uint64(b.outData.n)
+		b.stats.PDUsOut += uint64((b.outData.n + b.chunkSize - 1) / b.chunkSize)
+		b.stats.LastActivity = time.Now()
+		atomic.StoreInt64(&b.lastWrite, b.stats.LastActivity.UnixNano())
+	}
+	b.completeWrites()
+	b.acceptWrites()
+	b.checkFlushes()
+
+	// The writer owns the chunk just sent until it accepts the next one, so
+	// alternate between two buffers.
+	b.outData.data, b.outSpare = b.outSpare, b.outData.data
+
+	// Once the queue is drained an empty chunk is sent, and the writer
+	// accepting that means it is done with the last one.
+	idle := b.outData.n == 0 && b.outData.mode == nil
+	if !b.nextChunk() && idle {
+		b.txMode = false
+	}
+}
+
+func (b *BRSP) handleReadReq(r brspRequest) {
+	if len(b.readReqs) > 0 {
+		// Wait behind an earlier read that needs more input.
+		b.readReqs = append(b.readReqs, r)
+		b.resetTimer()
+		return
+	}
+	b.serveRead(r)
+}
+
+// serveRead answers r if it is ready or expired, and queues it otherwise.
+func (b *BRSP) serveRead(r brspRequest) {
+	if r.line {
+		b.serveLine(r)
+		return
+	}
+
+	if r.min == 0 && b.lossPending() {
+		loss := b.inLosses[0]
+		if !r.peek {
+			b.inLosses = b.inLosses[1:]
+		}
+		r.r <- brspResult{
+			err: &BRSPDataLossError{Missing: loss.missing},
+		}
+		return
+	}
+
+	if b.inQueue.queued() > 0 && b.inQueue.queued() >= r.min {
+		n := len(r.p)
+		if r.discard > 0 {
+			n = r.discard
+		}
+		if len(b.inModes) > 0 && r.min == 0 {
+			// Stop at the next mode change.
+			if l := b.inModes[0].offset - b.consumed(); l < uint64(n) {
+				n = int(l)
+			}
+		}
+		if len(b.inLosses) > 0 && r.min == 0 {
+			// Stop at the next loss.
+			if l := b.inLosses[0].offset - b.consumed(); l < uint64(n) {
+				n = int(l)
+			}
+		}
+		if r.discard > 0 {
+			n = b.inQueue.discard(n)
+		} else if r.peek {
+			n = b.inQueue.peek(r.p[:n])
+		} else {
+			n = b.inQueue.read(r.p[:n])
+		}
+		b.releaseModes()
+		r.r <- brspResult{
+			n: n,
+		}
+	} else if b.disconnected {
+		// Only a ReadAtLeast can find input here, less than it needs.
+		n := b.inQueue.read(r.p)
+		b.releaseModes()
+		err := b.inErr
+		if n > 0 && err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		r.r <- brspResult{
+			n:   n,
+			err: err,
+		}
+	} else if expired(earliest(b.readDeadline, r.expires), time.Now()) {
+		r.r <- brspResult{
+			err: ErrTimeout,
+		}
+	} else {
+		b.readReqs = append(b.readReqs, r)
+		b.resetTimer()
+	}
+}
+
+// serveLine is serveRead for ReadLine.
+func (b *BRSP) serveLine(r brspRequest) {
+	if i := b.inQueue.index(r.delim, len(r.p)); i >= 0 {
+		n := b.inQueue.read(r.p[:i+1])
+		b.releaseModes()
+		r.r <- brspResult{
+			n: n,
+		}
+	} else if b.inQueue.queued() >= len(r.p) {
+		r.r <- brspResult{
+			err: ErrFrameTooLarge,
+		}
+	} else if b.disconnected {
+		n := b.inQueue.read(r.p)
+		b.releaseModes()
+		err := b.inErr
+		if n > 0 && err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		r.r <- brspResult{
+			n:   n,
+			err: err,
+		}
+	} else if expired(earliest(b.readDeadline, r.expires), time.Now()) {
+		r.r <- brspResult{
+			err: ErrTimeout,
+		}
+	} else {
+		b.readReqs = append(b.readReqs, r)
+		b.resetTimer()
+	}
+}
+
+func (b *BRSP) handleTimeout() {
+	b.timeout = nil
+	now := time.Now()
+
+	reads := b.readReqs[:0]
+	for _, r := range b.readReqs {
+		if expired(earliest(b.readDeadline, r.expires), now) {
+			r.r <- brspResult{
+				err: ErrTimeout,
+			}
+		} else {
+			reads = append(reads, r)
+		}
+	}
+	b.readReqs = reads
+	// An expired ReadAtLeast may have held back reads that can go ahead.
+	b.serveReads()
+
+	b.writeReqs = b.expireWrites(b.writeReqs, now)
+	for i := 0; i < len(b.blockedWrites); {
+		if expired(earliest(b.writeDeadline, b.blockedWrites[i].r.expires), now) {
+			b.dropBlockedWrite(i, ErrTimeout)
+		} else {
+			i++
+		}
+	}
+	b.resetTimer()
+}
+
+// expireWrites fails the writes in ws whose deadline has passed with
+// ErrTimeout and returns the others.
+func (b *BRSP) expireWrites(ws []brspPendingWrite, now time.Time) []brspPendingWrite {
+	keep := ws[:0]
+	for _, w := range ws {
+		if expired(earliest(b.writeDeadline, w.r.expires), now) {
+			b.failWrite(w, ErrTimeout)
+		} else {
+			keep = append(keep, w)
+		}
+	}
+	return keep
+}
+
+func (b *BRSP) handleWriteError(e brspWriteError) {
+	// The writer reports an error before it takes the next chunk, so the
+	// batch holding the failed one is still in flight.
+	e.offset = b.written
+	b.writeErrs = append(b.writeErrs, e)
+	b.stats.WriteErrors++
+}
+
+// handleWriteReq copies the request into outData and outQueue before
+// replying; Write relies on this to let callers reuse their buffer.
+func (b *BRSP) handleWriteReq(r brspRequest) {
+	defer b.writeDone(r.seq)
+
+	if b.writeClosed {
+		r.r <- brspResult{
+			err: ErrClosed,
+		}
+		return
+	}
+	if expired(earliest(b.writeDeadline, r.expires), time.Now()) {
+		r.r <- brspResult{
+			err: ErrTimeout,
+		}
+		return
+	}
+	if len(b.writeErrs) > 0 {
+		r.r <- brspResult{
+			err: b.takeWriteError(b.enqueued),
+		}
+		return
+	}
+	if b.disconnected {
+		r.r <- brspResult{
+			err: ErrDisconnected,
+		}
+		return
+	}
+	if r.some {
+		b.acceptSome(r)
+		return
+	}
+	full := b.maxWrite > 0 && (len(b.blockedWrites) > 0 || b.writeSpace() < len(r.p))
+	if full && !b.blockWhenFull {
+		b.stats.WritesRejected++
+		b.stats.BytesRejected += uint64(len(r.p))
+		r.r <- brspResult{
+			err: ErrWriteBufferFull,
+		}
+		return
+	}
+	if full {
+		b.stats.WritesBlocked++
+	}
+
+	b.blockedWrites = append(b.blockedWrites, brspPendingWrite{
+		r:     r,
+		start: b.enqueued,
+	})
+	b.acceptWrites()
+	b.resetTimer()
+}
+
+// acceptSome queues the prefix of a WriteSome that fits in the write
+// buffer and answers it at once. Nothing fits while earlier writes are
+// blocked, as those come first.
+func (b *BRSP) acceptSome(r brspRequest) {
+	n := 0
+	if len(b.blockedWrites) == 0 {
+		n = len(r.p)
+		if space := b.writeSpace(); n > space {
+			n = space
+		}
+		b.enqueue(r.p[:n])
+	}
+
+	res := brspResult{n: n}
+	if n < len(r.p) {
+		b.stats.WritesRejected++
+		b.stats.BytesRejected += uint64(len(r.p) - n)
+		res.err = ErrWriteBufferFull
+	}
+	r.r <- res
+}
+
+// acceptWrites moves as much of the blocked writes into the outgoing queue
+// as the write buffer limit allows, in order, and answers the writes that
+// were queued completely.
+func (b *BRSP) acceptWrites() {
+	n := len(b.blockedWrites)
+	for len(b.blockedWrites) > 0 {
+		w := &b.blockedWrites[0]
+		p := w.r.p[w.accepted:]
+		if space := b.writeSpace(); len(p) > space {
+			p = p[:space]
+		}
+		if w.accepted == 0 {
+			w.start = b.enqueued
+		}
+		if len(p) > 0 || len(w.r.p) == 0 {
+			b.enqueue(p)
+			w.accepted += len(p)
+		}
+		if w.accepted < len(w.r.p) {
+			break
+		}
+
+		w.end = b.enqueued
+		if b.syncWrite && len(w.r.p) > 0 {
+			b.writeReqs = append(b.writeReqs, *w)
+		} else {
+			w.r.r <- brspResult{
+				n: len(w.r.p),
+			}
+		}
+		b.blockedWrites = b.blockedWrites[1:]
+	}
+	if len(b.blockedWrites) != n {
+		b.resetTimer()
+	}
 }
 
-func (b *BRSP) Close() error {
-	close(b.closed)
+// enqueue appends p to the outgoing data, starting a transmission if none
+// is in progress.
+func (b *BRSP) enqueue(p []byte) {
+	b.enqueued += uint64(len(p))
+	size := len(b.outQueue.data)
+	b.outQueue.write(p)
+	if len(b.outQueue.data) > size {
+		b.stats.OutQueueGrowths++
+	}
+	if n := b.outQueue.queued(); n > b.stats.MaxOutQueued {
+		b.stats.MaxOutQueued = n
+	}
+	if b.txMode || b.detached {
+		return
+	}
 
-	return nil
+	if b.coalesceDelay <= 0 || b.outQueue.queued() >= b.chunkSize {
+		b.startTx()
+	} else if b.coalesce == nil {
+		b.coalesceTimer = time.NewTimer(b.coalesceDelay)
+		b.coalesce = b.coalesceTimer.C
+	}
 }
 
-func (b *BRSP) Flush() error {
-	c := make(chan error)
-	b.flushReq <- c
-	err := <-c
-
-	return err
+// startTx moves the first chunk of outQueue to outData, so that the loop
+// starts handing chunks to the writer.
+func (b *BRSP) startTx() {
+	b.stopCoalesce()
+	b.nextChunk()
+	b.txMode = true
 }
 
-func (b *BRSP) Read(p []byte) (int, error) {
-	req := brspRequest{
-		p: p,
-		r: make(chan brspResult),
+// nextChunk fills outData with the next chunk for the writer: queued data
+// up to the batch size or the next mode change, or the mode change itself.
+// It returns false if there is nothing left to send.
+func (b *BRSP) nextChunk() bool {
+	b.outData.mode = nil
+	b.outData.keepalive = false
+	p := b.outData.data
+	if len(b.outModes) > 0 {
+		sent := b.enqueued - uint64(b.outQueue.queued())
+		if b.outModes[0].offset == sent {
+			m := b.outModes[0]
+			b.outData.n = 0
+			b.outData.mode = &m
+			b.outModes = b.outModes[1:]
+			return true
+		}
+		if l := b.outModes[0].offset - sent; l < uint64(len(p)) {
+			p = p[:l]
+		}
 	}
-	b.readReq <- req
-	res := <-req.r
-
-	return res.n, res.err
+	b.outData.n = b.outQueue.read(p)
+	return b.outData.n > 0
 }
 
-func (b *BRSP) Write(p []byte) (int, error) {
-	b.writeReq <- p
-
-	return len(p), nil
+// handleKeepalive sends a keepalive if nothing was exchanged with the
+// peripheral for the keepalive interval, and rearms the timer for when
+// that may next be the case.
+func (b *BRSP) handleKeepalive() {
+	interval := b.keepaliveOpts.Interval
+	last := b.stats.LastActivity
+	if b.lastKeepalive.After(last) {
+		last = b.lastKeepalive
+	}
+	now := time.Now()
+	if wait := last.Add(interval).Sub(now); wait > 0 {
+		b.keepTimer.Reset(wait)
+		return
+	}
+	if b.disconnected {
+		return
+	}
+	if !b.txMode && !b.detached && !b.outPending() {
+		b.outData.n = 0
+		b.outData.mode = nil
+		b.outData.keepalive = true
+		b.txMode = true
+	}
+	b.lastKeepalive = now
+	b.keepTimer.Reset(interval)
 }
 
-func (b *BRSP) discover() error {
-	svcs, err := b.p.DiscoverServices([]UUID{brspService})
-	if err != nil {
-		return err
+// handleIdle shuts the session down if nothing was exchanged with the
+// peripheral for the idle timeout, and otherwise rearms the timer for when
+// that may next be the case.
+func (b *BRSP) handleIdle() {
+	last := b.stats.LastActivity
+	if b.idleSince.After(last) {
+		last = b.idleSince
 	}
-
-	for _, s := range svcs {
-		if s.UUID().Equal(brspService) {
-			b.brspService = s
-			break
-		}
+	if wait := last.Add(b.timeouts.IdleTimeout).Sub(time.Now()); wait > 0 {
+		b.idleTimer.Reset(wait)
+		return
 	}
-	if b.brspService == nil {
-		return ErrNotBRSP
+	if !b.disconnected {
+		b.handleDisconnect(ErrIdle)
+		b.serveReads()
 	}
+}
 
-	chars, err := b.p.DiscoverCharacteristics([]UUID{brspMode, brspRx, brspTx}, b.brspService)
-	if err != nil {
-		return err
+func (b *BRSP) stopCoalesce() {
+	if b.coalesceTimer != nil {
+		b.coalesceTimer.Stop()
+		b.coalesceTimer = nil
+		b.coalesce = nil
 	}
+}
 
-	for _, c := range chars {
-		u := c.UUID()
-		if u.Equal(brspMode) {
-			b.brspMode = c
-		} else if u.Equal(brspRx) {
-			b.brspRx = c
-		} else if u.Equal(brspTx) {
-			b.brspTx = c
-		}
+func (b *BRSP) handleCoalesce() {
+	b.coalesceTimer = nil
+	b.coalesce = nil
+	if !b.txMode && !b.detached && b.outQueue.queued() > 0 {
+		b.startTx()
 	}
-	if b.brspMode == nil || b.brspRx == nil || b.brspTx == nil {
-		return ErrNotBRSP
+}
+
+// writeSpace returns how many more bytes may be queued for writing.
+func (b *BRSP) writeSpace() int {
+	if b.maxWrite <= 0 {
+		return int(^uint(0) >> 1)
+	}
+	if n := b.maxWrite - int(b.enqueued-b.written); n > 0 {
+		return n
 	}
+	return 0
+}
 
-	if _, err := b.p.DiscoverDescriptors(nil, b.brspTx); err != nil {
-		return err
+// failWrites answers all writes that are blocked or waiting to be written
+// with err, reporting how much of each was accepted or written.
+func (b *BRSP) failWrites(err error) {
+	for _, w := range b.writeReqs {
+		b.failWrite(w, err)
 	}
+	b.writeReqs = nil
 
-	return nil
+	for _, w := range b.blockedWrites {
+		b.failWrite(w, err)
+	}
+	b.blockedWrites = nil
 }
 
-func (b *BRSP) handleFlushReq(c chan error) {
-	if b.txMode {
-		b.flushReqs = append(b.flushReqs, c)
-	} else {
-		c <- b.writeError
-		b.writeError = nil
+func (b *BRSP) failWrite(w brspPendingWrite, err error) {
+	n := w.accepted
+	if b.syncWrite {
+		n = w.done(b.written)
+	}
+	w.r.r <- brspResult{
+		n:   n,
+		err: err,
 	}
 }
 
-func (b *BRSP) handleIncomingData(i brspIncoming) {
-	if len(b.readReqs) > 0 {
-		rr := b.readReqs[0]
-		copy(b.readReqs, b.readReqs[1:])
-		b.readReqs = b.readReqs[:len(b.readReqs)-1]
-		n := copy(rr.p, i.data[:i.n])
-		if i.n > n {
-			b.inQueue.write(i.data[n:i.n])
-		}
-		rr.r <- brspResult{
-			n:   n,
-			err: i.err,
-		}
-	} else {
-		b.inQueue.write(i.data[:i.n])
-		if i.err != nil {
-			b.readError = i.err
+// completeWrites answers the pending synchronous writes whose bytes have
+// all been written, reporting the write error, if any.
+func (b *BRSP) completeWrites() {
+	i := 0
+	for ; i < len(b.writeReqs) && b.writeReqs[i].end <= b.written; i++ {
+		w := b.writeReqs[i]
+		w.r.r <- brspResult{
+			n:   len(w.r.p),
+			err: b.takeWriteError(w.end),
 		}
 	}
+	if i > 0 {
+		b.writeReqs = b.writeReqs[i:]
+		b.resetTimer()
+	}
 }
 
-func (b *BRSP) handleOutgoingData() {
-	n := b.outQueue.read(b.outData.data[:])
-	if n > 0 {
-		b.outData.n = n
-	} else if b.outData.n > 0 {
-		b.outData.n = 0
-	} else {
-		b.txMode = false
-		for _, c := range b.flushReqs {
-			c <- b.writeError
-		}
-		b.writeError = nil
+// failModes fails the SetMode calls whose change has not been written.
+func (b *BRSP) failModes(err error) {
+	if b.outData.mode != nil {
+		b.outData.mode.r <- err
+		b.outData.mode = nil
 	}
+	for _, m := range b.outModes {
+		m.r <- err
+	}
+	b.outModes = nil
 }
 
-func (b *BRSP) handleReadReq(r brspRequest) {
-	if b.inQueue.queued() > 0 {
-		n := b.inQueue.read(r.p)
-		r.r <- brspResult{
-			n:   n,
-			err: b.readError,
-		}
-		b.readError = nil
-	} else {
-		b.readReqs = append(b.readReqs, r)
-	}
+// outPending tells whether there is output left to hand to the writer.
+func (b *BRSP) outPending() bool {
+	return b.outQueue.queued() > 0 || len(b.outModes) > 0
 }
 
-func (b *BRSP) handleWriteError(e error) {
-	b.writeError = e
+// setTxValue subscribes f to the TX characteristic, or unsubscribes if f
+// is nil, with notifications or indications as chosen for the link.
+func (l *brspLink) setTxValue(f func(*Characteristic, []byte, error)) error {
+	if l.notify {
+		return l.p.SetNotifyValue(l.tx, f)
+	}
+	return l.p.SetIndicateValue(l.tx, f)
 }
 
-func (b *BRSP) handleWriteReq(p []byte) {
-	if !b.txMode {
-		l := len(p)
-		if l > 20 {
-			l = 20
-		}
-		copy(b.outData.data[:], p)
-		b.outData.n = l
-		b.txMode = true
-		p = p[l:]
+// setModeValue subscribes f to the mode characteristic, preferring
+// indications, or unsubscribes if f is nil.
+func (l *brspLink) setModeValue(f func(*Characteristic, []byte, error)) error {
+	if l.mode.Properties()&CharIndicate == 0 {
+		return l.p.SetNotifyValue(l.mode, f)
 	}
+	return l.p.SetIndicateValue(l.mode, f)
+}
 
-	b.outQueue.write(p)
+// unsubscribe removes the subscriptions made by init.
+func (l *brspLink) unsubscribe() {
+	l.setTxValue(nil)
+	if l.mode.Properties()&(CharNotify|CharIndicate) != 0 {
+		l.setModeValue(nil)
+	}
+	if l.flow != nil {
+		l.setFlowValue(nil)
+	}
+	if l.stopChanged != nil {
+		l.stopChanged()
+	}
 }
 
-func (b *BRSP) init() error {
-	if err := b.discover(); err != nil {
+// init discovers the BRSP characteristics, subscribes to BRSPTxUUID and sets
+// the mode. It gives up between steps once ctx is done, and removes the
+// BRSPTxUUID subscription again if it fails after setting it.
+func (b *BRSP) init(ctx context.Context, l *brspLink) (err error) {
+	if err := l.discover(ctx, b.profile); err != nil {
+		return err
+	}
+	if err := ctx.Err(); err != nil {
 		return err
 	}
 
-	if err := b.p.SetIndicateValue(b.brspTx, nil); err != nil {
+	props := l.tx.Properties()
+	if props&CharIndicate == 0 {
+		l.notify = true
+	} else if props&CharNotify == 0 {
+		l.notify = false
+	}
+
+	if err := l.setTxValue(nil); err != nil {
 		return err
 	}
 
 	onTx := func(c *Characteristic, data []byte, err error) {
-		fmt.Printf("brspTx %v: % x\n", err, data)
-		bi := brspIncoming{err: err}
-		bi.n = copy(bi.data[:], data)
-		b.incomingData <- bi
+		b.logPDU(BRSPIn, data, err)
+		buf := brspBufPool.Get().(*[]byte)
+		*buf = append((*buf)[:0], data...)
+		bi := brspIncoming{
+			data: *buf,
+			buf:  buf,
+			err:  err,
+			gen:  l.gen,
+		}
+		select {
+		case b.incomingData <- bi:
+		case <-b.closed:
+			brspBufPool.Put(buf)
+		}
 	}
 
-	if err := b.p.SetIndicateValue(b.brspTx, onTx); err != nil {
+	if err := l.setTxValue(onTx); err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			l.setTxValue(nil)
+		}
+	}()
+	if err := ctx.Err(); err != nil {
 		return err
 	}
 
-	if err := b.p.WriteCharacteristic(b.brspMode, []byte{1}, true); err != nil {
+	if l.mode.Properties()&(CharNotify|CharIndicate) != 0 {
+		onMode := func(c *Characteristic, data []byte, err error) {
+			bi := brspIncoming{
+				data: append([]byte(nil), data...),
+				err:  err,
+				gen:  l.gen,
+				mode: true,
+			}
+			select {
+			case b.incomingData <- bi:
+			case <-b.closed:
+			}
+		}
+		if err := l.setModeValue(onMode); err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				l.setModeValue(nil)
+			}
+		}()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+
+	if l.flow != nil {
+		onFlow := func(c *Characteristic, data []byte, err error) {
+			if err != nil {
+				return
+			}
+			l.setFlow(data)
+			// Wake up the loop to look at the new state.
+			select {
+			case b.incomingData <- brspIncoming{flow: true, gen: l.gen}:
+			case <-b.closed:
+			}
+		}
+		if err := l.setFlowValue(onFlow); err != nil {
+			return err
+		}
+		defer func() {
+			if err != nil {
+				l.setFlowValue(nil)
+			}
+		}()
+		// Read the state in case it was busy already, unless a change was
+		// reported in the meantime.
+		if v, err := l.p.ReadCharacteristic(l.flow); err == nil {
+			atomic.CompareAndSwapInt32(&l.flowState, brspFlowUnknown, brspFlowState(v))
+		}
+	}
+
+	l.stopChanged = l.p.OnServicesChanged(func(start, end uint16) {
+		go b.resubscribe(l)
+	})
+	defer func() {
+		if err != nil {
+			l.stopChanged()
+		}
+	}()
+
+	if err := l.p.WriteCharacteristic(l.mode, []byte{b.profile.modeValue}, true); err != nil {
 		return err
 	}
 
-	return nil
+	return ctx.Err()
 }
 
 func (b *BRSP) loop() {
+	if b.keepaliveOpts.Interval > 0 {
+		b.lastKeepalive = time.Now()
+		b.keepTimer = time.NewTimer(b.keepaliveOpts.Interval)
+		b.keepalive = b.keepTimer.C
+	}
+	if b.timeouts.IdleTimeout > 0 {
+		b.idleSince = time.Now()
+		b.idleTimer = time.NewTimer(b.timeouts.IdleTimeout)
+		b.idle = b.idleTimer.C
+	}
+
+	defer close(b.loopDone)
 	defer func() {
-		for _, c := range b.flushReqs {
-			c <- ErrClosed
+		if b.timer != nil {
+			b.timer.Stop()
+		}
+		if b.keepTimer != nil {
+			b.keepTimer.Stop()
+		}
+		if b.idleTimer != nil {
+			b.idleTimer.Stop()
+		}
+		b.stopCoalesce()
+
+		for _, f := range b.flushReqs {
+			f.c <- ErrClosed
 		}
 
 		for _, r := range b.readReqs {
@@ -227,9 +2325,30 @@ func (b *BRSP) loop() {
 				err: ErrClosed,
 			}
 		}
+
+		b.failWrites(ErrClosed)
+		b.failModes(ErrClosed)
+
+		// A Service Changed indication must not set up the closed
+		// session again.
+		if b.link.stopChanged != nil {
+			b.link.stopChanged()
+		}
 	}()
 
 	for {
+		var modeChanges chan byte
+		var mode byte
+		if len(b.modeEvents) > 0 {
+			modeChanges = b.modeChanges
+			mode = b.modeEvents[0]
+		}
+
+		out := b.outgoingData
+		if b.link.flowBusy() {
+			out = nil
+		}
+
 		if b.txMode {
 			select {
 			case r := <-b.readReq:
@@ -238,12 +2357,40 @@ func (b *BRSP) loop() {
 				b.handleWriteReq(w)
 			case f := <-b.flushReq:
 				b.handleFlushReq(f)
+			case f := <-b.flushCancel:
+				b.handleFlushCancel(f)
+			case c := <-b.cancelReq:
+				b.handleCancel(c)
+			case c := <-b.closeWriteReq:
+				b.handleCloseWrite(c)
+			case l := <-b.attachReq:
+				b.handleAttach(l)
+			case m := <-b.modeReq:
+				b.handleModeReq(m)
+			case modeChanges <- mode:
+				b.handleModeEvent()
 			case d := <-b.incomingData:
 				b.handleIncomingData(d)
-			case b.outgoingData <- b.outData:
+			case out <- b.outData:
 				b.handleOutgoingData()
 			case e := <-b.writeErrors:
 				b.handleWriteError(e)
+			case d := <-b.deadlineReq:
+				b.handleDeadlineReq(d)
+			case c := <-b.countReq:
+				b.handleCountReq(c)
+			case c := <-b.drainReq:
+				b.handleDrainReq(c)
+			case c := <-b.statsReq:
+				b.handleStatsReq(c)
+			case <-b.timeout:
+				b.handleTimeout()
+			case <-b.coalesce:
+				b.handleCoalesce()
+			case <-b.keepalive:
+				b.handleKeepalive()
+			case <-b.idle:
+				b.handleIdle()
 			case <-b.closed:
 				return
 			}
@@ -255,10 +2402,38 @@ func (b *BRSP) loop() {
 				b.handleWriteReq(w)
 			case f := <-b.flushReq:
 				b.handleFlushReq(f)
+			case f := <-b.flushCancel:
+				b.handleFlushCancel(f)
+			case c := <-b.cancelReq:
+				b.handleCancel(c)
+			case c := <-b.closeWriteReq:
+				b.handleCloseWrite(c)
+			case l := <-b.attachReq:
+				b.handleAttach(l)
+			case m := <-b.modeReq:
+				b.handleModeReq(m)
+			case modeChanges <- mode:
+				b.handleModeEvent()
 			case d := <-b.incomingData:
 				b.handleIncomingData(d)
 			case e := <-b.writeErrors:
 				b.handleWriteError(e)
+			case d := <-b.deadlineReq:
+				b.handleDeadlineReq(d)
+			case c := <-b.countReq:
+				b.handleCountReq(c)
+			case c := <-b.drainReq:
+				b.handleDrainReq(c)
+			case c := <-b.statsReq:
+				b.handleStatsReq(c)
+			case <-b.timeout:
+				b.handleTimeout()
+			case <-b.coalesce:
+				b.handleCoalesce()
+			case <-b.keepalive:
+				b.handleKeepalive()
+			case <-b.idle:
+				b.handleIdle()
 			case <-b.closed:
 				return
 			}
@@ -266,53 +2441,379 @@ func (b *BRSP) loop() {
 	}
 }
 
-func (b *BRSP) writer() {
+// resetTimer arms the loop timer for the earliest deadline that a pending
+// Read or Write is waiting on, and disarms it if there is none.
+func (b *BRSP) resetTimer() {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+		b.timeout = nil
+	}
+
+	var d time.Time
+	for _, r := range b.readReqs {
+		d = earliest(d, earliest(b.readDeadline, r.expires))
+	}
+	for _, w := range b.writeReqs {
+		d = earliest(d, earliest(b.writeDeadline, w.r.expires))
+	}
+	for _, w := range b.blockedWrites {
+		d = earliest(d, earliest(b.writeDeadline, w.r.expires))
+	}
+	if d.IsZero() {
+		return
+	}
+
+	b.timer = time.NewTimer(d.Sub(time.Now()))
+	b.timeout = b.timer.C
+}
+
+func (b *BRSP) writer(l *brspLink, out <-chan brspOutgoing, errs chan<- brspWriteError) {
+	// report hands a failed write to the loop. It returns false if the
+	// writer should stop instead.
+	report := func(e brspWriteError) bool {
+		select {
+		case errs <- e:
+			return true
+		case <-l.gone:
+		case <-b.closed:
+		}
+		return false
+	}
+
+	// Sequence numbered PDUs, for the SendSequence option.
+	var seq byte
+	var pdu []byte
+	if b.sendSeq {
+		pdu = make([]byte, 0, b.chunkSize+1)
+	}
+
 	for {
 		select {
-		case d := <-b.outgoingData:
-			if d.n > 0 {
-				fmt.Printf("brspRx % x (%s)\n", d.data[:d.n], string(d.data[:d.n]))
-				if err := b.p.WriteCharacteristic(b.brspRx, d.data[:d.n], true); err != nil {
-					b.writeErrors <- err
+		case d := <-out:
+			if d.mode != nil {
+				err := l.p.WriteCharacteristic(l.mode, []byte{d.mode.mode}, true)
+				d.mode.r <- err
+			} else if d.keepalive {
+				err := b.writeKeepalive(l)
+				if err != nil && !report(brspWriteError{err: err, keepalive: true}) {
+					return
+				}
+			} else {
+				for p := d.data[:d.n]; len(p) > 0; {
+					n := len(p)
+					if n > b.chunkSize {
+						n = b.chunkSize
+					}
+					chunk := p[:n]
+					if b.sendSeq {
+						pdu = append(append(pdu[:0], seq), chunk...)
+						chunk = pdu
+						seq++
+					}
+					if err := b.writeChunk(l, chunk); err != nil && !report(brspWriteError{err: err}) {
+						return
+					}
+					p = p[n:]
 				}
 			}
+		case <-l.gone:
+			return
 		case <-b.closed:
 			return
 		}
 	}
 }
 
+// writeKeepalive sends a keepalive as configured by the Keepalive option.
+func (b *BRSP) writeKeepalive(l *brspLink) error {
+	if b.keepaliveOpts.ReadMode {
+		_, err := l.p.ReadCharacteristic(l.mode)
+		return err
+	}
+	return b.writeChunk(l, b.keepaliveOpts.Payload)
+}
+
+// logPDU passes a PDU to the logger and tap, if any.
+func (b *BRSP) logPDU(dir BRSPDirection, data []byte, err error) {
+	if l, ok := b.logger.(BRSPNamedLogger); ok {
+		l.LogNamedPDU(b.name, dir, data, err)
+	} else if b.logger != nil {
+		b.logger.LogPDU(dir, data, err)
+	}
+	if t, _ := b.tap.Load().(brspTap); t.f != nil {
+		t.f(dir, data, err)
+	}
+}
+
+// writeChunk writes p to the RX characteristic, retrying as allowed by
+// the retry policy. It returns the error of the last attempt, giving up
+// early if the link goes away or the session is closed during a backoff.
+func (b *BRSP) writeChunk(l *brspLink, p []byte) error {
+	delay := b.retry.Backoff
+	for attempt := 1; ; attempt++ {
+		err := l.p.WriteCharacteristic(l.rx, p, !b.writeRsp)
+		b.logPDU(BRSPOut, p, err)
+		if err == nil || attempt >= b.retry.MaxAttempts {
+			return err
+		}
+
+		if delay > 0 {
+			t := time.NewTimer(delay)
+			select {
+			case <-t.C:
+			case <-l.gone:
+				t.Stop()
+				return err
+			case <-b.closed:
+				t.Stop()
+				return err
+			}
+			delay *= 2
+		}
+		atomic.AddUint64(&b.retries, 1)
+	}
+}
+
 func OpenBRSP(p Peripheral) (*BRSP, error) {
+	return openBRSP(context.Background(), p, BRSPOptions{})
+}
+
+// OpenBRSPWithOptions opens a BRSP session on p configured by o.
+func OpenBRSPWithOptions(p Peripheral, o BRSPOptions) (*BRSP, error) {
+	return openBRSP(context.Background(), p, o)
+}
+
+// OpenBRSPContext opens a BRSP session on p like OpenBRSP, but gives up and
+// returns ctx.Err() if ctx is done before discovery and setup complete.
+// A subscription already set on the TX characteristic is removed when the
+// abandoned setup finishes.
+func OpenBRSPContext(ctx context.Context, p Peripheral) (*BRSP, error) {
+	return openBRSP(ctx, p, BRSPOptions{})
+}
+
+func openBRSP(ctx context.Context, p Peripheral, o BRSPOptions) (*BRSP, error) {
+	mtu := int(o.MTU)
+	if mtu == 0 {
+		mtu = int(p.MTU())
+	}
+	if mtu < brspDefaultMTU {
+		mtu = brspDefaultMTU
+	}
+	chunkSize := mtu - 3
+	if o.MaxChunkSize != 0 {
+		if o.MaxChunkSize < 1 || o.MaxChunkSize > chunkSize {
+			return nil, fmt.Errorf("BRSP MaxChunkSize %d out of range 1..%d", o.MaxChunkSize, chunkSize)
+		}
+		chunkSize = o.MaxChunkSize
+	}
+	if o.SendSequence {
+		if chunkSize < 2 {
+			return nil, fmt.Errorf("BRSP chunk size %d leaves no room for data after the sequence number", chunkSize)
+		}
+		chunkSize--
+	}
+
+	l := &brspLink{
+		p:      p,
+		notify: o.Notify,
+		gone:   make(chan struct{}),
+	}
 	b := &BRSP{
-		p:            p,
-		readReq:      make(chan brspRequest),
-		writeReq:     make(chan []byte),
-		flushReq:     make(chan chan error),
-		incomingData: make(chan brspIncoming),
-		outgoingData: make(chan brspOutgoing),
-		writeErrors:  make(chan error),
-		closed:       make(chan struct{}),
+		profile:       newBRSPProfile(o),
+		link:          l,
+		attachReq:     make(chan *brspLink),
+		readReq:       make(chan brspRequest),
+		writeReq:      make(chan brspRequest),
+		flushReq:      make(chan brspFlush),
+		flushCancel:   make(chan chan error),
+		cancelReq:     make(chan brspCancel),
+		closeWriteReq: make(chan brspFlush),
+		modeReq:       make(chan brspModeChange),
+		modeChanges:   make(chan byte),
+		deadlineReq:   make(chan brspDeadline),
+		countReq:      make(chan chan brspCounts),
+		drainReq:      make(chan chan int),
+		statsReq:      make(chan brspStatsReq),
+		loopDone:      make(chan struct{}),
+		incomingData:  make(chan brspIncoming),
+		outgoingData:  make(chan brspOutgoing),
+		writeErrors:   make(chan brspWriteError),
+		closed:        make(chan struct{}),
+		chunkSize:     chunkSize,
+		batchSize:     chunkSize,
+		syncWrite:     o.SyncWrite,
+		writeRsp:      o.WriteWithResponse,
+		coalesceDelay: o.CoalesceDelay,
+		notify:        o.Notify,
+		resumable:     o.Resumable,
+		closeMode:     o.CloseWriteMode,
+		checkSeq:      o.CheckSequence,
+		sendSeq:       o.SendSequence,
+		maxWrite:      o.MaxWriteBuffer,
+		blockWhenFull: o.BlockWhenFull,
+		logger:        o.Logger,
+		name:          o.Name,
+		timeouts:      o.Timeouts,
+		onResubscribe: o.OnResubscribe,
+		retry:         o.Retry,
+		keepaliveOpts: o.Keepalive,
+	}
+	if o.WriteBatch > 1 {
+		b.batchSize *= o.WriteBatch
 	}
+	b.outData.data = make([]byte, b.batchSize)
+	b.outSpare = make([]byte, b.batchSize)
+	b.inQueue = newBRSPQueue(o.ReadBufferSize, o.MaxBufferGrowth)
+	b.outQueue = newBRSPQueue(o.WriteBufferSize, o.MaxBufferGrowth)
+
+	// Peripheral requests can't be interrupted, so run the setup on its own
+	// goroutine and leave it behind if ctx is done first.
+	done := make(chan error, 1)
+	go func() {
+		done <- b.init(ctx, l)
+	}()
 
-	if err := b.init(); err != nil {
-		return nil, err
+	select {
+	case err := <-done:
+		if err != nil {
+			return nil, err
+		}
+	case <-ctx.Done():
+		b.Close()
+		go func() {
+			// init rechecks ctx when it is done, so this only happens if
+			// the last step raced with the cancellation.
+			if err := <-done; err == nil {
+				l.unsubscribe()
+			}
+		}()
+		return nil, ctx.Err()
 	}
 
 	go b.loop()
-	go b.writer()
+	go b.writer(l, b.outgoingData, b.writeErrors)
 
 	return b, nil
 }
 
 type brspIncoming struct {
-	data [20]byte
-	n    int
+	data []byte
+	buf  *[]byte // pooled buffer holding data, if any
 	err  error
+	gen  int  // link the data arrived on
+	mode bool // data is from the mode characteristic
+	flow bool // flow control state changed
+}
+
+// brspBufPool holds buffers for received PDUs on their way to the loop,
+// which returns them once it copied the data into inQueue.
+var brspBufPool = sync.Pool{
+	New: func() interface{} { return new([]byte) },
+}
+
+// brspProfile identifies the BRSP service on a peripheral.
+type brspProfile struct {
+	service   UUID
+	mode      UUID
+	rx        UUID
+	tx        UUID
+	flow      UUID // optional
+	modeValue byte
+}
+
+func newBRSPProfile(o BRSPOptions) brspProfile {
+	pr := brspProfile{
+		service:   o.ServiceUUID,
+		mode:      o.ModeUUID,
+		rx:        o.RxUUID,
+		tx:        o.TxUUID,
+		flow:      o.FlowUUID,
+		modeValue: o.ModeValue,
+	}
+	if pr.service.Len() == 0 {
+		pr.service = BRSPServiceUUID
+	}
+	if pr.mode.Len() == 0 {
+		pr.mode = BRSPModeUUID
+	}
+	if pr.rx.Len() == 0 {
+		pr.rx = BRSPRxUUID
+	}
+	if pr.tx.Len() == 0 {
+		pr.tx = BRSPTxUUID
+	}
+	if pr.modeValue == 0 {
+		pr.modeValue = 1
+	}
+	return pr
+}
+
+// brspLink is the connection a BRSP session runs over. Reattach replaces
+// it with a new one; gen tells them apart.
+type brspLink struct {
+	p      Peripheral
+	gen    int
+	notify bool
+	gone   chan struct{} // closed once the session has left the link
+
+	service *Service
+	mode    *Characteristic
+	rx      *Characteristic
+	tx      *Characteristic
+	flow    *Characteristic // flow control, if configured and present
+
+	stopChanged func() // unregisters the OnServicesChanged function
+
+	// flowState is the last state reported on flow, accessed atomically.
+	flowState int32
+}
+
+const (
+	brspFlowUnknown = iota
+	brspFlowClear
+	brspFlowBusy
+)
+
+// setFlow records the flow control value v.
+func (l *brspLink) setFlow(v []byte) {
+	atomic.StoreInt32(&l.flowState, brspFlowState(v))
+}
+
+// flowBusy reports whether the peripheral asked for writes to pause.
+func (l *brspLink) flowBusy() bool {
+	return atomic.LoadInt32(&l.flowState) == brspFlowBusy
+}
+
+func brspFlowState(v []byte) int32 {
+	if len(v) > 0 && v[len(v)-1] != 0 {
+		return brspFlowBusy
+	}
+	return brspFlowClear
+}
+
+// setFlowValue subscribes f to the flow control characteristic,
+// preferring indications, or unsubscribes if f is nil.
+func (l *brspLink) setFlowValue(f func(*Characteristic, []byte, error)) error {
+	if l.flow.Properties()&CharIndicate == 0 {
+		return l.p.SetNotifyValue(l.flow, f)
+	}
+	return l.p.SetIndicateValue(l.flow, f)
 }
 
 type brspOutgoing struct {
-	data [20]byte
-	n    int
+	data      []byte
+	n         int
+	mode      *brspModeChange // if set, the chunk is this mode change
+	keepalive bool            // if set, the chunk is a keepalive
+}
+
+// brspModeChange is a change of the BRSP mode at offset bytes into the
+// stream it applies to. r is set for changes requested by SetMode.
+type brspModeChange struct {
+	mode   byte
+	offset uint64
+	r      chan error
 }
 
 type brspResult struct {
@@ -320,72 +2821,152 @@ type brspResult struct {
 	err error
 }
 
-type brspRequest struct {
-	p []byte
-	r chan brspResult
-}
+// brspAddr is the net.Addr of a BRSP session end.
+type brspAddr string
 
-type brspQueue struct {
-	data []byte
-	head int
-	tail int
+func (a brspAddr) Network() string { return "brsp" }
+func (a brspAddr) String() string  { return string(a) }
+
+// brspIdleError is the type of ErrIdle.
+type brspIdleError struct {
+	brspTimeoutError
 }
 
-func (q *brspQueue) queued() int {
-	if q.head >= q.tail {
-		return q.head - q.tail
-	} else {
-		return len(q.data) + q.head - q.tail
+func (brspIdleError) Error() string { return "BRSP idle timeout" }
+func (brspIdleError) Unwrap() error { return ErrTimeout }
+
+// Temporary reports false: the peer stopped sending, retrying the Read
+// at once would only wait out the same idle timeout.
+func (brspIdleError) Temporary() bool { return false }
+
+// wrapErr labels err with the Name of the session, if it has one. io.EOF
+// is returned as is, as io.Reader requires.
+func (b *BRSP) wrapErr(err error) error {
+	if err == nil || err == io.EOF || b.name == "" {
+		return err
 	}
+	return &brspNamedError{b.name, err}
 }
 
-func (q *brspQueue) read(p []byte) int {
-	var n int
+// brspNamedError is an error labelled with the Name of its session. It
+// implements net.Error so that wrapped timeouts are still recognized.
+type brspNamedError struct {
+	name string
+	err  error
+}
 
-	if q.head >= q.tail {
-		n = copy(p, q.data[q.tail:q.head])
-		q.tail += n
-	} else {
-		n = copy(p, q.data[q.tail:])
-		q.tail += n
-		if q.tail == len(q.data) {
-			m := copy(p[n:], q.data[:q.head])
-			q.tail = m
-			n += m
-		}
-	}
+func (e *brspNamedError) Error() string { return "BRSP " + e.name + ": " + e.err.Error() }
+func (e *brspNamedError) Unwrap() error { return e.err }
 
-	if q.tail == q.head {
-		q.head = 0
-		q.tail = 0
-	}
+func (e *brspNamedError) Timeout() bool {
+	var ne net.Error
+	return errors.As(e.err, &ne) && ne.Timeout()
+}
 
-	return n
+func (e *brspNamedError) Temporary() bool {
+	var ne interface{ Temporary() bool }
+	return errors.As(e.err, &ne) && ne.Temporary()
 }
 
-func (q *brspQueue) write(p []byte) {
-	space := len(q.data) - q.queued()
+// brspTimeoutError is the type of ErrTimeout. It implements net.Error so
+// that code written for net.Conn recognizes the timeout.
+type brspTimeoutError struct{}
 
-	if len(p) >= space {
-		need := len(p) - space + 1
-		if need < 256 {
-			need = 256
-		}
+func (brspTimeoutError) Error() string   { return "BRSP timeout" }
+func (brspTimeoutError) Timeout() bool   { return true }
+func (brspTimeoutError) Temporary() bool { return true }
+
+// brspRequest is a read or write for the loop. Its result channel r has
+// capacity 1 and is answered exactly once, so the loop never blocks on a
+// caller that went away.
+type brspRequest struct {
+	p       []byte
+	r       chan brspResult
+	expires time.Time // from BRSPTimeouts, if set
+	seq     uint64    // sequence number of a Write
+	discard int       // bytes to skip rather than read into p
+	peek    bool      // copy into p without consuming
+	min     int       // bytes to wait for, for ReadAtLeast
+	line    bool      // read up to and including delim, for ReadLine
+	delim   byte
+	some    bool // queue what fits without blocking, for WriteSome
+}
+
+// brspCancel withdraws a Read or Write whose caller gave up. A nonzero seq
+// is that of a Write that never reached the loop.
+type brspCancel struct {
+	r   chan brspResult
+	err error
+	seq uint64
+}
 
-		data := make([]byte, len(q.data)+need)
-		n := q.read(data)
-		q.data = data
-		q.head = n
-		q.tail = 0
+// brspFlush is a Flush or CloseWrite covering the writes up to seq. Once
+// the loop has handled those, end is the stream offset they reach.
+type brspFlush struct {
+	c     chan error
+	seq   uint64
+	end   uint64
+	ready bool
+}
+
+// brspWriteError is an error writing the chunk at offset in the stream.
+type brspWriteError struct {
+	offset    uint64
+	err       error
+	keepalive bool // failed keepalive rather than data
+}
+
+type brspCounts struct {
+	buffered int
+	pending  int
+}
+
+type brspDeadline struct {
+	t     time.Time
+	read  bool
+	write bool
+}
+
+// expired reports whether the deadline d is set and has passed at now.
+func expired(d, now time.Time) bool {
+	return !d.IsZero() && !now.Before(d)
+}
+
+// earliest returns the earlier of two deadlines, where zero means none.
+func earliest(d, e time.Time) time.Time {
+	if d.IsZero() || !e.IsZero() && e.Before(d) {
+		return e
 	}
+	return d
+}
 
-	n := len(q.data) - q.head
-	if n < len(p) {
-		copy(q.data[q.head:], p)
-		p = p[n:]
-		q.head = 0
+// after returns the deadline for an operation limited to d, or zero if d
+// is not positive.
+func after(d time.Duration) time.Time {
+	if d <= 0 {
+		return time.Time{}
 	}
+	return time.Now().Add(d)
+}
 
-	copy(q.data[q.head:], p)
-	q.head += len(p)
+// brspPendingWrite is a write waiting for room in the write buffer, or a
+// synchronous write waiting for the bytes between the start and end stream
+// offsets to be written.
+type brspPendingWrite struct {
+	r        brspRequest
+	accepted int
+	start    uint64
+	end      uint64
+}
+
+// done returns how many bytes of the write were written once the stream has
+// been written up to offset written.
+func (w brspPendingWrite) done(written uint64) int {
+	if written <= w.start {
+		return 0
+	}
+	if written >= w.end {
+		return int(w.end - w.start)
+	}
+	return int(written - w.start)
 }
@@ -0,0 +1,121 @@
+package gatt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/PayRange/gatt/blukey"
+)
+
+// DialBRSP scans with d for a peripheral whose advertisement satisfies
+// filter, connects to it and opens a BRSP session, all within timeout.
+// filter gets the parsed BluKey advertisement, nil for other devices, and
+// the generic one; the first peripheral it accepts is used. If any step
+// fails the connection is cancelled and the returned error wraps the
+// cause, ErrTimeout when timeout expired.
+//
+// DialBRSP scans on its own and takes over the PeripheralDiscoveredRaw and
+// PeripheralConnected handlers of d while it runs, restoring the previous
+// ones before it returns. It must not run alongside other scans on d.
+func DialBRSP(d Device, filter func(blukey.Adv, *Advertisement) bool, timeout time.Duration) (*BRSP, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	b, _, err := dialWithHandlers(ctx, d, filter)
+	return b, err
+}
+
+// DialBlukey is like DialBRSP for the BluKey device with the given
+// DeviceId64, and also returns the advertisement it matched, whose AuthKey
+// authenticates the session. If transactable is set, advertisements of
+// the device that cannot transact are skipped until one can. ctx bounds
+// the whole dial; its expiry is reported as ErrTimeout.
+func DialBlukey(ctx context.Context, d Device, id uint64, transactable bool) (*BRSP, blukey.Adv, error) {
+	return dialWithHandlers(ctx, d, blukeyDialFilter(id, transactable))
+}
+
+// blukeyDialFilter returns the DialBRSP filter of DialBlukey.
+func blukeyDialFilter(id uint64, transactable bool) func(blukey.Adv, *Advertisement) bool {
+	return func(bka blukey.Adv, a *Advertisement) bool {
+		return bka != nil && bka.DeviceId64() == id && (!transactable || bka.CanTransact())
+	}
+}
+
+// dialWithHandlers saves and restores the handlers of d around dialBRSP.
+func dialWithHandlers(ctx context.Context, d Device, filter func(blukey.Adv, *Advertisement) bool) (*BRSP, blukey.Adv, error) {
+	if dev, ok := d.(*device); ok {
+		discovered, connected := dev.peripheralDiscoveredRaw, dev.peripheralConnected
+		defer d.Handle(PeripheralDiscoveredRaw(discovered), PeripheralConnected(connected))
+	}
+	return dialBRSP(ctx, d, filter, func(discovered func(Peripheral, []byte, int), connected func(Peripheral, error)) {
+		d.Handle(PeripheralDiscoveredRaw(discovered), PeripheralConnected(connected))
+	})
+}
+
+// dialBRSP does the work of DialBRSP, using handle to install the
+// discovery and connection handlers. It returns the BluKey advertisement
+// of the peripheral, if it had one.
+func dialBRSP(ctx context.Context, d Device, filter func(blukey.Adv, *Advertisement) bool,
+	handle func(func(Peripheral, []byte, int), func(Peripheral, error))) (*BRSP, blukey.Adv, error) {
+	type match struct {
+		p   Peripheral
+		bka blukey.Adv
+	}
+	found := make(chan match, 1)
+	connected := make(chan connResult, 1)
+	handle(
+		func(p Peripheral, data []byte, rssi int) {
+			a := &Advertisement{}
+			if err := a.unmarshall(data); err != nil {
+				return
+			}
+			bka := blukey.ParseAdData(data)
+			if !filter(bka, a) {
+				return
+			}
+			select {
+			case found <- match{p, bka}:
+			default:
+			}
+		},
+		func(p Peripheral, err error) {
+			select {
+			case connected <- connResult{p, err}:
+			default:
+			}
+		},
+	)
+
+	d.Scan(nil, false)
+	var m match
+	select {
+	case m = <-found:
+		d.StopScanning()
+	case <-ctx.Done():
+		d.StopScanning()
+		return nil, nil, dialError(ctx.Err())
+	}
+
+	d.Connect(m.p)
+	p, err := waitConnected(ctx, d, m.p, connected)
+	if err != nil {
+		return nil, nil, dialError(err)
+	}
+
+	b, err := OpenBRSPContext(ctx, p)
+	if err != nil {
+		d.CancelConnection(p)
+		return nil, nil, dialError(err)
+	}
+	return b, m.bka, nil
+}
+
+// dialError wraps the cause of a failed DialBRSP, reporting an expired
+// deadline as ErrTimeout.
+func dialError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = ErrTimeout
+	}
+	return fmt.Errorf("BRSP dial: %w", err)
+}
@@ -0,0 +1,267 @@
+package gatt
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PayRange/gatt/blukey"
+)
+
+// dialDevice is a Device that reports a fixed list of advertisements when
+// scanning and connects to a brspPeripheral.
+type dialDevice struct {
+	ads     [][]byte
+	conn    Peripheral
+	connErr error // reported by Connect instead of connecting to conn
+
+	discovered  func(Peripheral, []byte, int)
+	connected   func(Peripheral, error)
+	connWaiters connWaiters
+
+	mu        sync.Mutex
+	scanning  bool
+	connects  int
+	cancelled int
+}
+
+func (d *dialDevice) Init(func(Device, State)) error                    { return nil }
+func (d *dialDevice) Advertise(*AdvPacket) error                        { return nil }
+func (d *dialDevice) AdvertiseNameAndServices(string, []UUID) error     { return nil }
+func (d *dialDevice) AdvertiseIBeaconData([]byte) error                 { return nil }
+func (d *dialDevice) AdvertiseIBeacon(UUID, uint16, uint16, int8) error { return nil }
+func (d *dialDevice) StopAdvertising() error                            { return nil }
+func (d *dialDevice) RemoveAllServices() error                          { return nil }
+func (d *dialDevice) AddService(*Service) error                         { return nil }
+func (d *dialDevice) SetServices([]*Service) error                      { return nil }
+func (d *dialDevice) Handle(...Handler)                                 {}
+func (d *dialDevice) SetScanFilter(ScanFilter)                          {}
+func (d *dialDevice) Option(...Option) error                            { return nil }
+func (d *dialDevice) Address() Address                                  { return Address{} }
+func (d *dialDevice) AddToAcceptList(Address) error                     { return nil }
+func (d *dialDevice) RemoveFromAcceptList(Address) error                { return nil }
+func (d *dialDevice) ClearAcceptList() error                            { return nil }
+
+func (d *dialDevice) Scan(ss []UUID, dup bool) {
+	d.mu.Lock()
+	d.scanning = true
+	d.mu.Unlock()
+	go func() {
+		for _, ad := range d.ads {
+			d.discovered(newBRSPPeripheral(), ad, -50)
+		}
+	}()
+}
+
+func (d *dialDevice) StopScanning() {
+	d.mu.Lock()
+	d.scanning = false
+	d.mu.Unlock()
+}
+
+func (d *dialDevice) Connect(p Peripheral) {
+	d.mu.Lock()
+	d.connects++
+	d.mu.Unlock()
+	if d.connErr != nil {
+		go d.reportConnected(p, d.connErr)
+	} else if d.conn != nil {
+		go d.reportConnected(d.conn, nil)
+	}
+}
+
+// reportConnected reports a connection like the connected paths of the
+// platform devices.
+func (d *dialDevice) reportConnected(p Peripheral, err error) {
+	d.connWaiters.connected(p, err)
+	if d.connected != nil {
+		d.connected(p, err)
+	}
+}
+
+func (d *dialDevice) ConnectContext(ctx context.Context, p Peripheral) (Peripheral, error) {
+	return connectContext(ctx, d, p, &d.connWaiters)
+}
+
+func (d *dialDevice) CancelConnection(p Peripheral) {
+	d.mu.Lock()
+	d.cancelled++
+	d.mu.Unlock()
+}
+
+func (d *dialDevice) dial(name string, timeout time.Duration) (*BRSP, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	filter := func(bka blukey.Adv, a *Advertisement) bool {
+		return bka == nil && a.LocalName == name
+	}
+	b, _, err := d.dialFilter(ctx, filter)
+	return b, err
+}
+
+func (d *dialDevice) dialFilter(ctx context.Context, filter func(blukey.Adv, *Advertisement) bool) (*BRSP, blukey.Adv, error) {
+	return dialBRSP(ctx, d, filter, func(discovered func(Peripheral, []byte, int), connected func(Peripheral, error)) {
+		d.discovered, d.connected = discovered, connected
+	})
+}
+
+// nameAd returns advertising data holding only a complete local name.
+func nameAd(name string) []byte {
+	return append([]byte{byte(len(name) + 1), typeCompleteName}, name...)
+}
+
+func TestDialBRSP(t *testing.T) {
+	d := &dialDevice{
+		ads:  [][]byte{nameAd("other"), nameAd("target")},
+		conn: newBRSPPeripheral(),
+	}
+	b, err := d.dial("target", time.Second)
+	if err != nil {
+		t.Fatalf("dialBRSP: %s", err)
+	}
+	defer b.Close()
+	if d.scanning || d.connects != 1 || d.cancelled != 0 {
+		t.Errorf("scanning %t, connects %d, cancelled %d; want false, 1, 0", d.scanning, d.connects, d.cancelled)
+	}
+}
+
+func TestDialBRSPTimeout(t *testing.T) {
+	d := &dialDevice{ads: [][]byte{nameAd("other")}}
+	if _, err := d.dial("target", 20*time.Millisecond); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("dialBRSP: got %v want %v", err, ErrTimeout)
+	}
+	if d.scanning || d.connects != 0 {
+		t.Errorf("scanning %t, connects %d; want false, 0", d.scanning, d.connects)
+	}
+
+	// A peripheral that never completes the connection is cancelled.
+	d = &dialDevice{ads: [][]byte{nameAd("target")}}
+	if _, err := d.dial("target", 20*time.Millisecond); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("dialBRSP: got %v want %v", err, ErrTimeout)
+	}
+	if d.connects != 1 || d.cancelled != 1 {
+		t.Errorf("connects %d, cancelled %d; want 1, 1", d.connects, d.cancelled)
+	}
+}
+
+func TestDialBRSPNotBRSP(t *testing.T) {
+	d := &dialDevice{
+		ads:  [][]byte{nameAd("target")},
+		conn: newBRSPPeripheralWithUUIDs(MustParseUUID("1234"), BRSPModeUUID, BRSPRxUUID, BRSPTxUUID),
+	}
+	if _, err := d.dial("target", time.Second); !errors.Is(err, ErrNotBRSP) {
+		t.Fatalf("dialBRSP: got %v want %v", err, ErrNotBRSP)
+	}
+	if d.cancelled != 1 {
+		t.Errorf("cancelled %d want 1", d.cancelled)
+	}
+}
+
+// blukeyAd returns the advertising data of a.
+func blukeyAd(a interface{ Marshal() ([]byte, error) }) []byte {
+	b, err := a.Marshal()
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestDialBlukey(t *testing.T) {
+	busy := &blukey.AdvV2{Id: 7, Key: 1, Flags: blukey.AdvV2statusBusy}
+	ready := &blukey.AdvV2{Id: 7, Key: 2, Flags: blukey.AdvV2statusReady}
+	d := &dialDevice{
+		ads:  [][]byte{nameAd("other"), blukeyAd(&blukey.AdvV2{Id: 8}), blukeyAd(busy), blukeyAd(ready)},
+		conn: newBRSPPeripheral(),
+	}
+	b, a, err := d.dialFilter(context.Background(), blukeyDialFilter(7, true))
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	b.Close()
+	if a.DeviceId() != 7 || a.AuthKey() != 2 {
+		t.Errorf("dial: got %v with key %d want device 7 with key 2", a, a.AuthKey())
+	}
+
+	// Without transactable, the first advertisement of the device does.
+	d = &dialDevice{ads: d.ads, conn: newBRSPPeripheral()}
+	b, a, err = d.dialFilter(context.Background(), blukeyDialFilter(7, false))
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	b.Close()
+	if a.AuthKey() != 1 {
+		t.Errorf("dial: got %v with key %d want key 1", a, a.AuthKey())
+	}
+
+	// IDs wider than 32 bits are matched in full.
+	wide := &blukey.AdvV3{Id: 1<<32 | 7, Key: 3, Flags: blukey.AdvV2statusReady, Name: "PR"}
+	d = &dialDevice{ads: [][]byte{blukeyAd(wide), blukeyAd(ready)}, conn: newBRSPPeripheral()}
+	b, a, err = d.dialFilter(context.Background(), blukeyDialFilter(7, false))
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	b.Close()
+	if a.AuthKey() != 2 {
+		t.Errorf("dial 7: got %v with key %d want key 2", a, a.AuthKey())
+	}
+	d = &dialDevice{ads: d.ads, conn: newBRSPPeripheral()}
+	b, a, err = d.dialFilter(context.Background(), blukeyDialFilter(1<<32|7, false))
+	if err != nil {
+		t.Fatalf("dial: %s", err)
+	}
+	b.Close()
+	if a.AuthKey() != 3 {
+		t.Errorf("dial 1<<32|7: got %v with key %d want key 3", a, a.AuthKey())
+	}
+}
+
+func TestDialBlukeyFailure(t *testing.T) {
+	busy := blukeyAd(&blukey.AdvV1{Id: 7, Status: blukey.AdvV1busy})
+
+	// A device that never can transact is not connected to.
+	d := &dialDevice{ads: [][]byte{busy}, conn: newBRSPPeripheral()}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, a, err := d.dialFilter(ctx, blukeyDialFilter(7, true)); !errors.Is(err, ErrTimeout) || a != nil {
+		t.Fatalf("dial: got %v, %v want %v", a, err, ErrTimeout)
+	}
+	if d.scanning || d.connects != 0 {
+		t.Errorf("scanning %t, connects %d; want false, 0", d.scanning, d.connects)
+	}
+
+	// Cancelling while the connection is pending cancels it.
+	d = &dialDevice{ads: [][]byte{busy}}
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		for {
+			d.mu.Lock()
+			n := d.connects
+			d.mu.Unlock()
+			if n > 0 {
+				cancel()
+				return
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	if _, _, err := d.dialFilter(ctx, blukeyDialFilter(7, false)); !errors.Is(err, context.Canceled) {
+		t.Fatalf("dial: got %v want %v", err, context.Canceled)
+	}
+	if d.connects != 1 || d.cancelled != 1 {
+		t.Errorf("connects %d, cancelled %d; want 1, 1", d.connects, d.cancelled)
+	}
+
+	// A device without BRSP is disconnected.
+	d = &dialDevice{
+		ads:  [][]byte{busy},
+		conn: newBRSPPeripheralWithUUIDs(MustParseUUID("1234"), BRSPModeUUID, BRSPRxUUID, BRSPTxUUID),
+	}
+	if _, _, err := d.dialFilter(context.Background(), blukeyDialFilter(7, false)); !errors.Is(err, ErrNotBRSP) {
+		t.Fatalf("dial: got %v want %v", err, ErrNotBRSP)
+	}
+	if d.cancelled != 1 {
+		t.Errorf("cancelled %d want 1", d.cancelled)
+	}
+}
@@ -0,0 +1,148 @@
+package gatt
+
+import "bytes"
+
+// brspQueueMinSize is the capacity a brspQueue starts with once
+// something is written to it, unless its size is larger.
+const brspQueueMinSize = 256
+
+// brspQueue is a growable ring buffer of bytes. The zero value is an
+// empty queue ready to use. It doubles its capacity when full, adding no
+// more than step bytes beyond what is needed if step is positive.
+type brspQueue struct {
+	data []byte
+	off  int // index of the first queued byte
+	n    int // number of queued bytes
+	size int // capacity to start with
+	step int // largest growth, if positive
+}
+
+// newBRSPQueue returns an empty queue with size bytes of capacity that
+// grows by at most step bytes at a time.
+func newBRSPQueue(size, step int) brspQueue {
+	q := brspQueue{size: size, step: step}
+	if size > 0 {
+		q.data = make([]byte, size)
+	}
+	return q
+}
+
+// queued returns the number of bytes waiting to be read.
+func (q *brspQueue) queued() int {
+	return q.n
+}
+
+// read moves up to len(p) queued bytes into p and returns how many
+// were moved.
+func (q *brspQueue) read(p []byte) int {
+	return q.discard(q.peek(p))
+}
+
+// peek copies up to len(p) queued bytes into p without removing them
+// and returns how many were copied.
+func (q *brspQueue) peek(p []byte) int {
+	n := len(p)
+	if n > q.n {
+		n = q.n
+	}
+	if n == 0 {
+		return 0
+	}
+
+	m := copy(p[:n], q.data[q.off:])
+	copy(p[m:n], q.data)
+	return n
+}
+
+// index returns the position of the first c among the first max queued
+// bytes, or -1 if there is none.
+func (q *brspQueue) index(c byte, max int) int {
+	if max > q.n {
+		max = q.n
+	}
+	if max <= 0 {
+		return -1
+	}
+
+	first := q.data[q.off:]
+	if len(first) > max {
+		first = first[:max]
+	}
+	if i := bytes.IndexByte(first, c); i >= 0 {
+		return i
+	}
+	if i := bytes.IndexByte(q.data[:max-len(first)], c); i >= 0 {
+		return len(first) + i
+	}
+	return -1
+}
+
+// discard drops up to n queued bytes and returns how many were dropped.
+func (q *brspQueue) discard(n int) int {
+	if n > q.n {
+		n = q.n
+	}
+	if n <= 0 {
+		return 0
+	}
+
+	q.off += n
+	if q.off >= len(q.data) {
+		q.off -= len(q.data)
+	}
+	q.n -= n
+	if q.n == 0 {
+		q.off = 0
+	}
+	return n
+}
+
+// reset empties the queue and drops its buffer, keeping its settings.
+// The buffer is allocated again on the next write.
+func (q *brspQueue) reset() {
+	q.data = nil
+	q.off = 0
+	q.n = 0
+}
+
+// write appends p to the queue, growing it as needed.
+func (q *brspQueue) write(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	if q.n+len(p) > len(q.data) {
+		q.grow(q.n + len(p))
+	}
+
+	end := q.off + q.n
+	if end >= len(q.data) {
+		end -= len(q.data)
+	}
+	m := copy(q.data[end:], p)
+	copy(q.data, p[m:])
+	q.n += len(p)
+}
+
+// grow reallocates the queue to hold at least size bytes, unwrapping
+// the queued bytes to the start of the new buffer.
+func (q *brspQueue) grow(size int) {
+	c := 2 * len(q.data)
+	if q.step > 0 && c > len(q.data)+q.step {
+		c = len(q.data) + q.step
+	}
+	if c < brspQueueMinSize {
+		c = brspQueueMinSize
+	}
+	if c < q.size {
+		c = q.size
+	}
+	if c < size {
+		c = size
+	}
+
+	data := make([]byte, c)
+	n := q.read(data)
+	q.data = data
+	q.off = 0
+	q.n = n
+}
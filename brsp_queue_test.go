@@ -0,0 +1,331 @@
+package gatt
+
+import (
+	"bytes"
+	"testing"
+)
+
+// brspRefQueue is the obvious reference implementation of brspQueue.
+type brspRefQueue struct {
+	data []byte
+}
+
+func (q *brspRefQueue) queued() int { return len(q.data) }
+
+func (q *brspRefQueue) read(p []byte) int {
+	n := copy(p, q.data)
+	q.data = q.data[n:]
+	return n
+}
+
+func (q *brspRefQueue) peek(p []byte) int { return copy(p, q.data) }
+
+func (q *brspRefQueue) discard(n int) int {
+	if n > len(q.data) {
+		n = len(q.data)
+	}
+	q.data = q.data[n:]
+	return n
+}
+
+func (q *brspRefQueue) write(p []byte) { q.data = append(q.data, p...) }
+
+func seqBytes(start, n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(start + i)
+	}
+	return b
+}
+
+func readQueue(t *testing.T, q *brspQueue, n int, want []byte) {
+	t.Helper()
+	p := make([]byte, n)
+	got := p[:q.read(p)]
+	if !bytes.Equal(got, want) {
+		t.Fatalf("read(%d): got %v want %v", n, got, want)
+	}
+}
+
+func TestBRSPQueueEmpty(t *testing.T) {
+	var q brspQueue
+	if n := q.queued(); n != 0 {
+		t.Errorf("queued: got %d want 0", n)
+	}
+	readQueue(t, &q, 10, []byte{})
+
+	q.write(nil)
+	q.write([]byte{})
+	if n := q.queued(); n != 0 {
+		t.Errorf("queued after empty writes: got %d want 0", n)
+	}
+	if q.data != nil {
+		t.Errorf("empty write allocated %d bytes", len(q.data))
+	}
+
+	q.write([]byte{1, 2, 3})
+	readQueue(t, &q, 0, []byte{})
+	if n := q.queued(); n != 3 {
+		t.Errorf("queued after zero-length read: got %d want 3", n)
+	}
+}
+
+func TestBRSPQueueWrapAround(t *testing.T) {
+	var q brspQueue
+	q.write(seqBytes(0, 200))
+	readQueue(t, &q, 150, seqBytes(0, 150))
+
+	// Fill the queue so that the data wraps past the end of the buffer.
+	q.write(seqBytes(200, 206))
+	if n, c := q.queued(), len(q.data); n != 256 || c != 256 {
+		t.Fatalf("queued/cap: got %d/%d want 256/256", n, c)
+	}
+	if q.off+q.n <= len(q.data) {
+		t.Fatalf("queue did not wrap: off %d n %d cap %d", q.off, q.n, len(q.data))
+	}
+
+	// Read across the wrap point, in pieces that don't line up with it.
+	readQueue(t, &q, 100, seqBytes(150, 100))
+	readQueue(t, &q, 7, seqBytes(250, 7))
+	readQueue(t, &q, 1000, seqBytes(257, 149))
+	if n := q.queued(); n != 0 {
+		t.Errorf("queued: got %d want 0", n)
+	}
+}
+
+func TestBRSPQueueIndex(t *testing.T) {
+	var q brspQueue
+	if i := q.index(0, 10); i != -1 {
+		t.Errorf("index on empty queue: got %d want -1", i)
+	}
+
+	// Queue bytes 150 to 255 and then 0 to 149, wrapped.
+	q.write(seqBytes(0, 200))
+	readQueue(t, &q, 150, seqBytes(0, 150))
+	q.write(seqBytes(200, 206))
+
+	cases := []struct {
+		c    byte
+		max  int
+		want int
+	}{
+		{c: 150, max: 256, want: 0},
+		{c: 160, max: 256, want: 10},
+		{c: 10, max: 256, want: 116},
+		{c: 10, max: 116, want: -1},
+		{c: 10, max: 117, want: 116},
+		{c: 149, max: 1000, want: 255},
+		{c: 160, max: 0, want: -1},
+	}
+	for _, tt := range cases {
+		if i := q.index(tt.c, tt.max); i != tt.want {
+			t.Errorf("index(%d, %d): got %d want %d", tt.c, tt.max, i, tt.want)
+		}
+	}
+}
+
+func TestBRSPQueueDiscard(t *testing.T) {
+	var q brspQueue
+	if n := q.discard(10); n != 0 {
+		t.Errorf("discard on empty queue: got %d want 0", n)
+	}
+
+	q.write(seqBytes(0, 256))
+	readQueue(t, &q, 200, seqBytes(0, 200))
+	q.write(seqBytes(256, 100))
+	if n := q.discard(0); n != 0 {
+		t.Errorf("discard(0): got %d want 0", n)
+	}
+	// Discard across the wrap point.
+	if n := q.discard(90); n != 90 {
+		t.Errorf("discard(90): got %d want 90", n)
+	}
+	readQueue(t, &q, 10, seqBytes(290, 10))
+	if n := q.discard(100); n != 56 {
+		t.Errorf("discard(100): got %d want 56", n)
+	}
+	if n := q.queued(); n != 0 {
+		t.Errorf("queued: got %d want 0", n)
+	}
+}
+
+func TestBRSPQueuePeek(t *testing.T) {
+	var q brspQueue
+	q.write(seqBytes(0, 256))
+	readQueue(t, &q, 200, seqBytes(0, 200))
+	q.write(seqBytes(256, 100))
+
+	p := make([]byte, 200)
+	if n := q.peek(p); n != 156 || !bytes.Equal(p[:n], seqBytes(200, 156)) {
+		t.Fatalf("peek: got %v want %v", p[:n], seqBytes(200, 156))
+	}
+	if n := q.queued(); n != 156 {
+		t.Errorf("queued after peek: got %d want 156", n)
+	}
+	readQueue(t, &q, 200, seqBytes(200, 156))
+}
+
+func TestBRSPQueueGrowWhileWrapped(t *testing.T) {
+	var q brspQueue
+	q.write(seqBytes(0, 256))
+	readQueue(t, &q, 200, seqBytes(0, 200))
+	q.write(seqBytes(256, 100))
+	if q.off+q.n <= len(q.data) {
+		t.Fatalf("queue did not wrap: off %d n %d cap %d", q.off, q.n, len(q.data))
+	}
+
+	q.write(seqBytes(356, 300))
+	if n := q.queued(); n != 456 {
+		t.Fatalf("queued: got %d want 456", n)
+	}
+	if c := len(q.data); c < 456 {
+		t.Fatalf("cap: got %d want at least 456", c)
+	}
+	readQueue(t, &q, 456, seqBytes(200, 456))
+}
+
+func TestBRSPQueueGrowth(t *testing.T) {
+	for _, tt := range []struct {
+		size, step int
+		caps       []int
+	}{
+		{0, 0, []int{256, 512, 1024, 2048}},
+		{1000, 0, []int{1000, 2000, 4000}},
+		{0, 300, []int{256, 512, 812, 1112}},
+		{1000, 300, []int{1000, 1300, 1600}},
+	} {
+		q := newBRSPQueue(tt.size, tt.step)
+		var caps []int
+		for len(caps) < len(tt.caps) {
+			q.write([]byte{0})
+			if len(caps) == 0 || len(q.data) != caps[len(caps)-1] {
+				caps = append(caps, len(q.data))
+			}
+		}
+		for i := range caps {
+			if caps[i] != tt.caps[i] {
+				t.Errorf("size %d, step %d: got caps %v want %v", tt.size, tt.step, caps, tt.caps)
+				break
+			}
+		}
+	}
+
+	// A write larger than a step grows the queue to fit it at once.
+	q := newBRSPQueue(0, 300)
+	q.write(make([]byte, 1000))
+	if c := len(q.data); c != 1000 {
+		t.Errorf("cap after 1000 byte write: got %d want 1000", c)
+	}
+
+	q = newBRSPQueue(1000, 0)
+	q.write(make([]byte, 1500))
+	q.reset()
+	if q.queued() != 0 || q.data != nil {
+		t.Fatalf("reset: queued %d, cap %d", q.queued(), len(q.data))
+	}
+	q.write([]byte{0})
+	if c := len(q.data); c != 1000 {
+		t.Errorf("cap after reset: got %d want 1000", c)
+	}
+}
+
+// BenchmarkBRSPQueueStream queues a 1MB payload in 20 byte PDUs, as
+// when pushing a firmware image, with and without presizing the queue.
+func BenchmarkBRSPQueueStream(b *testing.B) {
+	pdu := make([]byte, 20)
+	for _, bm := range []struct {
+		name       string
+		size, step int
+	}{
+		{"Default", 0, 0},
+		{"Step64K", 0, 1 << 16},
+		{"Presized", 1 << 20, 0},
+	} {
+		b.Run(bm.name, func(b *testing.B) {
+			b.SetBytes(1 << 20)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				q := newBRSPQueue(bm.size, bm.step)
+				for n := len(pdu); n <= 1<<20; n += len(pdu) {
+					q.write(pdu)
+				}
+			}
+		})
+	}
+}
+
+func TestBRSPQueueInterleaved(t *testing.T) {
+	var q brspQueue
+	var ref brspRefQueue
+	next, want := 0, 0
+	for i := 0; i < 1000; i++ {
+		w := (i * 7) % 61
+		q.write(seqBytes(next, w))
+		ref.write(seqBytes(next, w))
+		next += w
+
+		r := (i * 11) % 53
+		p := make([]byte, r)
+		got := p[:q.read(p)]
+		exp := make([]byte, r)
+		exp = exp[:ref.read(exp)]
+		if !bytes.Equal(got, exp) || !bytes.Equal(got, seqBytes(want, len(got))) {
+			t.Fatalf("step %d: got %v want %v", i, got, exp)
+		}
+		want += len(got)
+		if q.queued() != ref.queued() {
+			t.Fatalf("step %d: queued %d want %d", i, q.queued(), ref.queued())
+		}
+	}
+}
+
+// FuzzBRSPQueue drives brspQueue and brspRefQueue with the same
+// operations. Each byte of ops is one operation: the low two bits select
+// write, peek, read or discard and the rest is its length.
+func FuzzBRSPQueue(f *testing.F) {
+	f.Add([]byte{0xfc, 0x80, 0xfe, 0xff, 0x42, 0xfc, 0x17})
+	f.Add([]byte{0x00, 0x01, 0x02, 0x03})
+	f.Add(bytes.Repeat([]byte{0xf0, 0x7f}, 20))
+	f.Fuzz(func(t *testing.T, ops []byte) {
+		var q brspQueue
+		var ref brspRefQueue
+		next := 0
+		for i, op := range ops {
+			n := int(op >> 2)
+			switch op & 3 {
+			case 0:
+				q.write(seqBytes(next, n))
+				ref.write(seqBytes(next, n))
+				next += n
+			case 1:
+				got := make([]byte, n)
+				got = got[:q.peek(got)]
+				want := make([]byte, n)
+				want = want[:ref.peek(want)]
+				if !bytes.Equal(got, want) {
+					t.Fatalf("op %d: peek(%d) got %v want %v", i, n, got, want)
+				}
+			case 2:
+				got := make([]byte, n)
+				got = got[:q.read(got)]
+				want := make([]byte, n)
+				want = want[:ref.read(want)]
+				if !bytes.Equal(got, want) {
+					t.Fatalf("op %d: read(%d) got %v want %v", i, n, got, want)
+				}
+			case 3:
+				if got, want := q.discard(n), ref.discard(n); got != want {
+					t.Fatalf("op %d: discard(%d) got %d want %d", i, n, got, want)
+				}
+			}
+			if q.queued() != ref.queued() {
+				t.Fatalf("op %d: queued %d want %d", i, q.queued(), ref.queued())
+			}
+		}
+		got := make([]byte, q.queued())
+		q.read(got)
+		if !bytes.Equal(got, ref.data) {
+			t.Fatalf("final contents: got %v want %v", got, ref.data)
+		}
+	})
+}
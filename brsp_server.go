@@ -0,0 +1,371 @@
+package gatt
+
+import (
+	"io"
+	"sync"
+)
+
+// A BRSPServer serves the BRSP service from the local GATT server, so that
+// centrals can open a BRSP session to this device the way OpenBRSP does
+// to a peripheral. Each central gets its own BRSPServerConn.
+type BRSPServer struct {
+	svc *Service
+
+	mu      sync.Mutex
+	conns   map[Central]*BRSPServerConn
+	pending []*BRSPServerConn // not yet returned by Accept
+	ready   chan struct{}     // signalled when pending grows
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// NewBRSPServer returns a BRSPServer for the standard BRSP service. Its
+// Service must be added to the device before centrals can use it.
+func NewBRSPServer() *BRSPServer {
+	s := &BRSPServer{
+		svc:    NewService(BRSPServiceUUID),
+		conns:  make(map[Central]*BRSPServerConn),
+		ready:  make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+
+	mode := s.svc.AddCharacteristic(BRSPModeUUID)
+	mode.HandleReadFunc(s.serveModeRead)
+	mode.HandleWriteFunc(s.serveModeWrite)
+	s.svc.AddCharacteristic(BRSPRxUUID).HandleWriteFunc(s.serveRxWrite)
+	s.svc.AddCharacteristic(BRSPTxUUID).HandleNotifyFunc(s.serveTxNotify)
+	return s
+}
+
+// ServeBRSP adds the service of a new BRSPServer to d and returns the
+// server.
+func ServeBRSP(d Device) (*BRSPServer, error) {
+	s := NewBRSPServer()
+	if err := d.AddService(s.Service()); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Service returns the BRSP service served by s.
+func (s *BRSPServer) Service() *Service {
+	return s.svc
+}
+
+// Accept waits for the next central to open a session and returns it.
+// After s is closed it returns ErrClosed.
+func (s *BRSPServer) Accept() (*BRSPServerConn, error) {
+	for {
+		s.mu.Lock()
+		if len(s.pending) > 0 {
+			c := s.pending[0]
+			s.pending = s.pending[1:]
+			if len(s.pending) > 0 {
+				s.signal()
+			}
+			s.mu.Unlock()
+			return c, nil
+		}
+		s.mu.Unlock()
+
+		select {
+		case <-s.ready:
+		case <-s.closed:
+			return nil, ErrClosed
+		}
+	}
+}
+
+// Close stops accepting sessions and closes the open ones.
+func (s *BRSPServer) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
+
+	s.mu.Lock()
+	conns := s.conns
+	s.conns = make(map[Central]*BRSPServerConn)
+	s.pending = nil
+	s.mu.Unlock()
+	for _, c := range conns {
+		c.Close()
+	}
+	return nil
+}
+
+// CentralDisconnected ends the session of c, if any, so that its Read
+// returns io.EOF. The GATT server does not tell services about lost
+// connections, so pass it on from the CentralDisconnected handler.
+func (s *BRSPServer) CentralDisconnected(c Central) {
+	s.mu.Lock()
+	conn := s.conns[c]
+	delete(s.conns, c)
+	s.mu.Unlock()
+	if conn != nil {
+		conn.end()
+	}
+}
+
+func (s *BRSPServer) signal() {
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// conn returns the session of c, starting one on first contact. It
+// returns nil once s is closed.
+func (s *BRSPServer) conn(c Central) *BRSPServerConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if conn := s.conns[c]; conn != nil {
+		return conn
+	}
+	select {
+	case <-s.closed:
+		return nil
+	default:
+	}
+
+	conn := &BRSPServerConn{
+		server:     s,
+		central:    c,
+		subscribed: make(chan struct{}),
+		gone:       make(chan struct{}),
+		ready:      make(chan struct{}, 1),
+		closed:     make(chan struct{}),
+	}
+	s.conns[c] = conn
+	s.pending = append(s.pending, conn)
+	s.signal()
+	return conn
+}
+
+// remove forgets conn if it is still the session of its central.
+func (s *BRSPServer) remove(conn *BRSPServerConn) {
+	s.mu.Lock()
+	if s.conns[conn.central] == conn {
+		delete(s.conns, conn.central)
+	}
+	s.mu.Unlock()
+}
+
+func (s *BRSPServer) serveModeRead(resp ResponseWriter, req *ReadRequest) {
+	var mode byte
+	if conn := s.conn(req.Central); conn != nil {
+		mode = conn.Mode()
+	}
+	resp.Write([]byte{mode})
+}
+
+func (s *BRSPServer) serveModeWrite(r Request, data []byte) byte {
+	conn := s.conn(r.Central)
+	if conn == nil {
+		return StatusUnexpectedError
+	}
+	if len(data) > 0 {
+		conn.mu.Lock()
+		conn.mode = data[len(data)-1]
+		conn.mu.Unlock()
+	}
+	return StatusSuccess
+}
+
+func (s *BRSPServer) serveRxWrite(r Request, data []byte) byte {
+	conn := s.conn(r.Central)
+	if conn == nil || !conn.receive(data) {
+		return StatusUnexpectedError
+	}
+	return StatusSuccess
+}
+
+// serveTxNotify gives the session of the subscribing central its way to
+// send data. A central subscribing again starts a new session.
+func (s *BRSPServer) serveTxNotify(r Request, n Notifier) {
+	conn := s.conn(r.Central)
+	if conn == nil {
+		return
+	}
+	conn.mu.Lock()
+	if conn.notifier != nil {
+		conn.mu.Unlock()
+		s.CentralDisconnected(r.Central)
+		if conn = s.conn(r.Central); conn == nil {
+			return
+		}
+		conn.mu.Lock()
+	}
+	conn.notifier = n
+	close(conn.subscribed)
+	conn.mu.Unlock()
+}
+
+// A BRSPServerConn is the session of one central with a BRSPServer. Data
+// the central writes to BRSPRxUUID is read with Read, and Write sends
+// data to it as notifications of BRSPTxUUID. The session ends when the
+// central is reported disconnected or a Write finds that it unsubscribed;
+// Read then returns io.EOF after any buffered data.
+type BRSPServerConn struct {
+	server     *BRSPServer
+	central    Central
+	subscribed chan struct{} // closed once notifier is set
+	gone       chan struct{} // closed once the session ended
+
+	wmu sync.Mutex // keeps the bytes of each Write together
+
+	mu       sync.Mutex
+	notifier Notifier
+	in       brspQueue
+	mode     byte
+	ended    bool
+	ready    chan struct{} // signalled when input arrives or the session ends
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+// Central returns the central at the other end of the session.
+func (c *BRSPServerConn) Central() Central {
+	return c.central
+}
+
+// Mode returns the last value the central wrote to the mode
+// characteristic.
+func (c *BRSPServerConn) Mode() byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.mode
+}
+
+// Read reads data written by the central, waiting until some is
+// available.
+func (c *BRSPServerConn) Read(p []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if c.isClosed() {
+			c.mu.Unlock()
+			return 0, ErrClosed
+		}
+		if c.in.queued() > 0 {
+			n := c.in.read(p)
+			if c.in.queued() > 0 || c.ended {
+				c.signal()
+			}
+			c.mu.Unlock()
+			return n, nil
+		}
+		if c.ended {
+			c.mu.Unlock()
+			return 0, io.EOF
+		}
+		c.mu.Unlock()
+
+		select {
+		case <-c.ready:
+		case <-c.closed:
+		}
+	}
+}
+
+// Write sends p to the central in notifications of BRSPTxUUID, waiting
+// until the central has subscribed to it. The bytes of one Write are not
+// interleaved with those of others.
+func (c *BRSPServerConn) Write(p []byte) (int, error) {
+	select {
+	case <-c.subscribed:
+	case <-c.gone:
+		return 0, ErrDisconnected
+	case <-c.closed:
+		return 0, ErrClosed
+	}
+
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	c.mu.Lock()
+	n, ended := c.notifier, c.ended
+	c.mu.Unlock()
+	if c.isClosed() {
+		return 0, ErrClosed
+	}
+	if ended {
+		return 0, ErrDisconnected
+	}
+
+	size := n.Cap()
+	if size <= 0 {
+		size = brspDefaultMTU - 3
+	}
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > size {
+			chunk = chunk[:size]
+		}
+		if n.Done() {
+			c.end()
+			return written, ErrDisconnected
+		}
+		if _, err := n.Write(chunk); err != nil {
+			if n.Done() {
+				c.end()
+				return written, ErrDisconnected
+			}
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// Close ends the session. Read and Write return ErrClosed afterwards.
+func (c *BRSPServerConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	c.server.remove(c)
+	return nil
+}
+
+func (c *BRSPServerConn) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (c *BRSPServerConn) signal() {
+	select {
+	case c.ready <- struct{}{}:
+	default:
+	}
+}
+
+// receive queues data written by the central and reports whether the
+// session still takes input.
+func (c *BRSPServerConn) receive(data []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ended || c.isClosed() {
+		return false
+	}
+	c.in.write(data)
+	c.signal()
+	return true
+}
+
+// end marks the session as ended by the central.
+func (c *BRSPServerConn) end() {
+	c.mu.Lock()
+	if !c.ended {
+		c.ended = true
+		close(c.gone)
+		c.signal()
+	}
+	c.mu.Unlock()
+	c.server.remove(c)
+}
@@ -0,0 +1,343 @@
+package gatt
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// serverPeripheral is a Peripheral that passes the operations of a client
+// on to the handlers of a local service, connecting the client and server
+// sides of a profile in memory.
+type serverPeripheral struct {
+	svc     *Service
+	central *testCentral
+
+	mu        sync.Mutex
+	notifiers map[*Characteristic]*testNotifier
+}
+
+func newServerPeripheral(svc *Service) *serverPeripheral {
+	return &serverPeripheral{
+		svc:       svc,
+		central:   &testCentral{id: "central"},
+		notifiers: make(map[*Characteristic]*testNotifier),
+	}
+}
+
+func (p *serverPeripheral) Device() Device                             { return nil }
+func (p *serverPeripheral) ID() string                                 { return "server" }
+func (p *serverPeripheral) Name() string                               { return "server" }
+func (p *serverPeripheral) Services() []*Service                       { return []*Service{p.svc} }
+func (p *serverPeripheral) ReadRSSI() (int, error)                     { return -1, nil }
+func (p *serverPeripheral) Pair() error                                { return nil }
+func (p *serverPeripheral) SetMTU(mtu uint16) error                    { return nil }
+func (p *serverPeripheral) MTU() uint16                                { return 23 }
+func (p *serverPeripheral) ReadDescriptor(*Descriptor) ([]byte, error) { return nil, nil }
+func (p *serverPeripheral) WriteDescriptor(*Descriptor, []byte) error  { return nil }
+
+func (p *serverPeripheral) ExchangeMTU(requested uint16) (uint16, error) {
+	return 23, nil
+}
+
+func (p *serverPeripheral) WriteCommand(c *Characteristic, b []byte) error {
+	return p.WriteCharacteristic(c, b, true)
+}
+
+func (p *serverPeripheral) WritableWithoutResponse() <-chan struct{} { return closedc }
+
+func (p *serverPeripheral) Subscribe(c *Characteristic, kind NotifyKind) (*Subscription, error) {
+	return nil, notImplemented
+}
+func (p *serverPeripheral) OnServicesChanged(f func(start, end uint16)) func() { return func() {} }
+
+func (p *serverPeripheral) SecurityLevel() (SecurityLevel, error) {
+	return SecurityNone, nil
+}
+
+func (p *serverPeripheral) SetSecurityLevel(l SecurityLevel) error {
+	return nil
+}
+
+func (p *serverPeripheral) ReliableWrite(f func(*WriteTx) error) error { return notImplemented }
+
+func (p *serverPeripheral) UpdateConnectionParams(min, max time.Duration, latency uint16, timeout time.Duration) error {
+	return nil
+}
+
+func (p *serverPeripheral) DiscoverServices(s []UUID) ([]*Service, error) {
+	return []*Service{p.svc}, nil
+}
+
+func (p *serverPeripheral) DiscoverIncludedServices(ss []UUID, s *Service) ([]*Service, error) {
+	return nil, nil
+}
+
+func (p *serverPeripheral) DiscoverCharacteristics(c []UUID, s *Service) ([]*Characteristic, error) {
+	return s.Characteristics(), nil
+}
+
+func (p *serverPeripheral) DiscoverDescriptors(d []UUID, c *Characteristic) ([]*Descriptor, error) {
+	return c.Descriptors(), nil
+}
+
+func (p *serverPeripheral) ReadCharacteristic(c *Characteristic) ([]byte, error) {
+	if c.rhandler == nil {
+		return c.value, nil
+	}
+	rsp := newResponseWriter(brspDefaultMTU - 1)
+	c.rhandler.ServeRead(rsp, &ReadRequest{Request: Request{Central: p.central}, Cap: brspDefaultMTU - 1})
+	if rsp.status != StatusSuccess {
+		return nil, errors.New("read failed")
+	}
+	return rsp.bytes(), nil
+}
+
+func (p *serverPeripheral) ReadLongCharacteristic(c *Characteristic) ([]byte, error) {
+	return p.ReadCharacteristic(c)
+}
+
+func (p *serverPeripheral) WriteCharacteristic(c *Characteristic, b []byte, noRsp bool) error {
+	if c.whandler == nil {
+		return errors.New("not writable")
+	}
+	if status := c.whandler.ServeWrite(Request{Central: p.central}, b); status != StatusSuccess {
+		return errors.New("write failed")
+	}
+	return nil
+}
+
+func (p *serverPeripheral) SetNotifyValue(c *Characteristic, f func(*Characteristic, []byte, error)) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if n := p.notifiers[c]; n != nil {
+		n.stop()
+		delete(p.notifiers, c)
+	}
+	if f != nil {
+		n := &testNotifier{c: c, f: f}
+		p.notifiers[c] = n
+		// Like the Linux server, serve the notifications in the background.
+		go c.nhandler.ServeNotify(Request{Central: p.central}, n)
+	}
+	return nil
+}
+
+func (p *serverPeripheral) SetIndicateValue(c *Characteristic, f func(*Characteristic, []byte, error)) error {
+	return p.SetNotifyValue(c, f)
+}
+
+// unsubscribe stops all notifications, like a central writing the CCCDs.
+func (p *serverPeripheral) unsubscribe() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for c, n := range p.notifiers {
+		n.stop()
+		delete(p.notifiers, c)
+	}
+}
+
+type testCentral struct {
+	id string
+}
+
+func (c *testCentral) ID() string   { return c.id }
+func (c *testCentral) Close() error { return nil }
+func (c *testCentral) MTU() int     { return brspDefaultMTU }
+
+// testNotifier delivers notifications to a client callback.
+type testNotifier struct {
+	c *Characteristic
+	f func(*Characteristic, []byte, error)
+
+	mu   sync.Mutex
+	done bool
+}
+
+func (n *testNotifier) Write(b []byte) (int, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.done {
+		return 0, errors.New("central stopped notifications")
+	}
+	n.f(n.c, append([]byte(nil), b...), nil)
+	return len(b), nil
+}
+
+func (n *testNotifier) Done() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.done
+}
+
+func (n *testNotifier) Cap() int { return brspDefaultMTU - 3 }
+
+func (n *testNotifier) stop() {
+	n.mu.Lock()
+	n.done = true
+	n.mu.Unlock()
+}
+
+// openServedBRSP opens a client session over p to the BRSPServer s and
+// returns both ends.
+func openServedBRSP(t *testing.T, s *BRSPServer, p *serverPeripheral) (*BRSP, *BRSPServerConn) {
+	b, err := OpenBRSP(p)
+	if err != nil {
+		t.Fatalf("OpenBRSP: %s", err)
+	}
+	c, err := s.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %s", err)
+	}
+	return b, c
+}
+
+func TestBRSPServer(t *testing.T) {
+	s := NewBRSPServer()
+	defer s.Close()
+	b, c := openServedBRSP(t, s, newServerPeripheral(s.Service()))
+	defer b.Close()
+
+	if m := c.Mode(); m != 1 {
+		t.Errorf("Mode: got %d want 1", m)
+	}
+
+	request := "a request longer than a single BRSP chunk\n"
+	b.Write([]byte(request))
+	if line, err := bufio.NewReader(c).ReadString('\n'); err != nil || line != request {
+		t.Fatalf("server ReadString: got %q, %v want %q", line, err, request)
+	}
+
+	reply := strings.Repeat("reply ", 20)
+	go c.Write([]byte(reply))
+	buf := make([]byte, len(reply))
+	if _, err := io.ReadFull(b, buf); err != nil || string(buf) != reply {
+		t.Fatalf("client ReadFull: got %q, %v want %q", buf, err, reply)
+	}
+
+	b.SetMode(2)
+	b.Flush()
+	if m := c.Mode(); m != 2 {
+		t.Errorf("Mode: got %d want 2", m)
+	}
+}
+
+func TestBRSPServerUnsubscribe(t *testing.T) {
+	s := NewBRSPServer()
+	defer s.Close()
+	p := newServerPeripheral(s.Service())
+	b, c := openServedBRSP(t, s, p)
+	defer b.Close()
+
+	b.Write([]byte("bye"))
+	b.Flush()
+	p.unsubscribe()
+
+	if _, err := c.Write([]byte("anyone there?")); err != ErrDisconnected {
+		t.Fatalf("Write: got %v want %v", err, ErrDisconnected)
+	}
+	if got, err := io.ReadAll(c); err != nil || string(got) != "bye" {
+		t.Errorf("ReadAll: got %q, %v want %q, nil", got, err, "bye")
+	}
+}
+
+func TestBRSPServerCentralDisconnected(t *testing.T) {
+	s := NewBRSPServer()
+	defer s.Close()
+	p := newServerPeripheral(s.Service())
+	b, c := openServedBRSP(t, s, p)
+	defer b.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := c.Read(make([]byte, 10))
+		done <- err
+	}()
+	s.CentralDisconnected(p.central)
+	if err := <-done; err != io.EOF {
+		t.Errorf("Read: got %v want %v", err, io.EOF)
+	}
+	if _, err := c.Write([]byte("x")); err != ErrDisconnected {
+		t.Errorf("Write: got %v want %v", err, ErrDisconnected)
+	}
+}
+
+func TestBRSPServerClose(t *testing.T) {
+	s := NewBRSPServer()
+	b, c := openServedBRSP(t, s, newServerPeripheral(s.Service()))
+	defer b.Close()
+
+	accepted := make(chan error, 1)
+	go func() {
+		_, err := s.Accept()
+		accepted <- err
+	}()
+	s.Close()
+	if err := <-accepted; err != ErrClosed {
+		t.Errorf("Accept: got %v want %v", err, ErrClosed)
+	}
+	if _, err := c.Read(make([]byte, 10)); err != ErrClosed {
+		t.Errorf("Read: got %v want %v", err, ErrClosed)
+	}
+	if _, err := c.Write([]byte("x")); err != ErrClosed {
+		t.Errorf("Write: got %v want %v", err, ErrClosed)
+	}
+	b.Write([]byte("late"))
+	if err := b.Flush(); err == nil {
+		t.Errorf("Flush: got nil error writing to a closed server")
+	}
+}
+
+func TestBRSPProbe(t *testing.T) {
+	s := NewBRSPServer()
+	defer s.Close()
+	b, c := openServedBRSP(t, s, newServerPeripheral(s.Service()))
+	defer b.Close()
+
+	// Echo everything back, like a peripheral in loopback mode.
+	go io.Copy(c, c)
+
+	payload := []byte(strings.Repeat("probe ", 10))
+	rtt, err := b.Probe(context.Background(), payload)
+	if err != nil {
+		t.Fatalf("Probe: %s", err)
+	}
+	if rtt <= 0 {
+		t.Errorf("Probe: got RTT %v want positive", rtt)
+	}
+	if got := b.Stats().LastProbeRTT; got != rtt {
+		t.Errorf("LastProbeRTT: got %v want %v", got, rtt)
+	}
+	if n := b.Buffered(); n != 0 {
+		t.Errorf("Buffered: got %d want 0", n)
+	}
+}
+
+func TestBRSPProbeFailure(t *testing.T) {
+	s := NewBRSPServer()
+	defer s.Close()
+	b, c := openServedBRSP(t, s, newServerPeripheral(s.Service()))
+	defer b.Close()
+
+	// Nothing is echoed yet.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := b.Probe(ctx, []byte("ping")); err != context.DeadlineExceeded {
+		t.Fatalf("Probe: got %v want %v", err, context.DeadlineExceeded)
+	}
+	if got := b.Stats().LastProbeRTT; got != 0 {
+		t.Errorf("LastProbeRTT: got %v want 0", got)
+	}
+
+	buf := make([]byte, 4)
+	io.ReadFull(c, buf)
+	c.Write([]byte("pong"))
+	if _, err := b.Probe(context.Background(), []byte("ping")); err != ErrProbeMismatch {
+		t.Errorf("Probe: got %v want %v", err, ErrProbeMismatch)
+	}
+}
@@ -0,0 +1,2664 @@
+package gatt
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// brspPeripheral is an in-memory Peripheral exposing the BRSP service.
+// Bytes written to the RX characteristic are collected in rxData, and
+// indicate delivers data to the subscribed TX callback.
+type brspPeripheral struct {
+	svc  *Service
+	mode *Characteristic
+	rx   *Characteristic
+	tx   *Characteristic
+
+	flow *Characteristic // set by withFlow
+
+	changed servicesChanged
+
+	mu          sync.Mutex
+	onTx        func(*Characteristic, []byte, error)
+	onFlow      func(*Characteristic, []byte, error)
+	flowValue   []byte // returned by reads of flow
+	discoverErr error  // if set, returned by DiscoverServices
+	notify      bool   // whether onTx was set with SetNotifyValue
+	onMode      func(*Characteristic, []byte, error)
+	rxData      bytes.Buffer
+	rxWrites    [][]byte
+	rxNoRsp     []bool // noRsp argument of each RX write
+	modes       [][]byte
+	modeAt      []int // RX bytes written before each mode write
+	modeRead    int   // reads of the mode characteristic
+	writeErr    error
+	rxFails     []error       // errors returned by the next RX writes, in turn
+	latency     time.Duration // delay applied to each RX write
+	rtt         time.Duration // extra delay for RX writes with response
+	modeHold    chan struct{} // if set, mode writes wait for it to be closed
+	rxGate      chan struct{} // if set, each RX write waits for a token
+	mtu         uint16        // returned by MTU if set
+}
+
+func newBRSPPeripheral() *brspPeripheral {
+	return newBRSPPeripheralWithUUIDs(BRSPServiceUUID, BRSPModeUUID, BRSPRxUUID, BRSPTxUUID)
+}
+
+func newBRSPPeripheralWithUUIDs(service, mode, rx, tx UUID) *brspPeripheral {
+	svc := NewService(service)
+	p := &brspPeripheral{
+		svc:  svc,
+		mode: NewCharacteristic(mode, svc, CharRead|CharWrite, 0x0002, 0x0003),
+		rx:   NewCharacteristic(rx, svc, CharWrite|CharWriteNR, 0x0004, 0x0005),
+		tx:   NewCharacteristic(tx, svc, CharIndicate|CharNotify, 0x0006, 0x0007),
+	}
+	svc.SetCharacteristics([]*Characteristic{p.mode, p.rx, p.tx})
+	return p
+}
+
+// withFlow adds a flow control characteristic with the given UUID and
+// initial value to p.
+func (p *brspPeripheral) withFlow(u UUID, v []byte) *brspPeripheral {
+	p.flow = NewCharacteristic(u, p.svc, CharRead|CharIndicate, 0x0008, 0x0009)
+	p.flowValue = v
+	p.svc.SetCharacteristics([]*Characteristic{p.mode, p.rx, p.tx, p.flow})
+	return p
+}
+
+func (p *brspPeripheral) Device() Device       { return nil }
+func (p *brspPeripheral) ID() string           { return "brsp-test" }
+func (p *brspPeripheral) Name() string         { return "brsp-test" }
+func (p *brspPeripheral) Services() []*Service { return []*Service{p.svc} }
+
+func (p *brspPeripheral) DiscoverServices(s []UUID) ([]*Service, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.discoverErr != nil {
+		return nil, p.discoverErr
+	}
+	return []*Service{p.svc}, nil
+}
+
+func (p *brspPeripheral) DiscoverIncludedServices(ss []UUID, s *Service) ([]*Service, error) {
+	return nil, nil
+}
+
+func (p *brspPeripheral) DiscoverCharacteristics(c []UUID, s *Service) ([]*Characteristic, error) {
+	return s.Characteristics(), nil
+}
+
+func (p *brspPeripheral) DiscoverDescriptors(d []UUID, c *Characteristic) ([]*Descriptor, error) {
+	return nil, nil
+}
+
+func (p *brspPeripheral) ReadCharacteristic(c *Characteristic) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if c == p.mode {
+		p.modeRead++
+	}
+	if c == p.flow {
+		return p.flowValue, nil
+	}
+	return nil, nil
+}
+
+func (p *brspPeripheral) ReadLongCharacteristic(c *Characteristic) ([]byte, error) {
+	return nil, nil
+}
+
+func (p *brspPeripheral) ReadDescriptor(d *Descriptor) ([]byte, error) {
+	return nil, nil
+}
+
+func (p *brspPeripheral) WriteCharacteristic(c *Characteristic, b []byte, noRsp bool) error {
+	if c == p.rx && p.latency > 0 {
+		time.Sleep(p.latency)
+	}
+	if c == p.rx && !noRsp && p.rtt > 0 {
+		time.Sleep(p.rtt)
+	}
+	if c == p.rx && p.rxGate != nil {
+		<-p.rxGate
+	}
+	if c == p.mode && p.modeHold != nil {
+		<-p.modeHold
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if c == p.mode {
+		p.modes = append(p.modes, append([]byte(nil), b...))
+		p.modeAt = append(p.modeAt, p.rxData.Len())
+		return nil
+	}
+	if p.writeErr != nil {
+		return p.writeErr
+	}
+	if len(p.rxFails) > 0 {
+		err := p.rxFails[0]
+		p.rxFails = p.rxFails[1:]
+		if err != nil {
+			return err
+		}
+	}
+	p.rxNoRsp = append(p.rxNoRsp, noRsp)
+	p.rxWrites = append(p.rxWrites, append([]byte(nil), b...))
+	p.rxData.Write(b)
+	return nil
+}
+
+func (p *brspPeripheral) WriteDescriptor(d *Descriptor, b []byte) error {
+	return nil
+}
+
+func (p *brspPeripheral) SetNotifyValue(c *Characteristic, f func(*Characteristic, []byte, error)) error {
+	p.mu.Lock()
+	if c == p.mode {
+		p.onMode = f
+		p.mu.Unlock()
+		return nil
+	}
+	p.onTx = f
+	p.notify = true
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *brspPeripheral) SetIndicateValue(c *Characteristic, f func(*Characteristic, []byte, error)) error {
+	p.mu.Lock()
+	if c == p.flow {
+		p.onFlow = f
+		p.mu.Unlock()
+		return nil
+	}
+	if c == p.mode {
+		p.onMode = f
+		p.mu.Unlock()
+		return nil
+	}
+	p.onTx = f
+	p.notify = false
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *brspPeripheral) ReadRSSI() (int, error)  { return -1, nil }
+func (p *brspPeripheral) Pair() error             { return nil }
+func (p *brspPeripheral) SetMTU(mtu uint16) error { return nil }
+func (p *brspPeripheral) ExchangeMTU(requested uint16) (uint16, error) {
+	return p.MTU(), nil
+}
+func (p *brspPeripheral) WriteCommand(c *Characteristic, b []byte) error {
+	return p.WriteCharacteristic(c, b, true)
+}
+func (p *brspPeripheral) WritableWithoutResponse() <-chan struct{} { return closedc }
+func (p *brspPeripheral) Subscribe(c *Characteristic, kind NotifyKind) (*Subscription, error) {
+	return nil, notImplemented
+}
+func (p *brspPeripheral) ReliableWrite(f func(*WriteTx) error) error { return notImplemented }
+func (p *brspPeripheral) OnServicesChanged(f func(start, end uint16)) func() {
+	return p.changed.add(f)
+}
+func (p *brspPeripheral) SecurityLevel() (SecurityLevel, error) {
+	return SecurityNone, nil
+}
+func (p *brspPeripheral) SetSecurityLevel(l SecurityLevel) error {
+	return nil
+}
+func (p *brspPeripheral) MTU() uint16 {
+	if p.mtu != 0 {
+		return p.mtu
+	}
+	return 23
+}
+func (p *brspPeripheral) UpdateConnectionParams(min, max time.Duration, latency uint16, timeout time.Duration) error {
+	return nil
+}
+
+// indicate delivers b to the BRSP session as an indication on TX.
+func (p *brspPeripheral) indicate(b []byte, err error) {
+	p.mu.Lock()
+	f := p.onTx
+	p.mu.Unlock()
+	f(p.tx, b, err)
+}
+
+// serviceChanged reports a change of all the handles, as a Service
+// Changed indication would.
+func (p *brspPeripheral) serviceChanged() {
+	p.changed.call(0x0001, 0xffff)
+}
+
+// setFlow indicates v on the flow control characteristic.
+func (p *brspPeripheral) setFlow(v byte) {
+	p.mu.Lock()
+	p.flowValue = []byte{v}
+	f := p.onFlow
+	p.mu.Unlock()
+	f(p.flow, []byte{v}, nil)
+}
+
+// received waits until at least n bytes were written to RX and returns them.
+func (p *brspPeripheral) received(t testing.TB, n int) []byte {
+	for i := 0; i < 200; i++ {
+		p.mu.Lock()
+		if p.rxData.Len() >= n {
+			b := append([]byte(nil), p.rxData.Bytes()...)
+			p.mu.Unlock()
+			return b
+		}
+		p.mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d bytes on RX", n)
+	return nil
+}
+
+func openTestBRSP(t *testing.T) (*BRSP, *brspPeripheral) {
+	return openTestBRSPWithOptions(t, BRSPOptions{})
+}
+
+func openTestBRSPWithOptions(t testing.TB, o BRSPOptions) (*BRSP, *brspPeripheral) {
+	p := newBRSPPeripheral()
+	b, err := OpenBRSPWithOptions(p, o)
+	if err != nil {
+		t.Fatalf("OpenBRSP: %s", err)
+	}
+	return b, p
+}
+
+func TestBRSPReadDeadline(t *testing.T) {
+	b, p := openTestBRSP(t)
+	defer b.Close()
+
+	buf := make([]byte, 20)
+
+	start := time.Now()
+	b.SetReadDeadline(start.Add(50 * time.Millisecond))
+	if _, err := b.Read(buf); err != ErrTimeout {
+		t.Fatalf("Read: got %v want %v", err, ErrTimeout)
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("Read returned after %s, before the deadline", d)
+	}
+
+	// An expired deadline fails the Read immediately.
+	if _, err := b.Read(buf); err != ErrTimeout {
+		t.Fatalf("Read after deadline: got %v want %v", err, ErrTimeout)
+	}
+
+	// The session survives the timeout.
+	b.SetReadDeadline(time.Time{})
+	go p.indicate([]byte("hello"), nil)
+	n, err := b.Read(buf)
+	if err != nil || string(buf[:n]) != "hello" {
+		t.Fatalf("Read: got %q, %v want %q, nil", buf[:n], err, "hello")
+	}
+}
+
+func TestBRSPReadDeadlineUnblocksPendingRead(t *testing.T) {
+	b, _ := openTestBRSP(t)
+	defer b.Close()
+
+	errc := make(chan error)
+	go func() {
+		_, err := b.Read(make([]byte, 20))
+		errc <- err
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	b.SetReadDeadline(time.Now())
+
+	select {
+	case err := <-errc:
+		if err != ErrTimeout {
+			t.Fatalf("Read: got %v want %v", err, ErrTimeout)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Read was not unblocked by SetReadDeadline")
+	}
+}
+
+func TestBRSPWriteDeadline(t *testing.T) {
+	b, p := openTestBRSP(t)
+	defer b.Close()
+
+	b.SetWriteDeadline(time.Now().Add(-time.Second))
+	if _, err := b.Write([]byte("late")); err != ErrTimeout {
+		t.Fatalf("Write: got %v want %v", err, ErrTimeout)
+	}
+
+	b.SetDeadline(time.Time{})
+	if _, err := b.Write([]byte("ok")); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	if got := p.received(t, 2); string(got) != "ok" {
+		t.Errorf("RX: got %q want %q", got, "ok")
+	}
+}
+
+func TestBRSPWriteReusedBuffer(t *testing.T) {
+	b, p := openTestBRSP(t)
+	defer b.Close()
+
+	var want []byte
+	buf := make([]byte, 7)
+	for i := 0; i < 50; i++ {
+		for j := range buf {
+			buf[j] = byte(i)
+		}
+		if _, err := b.Write(buf); err != nil {
+			t.Fatalf("Write: %s", err)
+		}
+		want = append(want, buf...)
+	}
+	// Scribble over the buffer once more; queued bytes must not change.
+	for j := range buf {
+		buf[j] = 0xff
+	}
+
+	if got := p.received(t, len(want)); !bytes.Equal(got, want) {
+		t.Errorf("RX: got % x want % x", got, want)
+	}
+}
+
+func TestBRSPCloseIdempotent(t *testing.T) {
+	b, _ := openTestBRSP(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			b.Read(make([]byte, 20))
+		}()
+		go func() {
+			defer wg.Done()
+			b.Write([]byte("data"))
+		}()
+		go func() {
+			defer wg.Done()
+			b.Flush()
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	if err := b.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatalf("second Close: %s", err)
+	}
+	wg.Wait()
+
+	if _, err := b.Read(make([]byte, 20)); err != ErrClosed {
+		t.Errorf("Read after Close: got %v want %v", err, ErrClosed)
+	}
+	if _, err := b.Write([]byte("x")); err != ErrClosed {
+		t.Errorf("Write after Close: got %v want %v", err, ErrClosed)
+	}
+	if err := b.Flush(); err != ErrClosed {
+		t.Errorf("Flush after Close: got %v want %v", err, ErrClosed)
+	}
+}
+
+func TestBRSPMTU(t *testing.T) {
+	cases := []struct {
+		mtu      uint16
+		maxChunk int
+		chunk    int
+		pdu      int // longest indication
+	}{
+		{mtu: 0, chunk: 20, pdu: 20},
+		{mtu: 10, chunk: 20, pdu: 20},
+		{mtu: 23, chunk: 20, pdu: 20},
+		{mtu: 185, chunk: 182, pdu: 182},
+		{mtu: 158, maxChunk: 64, chunk: 64, pdu: 155},
+		{mtu: 23, maxChunk: 20, chunk: 20, pdu: 20},
+	}
+
+	for _, tt := range cases {
+		b, p := openTestBRSPWithOptions(t, BRSPOptions{MTU: tt.mtu, MaxChunkSize: tt.maxChunk})
+
+		out := bytes.Repeat([]byte("0123456789"), 50)
+		if _, err := b.Write(out); err != nil {
+			t.Fatalf("MTU %d: Write: %s", tt.mtu, err)
+		}
+		if err := b.Flush(); err != nil {
+			t.Fatalf("MTU %d: Flush: %s", tt.mtu, err)
+		}
+		if got := p.received(t, len(out)); !bytes.Equal(got, out) {
+			t.Errorf("MTU %d: RX: got %q want %q", tt.mtu, got, out)
+		}
+		p.mu.Lock()
+		for _, w := range p.rxWrites {
+			if len(w) > tt.chunk {
+				t.Errorf("MTU %d: wrote %d byte chunk, want at most %d", tt.mtu, len(w), tt.chunk)
+			}
+		}
+		if len(p.rxWrites[0]) != tt.chunk {
+			t.Errorf("MTU %d: first chunk is %d bytes, want %d", tt.mtu, len(p.rxWrites[0]), tt.chunk)
+		}
+		p.mu.Unlock()
+
+		// Indications longer than 20 bytes are delivered intact.
+		in := out[:tt.pdu]
+		go p.indicate(in, nil)
+		buf := make([]byte, 512)
+		n, err := b.Read(buf)
+		if err != nil || !bytes.Equal(buf[:n], in) {
+			t.Errorf("MTU %d: Read: got %q, %v want %q, nil", tt.mtu, buf[:n], err, in)
+		}
+		b.Close()
+	}
+}
+
+func TestBRSPMaxChunkSizeInvalid(t *testing.T) {
+	for _, o := range []BRSPOptions{
+		{MaxChunkSize: -1},
+		{MaxChunkSize: 21},
+		{MTU: 158, MaxChunkSize: 156},
+	} {
+		if b, err := OpenBRSPWithOptions(newBRSPPeripheral(), o); err == nil {
+			b.Close()
+			t.Errorf("MTU %d, MaxChunkSize %d: got nil error", o.MTU, o.MaxChunkSize)
+		}
+	}
+}
+
+func TestBRSPPeripheralMTU(t *testing.T) {
+	p := newBRSPPeripheral()
+	p.mtu = 185
+	b, err := OpenBRSP(p)
+	if err != nil {
+		t.Fatalf("OpenBRSP: %s", err)
+	}
+	defer b.Close()
+
+	out := bytes.Repeat([]byte("0123456789"), 50)
+	if _, err := b.Write(out); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	if err := b.Flush(); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+	p.received(t, len(out))
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.rxWrites[0]) != 182 {
+		t.Errorf("first chunk is %d bytes, want 182 for the peripheral's MTU", len(p.rxWrites[0]))
+	}
+}
+
+func benchmarkBRSPThroughput(bb *testing.B, mtu uint16) {
+	b, p := openTestBRSPWithOptions(bb, BRSPOptions{MTU: mtu})
+	defer b.Close()
+	p.latency = 100 * time.Microsecond
+
+	data := make([]byte, 4096)
+	bb.SetBytes(int64(len(data)))
+	bb.ResetTimer()
+	for i := 0; i < bb.N; i++ {
+		b.Write(data)
+		if err := b.Flush(); err != nil {
+			bb.Fatalf("Flush: %s", err)
+		}
+	}
+}
+
+func BenchmarkBRSPThroughputMTU23(b *testing.B)  { benchmarkBRSPThroughput(b, 23) }
+func BenchmarkBRSPThroughputMTU185(b *testing.B) { benchmarkBRSPThroughput(b, 185) }
+
+func benchmarkBRSPWriteMode(bb *testing.B, withRsp bool) {
+	b, p := openTestBRSPWithOptions(bb, BRSPOptions{WriteWithResponse: withRsp})
+	defer b.Close()
+	p.rtt = 30 * time.Millisecond
+
+	data := make([]byte, 512)
+	bb.SetBytes(int64(len(data)))
+	bb.ResetTimer()
+	for i := 0; i < bb.N; i++ {
+		b.Write(data)
+		if err := b.Flush(); err != nil {
+			bb.Fatalf("Flush: %s", err)
+		}
+	}
+}
+
+func BenchmarkBRSPWriteWithResponse(b *testing.B)    { benchmarkBRSPWriteMode(b, true) }
+func BenchmarkBRSPWriteWithoutResponse(b *testing.B) { benchmarkBRSPWriteMode(b, false) }
+
+func BenchmarkBRSPIngest(bb *testing.B) {
+	b, p := openTestBRSPWithOptions(bb, BRSPOptions{ReadBufferSize: 1 << 16})
+	defer b.Close()
+
+	pdu := make([]byte, 20)
+	bb.SetBytes(int64(len(pdu)))
+	bb.ReportAllocs()
+	bb.ResetTimer()
+	for i := 0; i < bb.N; i++ {
+		p.indicate(pdu, nil)
+		if i%1000 == 999 {
+			b.DrainInput()
+		}
+	}
+}
+
+func benchmarkBRSPWriteBatch(bb *testing.B, batch int) {
+	b, _ := openTestBRSPWithOptions(bb, BRSPOptions{WriteBatch: batch})
+	defer b.Close()
+
+	data := make([]byte, 4096)
+	bb.SetBytes(int64(len(data)))
+	bb.ResetTimer()
+	for i := 0; i < bb.N; i++ {
+		b.Write(data)
+		if err := b.Flush(); err != nil {
+			bb.Fatalf("Flush: %s", err)
+		}
+	}
+}
+
+func BenchmarkBRSPWriteBatch1(b *testing.B) { benchmarkBRSPWriteBatch(b, 1) }
+func BenchmarkBRSPWriteBatch8(b *testing.B) { benchmarkBRSPWriteBatch(b, 8) }
+
+func TestBRSPReadFrom(t *testing.T) {
+	b, p := openTestBRSPWithOptions(t, BRSPOptions{MTU: 185})
+	defer b.Close()
+
+	data := make([]byte, 2<<20)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	// Hide bytes.Reader's WriteTo so that io.Copy uses ReadFrom.
+	n, err := io.Copy(b, struct{ io.Reader }{bytes.NewReader(data)})
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("Copy: got %d, %v want %d, nil", n, err, len(data))
+	}
+	if err := b.Flush(); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+	if got := p.received(t, len(data)); !bytes.Equal(got, data) {
+		t.Fatalf("received %d bytes that differ from the %d sent", len(got), len(data))
+	}
+}
+
+func TestBRSPReadFromError(t *testing.T) {
+	b, _ := openTestBRSP(t)
+	defer b.Close()
+
+	rerr := errors.New("source failed")
+	r := io.MultiReader(strings.NewReader("abc"), iotest.ErrReader(rerr))
+	if n, err := b.ReadFrom(r); n != 3 || err != rerr {
+		t.Errorf("ReadFrom: got %d, %v want 3, %v", n, err, rerr)
+	}
+
+	b.Close()
+	if _, err := b.ReadFrom(strings.NewReader("abc")); err != ErrClosed {
+		t.Errorf("ReadFrom after Close: got %v want %v", err, ErrClosed)
+	}
+}
+
+func TestBRSPWriteTo(t *testing.T) {
+	b, p := openTestBRSP(t)
+	defer b.Close()
+
+	data := make([]byte, 20*100000)
+	for i := range data {
+		data[i] = byte(i * 13)
+	}
+	go func() {
+		for i := 0; i < len(data); i += 20 {
+			p.indicate(data[i:i+20], nil)
+		}
+		p.indicate(nil, io.EOF)
+	}()
+
+	var out bytes.Buffer
+	// Hide bytes.Buffer's ReadFrom so that io.Copy uses WriteTo.
+	n, err := io.Copy(struct{ io.Writer }{&out}, b)
+	if err != nil || n != int64(len(data)) {
+		t.Fatalf("Copy: got %d, %v want %d, nil", n, err, len(data))
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Fatal("copied data differs from the data sent")
+	}
+}
+
+func TestBRSPWriteToClose(t *testing.T) {
+	b, p := openTestBRSP(t)
+	p.indicate([]byte("hello"), nil)
+
+	done := make(chan error, 1)
+	var out bytes.Buffer
+	go func() {
+		_, err := b.WriteTo(&out)
+		done <- err
+	}()
+	waitFor(t, "buffered", b.Buffered, 0)
+	b.Close()
+	if err := <-done; err != ErrClosed {
+		t.Errorf("WriteTo: got %v want %v", err, ErrClosed)
+	}
+	if got := out.String(); got != "hello" {
+		t.Errorf("WriteTo: wrote %q want %q", got, "hello")
+	}
+}
+
+func TestBRSPWriteReportsError(t *testing.T) {
+	b, p := openTestBRSP(t)
+	defer b.Close()
+
+	werr := errors.New("write failed")
+	p.mu.Lock()
+	p.writeErr = werr
+	p.mu.Unlock()
+
+	if _, err := b.Write([]byte("lost")); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+
+	// Once the failure has been observed, Write stops pretending success.
+	var err error
+	for i := 0; i < 100 && err == nil; i++ {
+		time.Sleep(5 * time.Millisecond)
+		_, err = b.Write([]byte("x"))
+	}
+	if err != werr {
+		t.Fatalf("Write: got %v want %v", err, werr)
+	}
+}
+
+func TestBRSPWriteRetry(t *testing.T) {
+	b, p := openTestBRSPWithOptions(t, BRSPOptions{
+		Retry: BRSPRetryPolicy{MaxAttempts: 3, Backoff: time.Millisecond},
+	})
+	defer b.Close()
+
+	werr := errors.New("unlikely error")
+	p.mu.Lock()
+	p.rxFails = []error{werr, werr, nil, werr, nil, werr, werr}
+	p.mu.Unlock()
+
+	data := []byte("a stream of several twenty-byte chunks, none of them lost")
+	if _, err := b.Write(data); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	if err := b.Flush(); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+	if got := p.received(t, len(data)); !bytes.Equal(got, data) {
+		t.Errorf("received %q want %q", got, data)
+	}
+	s := b.Stats()
+	if s.WriteRetries != 5 || s.WriteErrors != 0 {
+		t.Errorf("WriteRetries, WriteErrors: got %d, %d want 5, 0", s.WriteRetries, s.WriteErrors)
+	}
+}
+
+func TestBRSPWriteRetryExhausted(t *testing.T) {
+	tests := []struct {
+		retry   BRSPRetryPolicy
+		retries uint64
+	}{
+		{BRSPRetryPolicy{}, 0},
+		{BRSPRetryPolicy{MaxAttempts: 1}, 0},
+		{BRSPRetryPolicy{MaxAttempts: 3}, 2},
+	}
+	for _, tt := range tests {
+		b, p := openTestBRSPWithOptions(t, BRSPOptions{Retry: tt.retry})
+		werr := errors.New("write failed")
+		p.mu.Lock()
+		p.rxFails = []error{werr}
+		for i := uint64(0); i < tt.retries; i++ {
+			p.rxFails = append(p.rxFails, werr)
+		}
+		p.mu.Unlock()
+
+		b.Write([]byte("lost"))
+		if err := b.Flush(); err != werr {
+			t.Errorf("%+v: Flush: got %v want %v", tt.retry, err, werr)
+		}
+		b.Write([]byte("sent"))
+		if err := b.Flush(); err != nil {
+			t.Errorf("%+v: Flush: %s", tt.retry, err)
+		}
+		if got := string(p.received(t, 4)); got != "sent" {
+			t.Errorf("%+v: received %q want %q", tt.retry, got, "sent")
+		}
+		s := b.Stats()
+		if s.WriteRetries != tt.retries || s.WriteErrors != 1 {
+			t.Errorf("%+v: WriteRetries, WriteErrors: got %d, %d want %d, 1",
+				tt.retry, s.WriteRetries, s.WriteErrors, tt.retries)
+		}
+		b.Close()
+	}
+}
+
+func TestBRSPWriteBatch(t *testing.T) {
+	b, p := openTestBRSPWithOptions(t, BRSPOptions{WriteBatch: 4})
+	defer b.Close()
+
+	werr := errors.New("write failed")
+	p.mu.Lock()
+	p.rxFails = []error{nil, nil, nil, nil, nil, nil, nil, werr}
+	p.mu.Unlock()
+
+	data := make([]byte, 250)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	b.Write(data[:130])
+	if err := b.SetMode(2); err != nil {
+		t.Fatalf("SetMode: %s", err)
+	}
+	b.Write(data[130:])
+	if err := b.Flush(); err != werr {
+		t.Fatalf("Flush: got %v want %v", err, werr)
+	}
+
+	// The first chunk after the mode change failed and is lost; the rest
+	// arrives in order and in chunks of at most 20 bytes.
+	want := append(append([]byte(nil), data[:130]...), data[150:]...)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !bytes.Equal(p.rxData.Bytes(), want) {
+		t.Errorf("received %v want %v", p.rxData.Bytes(), want)
+	}
+	for _, w := range p.rxWrites {
+		if len(w) > 20 {
+			t.Errorf("RX write of %d bytes", len(w))
+		}
+	}
+	if got, want := p.modeAt[1], 130; got != want {
+		t.Errorf("mode written after %d bytes, want %d", got, want)
+	}
+	if s := b.Stats(); s.PDUsOut != uint64(len(p.rxWrites)+1) {
+		t.Errorf("PDUsOut: got %d want %d", s.PDUsOut, len(p.rxWrites)+1)
+	}
+}
+
+func TestBRSPKeepalive(t *testing.T) {
+	b, p := openTestBRSPWithOptions(t, BRSPOptions{
+		Keepalive: BRSPKeepalive{Interval: 10 * time.Millisecond},
+	})
+	defer b.Close()
+
+	time.Sleep(55 * time.Millisecond)
+	p.mu.Lock()
+	n := len(p.rxWrites)
+	for _, w := range p.rxWrites {
+		if len(w) != 0 {
+			t.Errorf("keepalive wrote %q", w)
+		}
+	}
+	p.mu.Unlock()
+	if n < 2 || n > 6 {
+		t.Errorf("keepalives: got %d want about 5", n)
+	}
+
+	// Keepalives never split the chunks of a Write, and traffic keeps them
+	// from being sent at all.
+	p.latency = 2 * time.Millisecond
+	data := bytes.Repeat([]byte("0123456789"), 50)
+	p.mu.Lock()
+	start := len(p.rxWrites)
+	p.mu.Unlock()
+	b.Write(data)
+	if err := b.Flush(); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	writes := p.rxWrites[start:]
+	for len(writes) > 0 && len(writes[0]) == 0 {
+		writes = writes[1:]
+	}
+	for len(writes) > 0 && len(writes[len(writes)-1]) == 0 {
+		writes = writes[:len(writes)-1]
+	}
+	if len(writes) != 25 {
+		t.Errorf("RX writes during Write: got %d want 25", len(writes))
+	}
+}
+
+func TestBRSPKeepaliveReadMode(t *testing.T) {
+	b, p := openTestBRSPWithOptions(t, BRSPOptions{
+		Keepalive: BRSPKeepalive{Interval: 10 * time.Millisecond, ReadMode: true},
+	})
+	defer b.Close()
+
+	time.Sleep(25 * time.Millisecond)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.modeRead == 0 || len(p.rxWrites) != 0 {
+		t.Errorf("mode reads, RX writes: got %d, %d want some, 0", p.modeRead, len(p.rxWrites))
+	}
+}
+
+func TestBRSPKeepaliveError(t *testing.T) {
+	b, p := openTestBRSPWithOptions(t, BRSPOptions{
+		Keepalive: BRSPKeepalive{Interval: 50 * time.Millisecond},
+	})
+	defer b.Close()
+
+	werr := errors.New("keepalive failed")
+	p.mu.Lock()
+	p.writeErr = werr
+	p.mu.Unlock()
+	waitFor(t, "write errors", func() int { return int(b.Stats().WriteErrors) }, 1)
+
+	if err := b.Flush(); err != werr {
+		t.Errorf("Flush: got %v want %v", err, werr)
+	}
+}
+
+func TestBRSPSyncWrite(t *testing.T) {
+	b, p := openTestBRSPWithOptions(t, BRSPOptions{SyncWrite: true})
+	defer b.Close()
+
+	werr := errors.New("write failed")
+	p.mu.Lock()
+	p.writeErr = werr
+	p.mu.Unlock()
+
+	if _, err := b.Write([]byte("lost")); err != werr {
+		t.Fatalf("Write: got %v want %v", err, werr)
+	}
+
+	p.mu.Lock()
+	p.writeErr = nil
+	p.mu.Unlock()
+
+	out := bytes.Repeat([]byte("sync"), 20)
+	n, err := b.Write(out)
+	if n != len(out) || err != nil {
+		t.Fatalf("Write: got %d, %v want %d, nil", n, err, len(out))
+	}
+
+	// The bytes were written before Write returned.
+	p.mu.Lock()
+	got := p.rxData.Bytes()
+	p.mu.Unlock()
+	if !bytes.Equal(got, out) {
+		t.Errorf("RX: got %q want %q", got, out)
+	}
+}
+
+func TestBRSPSyncWriteDeadline(t *testing.T) {
+	b, p := openTestBRSPWithOptions(t, BRSPOptions{SyncWrite: true})
+	defer b.Close()
+	p.latency = 20 * time.Millisecond
+
+	b.SetWriteDeadline(time.Now().Add(30 * time.Millisecond))
+	n, err := b.Write(make([]byte, 100))
+	if err != ErrTimeout {
+		t.Fatalf("Write: got %v want %v", err, ErrTimeout)
+	}
+	if n >= 100 {
+		t.Errorf("Write: reported %d bytes written before the deadline", n)
+	}
+}
+
+func TestBRSPConcurrentWriters(t *testing.T) {
+	for _, o := range []BRSPOptions{
+		{},
+		{MaxWriteBuffer: 64, BlockWhenFull: true},
+	} {
+		b, p := openTestBRSPWithOptions(t, o)
+
+		const writers, messages = 8, 100
+		var wg sync.WaitGroup
+		for g := 0; g < writers; g++ {
+			wg.Add(1)
+			go func(g int) {
+				defer wg.Done()
+				for i := 0; i < messages; i++ {
+					msg := fmt.Sprintf("<%d:%d:%s>", g, i, strings.Repeat("x", (g*7+i)%45))
+					if _, err := b.Write([]byte(msg)); err != nil {
+						t.Errorf("Write: %s", err)
+						return
+					}
+				}
+			}(g)
+		}
+		wg.Wait()
+		if err := b.Flush(); err != nil {
+			t.Fatalf("Flush: %s", err)
+		}
+		b.Close()
+
+		p.mu.Lock()
+		stream := p.rxData.String()
+		p.mu.Unlock()
+		next := make([]int, writers)
+		for _, msg := range strings.SplitAfter(stream, ">") {
+			if msg == "" {
+				continue
+			}
+			var g, i int
+			var x string
+			if _, err := fmt.Sscanf(msg, "<%d:%d:%s", &g, &i, &x); err != nil || g < 0 || g >= writers {
+				t.Fatalf("%+v: corrupt message %q", o, msg)
+			}
+			if want := fmt.Sprintf("<%d:%d:%s>", g, i, strings.Repeat("x", (g*7+i)%45)); msg != want || i != next[g] {
+				t.Fatalf("%+v: got %q want %q", o, msg, fmt.Sprintf("<%d:%d:...>", g, next[g]))
+			}
+			next[g]++
+		}
+		for g, n := range next {
+			if n != messages {
+				t.Errorf("%+v: writer %d: got %d messages want %d", o, g, n, messages)
+			}
+		}
+	}
+}
+
+func TestBRSPLastActivity(t *testing.T) {
+	b, p := openTestBRSP(t)
+	defer b.Close()
+
+	if !b.LastRead().IsZero() || !b.LastWrite().IsZero() {
+		t.Fatalf("LastRead, LastWrite: got %v, %v before any traffic", b.LastRead(), b.LastWrite())
+	}
+
+	start := time.Now()
+	b.Write([]byte("ping"))
+	if err := b.Flush(); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+	if w := b.LastWrite(); w.Before(start) || !b.LastRead().IsZero() {
+		t.Errorf("LastWrite, LastRead: got %v, %v want >= %v, zero", w, b.LastRead(), start)
+	}
+
+	go p.indicate([]byte("pong"), nil)
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(b, buf); err != nil {
+		t.Fatalf("Read: %s", err)
+	}
+	if r := b.LastRead(); r.Before(start) {
+		t.Errorf("LastRead: got %v want >= %v", r, start)
+	}
+}
+
+func TestBRSPIdleTimeout(t *testing.T) {
+	b, p := openTestBRSPWithOptions(t, BRSPOptions{
+		Timeouts: BRSPTimeouts{IdleTimeout: 50 * time.Millisecond},
+	})
+	defer b.Close()
+
+	// Traffic keeps the session alive.
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if _, err := b.Write([]byte("x")); err != nil {
+			t.Fatalf("Write %d: %s", i, err)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	p.indicate([]byte("last"), nil)
+
+	buf := make([]byte, 10)
+	if n, err := b.Read(buf); err != nil || string(buf[:n]) != "last" {
+		t.Fatalf("Read: got %q, %v want %q, nil", buf[:n], err, "last")
+	}
+	_, err := b.Read(buf)
+	if err != ErrIdle {
+		t.Fatalf("Read: got %v want %v", err, ErrIdle)
+	}
+	if d := time.Since(start); d < 150*time.Millisecond {
+		t.Errorf("idle after %v despite traffic", d)
+	}
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() || !errors.Is(err, ErrTimeout) {
+		t.Errorf("ErrIdle is not a timeout")
+	}
+	if ne, ok := err.(net.Error); ok && ne.Temporary() {
+		t.Errorf("ErrIdle is temporary")
+	}
+	if _, err := b.Write([]byte("x")); err != ErrDisconnected {
+		t.Errorf("Write: got %v want %v", err, ErrDisconnected)
+	}
+}
+
+func TestBRSPLogger(t *testing.T) {
+	type pdu struct {
+		dir  BRSPDirection
+		data string
+		err  error
+	}
+	pdus := make(chan pdu, 10)
+	logger := BRSPLoggerFunc(func(dir BRSPDirection, data []byte, err error) {
+		pdus <- pdu{dir, string(data), err}
+	})
+
+	b, p := openTestBRSPWithOptions(t, BRSPOptions{Logger: logger})
+	defer b.Close()
+
+	b.Write([]byte("ping"))
+	if got, want := <-pdus, (pdu{BRSPOut, "ping", nil}); got != want {
+		t.Errorf("out PDU: got %v want %v", got, want)
+	}
+
+	ierr := errors.New("indication failed")
+	go p.indicate([]byte("pong"), ierr)
+	if got, want := <-pdus, (pdu{BRSPIn, "pong", ierr}); got != want {
+		t.Errorf("in PDU: got %v want %v", got, want)
+	}
+}
+
+func TestBRSPWriterLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewBRSPWriterLogger(&buf)
+	l.LogPDU(BRSPIn, []byte{0x01, 0x02}, nil)
+	l.LogPDU(BRSPOut, []byte("hi"), nil)
+
+	want := "brspTx <nil>: 01 02\nbrspRx 68 69 (hi)\n"
+	if got := buf.String(); got != want {
+		t.Errorf("got %q want %q", got, want)
+	}
+}
+
+func TestBRSPName(t *testing.T) {
+	var buf bytes.Buffer
+	b, _ := openTestBRSPWithOptions(t, BRSPOptions{
+		Name:     "dev1",
+		Logger:   NewBRSPWriterLogger(&buf),
+		Timeouts: BRSPTimeouts{ReadTimeout: 10 * time.Millisecond},
+	})
+	defer b.Close()
+
+	if got := b.Name(); got != "dev1" {
+		t.Errorf("Name: got %q want %q", got, "dev1")
+	}
+	b.Write([]byte("hi"))
+	if err := b.Flush(); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+	if got, want := buf.String(), "dev1: brspRx 68 69 (hi)\n"; got != want {
+		t.Errorf("log: got %q want %q", got, want)
+	}
+
+	_, err := b.Read(make([]byte, 10))
+	if !errors.Is(err, ErrTimeout) || !strings.Contains(err.Error(), "dev1") {
+		t.Errorf("Read: got %v want %v labelled dev1", err, ErrTimeout)
+	}
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Errorf("Read: got %#v want a net.Error timeout", err)
+	}
+
+	b.Close()
+	if _, err := b.Write([]byte("x")); !errors.Is(err, ErrClosed) || !strings.Contains(err.Error(), "dev1") {
+		t.Errorf("Write: got %v want %v labelled dev1", err, ErrClosed)
+	}
+	if err := b.Flush(); !errors.Is(err, ErrClosed) {
+		t.Errorf("Flush: got %v want %v", err, ErrClosed)
+	}
+}
+
+func TestBRSPSetTap(t *testing.T) {
+	type pdu struct {
+		dir  BRSPDirection
+		data string
+		err  error
+	}
+	pdus := make(chan pdu, 10)
+	b, p := openTestBRSP(t)
+	defer b.Close()
+
+	b.Write([]byte("untapped"))
+	b.Flush()
+
+	b.SetTap(func(dir BRSPDirection, data []byte, err error) {
+		pdus <- pdu{dir, string(data), err}
+	})
+	b.Write([]byte("ping"))
+	if got, want := <-pdus, (pdu{BRSPOut, "ping", nil}); got != want {
+		t.Errorf("out PDU: got %v want %v", got, want)
+	}
+	go p.indicate([]byte("pong"), nil)
+	if got, want := <-pdus, (pdu{BRSPIn, "pong", nil}); got != want {
+		t.Errorf("in PDU: got %v want %v", got, want)
+	}
+
+	b.SetTap(nil)
+	b.Write([]byte("untapped"))
+	b.Flush()
+	select {
+	case got := <-pdus:
+		t.Errorf("PDU after removing the tap: %v", got)
+	default:
+	}
+}
+
+func TestOpenBRSPContextCancel(t *testing.T) {
+	p := newBRSPPeripheral()
+	p.modeHold = make(chan struct{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if _, err := OpenBRSPContext(ctx, p); err != context.DeadlineExceeded {
+		t.Fatalf("OpenBRSPContext: got %v want %v", err, context.DeadlineExceeded)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("OpenBRSPContext returned after %s", d)
+	}
+
+	// Let the abandoned setup finish; it must drop its TX subscription.
+	close(p.modeHold)
+	for i := 0; i < 200; i++ {
+		p.mu.Lock()
+		sub := p.onTx != nil
+		p.mu.Unlock()
+		if !sub {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Error("TX subscription was not removed")
+}
+
+func TestOpenBRSPContext(t *testing.T) {
+	p := newBRSPPeripheral()
+	b, err := OpenBRSPContext(context.Background(), p)
+	if err != nil {
+		t.Fatalf("OpenBRSPContext: %s", err)
+	}
+	defer b.Close()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.onTx == nil {
+		t.Error("TX is not subscribed")
+	}
+	if len(p.modes) != 1 || !bytes.Equal(p.modes[0], []byte{1}) {
+		t.Errorf("mode writes: got %v want [[1]]", p.modes)
+	}
+}
+
+// waitFor polls f until it returns want or a second has passed.
+func waitFor(t *testing.T, what string, f func() int, want int) {
+	got := f()
+	for i := 0; i < 200 && got != want; i++ {
+		time.Sleep(5 * time.Millisecond)
+		got = f()
+	}
+	if got != want {
+		t.Fatalf("%s: got %d want %d", what, got, want)
+	}
+}
+
+func TestBRSPBuffered(t *testing.T) {
+	b, p := openTestBRSP(t)
+	defer b.Close()
+
+	waitFor(t, "Buffered", b.Buffered, 0)
+
+	chunk := bytes.Repeat([]byte{0xaa}, 20)
+	for i := 0; i < 10; i++ {
+		p.indicate(chunk, nil)
+	}
+	waitFor(t, "Buffered", b.Buffered, 200)
+
+	buf := make([]byte, 150)
+	if n, _ := b.Read(buf); n != 150 {
+		t.Fatalf("Read: got %d bytes want 150", n)
+	}
+	waitFor(t, "Buffered", b.Buffered, 50)
+
+	// Wrap around the end of the queue's storage.
+	for i := 0; i < 5; i++ {
+		p.indicate(chunk, nil)
+	}
+	waitFor(t, "Buffered", b.Buffered, 150)
+
+	if n, _ := b.Read(make([]byte, 200)); n != 150 {
+		t.Fatalf("Read: got %d bytes want 150", n)
+	}
+	waitFor(t, "Buffered", b.Buffered, 0)
+}
+
+func TestBRSPReadAtLeast(t *testing.T) {
+	b, p := openTestBRSP(t)
+	defer b.Close()
+
+	buf := make([]byte, 16)
+	if n, err := b.ReadAtLeast(buf[:4], 8); n != 0 || err != io.ErrShortBuffer {
+		t.Errorf("ReadAtLeast: got %d, %v want 0, %v", n, err, io.ErrShortBuffer)
+	}
+	if n, err := b.ReadAtLeast(buf, 0); n != 0 || err != nil {
+		t.Errorf("ReadAtLeast: got %d, %v want 0, nil", n, err)
+	}
+
+	done := make(chan string, 1)
+	go func() {
+		n, _ := b.ReadAtLeast(buf, 8)
+		done <- string(buf[:n])
+	}()
+	p.indicate([]byte("abc"), nil)
+	p.indicate([]byte("defgh"), nil)
+	if got := <-done; got != "abcdefgh" {
+		t.Errorf("ReadAtLeast: got %q want %q", got, "abcdefgh")
+	}
+
+	// A timeout leaves partial input in place.
+	p.indicate([]byte("xyz"), nil)
+	b.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := b.ReadAtLeast(buf, 8); err != ErrTimeout {
+		t.Errorf("ReadAtLeast: got %v want %v", err, ErrTimeout)
+	}
+	b.SetReadDeadline(time.Time{})
+	if n, _ := b.Read(buf); string(buf[:n]) != "xyz" {
+		t.Errorf("Read: got %q want %q", buf[:n], "xyz")
+	}
+}
+
+func TestBRSPReadAtLeastOrder(t *testing.T) {
+	b, p := openTestBRSP(t)
+	defer b.Close()
+
+	first := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 8)
+		n, _ := b.ReadAtLeast(buf, 8)
+		first <- string(buf[:n])
+	}()
+	time.Sleep(10 * time.Millisecond)
+	second := make(chan string, 1)
+	go func() {
+		buf := make([]byte, 8)
+		n, _ := b.Read(buf)
+		second <- string(buf[:n])
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// The later Read must not take the input the ReadAtLeast waits for.
+	p.indicate([]byte("1234"), nil)
+	select {
+	case got := <-second:
+		t.Fatalf("Read overtook ReadAtLeast with %q", got)
+	case <-time.After(20 * time.Millisecond):
+	}
+	p.indicate([]byte("56789abc"), nil)
+	if got := <-first; got != "12345678" {
+		t.Errorf("ReadAtLeast: got %q want %q", got, "12345678")
+	}
+	if got := <-second; got != "9abc" {
+		t.Errorf("Read: got %q want %q", got, "9abc")
+	}
+}
+
+func TestBRSPReadAtLeastDisconnect(t *testing.T) {
+	b, p := openTestBRSP(t)
+	defer b.Close()
+
+	p.indicate([]byte("ab"), io.EOF)
+	buf := make([]byte, 8)
+	if n, err := b.ReadAtLeast(buf, 5); string(buf[:n]) != "ab" || err != io.ErrUnexpectedEOF {
+		t.Errorf("ReadAtLeast: got %q, %v want %q, %v", buf[:n], err, "ab", io.ErrUnexpectedEOF)
+	}
+	if _, err := b.ReadAtLeast(buf, 5); err != io.EOF {
+		t.Errorf("ReadAtLeast: got %v want %v", err, io.EOF)
+	}
+}
+
+func TestBRSPCloseCause(t *testing.T) {
+	local, _ := openTestBRSP(t)
+	local.Close()
+	remote, p := openTestBRSP(t)
+	defer remote.Close()
+	p.indicate([]byte("last"), io.EOF)
+
+	buf := make([]byte, 10)
+	remote.Read(buf)
+	cases := []struct {
+		name string
+		b    *BRSP
+		read error
+		rest error // Write and Flush
+	}{
+		{name: "local", b: local, read: ErrClosed, rest: ErrClosed},
+		{name: "remote", b: remote, read: io.EOF, rest: ErrDisconnected},
+	}
+	for _, tt := range cases {
+		_, rerr := tt.b.Read(buf)
+		_, werr := tt.b.Write([]byte("x"))
+		ferr := tt.b.Flush()
+		for _, e := range []struct {
+			op   string
+			err  error
+			want error
+		}{
+			{"Read", rerr, tt.read},
+			{"Write", werr, tt.rest},
+			{"Flush", ferr, tt.rest},
+		} {
+			if !errors.Is(e.err, e.want) {
+				t.Errorf("%s %s: got %v want %v", tt.name, e.op, e.err, e.want)
+			}
+			if tt.name == "remote" && errors.Is(e.err, ErrClosed) {
+				t.Errorf("%s %s: got %v after the peripheral went away", tt.name, e.op, e.err)
+			}
+		}
+	}
+}
+
+func TestBRSPAbandonedRead(t *testing.T) {
+	b, p := openTestBRSP(t)
+	defer b.Close()
+
+	// A reader that gave up without telling the session: its request is
+	// pending in the loop, and nobody will ever receive the result.
+	abandoned := brspRequest{p: make([]byte, 10), r: make(chan brspResult, 1)}
+	b.readReq <- abandoned
+
+	p.indicate([]byte("for nobody"), nil)
+	p.indicate([]byte("for me"), nil)
+	buf := make([]byte, 10)
+	if n, err := b.Read(buf); err != nil || string(buf[:n]) != "for me" {
+		t.Errorf("Read: got %q, %v want %q, nil", buf[:n], err, "for me")
+	}
+	b.Write([]byte("still working"))
+	if err := b.Flush(); err != nil {
+		t.Errorf("Flush: %s", err)
+	}
+	if res := <-abandoned.r; string(abandoned.p[:res.n]) != "for nobody" {
+		t.Errorf("abandoned read: got %q want %q", abandoned.p[:res.n], "for nobody")
+	}
+}
+
+func TestBRSPCheckSequence(t *testing.T) {
+	b, p := openTestBRSPWithOptions(t, BRSPOptions{CheckSequence: true})
+	defer b.Close()
+
+	p.indicate([]byte{254, 'a', 'b'}, nil)
+	p.indicate([]byte{255, 'c'}, nil)
+	p.indicate([]byte{0, 'd'}, nil)
+	p.indicate([]byte{3, 'e'}, nil) // 1 and 2 were lost
+	p.indicate([]byte{4, 'f'}, nil)
+
+	buf := make([]byte, 10)
+	if n, err := b.Read(buf); err != nil || string(buf[:n]) != "abcd" {
+		t.Fatalf("Read: got %q, %v want %q, nil", buf[:n], err, "abcd")
+	}
+	if peeked, err := b.Peek(10); len(peeked) != 0 || !errors.Is(err, ErrDataLoss) {
+		t.Errorf("Peek: got %q, %v want %v", peeked, err, ErrDataLoss)
+	}
+	_, err := b.Read(buf)
+	if lerr, ok := err.(*BRSPDataLossError); !ok || lerr.Missing != 2 || !errors.Is(err, ErrDataLoss) {
+		t.Fatalf("Read: got %v want 2 PDUs missing", err)
+	}
+	if n, err := b.Read(buf); err != nil || string(buf[:n]) != "ef" {
+		t.Errorf("Read: got %q, %v want %q, nil", buf[:n], err, "ef")
+	}
+
+	// ReadAtLeast reads across a gap.
+	p.indicate([]byte{5, 'g'}, nil)
+	p.indicate([]byte{7, 'h'}, nil)
+	if n, err := b.ReadAtLeast(buf, 2); err != nil || string(buf[:n]) != "gh" {
+		t.Errorf("ReadAtLeast: got %q, %v want %q, nil", buf[:n], err, "gh")
+	}
+	p.indicate([]byte{8, 'i'}, nil)
+	if n, err := b.Read(buf); err != nil || string(buf[:n]) != "i" {
+		t.Errorf("Read: got %q, %v want %q, nil", buf[:n], err, "i")
+	}
+}
+
+func TestBRSPSendSequence(t *testing.T) {
+	b, p := openTestBRSPWithOptions(t, BRSPOptions{SendSequence: true})
+	defer b.Close()
+
+	out := bytes.Repeat([]byte("0123456789"), 30)
+	b.Write(out)
+	if err := b.Flush(); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var data []byte
+	for i, w := range p.rxWrites {
+		if len(w) > 20 || w[0] != byte(i) {
+			t.Fatalf("PDU %d: got %d bytes with sequence number %d", i, len(w), w[0])
+		}
+		data = append(data, w[1:]...)
+	}
+	if !bytes.Equal(data, out) {
+		t.Errorf("RX data: got %q want %q", data, out)
+	}
+	if n := len(p.rxWrites); n != 16 {
+		t.Errorf("PDUs: got %d want 16", n)
+	}
+}
+
+func TestBRSPReadLine(t *testing.T) {
+	b, p := openTestBRSP(t)
+	defer b.Close()
+
+	done := make(chan string, 1)
+	go func() {
+		line, err := b.ReadLine('\r', 16)
+		if err != nil {
+			t.Errorf("ReadLine: %s", err)
+		}
+		done <- string(line)
+	}()
+	// The delimiter arrives on its own, after a line split across PDUs.
+	p.indicate([]byte("AT+"), nil)
+	p.indicate([]byte("OK"), nil)
+	p.indicate([]byte("\rNEXT"), nil)
+	if line := <-done; line != "AT+OK\r" {
+		t.Errorf("ReadLine: got %q want %q", line, "AT+OK\r")
+	}
+
+	b.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if line, err := b.ReadLine('\r', 16); err != ErrTimeout || len(line) != 0 {
+		t.Errorf("ReadLine: got %q, %v want %v", line, err, ErrTimeout)
+	}
+	b.SetReadDeadline(time.Time{})
+	p.indicate([]byte("\r"), nil)
+	if line, err := b.ReadLine('\r', 16); err != nil || string(line) != "NEXT\r" {
+		t.Errorf("ReadLine: got %q, %v want %q, nil", line, err, "NEXT\r")
+	}
+
+	p.indicate([]byte("0123456789abcdefXY\r"), nil)
+	if _, err := b.ReadLine('\r', 16); err != ErrFrameTooLarge {
+		t.Errorf("ReadLine: got %v want %v", err, ErrFrameTooLarge)
+	}
+	b.Discard(16)
+	if line, err := b.ReadLine('\r', 16); err != nil || string(line) != "XY\r" {
+		t.Errorf("ReadLine: got %q, %v want %q, nil", line, err, "XY\r")
+	}
+
+	p.indicate([]byte("half"), io.EOF)
+	if line, err := b.ReadLine('\r', 16); string(line) != "half" || err != io.ErrUnexpectedEOF {
+		t.Errorf("ReadLine: got %q, %v want %q, %v", line, err, "half", io.ErrUnexpectedEOF)
+	}
+	if _, err := b.ReadLine('\r', 16); err != io.EOF {
+		t.Errorf("ReadLine: got %v want %v", err, io.EOF)
+	}
+}
+
+func TestBRSPPeek(t *testing.T) {
+	b, p := openTestBRSP(t)
+	defer b.Close()
+
+	done := make(chan []byte, 1)
+	go func() {
+		buf, _ := b.Peek(4)
+		done <- buf
+	}()
+	p.indicate([]byte("GET /"), nil)
+	peeked := <-done
+	if string(peeked) != "GET " {
+		t.Fatalf("Peek: got %q want %q", peeked, "GET ")
+	}
+
+	if buf, err := b.Peek(100); string(buf) != "GET /" || err != nil {
+		t.Errorf("Peek: got %q, %v want %q, nil", buf, err, "GET /")
+	}
+	if n := b.Buffered(); n != 5 {
+		t.Errorf("Buffered after Peek: got %d want 5", n)
+	}
+
+	// The peeked bytes are a copy, unaffected by the queue changing.
+	p.indicate(bytes.Repeat([]byte("x"), 1000), nil)
+	buf := make([]byte, 5)
+	if n, _ := b.Read(buf); string(buf[:n]) != "GET /" {
+		t.Errorf("Read: got %q want %q", buf[:n], "GET /")
+	}
+	if string(peeked) != "GET " {
+		t.Errorf("peeked bytes changed to %q", peeked)
+	}
+	b.DrainInput()
+
+	b.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := b.Peek(1); err != ErrTimeout {
+		t.Errorf("Peek: got %v want %v", err, ErrTimeout)
+	}
+}
+
+func TestBRSPDiscard(t *testing.T) {
+	b, p := openTestBRSP(t)
+	defer b.Close()
+
+	p.indicate([]byte("hello world"), nil)
+	if n, err := b.Discard(6); n != 6 || err != nil {
+		t.Fatalf("Discard: got %d, %v want 6, nil", n, err)
+	}
+	buf := make([]byte, 10)
+	if n, _ := b.Read(buf); string(buf[:n]) != "world" {
+		t.Fatalf("Read: got %q want %q", buf[:n], "world")
+	}
+
+	// Discard waits for data like Read does.
+	done := make(chan int, 1)
+	go func() {
+		n, _ := b.Discard(5)
+		done <- n
+	}()
+	p.indicate([]byte("abc"), nil)
+	p.indicate([]byte("defgh"), nil)
+	if n := <-done; n != 5 {
+		t.Fatalf("Discard: got %d want 5", n)
+	}
+	if n, _ := b.Read(buf); string(buf[:n]) != "fgh" {
+		t.Fatalf("Read: got %q want %q", buf[:n], "fgh")
+	}
+
+	p.indicate([]byte("xy"), io.EOF)
+	if n, err := b.Discard(5); n != 2 || err != io.EOF {
+		t.Errorf("Discard after disconnect: got %d, %v want 2, %v", n, err, io.EOF)
+	}
+}
+
+func TestBRSPDrainInput(t *testing.T) {
+	b, p := openTestBRSP(t)
+	defer b.Close()
+
+	if n := b.DrainInput(); n != 0 {
+		t.Errorf("DrainInput: got %d want 0", n)
+	}
+	p.indicate([]byte("garbage"), nil)
+	p.indicate([]byte("more garbage"), nil)
+	waitFor(t, "buffered", b.Buffered, 19)
+	if n := b.DrainInput(); n != 19 {
+		t.Errorf("DrainInput: got %d want 19", n)
+	}
+	if n := b.Buffered(); n != 0 {
+		t.Errorf("Buffered: got %d want 0", n)
+	}
+
+	p.indicate([]byte("sync"), nil)
+	buf := make([]byte, 10)
+	if n, _ := b.Read(buf); string(buf[:n]) != "sync" {
+		t.Errorf("Read: got %q want %q", buf[:n], "sync")
+	}
+
+	b.Close()
+	if n := b.DrainInput(); n != 0 {
+		t.Errorf("DrainInput after Close: got %d want 0", n)
+	}
+}
+
+func TestBRSPPending(t *testing.T) {
+	b, p := openTestBRSP(t)
+	defer b.Close()
+	p.rxGate = make(chan struct{})
+
+	waitFor(t, "Pending", b.Pending, 0)
+
+	b.Write(make([]byte, 50))
+	waitFor(t, "Pending", b.Pending, 50)
+
+	p.rxGate <- struct{}{}
+	waitFor(t, "Pending", b.Pending, 30)
+
+	b.Write(make([]byte, 15))
+	waitFor(t, "Pending", b.Pending, 45)
+
+	for i := 0; i < 3; i++ {
+		p.rxGate <- struct{}{}
+	}
+	waitFor(t, "Pending", b.Pending, 0)
+	if err := b.Flush(); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+	if got := p.received(t, 65); len(got) != 65 {
+		t.Errorf("RX: got %d bytes want 65", len(got))
+	}
+}
+
+func TestBRSPMaxWriteBuffer(t *testing.T) {
+	b, p := openTestBRSPWithOptions(t, BRSPOptions{MaxWriteBuffer: 64})
+	defer b.Close()
+	p.rxGate = make(chan struct{})
+
+	chunk := make([]byte, 16)
+	for i := 0; i < 4; i++ {
+		if _, err := b.Write(chunk); err != nil {
+			t.Fatalf("Write %d: %s", i, err)
+		}
+	}
+	if _, err := b.Write(chunk); err != ErrWriteBufferFull {
+		t.Fatalf("Write: got %v want %v", err, ErrWriteBufferFull)
+	}
+	if n := b.Pending(); n != 64 {
+		t.Errorf("Pending: got %d want 64", n)
+	}
+	if st := b.Stats(); st.WritesRejected != 1 || st.BytesRejected != 16 || st.WritesBlocked != 0 {
+		t.Errorf("Stats: got %d writes, %d bytes rejected, %d blocked want 1, 16, 0",
+			st.WritesRejected, st.BytesRejected, st.WritesBlocked)
+	}
+
+	// Once a chunk has been written there is room again.
+	p.rxGate <- struct{}{}
+	waitFor(t, "Pending", b.Pending, 48)
+	if _, err := b.Write(chunk); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+
+	close(p.rxGate)
+	if err := b.Flush(); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+	if got := p.received(t, 80); len(got) != 80 {
+		t.Errorf("RX: got %d bytes want 80", len(got))
+	}
+}
+
+func TestBRSPWriteSome(t *testing.T) {
+	b, p := openTestBRSPWithOptions(t, BRSPOptions{MaxWriteBuffer: 64, BlockWhenFull: true})
+	defer b.Close()
+	p.rxGate = make(chan struct{})
+
+	if n, err := b.WriteSome(seqBytes(0, 40)); n != 40 || err != nil {
+		t.Fatalf("WriteSome: got %d, %v want 40, nil", n, err)
+	}
+	if n, err := b.WriteSome(seqBytes(40, 40)); n != 24 || err != ErrWriteBufferFull {
+		t.Fatalf("WriteSome: got %d, %v want 24, %v", n, err, ErrWriteBufferFull)
+	}
+	if n, err := b.WriteSome(seqBytes(64, 40)); n != 0 || err != ErrWriteBufferFull {
+		t.Fatalf("WriteSome: got %d, %v want 0, %v", n, err, ErrWriteBufferFull)
+	}
+
+	// A blocked Write keeps its place ahead of later WriteSome calls.
+	done := make(chan error, 1)
+	go func() {
+		_, err := b.Write(seqBytes(64, 8))
+		done <- err
+	}()
+	waitFor(t, "WritesBlocked", func() int { return int(b.Stats().WritesBlocked) }, 1)
+	if n, err := b.WriteSome(seqBytes(72, 8)); n != 0 || err != ErrWriteBufferFull {
+		t.Fatalf("WriteSome behind blocked Write: got %d, %v want 0, %v", n, err, ErrWriteBufferFull)
+	}
+
+	p.rxGate <- struct{}{}
+	if err := <-done; err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	if n, err := b.WriteSome(seqBytes(72, 40)); n != 12 || err != ErrWriteBufferFull {
+		t.Fatalf("WriteSome: got %d, %v want 12, %v", n, err, ErrWriteBufferFull)
+	}
+
+	close(p.rxGate)
+	if err := b.Flush(); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+	if got := p.received(t, 84); !bytes.Equal(got, seqBytes(0, 84)) {
+		t.Errorf("RX: got %v want %v", got, seqBytes(0, 84))
+	}
+	if st := b.Stats(); st.WritesRejected != 4 {
+		t.Errorf("WritesRejected: got %d want 4", st.WritesRejected)
+	}
+}
+
+func TestBRSPMaxWriteBufferBlocking(t *testing.T) {
+	b, p := openTestBRSPWithOptions(t, BRSPOptions{MaxWriteBuffer: 50, BlockWhenFull: true})
+	defer b.Close()
+	p.rxGate = make(chan struct{})
+
+	// The peripheral is stalled; Write must block rather than buffer 1KB.
+	out := make([]byte, 1024)
+	for i := range out {
+		out[i] = byte(i)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := b.Write(out)
+		done <- err
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	if n := b.Pending(); n > 50 {
+		t.Errorf("Pending: got %d, want at most 50", n)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("Write returned %v while the peripheral was stalled", err)
+	default:
+	}
+
+	close(p.rxGate)
+	if err := <-done; err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	if err := b.Flush(); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+	if got := p.received(t, len(out)); !bytes.Equal(got, out) {
+		t.Errorf("RX: got % x want % x", got, out)
+	}
+	if st := b.Stats(); st.WritesBlocked != 1 || st.WritesRejected != 0 || st.MaxOutQueued > 50 {
+		t.Errorf("Stats: got %d writes blocked, %d rejected, %d max queued want 1, 0, <= 50",
+			st.WritesBlocked, st.WritesRejected, st.MaxOutQueued)
+	}
+}
+
+func TestBRSPCloseWithFullWriteBuffer(t *testing.T) {
+	b, p := openTestBRSPWithOptions(t, BRSPOptions{MaxWriteBuffer: 20, BlockWhenFull: true})
+	p.rxGate = make(chan struct{})
+	defer close(p.rxGate)
+
+	done := make(chan error, 2)
+	go func() {
+		_, err := b.Write(make([]byte, 100))
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	go func() {
+		done <- b.Flush()
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	b.Close()
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-done:
+			if err != ErrClosed {
+				t.Errorf("got %v want %v", err, ErrClosed)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Write or Flush still blocked after Close")
+		}
+	}
+}
+
+func TestBRSPCloseStress(t *testing.T) {
+	for round := 0; round < 20; round++ {
+		b, p := openTestBRSPWithOptions(t, BRSPOptions{MaxWriteBuffer: 64, BlockWhenFull: true})
+		go func() {
+			for i := 0; i < 20; i++ {
+				p.indicate([]byte("incoming"), nil)
+			}
+		}()
+
+		const workers = 8
+		errs := make(chan error, 4*workers)
+		var wg sync.WaitGroup
+		for i := 0; i < workers; i++ {
+			wg.Add(4)
+			go func() {
+				defer wg.Done()
+				for {
+					if _, err := b.Read(make([]byte, 5)); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				for {
+					if _, err := b.Write(make([]byte, 30)); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				for {
+					if err := b.Flush(); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}()
+			go func() {
+				defer wg.Done()
+				for {
+					b.Stats()
+					b.Buffered()
+					if err := b.SetDeadline(time.Time{}); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}()
+		}
+		time.Sleep(time.Millisecond)
+		b.Close()
+
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("round %d: calls still blocked after Close", round)
+		}
+		close(errs)
+		for err := range errs {
+			if err != ErrClosed {
+				t.Errorf("round %d: got %v want %v", round, err, ErrClosed)
+			}
+		}
+	}
+}
+
+func TestBRSPFlushContext(t *testing.T) {
+	b, p := openTestBRSP(t)
+	defer b.Close()
+	p.rxGate = make(chan struct{})
+
+	if _, err := b.Write([]byte("stalled")); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := b.FlushContext(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("FlushContext: got %v want %v", err, context.DeadlineExceeded)
+	}
+
+	// The abandoned flush must not wedge the loop once the peripheral
+	// catches up, and a later Flush still completes.
+	werr := errors.New("write failed")
+	p.mu.Lock()
+	p.writeErr = werr
+	p.mu.Unlock()
+	close(p.rxGate)
+	if err := b.Flush(); err != werr {
+		t.Fatalf("Flush: got %v want %v", err, werr)
+	}
+	if err := b.Flush(); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+}
+
+func TestBRSPDisconnect(t *testing.T) {
+	b, p := openTestBRSP(t)
+	defer b.Close()
+
+	p.indicate([]byte("one\ntwo\n"), nil)
+	p.indicate([]byte("three\n"), io.EOF)
+
+	var lines []string
+	s := bufio.NewScanner(b)
+	for s.Scan() {
+		lines = append(lines, s.Text())
+	}
+	if err := s.Err(); err != nil {
+		t.Fatalf("Scan: %s", err)
+	}
+	if got, want := strings.Join(lines, ","), "one,two,three"; got != want {
+		t.Errorf("lines: got %q want %q", got, want)
+	}
+
+	if n, err := b.Read(make([]byte, 10)); n != 0 || err != io.EOF {
+		t.Errorf("Read: got %d, %v want 0, %v", n, err, io.EOF)
+	}
+	if _, err := b.Write([]byte("x")); err != ErrDisconnected {
+		t.Errorf("Write: got %v want %v", err, ErrDisconnected)
+	}
+	if err := b.Flush(); err != ErrDisconnected {
+		t.Errorf("Flush: got %v want %v", err, ErrDisconnected)
+	}
+}
+
+func TestBRSPDisconnectUnblocksPending(t *testing.T) {
+	b, p := openTestBRSPWithOptions(t, BRSPOptions{SyncWrite: true})
+	defer b.Close()
+	p.rxGate = make(chan struct{})
+	defer close(p.rxGate)
+
+	rerr := make(chan error, 1)
+	go func() {
+		_, err := b.Read(make([]byte, 10))
+		rerr <- err
+	}()
+	werr := make(chan error, 1)
+	go func() {
+		_, err := b.Write(make([]byte, 100))
+		werr <- err
+	}()
+	waitFor(t, "pending", b.Pending, 100)
+
+	p.indicate(nil, io.EOF)
+	if err := <-rerr; err != io.EOF {
+		t.Errorf("Read: got %v want %v", err, io.EOF)
+	}
+	if err := <-werr; err != ErrDisconnected {
+		t.Errorf("Write: got %v want %v", err, ErrDisconnected)
+	}
+	if n := b.Pending(); n != 0 {
+		t.Errorf("Pending: got %d want 0", n)
+	}
+}
+
+func TestBRSPServiceChanged(t *testing.T) {
+	p := newBRSPPeripheral()
+	resubscribed := make(chan error, 1)
+	b, err := OpenBRSPWithOptions(p, BRSPOptions{
+		OnResubscribe: func(err error) { resubscribed <- err },
+	})
+	if err != nil {
+		t.Fatalf("OpenBRSP: %s", err)
+	}
+	defer b.Close()
+
+	b.Write([]byte("before"))
+	b.Flush()
+	p.serviceChanged()
+	if err := <-resubscribed; err != nil {
+		t.Fatalf("OnResubscribe: %s", err)
+	}
+
+	p.mu.Lock()
+	modes := len(p.modes)
+	p.mu.Unlock()
+	if modes != 2 {
+		t.Errorf("mode writes: got %d want 2", modes)
+	}
+
+	p.indicate([]byte("still there"), nil)
+	buf := make([]byte, 20)
+	if n, err := b.Read(buf); err != nil || string(buf[:n]) != "still there" {
+		t.Errorf("Read: got %q, %v want %q, nil", buf[:n], err, "still there")
+	}
+	b.Write([]byte(" after"))
+	if err := b.Flush(); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+	if got := string(p.received(t, 12)); got != "before after" {
+		t.Errorf("received %q want %q", got, "before after")
+	}
+}
+
+var brspTestFlowUUID = MustParseUUID("7d0a61d4-2a0e-4c1b-9f4e-54a3e2d1f0c5")
+
+func TestBRSPFlowControl(t *testing.T) {
+	p := newBRSPPeripheral().withFlow(brspTestFlowUUID, []byte{1})
+	b, err := OpenBRSPWithOptions(p, BRSPOptions{FlowUUID: brspTestFlowUUID})
+	if err != nil {
+		t.Fatalf("OpenBRSP: %s", err)
+	}
+	defer b.Close()
+
+	if _, err := b.Write([]byte("held back")); err != nil {
+		t.Fatalf("Write: %s", err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	p.mu.Lock()
+	n := len(p.rxWrites)
+	p.mu.Unlock()
+	if n != 0 {
+		t.Fatalf("RX writes while busy: got %d want 0", n)
+	}
+
+	p.setFlow(0)
+	if err := b.Flush(); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+	if got := string(p.received(t, 9)); got != "held back" {
+		t.Errorf("received %q want %q", got, "held back")
+	}
+
+	p.setFlow(1)
+	b.Write([]byte(" again"))
+	time.Sleep(20 * time.Millisecond)
+	p.mu.Lock()
+	n = p.rxData.Len()
+	p.mu.Unlock()
+	if n != 9 {
+		t.Fatalf("RX bytes while busy: got %d want 9", n)
+	}
+	p.setFlow(0)
+	if err := b.Flush(); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+	if got := string(p.received(t, 15)); got != "held back again" {
+		t.Errorf("received %q want %q", got, "held back again")
+	}
+}
+
+func TestBRSPFlowControlAbsent(t *testing.T) {
+	p := newBRSPPeripheral()
+	b, err := OpenBRSPWithOptions(p, BRSPOptions{FlowUUID: brspTestFlowUUID})
+	if err != nil {
+		t.Fatalf("OpenBRSP: %s", err)
+	}
+	defer b.Close()
+
+	b.Write([]byte("hello"))
+	if err := b.Flush(); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+	if got := string(p.received(t, 5)); got != "hello" {
+		t.Errorf("received %q want %q", got, "hello")
+	}
+}
+
+func TestBRSPSubscriptionLost(t *testing.T) {
+	p := newBRSPPeripheral()
+	resubscribed := make(chan error, 1)
+	b, err := OpenBRSPWithOptions(p, BRSPOptions{
+		OnResubscribe: func(err error) { resubscribed <- err },
+	})
+	if err != nil {
+		t.Fatalf("OpenBRSP: %s", err)
+	}
+	defer b.Close()
+
+	p.indicate([]byte("buffered"), nil)
+	derr := errors.New("discovery failed")
+	p.mu.Lock()
+	p.discoverErr = derr
+	p.mu.Unlock()
+	p.serviceChanged()
+	if err := <-resubscribed; err != derr {
+		t.Fatalf("OnResubscribe: got %v want %v", err, derr)
+	}
+
+	buf := make([]byte, 20)
+	if n, err := b.Read(buf); err != nil || string(buf[:n]) != "buffered" {
+		t.Errorf("Read: got %q, %v want %q, nil", buf[:n], err, "buffered")
+	}
+	if _, err := b.Read(buf); err != ErrSubscriptionLost {
+		t.Errorf("Read: got %v want %v", err, ErrSubscriptionLost)
+	}
+	if _, err := b.Write([]byte("x")); err != ErrDisconnected {
+		t.Errorf("Write: got %v want %v", err, ErrDisconnected)
+	}
+}
+
+func TestBRSPTxSubscription(t *testing.T) {
+	tests := []struct {
+		props  Property
+		notify bool
+		want   bool
+	}{
+		{CharIndicate | CharNotify, false, false},
+		{CharIndicate | CharNotify, true, true},
+		{CharIndicate, true, false},
+		{CharNotify, false, true},
+	}
+	for _, tt := range tests {
+		p := newBRSPPeripheral()
+		p.tx.props = tt.props
+		b, err := OpenBRSPWithOptions(p, BRSPOptions{Notify: tt.notify})
+		if err != nil {
+			t.Fatalf("OpenBRSP: %s", err)
+		}
+
+		p.mu.Lock()
+		notify := p.notify
+		p.mu.Unlock()
+		if notify != tt.want {
+			t.Errorf("props %s, Notify %t: notify got %t want %t", tt.props, tt.notify, notify, tt.want)
+		}
+
+		go p.indicate([]byte("data"), nil)
+		buf := make([]byte, 10)
+		if n, err := b.Read(buf); err != nil || string(buf[:n]) != "data" {
+			t.Errorf("props %s, Notify %t: Read got %q, %v", tt.props, tt.notify, buf[:n], err)
+		}
+		b.Close()
+	}
+}
+
+func TestBRSPWriteWithResponse(t *testing.T) {
+	for _, withRsp := range []bool{false, true} {
+		b, p := openTestBRSPWithOptions(t, BRSPOptions{WriteWithResponse: withRsp})
+
+		b.Write(make([]byte, 30))
+		if err := b.Flush(); err != nil {
+			t.Fatalf("Flush: %s", err)
+		}
+		p.mu.Lock()
+		noRsp := p.rxNoRsp
+		if len(noRsp) != 2 || noRsp[0] == withRsp || noRsp[1] == withRsp {
+			t.Errorf("WriteWithResponse %t: got noRsp %v", withRsp, noRsp)
+		}
+		p.mu.Unlock()
+		b.Close()
+	}
+}
+
+func TestBRSPCoalesce(t *testing.T) {
+	b, p := openTestBRSPWithOptions(t, BRSPOptions{CoalesceDelay: 50 * time.Millisecond})
+	defer b.Close()
+
+	for i := 0; i < 10; i++ {
+		if _, err := b.Write([]byte{byte(2 * i), byte(2*i + 1)}); err != nil {
+			t.Fatalf("Write: %s", err)
+		}
+	}
+	p.received(t, 20)
+
+	p.mu.Lock()
+	writes := p.rxWrites
+	p.mu.Unlock()
+	if len(writes) != 1 || len(writes[0]) != 20 {
+		t.Errorf("RX writes: got %d, want a single 20-byte write", len(writes))
+	}
+
+	// A short tail goes out after the delay, or right away on Flush.
+	start := time.Now()
+	b.Write([]byte("tail"))
+	p.received(t, 24)
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Errorf("tail sent after %s, want at least %s", d, 50*time.Millisecond)
+	}
+
+	start = time.Now()
+	b.Write([]byte("flushed"))
+	if err := b.Flush(); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+	if d := time.Since(start); d >= 50*time.Millisecond {
+		t.Errorf("Flush took %s, want it to skip the delay", d)
+	}
+}
+
+func TestBRSPCloseWrite(t *testing.T) {
+	b, p := openTestBRSPWithOptions(t, BRSPOptions{CloseWriteMode: []byte{0}})
+	defer b.Close()
+	p.latency = 5 * time.Millisecond
+
+	b.Write([]byte("request that spans two chunks"))
+	if err := b.CloseWrite(); err != nil {
+		t.Fatalf("CloseWrite: %s", err)
+	}
+
+	p.mu.Lock()
+	rx := p.rxData.String()
+	modes := p.modes
+	p.mu.Unlock()
+	if rx != "request that spans two chunks" {
+		t.Errorf("RX: got %q before CloseWrite returned", rx)
+	}
+	if len(modes) != 2 || !bytes.Equal(modes[1], []byte{0}) {
+		t.Errorf("modes: got %v want [[1] [0]]", modes)
+	}
+
+	if _, err := b.Write([]byte("x")); err != ErrClosed {
+		t.Errorf("Write: got %v want %v", err, ErrClosed)
+	}
+	if err := b.CloseWrite(); err != ErrClosed {
+		t.Errorf("CloseWrite: got %v want %v", err, ErrClosed)
+	}
+
+	go p.indicate([]byte("response"), nil)
+	buf := make([]byte, 20)
+	if n, err := b.Read(buf); err != nil || string(buf[:n]) != "response" {
+		t.Errorf("Read: got %q, %v want %q, nil", buf[:n], err, "response")
+	}
+}
+
+func TestBRSPCloseGracefully(t *testing.T) {
+	b, p := openTestBRSPWithOptions(t, BRSPOptions{CloseWriteMode: []byte{0}})
+	p.rxGate = make(chan struct{})
+
+	b.Write([]byte("last command before hangup"))
+	done := make(chan error, 1)
+	go func() { done <- b.CloseGracefully(context.Background()) }()
+
+	p.rxGate <- struct{}{}
+	select {
+	case err := <-done:
+		t.Fatalf("CloseGracefully returned %v with output pending", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	p.rxGate <- struct{}{}
+	if err := <-done; err != nil {
+		t.Fatalf("CloseGracefully: %s", err)
+	}
+
+	p.mu.Lock()
+	rx := p.rxData.String()
+	modes := p.modes
+	p.mu.Unlock()
+	if rx != "last command before hangup" {
+		t.Errorf("RX: got %q", rx)
+	}
+	if len(modes) != 2 || !bytes.Equal(modes[1], []byte{0}) {
+		t.Errorf("modes: got %v want [[1] [0]]", modes)
+	}
+	if _, err := b.Write([]byte("x")); err != ErrClosed {
+		t.Errorf("Write: got %v want %v", err, ErrClosed)
+	}
+}
+
+func TestBRSPCloseGracefullyTimeout(t *testing.T) {
+	b, p := openTestBRSP(t)
+	p.rxGate = make(chan struct{})
+	defer close(p.rxGate)
+
+	b.Write([]byte("never written"))
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := b.CloseGracefully(ctx); err != context.DeadlineExceeded {
+		t.Errorf("CloseGracefully: got %v want %v", err, context.DeadlineExceeded)
+	}
+	if _, err := b.Write([]byte("x")); err != ErrClosed {
+		t.Errorf("Write: got %v want %v", err, ErrClosed)
+	}
+}
+
+func TestBRSPReattach(t *testing.T) {
+	b, p := openTestBRSPWithOptions(t, BRSPOptions{Resumable: true})
+	defer b.Close()
+	p.rxGate = make(chan struct{})
+	defer close(p.rxGate)
+
+	data := make([]byte, 100)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	b.Write(data)
+
+	// The link drops after two chunks, with the third one in flight.
+	p.rxGate <- struct{}{}
+	p.rxGate <- struct{}{}
+	if got := p.received(t, 40); !bytes.Equal(got, data[:40]) {
+		t.Fatalf("RX before disconnect: got % x", got)
+	}
+	p.indicate([]byte("unread"), nil)
+	p.indicate(nil, io.EOF)
+
+	buf := make([]byte, 20)
+	if n, err := b.Read(buf); err != nil || string(buf[:n]) != "unread" {
+		t.Fatalf("Read: got %q, %v want %q, nil", buf[:n], err, "unread")
+	}
+	rc := make(chan string, 1)
+	go func() {
+		n, err := b.Read(buf)
+		if err != nil {
+			rc <- err.Error()
+		}
+		rc <- string(buf[:n])
+	}()
+	select {
+	case s := <-rc:
+		t.Fatalf("Read returned %q while detached", s)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	p2 := newBRSPPeripheral()
+	if err := b.Reattach(p2); err != nil {
+		t.Fatalf("Reattach: %s", err)
+	}
+	if got := p2.received(t, 60); !bytes.Equal(got, data[40:]) {
+		t.Errorf("RX after Reattach: got % x want % x", got, data[40:])
+	}
+	if err := b.Flush(); err != nil {
+		t.Errorf("Flush: %s", err)
+	}
+
+	go p2.indicate([]byte("resumed"), nil)
+	if s := <-rc; s != "resumed" {
+		t.Errorf("Read: got %q want %q", s, "resumed")
+	}
+}
+
+func TestBRSPReattachNotResumable(t *testing.T) {
+	b, _ := openTestBRSP(t)
+	defer b.Close()
+
+	if err := b.Reattach(newBRSPPeripheral()); err != ErrNotResumable {
+		t.Errorf("Reattach: got %v want %v", err, ErrNotResumable)
+	}
+}
+
+func TestBRSPSetMode(t *testing.T) {
+	b, p := openTestBRSP(t)
+	defer b.Close()
+	p.latency = 5 * time.Millisecond
+
+	b.Write([]byte("data before the mode change"))
+	if err := b.SetMode(2); err != nil {
+		t.Fatalf("SetMode: %s", err)
+	}
+	b.Write([]byte("after"))
+	if err := b.Flush(); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.modes) != 2 || !bytes.Equal(p.modes[1], []byte{2}) {
+		t.Fatalf("modes: got %v want [[1] [2]]", p.modes)
+	}
+	if got, want := p.modeAt[1], len("data before the mode change"); got != want {
+		t.Errorf("mode written after %d bytes, want %d", got, want)
+	}
+}
+
+func TestBRSPModeChanges(t *testing.T) {
+	p := newBRSPPeripheral()
+	p.mode.props |= CharNotify
+	b, err := OpenBRSP(p)
+	if err != nil {
+		t.Fatalf("OpenBRSP: %s", err)
+	}
+	defer b.Close()
+
+	p.indicate([]byte("abc"), nil)
+	p.mu.Lock()
+	onMode := p.onMode
+	p.mu.Unlock()
+	onMode(p.mode, []byte{2}, nil)
+	p.indicate([]byte("def"), nil)
+
+	select {
+	case m := <-b.ModeChanges():
+		t.Fatalf("mode %d delivered before the data preceding it was read", m)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	buf := make([]byte, 10)
+	if n, err := b.Read(buf); err != nil || string(buf[:n]) != "abc" {
+		t.Fatalf("Read: got %q, %v want %q, nil", buf[:n], err, "abc")
+	}
+	if m := <-b.ModeChanges(); m != 2 {
+		t.Errorf("ModeChanges: got %d want 2", m)
+	}
+	if n, err := b.Read(buf); err != nil || string(buf[:n]) != "def" {
+		t.Fatalf("Read: got %q, %v want %q, nil", buf[:n], err, "def")
+	}
+}
+
+func TestBRSPCustomProfile(t *testing.T) {
+	o := BRSPOptions{
+		ServiceUUID: MustParseUUID("0b9a9e3a-0c6f-4a4a-9c7e-000000000001"),
+		ModeUUID:    MustParseUUID("0b9a9e3a-0c6f-4a4a-9c7e-000000000002"),
+		RxUUID:      MustParseUUID("0b9a9e3a-0c6f-4a4a-9c7e-000000000003"),
+		TxUUID:      MustParseUUID("0b9a9e3a-0c6f-4a4a-9c7e-000000000004"),
+		ModeValue:   2,
+	}
+	p := newBRSPPeripheralWithUUIDs(o.ServiceUUID, o.ModeUUID, o.RxUUID, o.TxUUID)
+
+	if _, err := OpenBRSP(p); err != ErrNotBRSP {
+		t.Fatalf("OpenBRSP: got %v want %v", err, ErrNotBRSP)
+	}
+
+	b, err := OpenBRSPWithOptions(p, o)
+	if err != nil {
+		t.Fatalf("OpenBRSPWithOptions: %s", err)
+	}
+	defer b.Close()
+
+	p.mu.Lock()
+	modes := p.modes
+	p.mu.Unlock()
+	if len(modes) != 1 || !bytes.Equal(modes[0], []byte{2}) {
+		t.Errorf("modes: got %v want [[2]]", modes)
+	}
+
+	b.Write([]byte("hi"))
+	if got := p.received(t, 2); string(got) != "hi" {
+		t.Errorf("RX: got %q want %q", got, "hi")
+	}
+}
+
+func TestBRSPTimeouts(t *testing.T) {
+	b, p := openTestBRSPWithOptions(t, BRSPOptions{
+		MaxWriteBuffer: 20,
+		BlockWhenFull:  true,
+		Timeouts: BRSPTimeouts{
+			ReadTimeout:  30 * time.Millisecond,
+			WriteTimeout: 30 * time.Millisecond,
+			FlushTimeout: 30 * time.Millisecond,
+		},
+	})
+	defer b.Close()
+	p.rxGate = make(chan struct{})
+
+	buf := make([]byte, 20)
+	start := time.Now()
+	if _, err := b.Read(buf); err != ErrTimeout {
+		t.Fatalf("Read: got %v want %v", err, ErrTimeout)
+	}
+	if d := time.Since(start); d < 30*time.Millisecond {
+		t.Errorf("Read timed out after %s", d)
+	}
+
+	// Each Read gets its own timeout, so data arriving later is delivered.
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		p.indicate([]byte("late"), nil)
+	}()
+	if n, err := b.Read(buf); err != nil || string(buf[:n]) != "late" {
+		t.Fatalf("Read: got %q, %v want %q, nil", buf[:n], err, "late")
+	}
+
+	if _, err := b.Write(make([]byte, 50)); err != ErrTimeout {
+		t.Errorf("Write: got %v want %v", err, ErrTimeout)
+	}
+	if err := b.Flush(); err != ErrTimeout {
+		t.Errorf("Flush: got %v want %v", err, ErrTimeout)
+	}
+
+	close(p.rxGate)
+	if err := b.Flush(); err != nil {
+		t.Errorf("Flush: %s", err)
+	}
+}
+
+func TestBRSPStats(t *testing.T) {
+	b, p := openTestBRSP(t)
+
+	start := time.Now()
+	b.Write(make([]byte, 45))
+	if err := b.Flush(); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+	p.indicate([]byte("hello"), nil)
+	p.indicate([]byte("world"), nil)
+	b.Read(make([]byte, 10))
+
+	werr := errors.New("write failed")
+	p.mu.Lock()
+	p.writeErr = werr
+	p.mu.Unlock()
+	b.Write([]byte("lost"))
+	if err := b.Flush(); err != werr {
+		t.Fatalf("Flush: got %v want %v", err, werr)
+	}
+
+	st := b.Stats()
+	if st.LastActivity.Before(start) {
+		t.Errorf("LastActivity: got %s, before the traffic", st.LastActivity)
+	}
+	st.LastActivity = time.Time{}
+	want := BRSPStats{
+		BytesRead:       10,
+		BytesWritten:    49,
+		PDUsIn:          2,
+		PDUsOut:         4,
+		WriteErrors:     1,
+		MaxInQueued:     10,
+		MaxOutQueued:    45,
+		InQueueGrowths:  1,
+		OutQueueGrowths: 1,
+	}
+	if st != want {
+		t.Errorf("Stats: got %+v want %+v", st, want)
+	}
+
+	b.ResetStats()
+	st = b.Stats()
+	if st.LastActivity.Before(start) {
+		t.Errorf("LastActivity: got %s after ResetStats", st.LastActivity)
+	}
+	st.LastActivity = time.Time{}
+	if st != (BRSPStats{}) {
+		t.Errorf("Stats after ResetStats: got %+v want zero", st)
+	}
+
+	p.mu.Lock()
+	p.writeErr = nil
+	p.mu.Unlock()
+	b.Write([]byte("x"))
+	b.Flush()
+	b.Close()
+	if st := b.Stats(); st.PDUsOut != 1 {
+		t.Errorf("Stats after Close: got %+v", st)
+	}
+}
+
+func TestBRSPReadContext(t *testing.T) {
+	b, p := openTestBRSP(t)
+	defer b.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := b.ReadContext(ctx, make([]byte, 10)); err != context.Canceled {
+		t.Errorf("ReadContext: got %v want %v", err, context.Canceled)
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := b.ReadContext(ctx, make([]byte, 10)); err != context.DeadlineExceeded {
+		t.Errorf("ReadContext: got %v want %v", err, context.DeadlineExceeded)
+	}
+
+	// The abandoned read must not take input meant for the next one.
+	p.indicate([]byte("data"), nil)
+	buf := make([]byte, 10)
+	if n, err := b.Read(buf); err != nil || string(buf[:n]) != "data" {
+		t.Errorf("Read: got %q, %v want %q, nil", buf[:n], err, "data")
+	}
+}
+
+func TestBRSPWriteContext(t *testing.T) {
+	b, p := openTestBRSPWithOptions(t, BRSPOptions{MaxWriteBuffer: 30, BlockWhenFull: true})
+	defer b.Close()
+	p.rxGate = make(chan struct{})
+
+	b.Write([]byte("first"))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	n, err := b.WriteContext(ctx, bytes.Repeat([]byte("x"), 100))
+	if n != 25 || err != context.DeadlineExceeded {
+		t.Fatalf("WriteContext: got %d, %v want 25, %v", n, err, context.DeadlineExceeded)
+	}
+
+	// Flush covers only what was queued.
+	close(p.rxGate)
+	if err := b.Flush(); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+	if got := p.received(t, 30); len(got) != 30 {
+		t.Errorf("received %d bytes want 30", len(got))
+	}
+}
+
+func TestBRSPWriteContextBeforeLoop(t *testing.T) {
+	b, p := openTestBRSP(t)
+	defer b.Close()
+
+	// Stall the loop so that the write below gives up before reaching it.
+	r := brspRequest{p: make([]byte, 1), r: make(chan brspResult)}
+	b.readReq <- r
+	go p.indicate([]byte{0}, nil)
+	time.Sleep(time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	werr := make(chan error, 1)
+	go func() {
+		_, err := b.WriteContext(ctx, []byte("never sent"))
+		werr <- err
+	}()
+	for atomic.LoadUint64(&b.writeSeq) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	time.Sleep(time.Millisecond)
+	<-r.r
+
+	if err := <-werr; err != context.Canceled {
+		t.Errorf("WriteContext: got %v want %v", err, context.Canceled)
+	}
+	done := make(chan error, 1)
+	go func() { done <- b.Flush() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Flush: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Flush waits for the abandoned write")
+	}
+}
+
+func TestBRSPFlushBarrier(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		b, p := openTestBRSP(t)
+		p.rxGate = make(chan struct{})
+
+		// Stall the loop on a Read whose result nobody receives yet, so
+		// that the Write below is still waiting to be handled when Flush
+		// is called.
+		r := brspRequest{p: make([]byte, 1), r: make(chan brspResult)}
+		b.readReq <- r
+		go p.indicate([]byte{0}, nil)
+		time.Sleep(time.Millisecond)
+
+		go b.Write([]byte("data"))
+		for atomic.LoadUint64(&b.writeSeq) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		flushed := make(chan error, 1)
+		go func() { flushed <- b.Flush() }()
+		time.Sleep(time.Millisecond)
+		<-r.r
+
+		select {
+		case err := <-flushed:
+			t.Fatalf("Flush returned %v before the earlier Write was sent", err)
+		case <-time.After(10 * time.Millisecond):
+		}
+		close(p.rxGate)
+		if err := <-flushed; err != nil {
+			t.Fatalf("Flush: %s", err)
+		}
+		b.Close()
+	}
+}
+
+func TestBRSPFlushReportsOwnErrors(t *testing.T) {
+	b, p := openTestBRSP(t)
+	defer b.Close()
+
+	werr := errors.New("write failed")
+	p.mu.Lock()
+	p.writeErr = werr
+	p.mu.Unlock()
+	b.Write([]byte("lost"))
+	if err := b.Flush(); err != werr {
+		t.Fatalf("Flush: got %v want %v", err, werr)
+	}
+	// The error was reported, so it does not leak into later calls.
+	if err := b.Flush(); err != nil {
+		t.Fatalf("Flush: got %v want nil", err)
+	}
+
+	// An error already returned by Write is not reported again by Flush.
+	b.Write([]byte("lost"))
+	waitFor(t, "write errors", func() int { return int(b.Stats().WriteErrors) }, 2)
+	if _, err := b.Write([]byte("x")); err != werr {
+		t.Fatalf("Write: got %v want %v", err, werr)
+	}
+	p.mu.Lock()
+	p.writeErr = nil
+	p.mu.Unlock()
+	if err := b.Flush(); err != nil {
+		t.Fatalf("Flush: got %v want nil", err)
+	}
+}
@@ -22,6 +22,7 @@ type central struct {
 	security    security
 	l2conn      io.ReadWriteCloser
 	notifiers   map[uint16]*notifier
+	cccs        map[uint16]uint16 // CCCD values written, by handle
 	notifiersmu *sync.Mutex
 }
 
@@ -33,6 +34,7 @@ func newCentral(a *attrRange, addr net.HardwareAddr, l2conn io.ReadWriteCloser)
 		security:    securityLow,
 		l2conn:      l2conn,
 		notifiers:   make(map[uint16]*notifier),
+		cccs:        make(map[uint16]uint16),
 		notifiersmu: &sync.Mutex{},
 	}
 }
@@ -252,6 +254,9 @@ func (c *central) handleRead(b []byte) []byte {
 		return attErrorRsp(attOpReadReq, h, attEcodeAuthentication)
 	}
 	v := a.value
+	if a.typ.Equal(attrClientCharacteristicConfigUUID) {
+		v = c.ccc(h)
+	}
 	if v == nil {
 		req := &ReadRequest{
 			Request: Request{Central: c},
@@ -384,7 +389,7 @@ func (c *central) handleWrite(reqType byte, b []byte) []byte {
 		r := Request{Central: c}
 		if c, ok := a.pvt.(*Characteristic); ok {
 			c.whandler.ServeWrite(r, value)
-		} else if d, ok := a.pvt.(*Characteristic); ok {
+		} else if d, ok := a.pvt.(*Descriptor); ok {
 			d.whandler.ServeWrite(r, value)
 		}
 		if noRsp {
@@ -400,6 +405,9 @@ func (c *central) handleWrite(reqType byte, b []byte) []byte {
 	}
 	ccc := binary.LittleEndian.Uint16(value)
 	// char := a.pvt.(*Descriptor).char
+	c.notifiersmu.Lock()
+	c.cccs[h] = ccc
+	c.notifiersmu.Unlock()
 	if ccc&(gattCCCNotifyFlag|gattCCCIndicateFlag) != 0 {
 		c.startNotify(&a, int(c.mtu-3))
 	} else {
@@ -423,6 +431,16 @@ func readHandleRange(b []byte) (start, end uint16) {
 	return binary.LittleEndian.Uint16(b), binary.LittleEndian.Uint16(b[2:])
 }
 
+// ccc returns the value of the CCCD at handle h, as written by this
+// central; each central configures the characteristics for itself.
+func (c *central) ccc(h uint16) []byte {
+	c.notifiersmu.Lock()
+	defer c.notifiersmu.Unlock()
+	b := make([]byte, 2)
+	binary.LittleEndian.PutUint16(b, c.cccs[h])
+	return b
+}
+
 func (c *central) startNotify(a *attr, maxlen int) {
 	c.notifiersmu.Lock()
 	defer c.notifiersmu.Unlock()
@@ -0,0 +1,56 @@
+package gatt
+
+import "encoding/binary"
+
+// A CCCDValue is the value of a client characteristic configuration
+// descriptor (CCCD): the kinds of values the peripheral sends the client
+// for the characteristic.
+type CCCDValue uint16
+
+const (
+	CCCDNotify   CCCDValue = gattCCCNotifyFlag
+	CCCDIndicate CCCDValue = gattCCCIndicateFlag
+)
+
+// ParseCCCDValue parses b, the value of a CCCD.
+func ParseCCCDValue(b []byte) (CCCDValue, error) {
+	if len(b) != 2 {
+		return 0, ErrInvalidLength
+	}
+	return CCCDValue(binary.LittleEndian.Uint16(b)), nil
+}
+
+// Notify reports whether notifications are enabled.
+func (v CCCDValue) Notify() bool { return v&CCCDNotify != 0 }
+
+// Indicate reports whether indications are enabled.
+func (v CCCDValue) Indicate() bool { return v&CCCDIndicate != 0 }
+
+// Bytes returns v encoded as the value of a CCCD.
+func (v CCCDValue) Bytes() []byte {
+	b := make([]byte, 2)
+	binary.LittleEndian.PutUint16(b, uint16(v))
+	return b
+}
+
+// ClientConfig returns the CCCD of the characteristic, found by
+// DiscoverDescriptors, and reports whether it has one.
+func (c *Characteristic) ClientConfig() (*Descriptor, bool) {
+	return c.cccd, c.cccd != nil
+}
+
+// ReadClientConfig reads the CCCD of c from p, to find out which values
+// the peripheral sends, such as after reconnecting to a bonded peripheral
+// that keeps the configuration. The descriptors of c must have been
+// discovered; if it has no CCCD, the error is ErrNoClientConfig.
+func ReadClientConfig(p Peripheral, c *Characteristic) (CCCDValue, error) {
+	d, ok := c.ClientConfig()
+	if !ok {
+		return 0, ErrNoClientConfig
+	}
+	b, err := p.ReadDescriptor(d)
+	if err != nil {
+		return 0, err
+	}
+	return ParseCCCDValue(b)
+}
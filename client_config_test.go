@@ -0,0 +1,41 @@
+package gatt
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCCCDValue(t *testing.T) {
+	for _, tt := range []struct {
+		b                []byte
+		notify, indicate bool
+	}{
+		{[]byte{0x00, 0x00}, false, false},
+		{[]byte{0x01, 0x00}, true, false},
+		{[]byte{0x02, 0x00}, false, true},
+		{[]byte{0x03, 0x00}, true, true},
+	} {
+		v, err := ParseCCCDValue(tt.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v.Notify() != tt.notify || v.Indicate() != tt.indicate {
+			t.Errorf("[% X]: got notify %t, indicate %t", tt.b, v.Notify(), v.Indicate())
+		}
+		if b := v.Bytes(); !bytes.Equal(b, tt.b) {
+			t.Errorf("Bytes: got [% X], want [% X]", b, tt.b)
+		}
+	}
+	if _, err := ParseCCCDValue([]byte{0x01}); err != ErrInvalidLength {
+		t.Errorf("short value: got %v, want ErrInvalidLength", err)
+	}
+}
+
+func TestReadClientConfigMissing(t *testing.T) {
+	if _, ok := (&Characteristic{}).ClientConfig(); ok {
+		t.Error("ClientConfig: found one")
+	}
+	if _, err := ReadClientConfig(&brspPeripheral{}, &Characteristic{}); err != ErrNoClientConfig {
+		t.Errorf("got %v, want ErrNoClientConfig", err)
+	}
+}
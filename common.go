@@ -71,6 +71,8 @@ type Service struct {
 
 	h    uint16
 	endh uint16
+
+	discovered bool // characteristics discovered, see DiscoveryCache
 }
 
 // NewService creates and initialize a new Service using u as it's UUID.
@@ -138,6 +140,8 @@ type Characteristic struct {
 	h    uint16
 	vh   uint16
 	endh uint16
+
+	discovered bool // descriptors discovered, see DiscoveryCache
 }
 
 // NewCharacteristic creates and returns a Characteristic.
@@ -290,8 +294,7 @@ func (c *Characteristic) HandleNotify(h NotifyHandler) {
 		uuid:   attrClientCharacteristicConfigUUID,
 		props:  CharRead | CharWrite | CharWriteNR,
 		secure: secure,
-		// FIXME: currently, we always return 0, which is inaccurate.
-		// Each connection should have it's own copy of this value.
+		// Each central reads the value it wrote, see central.ccc.
 		value: []byte{0x00, 0x00},
 		char:  c,
 	}
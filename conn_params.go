@@ -0,0 +1,69 @@
+package gatt
+
+import (
+	"fmt"
+	"time"
+)
+
+// ConnParams are the parameters of a connection to a peripheral.
+type ConnParams struct {
+	MinInterval        time.Duration // 7.5ms to 4s, in steps of 1.25ms
+	MaxInterval        time.Duration // MinInterval to 4s, in steps of 1.25ms
+	Latency            uint16        // connection events the peripheral may skip, up to 499
+	SupervisionTimeout time.Duration // 100ms to 32s, in steps of 10ms
+}
+
+const (
+	connIntervalUnit = 1250 * time.Microsecond
+	connTimeoutUnit  = 10 * time.Millisecond
+)
+
+// connParamUnits are ConnParams in the units of the controller.
+type connParamUnits struct {
+	intervalMin, intervalMax, latency, timeout uint16
+}
+
+// units checks p against the ranges of the specification and converts it
+// to the units of the controller, rounding down.
+func (p ConnParams) units() (connParamUnits, error) {
+	u := connParamUnits{
+		intervalMin: uint16(p.MinInterval / connIntervalUnit),
+		intervalMax: uint16(p.MaxInterval / connIntervalUnit),
+		latency:     p.Latency,
+		timeout:     uint16(p.SupervisionTimeout / connTimeoutUnit),
+	}
+	switch {
+	case p.MinInterval < 6*connIntervalUnit || p.MinInterval > 3200*connIntervalUnit:
+		return u, fmt.Errorf("connection interval %v out of range [7.5ms, 4s]", p.MinInterval)
+	case p.MaxInterval < p.MinInterval || p.MaxInterval > 3200*connIntervalUnit:
+		return u, fmt.Errorf("connection interval %v out of range [%v, 4s]", p.MaxInterval, p.MinInterval)
+	case p.Latency > 499:
+		return u, fmt.Errorf("peripheral latency %d out of range [0, 499]", p.Latency)
+	case p.SupervisionTimeout < 10*connTimeoutUnit || p.SupervisionTimeout > 3200*connTimeoutUnit:
+		return u, fmt.Errorf("supervision timeout %v out of range [100ms, 32s]", p.SupervisionTimeout)
+	case p.SupervisionTimeout <= 2*time.Duration(1+p.Latency)*p.MaxInterval:
+		// The link must survive the peripheral skipping events.
+		return u, fmt.Errorf("supervision timeout %v not above %v", p.SupervisionTimeout,
+			2*time.Duration(1+p.Latency)*p.MaxInterval)
+	}
+	return u, nil
+}
+
+// connParams converts u back to ConnParams.
+func (u connParamUnits) connParams() ConnParams {
+	return ConnParams{
+		MinInterval:        time.Duration(u.intervalMin) * connIntervalUnit,
+		MaxInterval:        time.Duration(u.intervalMax) * connIntervalUnit,
+		Latency:            u.latency,
+		SupervisionTimeout: time.Duration(u.timeout) * connTimeoutUnit,
+	}
+}
+
+// PeripheralConnParamsRequested returns a Handler, which sets the specified
+// function to be called when a connected peripheral asks for other
+// connection parameters. f returns the parameters to apply, the requested
+// ones or adjusted, or false to reject the request. Without the handler,
+// requests are granted as they are. Only the Linux implementation calls it.
+func PeripheralConnParamsRequested(f func(p Peripheral, req ConnParams) (ConnParams, bool)) Handler {
+	return func(d Device) { d.(*device).connParamsRequested = f }
+}
@@ -0,0 +1,49 @@
+package gatt
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConnParamsUnits(t *testing.T) {
+	ms := time.Millisecond
+	for _, tt := range []struct {
+		p    ConnParams
+		want connParamUnits
+		ok   bool
+	}{
+		{ConnParams{7500 * time.Microsecond, 4 * time.Second, 0, 32 * time.Second}, connParamUnits{6, 3200, 0, 3200}, true},
+		{ConnParams{10 * ms, 30 * ms, 0, 200 * ms}, connParamUnits{8, 24, 0, 20}, true},
+		{ConnParams{30 * ms, 30 * ms, 4, 400 * ms}, connParamUnits{24, 24, 4, 40}, true},
+		{ConnParams{31 * ms, 31 * ms, 0, 105 * ms}, connParamUnits{24, 24, 0, 10}, true}, // rounded down
+		{ConnParams{5 * ms, 30 * ms, 0, 200 * ms}, connParamUnits{}, false},              // interval too short
+		{ConnParams{30 * ms, 20 * ms, 0, 200 * ms}, connParamUnits{}, false},             // max below min
+		{ConnParams{30 * ms, 5 * time.Second, 0, 20 * time.Second}, connParamUnits{}, false},
+		{ConnParams{30 * ms, 30 * ms, 500, 32 * time.Second}, connParamUnits{}, false}, // latency too high
+		{ConnParams{7500 * time.Microsecond, 10 * ms, 0, 50 * ms}, connParamUnits{}, false},
+		{ConnParams{30 * ms, 30 * ms, 0, 33 * time.Second}, connParamUnits{}, false},
+		{ConnParams{30 * ms, 30 * ms, 4, 300 * ms}, connParamUnits{}, false}, // timeout not above 2*(1+4)*30ms
+		{ConnParams{30 * ms, 30 * ms, 0, 60 * ms}, connParamUnits{}, false},
+	} {
+		u, err := tt.p.units()
+		if (err == nil) != tt.ok {
+			t.Errorf("%+v: got error %v, want ok %t", tt.p, err, tt.ok)
+			continue
+		}
+		if tt.ok && u != tt.want {
+			t.Errorf("%+v: got %+v, want %+v", tt.p, u, tt.want)
+		}
+	}
+}
+
+func TestConnParamUnitsConnParams(t *testing.T) {
+	u := connParamUnits{intervalMin: 6, intervalMax: 24, latency: 2, timeout: 300}
+	want := ConnParams{7500 * time.Microsecond, 30 * time.Millisecond, 2, 3 * time.Second}
+	p := u.connParams()
+	if p != want {
+		t.Fatalf("got %+v, want %+v", p, want)
+	}
+	if back, err := p.units(); err != nil || back != u {
+		t.Errorf("round trip: got %+v, %v, want %+v", back, err, u)
+	}
+}
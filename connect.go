@@ -0,0 +1,119 @@
+package gatt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// A ConnectError reports why ConnectContext failed to connect to a
+// peripheral.
+type ConnectError struct {
+	ID  string // ID of the peripheral
+	Err error  // ctx.Err() if the context ended, else the error reported
+}
+
+func (e *ConnectError) Error() string {
+	return fmt.Sprintf("gatt: connect to %s: %v", e.ID, e.Err)
+}
+
+func (e *ConnectError) Unwrap() error { return e.Err }
+
+// Timeout reports whether the context passed to ConnectContext expired,
+// as opposed to being cancelled or the controller failing to connect.
+func (e *ConnectError) Timeout() bool {
+	return errors.Is(e.Err, context.DeadlineExceeded)
+}
+
+// ConnectContext connects to p like Connect, but waits until the
+// connection is established or ctx ends, and returns the connected
+// peripheral. If it fails, the connection attempt is cancelled, so that
+// it does not linger, and the error is a *ConnectError.
+//
+// The PeripheralConnected handler of d is still called, and may be
+// changed meanwhile.
+func (d *device) ConnectContext(ctx context.Context, p Peripheral) (Peripheral, error) {
+	return connectContext(ctx, d, p, &d.connWaiters)
+}
+
+// connResult is a call of the PeripheralConnected handler.
+type connResult struct {
+	p   Peripheral
+	err error
+}
+
+// connWaiters holds the calls of ConnectContext waiting for their
+// peripheral, by ID. The zero value is ready to use.
+type connWaiters struct {
+	mu   sync.Mutex
+	ws   map[string]map[int]chan connResult
+	next int
+}
+
+// add registers a wait for the peripheral with the given ID, and returns
+// the channel of its result and the function unregistering it.
+func (cw *connWaiters) add(id string) (<-chan connResult, func()) {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	if cw.ws == nil {
+		cw.ws = make(map[string]map[int]chan connResult)
+	}
+	if cw.ws[id] == nil {
+		cw.ws[id] = make(map[int]chan connResult)
+	}
+	n := cw.next
+	cw.next++
+	c := make(chan connResult, 1)
+	cw.ws[id][n] = c
+	return c, func() {
+		cw.mu.Lock()
+		defer cw.mu.Unlock()
+		delete(cw.ws[id], n)
+		if len(cw.ws[id]) == 0 {
+			delete(cw.ws, id)
+		}
+	}
+}
+
+// connected reports the result of a connection to p to the waits for it.
+func (cw *connWaiters) connected(p Peripheral, err error) {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	for _, c := range cw.ws[p.ID()] {
+		select {
+		case c <- connResult{p, err}:
+		default:
+		}
+	}
+}
+
+// connectContext does the work of ConnectContext, waiting on cw for the
+// connection to be reported.
+func connectContext(ctx context.Context, d Device, p Peripheral, cw *connWaiters) (Peripheral, error) {
+	connected, done := cw.add(p.ID())
+	defer done()
+	d.Connect(p)
+	return waitConnected(ctx, d, p, connected)
+}
+
+// waitConnected waits for the connection to p to be reported on
+// connected, skipping other peripherals, and cancels it if it fails or
+// ctx ends first.
+func waitConnected(ctx context.Context, d Device, p Peripheral, connected <-chan connResult) (Peripheral, error) {
+	for {
+		select {
+		case r := <-connected:
+			if r.err != nil {
+				d.CancelConnection(p)
+				return nil, &ConnectError{ID: p.ID(), Err: r.err}
+			}
+			if r.p != nil && r.p.ID() == p.ID() {
+				return r.p, nil
+			}
+		case <-ctx.Done():
+			d.CancelConnection(p)
+			return nil, &ConnectError{ID: p.ID(), Err: ctx.Err()}
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package gatt
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestConnectContext(t *testing.T) {
+	p := newBRSPPeripheral()
+	d := &dialDevice{conn: p}
+	got, err := d.ConnectContext(context.Background(), p)
+	if err != nil || got != p {
+		t.Fatalf("ConnectContext: got %v, %v", got, err)
+	}
+	if d.connects != 1 || d.cancelled != 0 {
+		t.Errorf("ConnectContext: %d connects, %d cancelled", d.connects, d.cancelled)
+	}
+}
+
+func TestConnectContextFailure(t *testing.T) {
+	errController := errors.New("connection failed to be established")
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for _, tt := range []struct {
+		name    string
+		d       *dialDevice
+		timeout time.Duration
+		ctx     context.Context
+		err     error
+	}{
+		{"timeout", &dialDevice{}, 20 * time.Millisecond, context.Background(), context.DeadlineExceeded},
+		{"cancelled", &dialDevice{}, time.Second, cancelled, context.Canceled},
+		{"controller error", &dialDevice{connErr: errController}, time.Second, context.Background(), errController},
+	} {
+		ctx, cancel := context.WithTimeout(tt.ctx, tt.timeout)
+		p := newBRSPPeripheral()
+		got, err := tt.d.ConnectContext(ctx, p)
+		cancel()
+
+		var ce *ConnectError
+		if got != nil || !errors.As(err, &ce) || !errors.Is(err, tt.err) || ce.ID != p.ID() {
+			t.Errorf("%s: got %v, %v want %v", tt.name, got, err, tt.err)
+			continue
+		}
+		if ce.Timeout() != (tt.err == context.DeadlineExceeded) {
+			t.Errorf("%s: Timeout() = %t", tt.name, ce.Timeout())
+		}
+		if tt.d.connects != 1 || tt.d.cancelled != 1 {
+			t.Errorf("%s: %d connects, %d cancelled", tt.name, tt.d.connects, tt.d.cancelled)
+		}
+	}
+}
+
+func TestConnWaiters(t *testing.T) {
+	var cw connWaiters
+	a1, done1 := cw.add("a")
+	a2, done2 := cw.add("a")
+	b, doneB := cw.add("b")
+	defer doneB()
+
+	pa := idPeripheral{id: "a"}
+	cw.connected(pa, nil)
+	for i, c := range []<-chan connResult{a1, a2} {
+		select {
+		case r := <-c:
+			if r.p != pa || r.err != nil {
+				t.Errorf("wait %d: got %v, %v", i, r.p, r.err)
+			}
+		default:
+			t.Errorf("wait %d not told", i)
+		}
+	}
+	select {
+	case r := <-b:
+		t.Errorf("told of %v waiting for b", r.p)
+	default:
+	}
+
+	// Once done, a wait is no longer told.
+	done1()
+	errController := errors.New("connection failed to be established")
+	cw.connected(pa, errController)
+	select {
+	case r := <-a1:
+		t.Errorf("done wait told of %v", r.p)
+	default:
+	}
+	if r := <-a2; r.err != errController {
+		t.Errorf("got %v want %v", r.err, errController)
+	}
+	done2()
+	if len(cw.ws) != 1 {
+		t.Errorf("%d IDs waited for, want 1", len(cw.ws))
+	}
+}
+
+func TestConnectContextHandler(t *testing.T) {
+	p := newBRSPPeripheral()
+	d := &dialDevice{conn: p}
+	handled := make(chan Peripheral, 2)
+	d.connected = func(p Peripheral, err error) { handled <- p }
+
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := d.ConnectContext(context.Background(), p)
+			errs <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("ConnectContext: %s", err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		if got := <-handled; got != p {
+			t.Errorf("handler: got %v want %v", got, p)
+		}
+	}
+}
@@ -20,6 +20,7 @@ var (
 	attrReconnectionAddrUUID  = UUID16(0x2A03)
 	attrPeferredParamsUUID    = UUID16(0x2A04)
 	attrServiceChangedUUID    = UUID16(0x2A05)
+	attrDatabaseHashUUID      = UUID16(0x2B2A)
 )
 
 const (
@@ -27,6 +28,11 @@ const (
 	gattCCCIndicateFlag = 0x0002
 )
 
+const (
+	attDefaultMTU = 23  // the ATT MTU until exchanged
+	attMaxMTU     = 517 // enough for the longest attribute value, 512 bytes
+)
+
 const (
 	attOpError              = 0x01
 	attOpMtuReq             = 0x02
@@ -1,6 +1,7 @@
 package gatt
 
 import (
+	"context"
 	"errors"
 
 	"github.com/PayRange/gatt/blukey"
@@ -76,9 +77,17 @@ type Device interface {
 	// StopScanning stops scanning.
 	StopScanning()
 
+	// SetScanFilter sets the filter selecting the advertisements reported
+	// to the discovery handlers. A nil filter reports all of them.
+	SetScanFilter(f ScanFilter)
+
 	// Connect connects to a remote peripheral.
 	Connect(p Peripheral)
 
+	// ConnectContext connects to a remote peripheral and waits until it
+	// is connected or ctx ends, cancelling the attempt if it fails.
+	ConnectContext(ctx context.Context, p Peripheral) (Peripheral, error)
+
 	// CancelConnection disconnects a remote peripheral.
 	CancelConnection(p Peripheral)
 
@@ -87,6 +96,24 @@ type Device interface {
 
 	// Option sets the options specified.
 	Option(o ...Option) error
+
+	// AddToAcceptList adds the device of address a to the Filter Accept
+	// List of the controller, which scanning and connecting use if set up
+	// to with LnxScanAcceptList and LnxConnectAcceptList. If the list is
+	// full, the error is an *AcceptListFullError.
+	AddToAcceptList(a Address) error
+
+	// RemoveFromAcceptList removes the device of address a from the
+	// Filter Accept List.
+	RemoveFromAcceptList(a Address) error
+
+	// ClearAcceptList removes all the devices from the Filter Accept List.
+	ClearAcceptList() error
+
+	// Address returns the own address of the device, as scanning,
+	// advertising and connecting use it. See LnxOwnAddress. On Darwin,
+	// Core Bluetooth does not tell it, and it is zero.
+	Address() Address
 }
 
 // deviceHandler is the handlers(callbacks) of the Device.
@@ -109,11 +136,19 @@ type deviceHandler struct {
 	// blukeyDiscovered is called when a BluKey is found during scan procedure.
 	blukeyDiscovered func(p Peripheral, a blukey.Adv, rssi int)
 
+	// scanFilter, if not nil, selects the advertisements passed to the
+	// handlers above.
+	scanFilter ScanFilter
+
 	// peripheralConnected is called when a remote peripheral is conneted.
 	peripheralConnected func(p Peripheral, err error)
 
 	// peripheralConnected is called when a remote peripheral is disconneted.
 	peripheralDisconnected func(p Peripheral, err error)
+
+	// connParamsRequested decides on the connection parameters a
+	// connected peripheral asks for.
+	connParamsRequested func(p Peripheral, req ConnParams) (ConnParams, bool)
 }
 
 // A Handler is a self-referential function, which registers the options specified.
@@ -158,6 +193,7 @@ func PeripheralConnected(f func(Peripheral, error)) Handler {
 }
 
 // PeripheralDisconnected returns a Handler, which sets the specified function to be called when a remote peripheral device disconnects.
+// On Linux, the error is a *DisconnectError telling why; the requests to the peripheral in flight fail with it too.
 func PeripheralDisconnected(f func(Peripheral, error)) Handler {
 	return func(d Device) { d.(*device).peripheralDisconnected = f }
 }
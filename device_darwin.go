@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"sync"
 	"time"
@@ -49,6 +50,8 @@ type device struct {
 	attrs map[int]*attr
 
 	subscribers map[string]*central
+
+	connWaiters connWaiters // of ConnectContext
 }
 
 func NewDevice(opts ...Option) (Device, error) {
@@ -80,6 +83,15 @@ func (d *device) Init(f func(Device, State)) error {
 	return nil
 }
 
+// Address returns the zero Address, as Core Bluetooth does not tell the
+// own address.
+func (d *device) Address() Address { return Address{} }
+
+// The accept list of the controller is not available on Darwin.
+func (d *device) AddToAcceptList(a Address) error      { return errors.New("Not implemented") }
+func (d *device) RemoveFromAcceptList(a Address) error { return errors.New("Not implemented") }
+func (d *device) ClearAcceptList() error               { return errors.New("Not implemented") }
+
 func (d *device) Advertise(a *AdvPacket) error {
 	rsp := d.sendReq(8, xpc.Dict{
 		"kCBAdvDataAppleMfgData": a.b, // not a.Bytes(). should be slice
@@ -421,6 +433,9 @@ func (d *device) HandleXpcEvent(event xpc.Dict, err error) {
 				a.ServiceData = append(a.ServiceData, sd)
 			}
 		}
+		if d.scanFilter != nil && !d.scanFilter(a) {
+			return
+		}
 		if d.peripheralDiscovered != nil {
 			go d.peripheralDiscovered(&peripheral{id: xpc.UUID(u.b), d: d}, a, rssi)
 		}
@@ -435,11 +450,13 @@ func (d *device) HandleXpcEvent(event xpc.Dict, err error) {
 			quitc: make(chan struct{}),
 			sub:   newSubscriber(),
 		}
+		p.subs = NewSubscribers(p.setNotifyValue)
 		d.plistmu.Lock()
 		d.plist[u.String()] = p
 		d.plistmu.Unlock()
 		go p.loop()
 
+		d.connWaiters.connected(p, nil)
 		if d.peripheralConnected != nil {
 			go d.peripheralConnected(p, nil)
 		}
@@ -454,6 +471,8 @@ func (d *device) HandleXpcEvent(event xpc.Dict, err error) {
 			d.peripheralDisconnected(p, nil) // TODO: Get Result as error?
 		}
 		close(p.quitc)
+		p.sub.disconnect(io.EOF)
+		p.subs.End(io.EOF)
 
 	case // Peripheral events
 		rssiRead,
@@ -1,8 +1,12 @@
 package gatt
 
 import (
+	"crypto/rand"
 	"encoding/binary"
+	"fmt"
+	"log"
 	"net"
+	"time"
 
 	"github.com/PayRange/gatt/blukey"
 	"github.com/PayRange/gatt/linux"
@@ -20,6 +24,7 @@ type device struct {
 	attrs *attrRange
 
 	devID   int
+	devAddr string // of the controller, see LnxDeviceAddress
 	chkLE   bool
 	maxConn int
 
@@ -27,9 +32,58 @@ type device struct {
 	scanResp  *cmd.LESetScanResponseData
 	advParam  *cmd.LESetAdvertisingParameters
 	scanParam *cmd.LESetScanParameters
+
+	discoveryCache DiscoveryCache
+
+	pairing       bool // pair when requests need it, see LnxPairing
+	pairingAgent  PairingAgent
+	keyStore      KeyStore
+	securityLevel SecurityLevel // required on connection
+
+	ownAddr      AddressType // see LnxOwnAddress
+	addrRotation time.Duration
+	irk          [16]byte      // of resolvable private addresses
+	rotatec      chan struct{} // closed to stop address rotation
+
+	connectAccept bool // Connect uses the accept list
+
+	reconnect *reconnector // nil without LnxReconnectPolicy
+
+	connWaiters connWaiters // of ConnectContext
 }
 
 func NewDevice(opts ...Option) (Device, error) {
+	d := newDevice(opts...)
+	devID, err := d.deviceID()
+	if err != nil {
+		return nil, err
+	}
+	h, err := linux.NewHCI(devID, d.chkLE, d.maxConn)
+	if err != nil {
+		return nil, err
+	}
+	d.hci = h
+	if d.ownAddr != PublicAddress {
+		if err := d.initOwnAddress(); err != nil {
+			h.Close()
+			return nil, err
+		}
+	}
+	if err := h.SetScanParameters(*d.scanParam); err != nil {
+		h.Close()
+		return nil, err
+	}
+	if d.ownAddr != PublicAddress && d.addrRotation > 0 {
+		d.rotatec = make(chan struct{})
+		go d.rotateAddress(d.rotatec)
+	}
+	return d, nil
+}
+
+// newDevice returns a device with the default settings, then opts, and
+// no HCI device yet. Devices share no settings, so that several can be
+// used at once, one per adapter.
+func newDevice(opts ...Option) *device {
 	d := &device{
 		maxConn: 1,    // Support 1 connection at a time.
 		devID:   -1,   // Find an available HCI device.
@@ -53,15 +107,88 @@ func NewDevice(opts ...Option) (Device, error) {
 			ScanningFilterPolicy: 0x00,   // [0x00]: accept all, 0x01: ignore non-white-listed.
 		},
 	}
-
 	d.Option(opts...)
-	h, err := linux.NewHCI(d.devID, d.chkLE, d.maxConn)
+	return d
+}
+
+// deviceID returns the id of the HCI device to open: that of the
+// controller of address devAddr if set, else devID.
+func (d *device) deviceID() (int, error) {
+	if d.devAddr == "" {
+		return d.devID, nil
+	}
+	a, err := net.ParseMAC(d.devAddr)
+	if err != nil || len(a) != 6 {
+		return 0, fmt.Errorf("invalid controller address %q", d.devAddr)
+	}
+	return linux.FindDevice([6]byte{a[0], a[1], a[2], a[3], a[4], a[5]})
+}
+
+// initOwnAddress sets the first random own address, and has scanning and
+// advertising use it.
+func (d *device) initOwnAddress() error {
+	if d.ownAddr == ResolvablePrivateAddress {
+		if _, err := rand.Read(d.irk[:]); err != nil {
+			return err
+		}
+	}
+	d.scanParam.OwnAddressType = 0x01
+	if d.advParam != nil {
+		d.advParam.OwnAddressType = 0x01
+	}
+	return d.setOwnAddress()
+}
+
+// setOwnAddress gives the controller a new random own address, of the
+// type set with LnxOwnAddress.
+func (d *device) setOwnAddress() error {
+	var a [6]byte
+	var err error
+	if d.ownAddr == ResolvablePrivateAddress {
+		a, err = newResolvablePrivateAddress(d.irk)
+	} else {
+		a, err = newStaticRandomAddress()
+	}
 	if err != nil {
-		return nil, err
+		return err
 	}
+	return d.hci.SetRandomAddress(a)
+}
 
-	d.hci = h
-	return d, nil
+// addrRetry is how soon a rotation of the own address put off by
+// connections is tried again.
+const addrRetry = time.Second
+
+// rotateAddress gives the device a new random own address every
+// addrRotation, once it has no connection up or being made, until quit is
+// closed.
+func (d *device) rotateAddress(quit <-chan struct{}) {
+	t := time.NewTimer(d.addrRotation)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-quit:
+			return
+		}
+		next := d.addrRotation
+		switch err := d.setOwnAddress(); err {
+		case nil:
+		case linux.ErrBusy:
+			next = addrRetry
+		default:
+			log.Printf("gatt: failed to rotate the own address: %s", err)
+		}
+		t.Reset(next)
+	}
+}
+
+func (d *device) Address() Address {
+	a, t := d.hci.Address()
+	if t == 0x00 {
+		return Address{Addr: a, Type: PublicAddress}
+	}
+	return Address{Addr: a, Type: d.ownAddr}
 }
 
 func (d *device) Init(f func(Device, State)) error {
@@ -81,26 +208,73 @@ func (d *device) Init(f func(Device, State)) error {
 			d:     d,
 			pd:    pd,
 			l2c:   pd.Conn,
-			reqc:  make(chan message),
+			reqc:  make(chan message, reqQueueLen),
 			quitc: make(chan struct{}),
 			sub:   newSubscriber(),
+			cache: d.discoveryCache,
 		}
-		if d.peripheralConnected != nil {
-			go d.peripheralConnected(p, nil)
-		}
+		p.subs = NewSubscribers(p.setNotifyValue)
+		go func() {
+			err := p.connected()
+			if d.reconnect.connected(p, err) {
+				return
+			}
+			d.connWaiters.connected(p, err)
+			if d.peripheralConnected != nil {
+				d.peripheralConnected(p, err)
+			}
+		}()
 		p.loop()
 		if d.peripheralDisconnected != nil {
-			d.peripheralDisconnected(p, nil)
+			d.peripheralDisconnected(p, p.disconnectErr)
 		}
+		d.reconnect.disconnected(p, p.disconnectErr)
+	}
+	d.hci.ConnectFailedHandler = func(pd *linux.PlatData, status uint8) {
+		p := &peripheral{d: d, pd: pd}
+		err := fmt.Errorf("LE connection failed with status 0x%02X", status)
+		if d.reconnect.connected(p, err) {
+			return
+		}
+		d.connWaiters.connected(p, err)
+		if d.peripheralConnected != nil {
+			go d.peripheralConnected(p, err)
+		}
+	}
+	d.hci.ConnParamsRequestHandler = func(pd *linux.PlatData, req linux.ConnParams) (linux.ConnParams, bool) {
+		if d.connParamsRequested == nil {
+			return req, true
+		}
+		p := &peripheral{d: d, pd: pd, l2c: pd.Conn}
+		cp, ok := d.connParamsRequested(p, connParamUnits{req.IntervalMin, req.IntervalMax, req.Latency, req.SupervisionTimeout}.connParams())
+		if !ok {
+			return req, false
+		}
+		u, err := cp.units()
+		if err != nil {
+			log.Printf("gatt: rejecting connection parameters request: %s", err)
+			return req, false
+		}
+		return u.linux(), true
 	}
 	d.hci.AdvertisementHandler = func(pd *linux.PlatData) {
+		// Parse the advertisement once, and only if needed.
+		var a *Advertisement
+		parsed := func() *Advertisement {
+			if a == nil {
+				a = &Advertisement{}
+				a.unmarshall(pd.Data)
+				a.Connectable = pd.Connectable
+			}
+			return a
+		}
+		if d.scanFilter != nil && !d.scanFilter(parsed()) {
+			return
+		}
 		if d.peripheralDiscovered != nil {
-			a := &Advertisement{}
-			a.unmarshall(pd.Data)
-			a.Connectable = pd.Connectable
 			p := &peripheral{pd: pd, d: d}
-			pd.Name = a.LocalName
-			d.peripheralDiscovered(p, a, int(pd.RSSI))
+			pd.Name = parsed().LocalName
+			d.peripheralDiscovered(p, parsed(), int(pd.RSSI))
 		}
 		if d.peripheralDiscoveredRaw != nil {
 			pd.ParseName()
@@ -109,10 +283,8 @@ func (d *device) Init(f func(Device, State)) error {
 		}
 		if d.blukeyDiscovered != nil {
 			if bka := blukey.ParseAdData(pd.Data); bka != nil {
-				a := &Advertisement{}
-				a.unmarshall(pd.Data)
 				p := &peripheral{pd: pd, d: d}
-				pd.Name = a.LocalName
+				pd.Name = parsed().LocalName
 				d.blukeyDiscovered(p, bka, int(pd.RSSI))
 			}
 		}
@@ -124,6 +296,10 @@ func (d *device) Init(f func(Device, State)) error {
 }
 
 func (d *device) Stop() error {
+	if d.rotatec != nil {
+		close(d.rotatec)
+		d.rotatec = nil
+	}
 	d.state = StatePoweredOff
 	defer d.stateChanged(d, d.state)
 	return d.hci.Close()
@@ -218,10 +394,26 @@ func (d *device) StopScanning() {
 }
 
 func (d *device) Connect(p Peripheral) {
+	d.reconnect.resume(p)
+	d.connect(p)
+}
+
+// connect starts connecting to p, as Connect, for the reconnector too.
+func (d *device) connect(p Peripheral) {
+	if d.connectAccept {
+		d.hci.ConnectAcceptList(p.(*peripheral).pd)
+		return
+	}
 	d.hci.Connect(p.(*peripheral).pd)
 }
 
 func (d *device) CancelConnection(p Peripheral) {
+	d.reconnect.cancel(p)
+	d.abort(p)
+}
+
+// abort cancels the connection attempt to p, or closes the connection.
+func (d *device) abort(p Peripheral) {
 	d.hci.CancelConnection(p.(*peripheral).pd)
 }
 
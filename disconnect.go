@@ -0,0 +1,63 @@
+package gatt
+
+import (
+	"fmt"
+	"io"
+)
+
+// A DisconnectReason is why a connection ended, as the HCI Disconnection
+// Complete event reports it.
+type DisconnectReason uint8
+
+const (
+	ReasonUnknown                DisconnectReason = 0x00 // not reported
+	ReasonAuthenticationFailure  DisconnectReason = 0x05
+	ReasonConnectionTimeout      DisconnectReason = 0x08 // supervision timeout, out of range
+	ReasonRemoteUserTerminated   DisconnectReason = 0x13
+	ReasonRemoteLowResources     DisconnectReason = 0x14
+	ReasonRemotePowerOff         DisconnectReason = 0x15
+	ReasonLocalHostTerminated    DisconnectReason = 0x16 // Close, CancelConnection
+	ReasonLMPResponseTimeout     DisconnectReason = 0x22 // LL response timeout
+	ReasonUnacceptableConnParams DisconnectReason = 0x3B
+	ReasonMICFailure             DisconnectReason = 0x3D
+	ReasonFailedToEstablish      DisconnectReason = 0x3E
+)
+
+var disconnectReasonName = map[DisconnectReason]string{
+	ReasonUnknown:                "unknown reason",
+	ReasonAuthenticationFailure:  "authentication failure",
+	ReasonConnectionTimeout:      "connection timeout",
+	ReasonRemoteUserTerminated:   "remote user terminated connection",
+	ReasonRemoteLowResources:     "remote device terminated connection due to low resources",
+	ReasonRemotePowerOff:         "remote device terminated connection due to power off",
+	ReasonLocalHostTerminated:    "connection terminated by local host",
+	ReasonLMPResponseTimeout:     "LMP response timeout",
+	ReasonUnacceptableConnParams: "unacceptable connection parameters",
+	ReasonMICFailure:             "connection terminated due to MIC failure",
+	ReasonFailedToEstablish:      "connection failed to be established",
+}
+
+func (r DisconnectReason) String() string {
+	if s, ok := disconnectReasonName[r]; ok {
+		return s
+	}
+	return fmt.Sprintf("reason 0x%02X", uint8(r))
+}
+
+// A DisconnectError reports that the connection to a peripheral ended. It
+// is passed to the PeripheralDisconnected handler, and returned by the
+// requests in flight or made on the connection after it ended. For
+// errors.Is, it is io.EOF, which these requests used to return.
+type DisconnectError struct {
+	ID     string // ID of the peripheral
+	reason DisconnectReason
+}
+
+// Reason returns why the connection ended.
+func (e *DisconnectError) Reason() DisconnectReason { return e.reason }
+
+func (e *DisconnectError) Error() string {
+	return fmt.Sprintf("gatt: %s disconnected: %s", e.ID, e.reason)
+}
+
+func (e *DisconnectError) Is(target error) bool { return target == io.EOF }
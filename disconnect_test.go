@@ -0,0 +1,37 @@
+package gatt
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestDisconnectReason(t *testing.T) {
+	for _, tt := range []struct {
+		r    DisconnectReason
+		want string
+	}{
+		{ReasonConnectionTimeout, "connection timeout"},
+		{ReasonRemoteUserTerminated, "remote user terminated connection"},
+		{ReasonLocalHostTerminated, "connection terminated by local host"},
+		{ReasonLMPResponseTimeout, "LMP response timeout"},
+		{0x42, "reason 0x42"},
+	} {
+		if got := tt.r.String(); got != tt.want {
+			t.Errorf("0x%02X: got %q, want %q", uint8(tt.r), got, tt.want)
+		}
+	}
+
+	err := fmt.Errorf("reading: %w", &DisconnectError{ID: "C0:26:DF:00:10:01", reason: ReasonRemoteUserTerminated})
+	var de *DisconnectError
+	if !errors.As(err, &de) || de.Reason() != ReasonRemoteUserTerminated {
+		t.Fatalf("got %v", err)
+	}
+	if !errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("errors.Is of %v", err)
+	}
+	if got, want := de.Error(), "gatt: C0:26:DF:00:10:01 disconnected: remote user terminated connection"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,197 @@
+package gatt
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// A DiscoveryCache keeps the GATT databases discovered on peripherals, by
+// peripheral ID, so that discovery can be skipped when reconnecting. A
+// peripheral uses its entry until it indicates Service Changed or answers
+// a request with an Invalid Handle error, which deletes the entry. If the
+// peripheral has the Database Hash characteristic, the entry is also
+// checked against it on the first DiscoverServices of a connection.
+//
+// Only the Linux implementation uses one, see LnxDiscoveryCache.
+type DiscoveryCache interface {
+	// Get returns the database cached for the peripheral with the ID.
+	Get(id string) (*GATTDatabase, bool)
+
+	// Put caches db for the peripheral with the ID, replacing any.
+	Put(id string, db *GATTDatabase) error
+
+	// Delete drops the database cached for the peripheral with the ID.
+	Delete(id string) error
+}
+
+// A GATTDatabase is the services of a peripheral as far as discovered, as
+// a DiscoveryCache keeps them.
+type GATTDatabase struct {
+	// Hash is the value of the Database Hash characteristic, if any.
+	Hash []byte `json:",omitempty"`
+
+	Services []CachedService
+}
+
+// A CachedService is a service in a GATTDatabase.
+type CachedService struct {
+	UUID      UUID
+	Handle    uint16
+	EndHandle uint16
+
+	// Characteristics is nil until discovered.
+	Characteristics []CachedCharacteristic
+}
+
+// A CachedCharacteristic is a characteristic in a GATTDatabase.
+type CachedCharacteristic struct {
+	UUID        UUID
+	Properties  Property
+	Handle      uint16
+	ValueHandle uint16
+	EndHandle   uint16
+
+	// Descriptors is nil until discovered.
+	Descriptors []CachedDescriptor
+}
+
+// A CachedDescriptor is a descriptor in a GATTDatabase.
+type CachedDescriptor struct {
+	UUID   UUID
+	Handle uint16
+}
+
+// newGATTDatabase returns the database of svcs, with the hash given.
+func newGATTDatabase(hash []byte, svcs []*Service) *GATTDatabase {
+	db := &GATTDatabase{Hash: hash, Services: make([]CachedService, 0, len(svcs))}
+	for _, s := range svcs {
+		cs := CachedService{UUID: s.uuid, Handle: s.h, EndHandle: s.endh}
+		if s.discovered {
+			cs.Characteristics = make([]CachedCharacteristic, 0, len(s.chars))
+		}
+		for _, c := range s.chars {
+			cc := CachedCharacteristic{
+				UUID:        c.uuid,
+				Properties:  c.props,
+				Handle:      c.h,
+				ValueHandle: c.vh,
+				EndHandle:   c.endh,
+			}
+			if c.discovered {
+				cc.Descriptors = make([]CachedDescriptor, 0, len(c.descs))
+			}
+			for _, d := range c.descs {
+				cc.Descriptors = append(cc.Descriptors, CachedDescriptor{UUID: d.uuid, Handle: d.h})
+			}
+			cs.Characteristics = append(cs.Characteristics, cc)
+		}
+		db.Services = append(db.Services, cs)
+	}
+	return db
+}
+
+// services returns the services of db, marked discovered as far as db
+// knows them.
+func (db *GATTDatabase) services() []*Service {
+	svcs := make([]*Service, 0, len(db.Services))
+	for _, cs := range db.Services {
+		s := &Service{uuid: cs.UUID, h: cs.Handle, endh: cs.EndHandle, discovered: cs.Characteristics != nil}
+		for _, cc := range cs.Characteristics {
+			c := &Characteristic{
+				uuid:       cc.UUID,
+				props:      cc.Properties,
+				svc:        s,
+				h:          cc.Handle,
+				vh:         cc.ValueHandle,
+				endh:       cc.EndHandle,
+				discovered: cc.Descriptors != nil,
+			}
+			for _, cd := range cc.Descriptors {
+				d := &Descriptor{uuid: cd.UUID, h: cd.Handle, char: c}
+				c.descs = append(c.descs, d)
+				if d.uuid.Equal(attrClientCharacteristicConfigUUID) {
+					c.cccd = d
+				}
+			}
+			s.chars = append(s.chars, c)
+		}
+		svcs = append(svcs, s)
+	}
+	return svcs
+}
+
+// FileDiscoveryCache is a DiscoveryCache keeping each database in a JSON
+// file of its own in a directory.
+type FileDiscoveryCache struct {
+	dir string
+	mu  sync.Mutex
+}
+
+// NewFileDiscoveryCache returns a FileDiscoveryCache keeping the databases
+// in dir, which is created if needed.
+func NewFileDiscoveryCache(dir string) (*FileDiscoveryCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileDiscoveryCache{dir: dir}, nil
+}
+
+// path returns the path of the file for the peripheral with the ID.
+func (fc *FileDiscoveryCache) path(id string) string {
+	return filepath.Join(fc.dir, url.PathEscape(id)+".json")
+}
+
+// Get returns the database cached for the peripheral with the ID. A file
+// that cannot be read or decoded counts as missing.
+func (fc *FileDiscoveryCache) Get(id string) (*GATTDatabase, bool) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	b, err := ioutil.ReadFile(fc.path(id))
+	if err != nil {
+		return nil, false
+	}
+	db := &GATTDatabase{}
+	if err := json.Unmarshal(b, db); err != nil {
+		return nil, false
+	}
+	return db, true
+}
+
+// Put writes db to the file of the peripheral with the ID, replacing it
+// at once.
+func (fc *FileDiscoveryCache) Put(id string, db *GATTDatabase) error {
+	b, err := json.Marshal(db)
+	if err != nil {
+		return err
+	}
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	f, err := ioutil.TempFile(fc.dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), fc.path(id))
+}
+
+// Delete removes the file of the peripheral with the ID, if any.
+func (fc *FileDiscoveryCache) Delete(id string) error {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	if err := os.Remove(fc.path(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package gatt
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+)
+
+func TestGATTDatabase(t *testing.T) {
+	s := &Service{uuid: UUID16(0x180f), h: 1, endh: 5, discovered: true}
+	c := &Characteristic{uuid: UUID16(0x2a19), props: CharRead | CharNotify, svc: s, h: 2, vh: 3, endh: 5, discovered: true}
+	c.descs = []*Descriptor{{uuid: attrClientCharacteristicConfigUUID, h: 4, char: c}, {uuid: UUID16(0x2901), h: 5, char: c}}
+	s.chars = []*Characteristic{c, {uuid: UUID16(0x2a1a), svc: s, h: 6, vh: 7}}
+	other := &Service{uuid: UUID16(0x180a), h: 8, endh: 9}
+
+	db := newGATTDatabase([]byte{1}, []*Service{s, other})
+	if db.Services[1].Characteristics != nil {
+		t.Error("characteristics not discovered cached as none")
+	}
+	if db.Services[0].Characteristics[1].Descriptors != nil {
+		t.Error("descriptors not discovered cached as none")
+	}
+
+	svcs := db.services()
+	if !reflect.DeepEqual(newGATTDatabase([]byte{1}, svcs), db) {
+		t.Error("services do not round-trip")
+	}
+	got := svcs[0].chars[0]
+	if d, ok := got.ClientConfig(); !ok || d.h != 4 || got.svc != svcs[0] || d.char != got {
+		t.Error("services not linked up")
+	}
+	if !svcs[0].discovered || svcs[1].discovered || !got.discovered || svcs[0].chars[1].discovered {
+		t.Error("discovered flags not restored")
+	}
+}
+
+func TestFileDiscoveryCache(t *testing.T) {
+	dir := t.TempDir()
+	fc, err := NewFileDiscoveryCache(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const id = "01:02:03:04:05:06"
+	if _, ok := fc.Get(id); ok {
+		t.Fatal("Get before Put: found")
+	}
+
+	db := &GATTDatabase{
+		Hash: []byte{0xaa, 0xbb},
+		Services: []CachedService{{
+			UUID: MustParseUUID("09fc95c0-c111-11e3-9904-0002a5d5c51b"), Handle: 1, EndHandle: 4,
+			Characteristics: []CachedCharacteristic{{
+				UUID: UUID16(0x2a19), Properties: CharRead, Handle: 2, ValueHandle: 3, EndHandle: 4,
+				Descriptors: []CachedDescriptor{},
+			}},
+		}},
+	}
+	if err := fc.Put(id, db); err != nil {
+		t.Fatal(err)
+	}
+	// Another cache on the directory, as after a restart.
+	fc, _ = NewFileDiscoveryCache(dir)
+	got, ok := fc.Get(id)
+	if !ok || !reflect.DeepEqual(got, db) {
+		t.Fatalf("Get: got %+v, %t, want %+v", got, ok, db)
+	}
+
+	if err := fc.Delete(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fc.Get(id); ok {
+		t.Error("Get after Delete: found")
+	}
+	if err := fc.Delete(id); err != nil {
+		t.Errorf("Delete of a missing entry: %v", err)
+	}
+
+	if err := ioutil.WriteFile(fc.path(id), []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fc.Get(id); ok {
+		t.Error("Get of a corrupt file: found")
+	}
+}
@@ -0,0 +1,72 @@
+package gatttest
+
+import (
+	"github.com/PayRange/gatt"
+)
+
+// BRSPPeripheral is a Peripheral serving the standard BRSP service.
+type BRSPPeripheral struct {
+	*Peripheral
+
+	Mode *gatt.Characteristic
+	RX   *gatt.Characteristic
+	TX   *gatt.Characteristic
+}
+
+// NewBRSPPeripheral returns a BRSPPeripheral with the given ID. Data the
+// central writes to RX is passed to HandleWrite; SendTX delivers data to
+// the central.
+func NewBRSPPeripheral(id string) *BRSPPeripheral {
+	svc := gatt.NewService(gatt.BRSPServiceUUID)
+	p := &BRSPPeripheral{
+		Mode: gatt.NewCharacteristic(gatt.BRSPModeUUID, svc, gatt.CharRead|gatt.CharWrite, 0x0002, 0x0003),
+		RX:   gatt.NewCharacteristic(gatt.BRSPRxUUID, svc, gatt.CharWrite|gatt.CharWriteNR, 0x0004, 0x0005),
+		TX:   gatt.NewCharacteristic(gatt.BRSPTxUUID, svc, gatt.CharIndicate|gatt.CharNotify, 0x0006, 0x0007),
+	}
+	svc.SetCharacteristics([]*gatt.Characteristic{p.Mode, p.RX, p.TX})
+	p.Peripheral = NewPeripheral(id, svc)
+	return p
+}
+
+// SendTX delivers b to the BRSP session reading from the peripheral and
+// reports whether one is subscribed.
+func (p *BRSPPeripheral) SendTX(b []byte) bool {
+	return p.Notify(p.TX, b)
+}
+
+// NewBRSPPipe returns two BRSP sessions connected back to back, so that
+// data written to one can be read from the other.
+func NewBRSPPipe() (*gatt.BRSP, *gatt.BRSP, error) {
+	return NewBRSPPipeWithOptions(gatt.BRSPOptions{})
+}
+
+// NewBRSPPipeWithOptions is like NewBRSPPipe but opens both sessions with
+// the options o.
+func NewBRSPPipeWithOptions(o gatt.BRSPOptions) (*gatt.BRSP, *gatt.BRSP, error) {
+	pa := NewBRSPPeripheral("brsp-a")
+	pb := NewBRSPPeripheral("brsp-b")
+	pa.HandleWrite = forwardRX(pa, pb)
+	pb.HandleWrite = forwardRX(pb, pa)
+
+	a, err := gatt.OpenBRSPWithOptions(pa, o)
+	if err != nil {
+		return nil, nil, err
+	}
+	b, err := gatt.OpenBRSPWithOptions(pb, o)
+	if err != nil {
+		a.Close()
+		return nil, nil, err
+	}
+	return a, b, nil
+}
+
+// forwardRX returns a write handler for from that passes data written to
+// its RX characteristic on to the TX characteristic of to.
+func forwardRX(from, to *BRSPPeripheral) func(*gatt.Characteristic, []byte, bool) error {
+	return func(c *gatt.Characteristic, b []byte, noRsp bool) error {
+		if c == from.RX {
+			to.SendTX(b)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,211 @@
+package gatttest
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/PayRange/gatt"
+)
+
+func TestBRSPPipe(t *testing.T) {
+	a, b, err := NewBRSPPipe()
+	if err != nil {
+		t.Fatalf("NewBRSPPipe: %s", err)
+	}
+	defer a.Close()
+	defer b.Close()
+
+	go func() {
+		a.Write([]byte("a message longer than a single BRSP chunk\n"))
+		a.Flush()
+	}()
+	line, err := bufio.NewReader(b).ReadString('\n')
+	if err != nil || line != "a message longer than a single BRSP chunk\n" {
+		t.Fatalf("ReadString: got %q, %v", line, err)
+	}
+
+	go b.Write([]byte("reply"))
+	buf := make([]byte, 10)
+	if n, err := io.ReadFull(a, buf[:5]); err != nil || string(buf[:n]) != "reply" {
+		t.Fatalf("ReadFull: got %q, %v", buf[:n], err)
+	}
+}
+
+// echo serves c like a line-based network service would.
+func echo(c net.Conn) error {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	for {
+		c.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(c, "%s: %s", c.RemoteAddr(), line); err != nil {
+			return err
+		}
+	}
+}
+
+func TestBRSPNetConn(t *testing.T) {
+	a, b, err := NewBRSPPipe()
+	if err != nil {
+		t.Fatalf("NewBRSPPipe: %s", err)
+	}
+	defer a.Close()
+
+	if addr := a.RemoteAddr(); addr.Network() != "brsp" || addr.String() != "brsp-a" {
+		t.Errorf("RemoteAddr: got %s %q want brsp %q", addr.Network(), addr, "brsp-a")
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- echo(b)
+	}()
+
+	var c net.Conn = a
+	r := bufio.NewReader(c)
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(c, "request %d\n", i)
+		want := fmt.Sprintf("brsp-b: request %d\n", i)
+		if line, err := r.ReadString('\n'); err != nil || line != want {
+			t.Fatalf("ReadString: got %q, %v want %q", line, err, want)
+		}
+	}
+
+	// With no more requests the server times out like on a network.
+	var nerr net.Error
+	if err := <-done; !errors.As(err, &nerr) || !nerr.Timeout() {
+		t.Errorf("echo: got %v want a timeout", err)
+	}
+}
+
+func TestBRSPPeripheralAccess(t *testing.T) {
+	a, b, err := NewBRSPPipe()
+	if err != nil {
+		t.Fatalf("NewBRSPPipe: %s", err)
+	}
+	defer a.Close()
+	defer b.Close()
+
+	p, ok := a.Peripheral().(*BRSPPeripheral)
+	if !ok || p.ID() != "brsp-a" {
+		t.Fatalf("Peripheral: got %v", a.Peripheral())
+	}
+	if a.Service() != p.Services()[0] ||
+		a.ModeCharacteristic() != p.Mode || a.RxCharacteristic() != p.RX || a.TxCharacteristic() != p.TX {
+		t.Errorf("BRSP attributes differ from the peripheral's")
+	}
+
+	// Unrelated requests on the peripheral don't disturb the stream.
+	data := make([]byte, 10000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	stop := make(chan struct{})
+	reads := make(chan error, 1)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				reads <- nil
+				return
+			default:
+			}
+			if v, err := p.ReadCharacteristic(p.Mode); err != nil || !bytes.Equal(v, []byte{1}) {
+				reads <- fmt.Errorf("ReadCharacteristic: got %v, %v", v, err)
+				return
+			}
+		}
+	}()
+	go func() {
+		a.Write(data)
+		a.Flush()
+	}()
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(b, got); err != nil || !bytes.Equal(got, data) {
+		t.Errorf("ReadFull: %v, data intact: %t", err, bytes.Equal(got, data))
+	}
+	close(stop)
+	if err := <-reads; err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBRSPPeripheralDisconnect(t *testing.T) {
+	p := NewBRSPPeripheral("brsp")
+	var rx []byte
+	p.HandleWrite = func(c *gatt.Characteristic, b []byte, noRsp bool) error {
+		if c == p.RX {
+			rx = append(rx, b...)
+		}
+		return nil
+	}
+
+	s, err := gatt.OpenBRSP(p)
+	if err != nil {
+		t.Fatalf("OpenBRSP: %s", err)
+	}
+	defer s.Close()
+
+	s.Write([]byte("ping"))
+	if err := s.Flush(); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+	if string(rx) != "ping" {
+		t.Errorf("RX: got %q want %q", rx, "ping")
+	}
+
+	p.SendTX([]byte("pong"))
+	p.Disconnect(io.EOF)
+	buf := make([]byte, 10)
+	if n, err := s.Read(buf); err != nil || string(buf[:n]) != "pong" {
+		t.Errorf("Read: got %q, %v want %q, nil", buf[:n], err, "pong")
+	}
+	if _, err := s.Read(buf); err != io.EOF {
+		t.Errorf("Read: got %v want %v", err, io.EOF)
+	}
+}
+
+func TestBRSPServicesChangedAfterClose(t *testing.T) {
+	p := NewBRSPPeripheral("brsp")
+	var mu sync.Mutex
+	writes := 0
+	p.HandleWrite = func(c *gatt.Characteristic, b []byte, noRsp bool) error {
+		mu.Lock()
+		writes++
+		mu.Unlock()
+		return nil
+	}
+
+	resubscribed := make(chan error, 1)
+	s, err := gatt.OpenBRSPWithOptions(p, gatt.BRSPOptions{
+		OnResubscribe: func(err error) { resubscribed <- err },
+	})
+	if err != nil {
+		t.Fatalf("OpenBRSP: %s", err)
+	}
+	mu.Lock()
+	writes = 0
+	mu.Unlock()
+
+	s.Close()
+	p.ChangeServices(0x0001, 0xffff)
+	select {
+	case err := <-resubscribed:
+		t.Fatalf("resubscribed after Close: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if writes != 0 {
+		t.Errorf("%d writes after Close", writes)
+	}
+}
@@ -0,0 +1,289 @@
+// Package gatttest provides in-memory fakes for testing code built on gatt
+// without Bluetooth hardware.
+package gatttest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/PayRange/gatt"
+)
+
+// Peripheral is an in-memory gatt.Peripheral serving a fixed set of
+// services. Written values are kept per characteristic and descriptor,
+// and Notify delivers values to the subscribed callbacks.
+type Peripheral struct {
+	// HandleWrite, if set, is called for every characteristic write
+	// before the value is stored. Its error is returned to the writer.
+	HandleWrite func(c *gatt.Characteristic, b []byte, noRsp bool) error
+
+	// HandleWriteDescriptor, if set, is called for every descriptor write
+	// before the value is stored, like HandleWrite.
+	HandleWriteDescriptor func(d *gatt.Descriptor, b []byte) error
+
+	id   string
+	svcs []*gatt.Service
+
+	mu     sync.Mutex
+	values map[*gatt.Characteristic][]byte
+	descs  map[*gatt.Descriptor][]byte
+	subs   map[*gatt.Characteristic]func(*gatt.Characteristic, []byte, error)
+	chans  *gatt.Subscribers
+
+	changed     map[int]func(start, end uint16)
+	nextChanged int
+
+	security gatt.SecurityLevel
+}
+
+// NewPeripheral returns a Peripheral with the given ID serving svcs.
+func NewPeripheral(id string, svcs ...*gatt.Service) *Peripheral {
+	return &Peripheral{
+		id:     id,
+		svcs:   svcs,
+		values: make(map[*gatt.Characteristic][]byte),
+		descs:  make(map[*gatt.Descriptor][]byte),
+		subs:   make(map[*gatt.Characteristic]func(*gatt.Characteristic, []byte, error)),
+		chans:  newSubscribers(),
+
+		changed: make(map[int]func(start, end uint16)),
+	}
+}
+
+func newSubscribers() *gatt.Subscribers {
+	return gatt.NewSubscribers(func(*gatt.Characteristic, gatt.NotifyKind) error { return nil })
+}
+
+func (p *Peripheral) Device() gatt.Device       { return nil }
+func (p *Peripheral) ID() string                { return p.id }
+func (p *Peripheral) Name() string              { return p.id }
+func (p *Peripheral) Services() []*gatt.Service { return p.svcs }
+func (p *Peripheral) ReadRSSI() (int, error)    { return 0, nil }
+func (p *Peripheral) Pair() error               { return nil }
+func (p *Peripheral) SetMTU(mtu uint16) error   { return nil }
+func (p *Peripheral) MTU() uint16               { return 23 }
+
+func (p *Peripheral) ExchangeMTU(requested uint16) (uint16, error) { return 23, nil }
+
+func (p *Peripheral) SecurityLevel() (gatt.SecurityLevel, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.security, nil
+}
+
+// SetSecurityLevel raises the security level to l, which the in-memory
+// link always reaches.
+func (p *Peripheral) SetSecurityLevel(l gatt.SecurityLevel) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if l > p.security {
+		p.security = l
+	}
+	return nil
+}
+
+func (p *Peripheral) UpdateConnectionParams(min, max time.Duration, latency uint16, timeout time.Duration) error {
+	return nil
+}
+
+func (p *Peripheral) DiscoverServices(ss []gatt.UUID) ([]*gatt.Service, error) {
+	var svcs []*gatt.Service
+	for _, s := range p.svcs {
+		if contains(ss, s.UUID()) {
+			svcs = append(svcs, s)
+		}
+	}
+	return svcs, nil
+}
+
+func (p *Peripheral) DiscoverIncludedServices(ss []gatt.UUID, s *gatt.Service) ([]*gatt.Service, error) {
+	return nil, nil
+}
+
+func (p *Peripheral) DiscoverCharacteristics(cs []gatt.UUID, s *gatt.Service) ([]*gatt.Characteristic, error) {
+	var chars []*gatt.Characteristic
+	for _, c := range s.Characteristics() {
+		if contains(cs, c.UUID()) {
+			chars = append(chars, c)
+		}
+	}
+	return chars, nil
+}
+
+func (p *Peripheral) DiscoverDescriptors(ds []gatt.UUID, c *gatt.Characteristic) ([]*gatt.Descriptor, error) {
+	var descs []*gatt.Descriptor
+	for _, d := range c.Descriptors() {
+		if contains(ds, d.UUID()) {
+			descs = append(descs, d)
+		}
+	}
+	return descs, nil
+}
+
+func (p *Peripheral) ReadCharacteristic(c *gatt.Characteristic) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]byte(nil), p.values[c]...), nil
+}
+
+func (p *Peripheral) ReadLongCharacteristic(c *gatt.Characteristic) ([]byte, error) {
+	return p.ReadCharacteristic(c)
+}
+
+func (p *Peripheral) ReadDescriptor(d *gatt.Descriptor) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]byte(nil), p.descs[d]...), nil
+}
+
+func (p *Peripheral) WriteCharacteristic(c *gatt.Characteristic, b []byte, noRsp bool) error {
+	if p.HandleWrite != nil {
+		if err := p.HandleWrite(c, b, noRsp); err != nil {
+			return err
+		}
+	}
+	p.mu.Lock()
+	p.values[c] = append([]byte(nil), b...)
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *Peripheral) WriteCommand(c *gatt.Characteristic, b []byte) error {
+	return p.WriteCharacteristic(c, b, true)
+}
+
+// WritableWithoutResponse returns a closed channel, as writes are applied
+// at once.
+func (p *Peripheral) WritableWithoutResponse() <-chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}
+
+// ReliableWrite applies the writes queued by f together, after passing
+// each to HandleWrite. If f or HandleWrite fails, none is applied.
+func (p *Peripheral) ReliableWrite(f func(tx *gatt.WriteTx) error) error {
+	var tx gatt.WriteTx
+	if err := f(&tx); err != nil {
+		return err
+	}
+	ws := tx.Writes()
+	if p.HandleWrite != nil {
+		for _, w := range ws {
+			if err := p.HandleWrite(w.Characteristic, w.Value, false); err != nil {
+				return err
+			}
+		}
+	}
+	p.mu.Lock()
+	for _, w := range ws {
+		p.values[w.Characteristic] = append([]byte(nil), w.Value...)
+	}
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *Peripheral) WriteDescriptor(d *gatt.Descriptor, b []byte) error {
+	if p.HandleWriteDescriptor != nil {
+		if err := p.HandleWriteDescriptor(d, b); err != nil {
+			return err
+		}
+	}
+	p.mu.Lock()
+	p.descs[d] = append([]byte(nil), b...)
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *Peripheral) SetNotifyValue(c *gatt.Characteristic, f func(*gatt.Characteristic, []byte, error)) error {
+	p.mu.Lock()
+	if f == nil {
+		delete(p.subs, c)
+	} else {
+		p.subs[c] = f
+	}
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *Peripheral) SetIndicateValue(c *gatt.Characteristic, f func(*gatt.Characteristic, []byte, error)) error {
+	return p.SetNotifyValue(c, f)
+}
+
+func (p *Peripheral) Subscribe(c *gatt.Characteristic, kind gatt.NotifyKind) (*gatt.Subscription, error) {
+	p.mu.Lock()
+	chans := p.chans
+	p.mu.Unlock()
+	return chans.Subscribe(c, kind)
+}
+
+func (p *Peripheral) OnServicesChanged(f func(start, end uint16)) (remove func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	id := p.nextChanged
+	p.nextChanged++
+	p.changed[id] = f
+	return func() {
+		p.mu.Lock()
+		delete(p.changed, id)
+		p.mu.Unlock()
+	}
+}
+
+// ChangeServices simulates a Service Changed indication of the handles
+// from start to end: it calls the functions registered with
+// OnServicesChanged, and waits for them to return.
+func (p *Peripheral) ChangeServices(start, end uint16) {
+	p.mu.Lock()
+	var fs []func(start, end uint16)
+	for _, f := range p.changed {
+		fs = append(fs, f)
+	}
+	p.mu.Unlock()
+	for _, f := range fs {
+		f(start, end)
+	}
+}
+
+// Notify delivers b to the callback subscribed to c, if any, and waits for
+// it to return, and to the Subscriptions to c. It reports whether there
+// was a subscriber.
+func (p *Peripheral) Notify(c *gatt.Characteristic, b []byte) bool {
+	p.mu.Lock()
+	f := p.subs[c]
+	chans := p.chans
+	p.mu.Unlock()
+	if f != nil {
+		f(c, append([]byte(nil), b...), nil)
+	}
+	subscribed := chans.Deliver(c, append([]byte(nil), b...))
+	return f != nil || subscribed
+}
+
+// Disconnect simulates the connection going away: every subscribed
+// callback is called with err, every Subscription ends with err, and the
+// subscriptions are dropped.
+func (p *Peripheral) Disconnect(err error) {
+	p.mu.Lock()
+	subs, chans := p.subs, p.chans
+	p.subs = make(map[*gatt.Characteristic]func(*gatt.Characteristic, []byte, error))
+	p.chans = newSubscribers()
+	p.mu.Unlock()
+	for c, f := range subs {
+		f(c, nil, err)
+	}
+	chans.End(err)
+}
+
+// contains reports whether u is in uu, where a nil uu matches everything.
+func contains(uu []gatt.UUID, u gatt.UUID) bool {
+	if uu == nil {
+		return true
+	}
+	for _, v := range uu {
+		if v.Equal(u) {
+			return true
+		}
+	}
+	return false
+}
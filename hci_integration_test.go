@@ -0,0 +1,71 @@
+//go:build linux && integration
+// +build linux,integration
+
+package gatt
+
+import (
+	"testing"
+	"time"
+)
+
+// TestTwoAdapters runs a Device on each of hci0 and hci1 at once. It needs
+// both adapters, and the rights to open them:
+//
+//	sudo go test -tags integration -run TestTwoAdapters .
+func TestTwoAdapters(t *testing.T) {
+	var ds [2]Device
+	defer func() {
+		for _, d := range ds {
+			if d != nil {
+				d.(*device).Stop()
+			}
+		}
+	}()
+	for i := range ds {
+		d, err := NewDevice(LnxDeviceID(i, true))
+		if err != nil {
+			t.Fatalf("hci%d: %v", i, err)
+		}
+		ds[i] = d
+		on := make(chan State, 1)
+		d.Handle(PeripheralDiscovered(func(Peripheral, *Advertisement, int) {}))
+		if err := d.Init(func(d Device, s State) {
+			select {
+			case on <- s:
+			default:
+			}
+		}); err != nil {
+			t.Fatalf("hci%d: %v", i, err)
+		}
+		if s := <-on; s != StatePoweredOn {
+			t.Fatalf("hci%d: state %s", i, s)
+		}
+	}
+	if ds[0].Address() == ds[1].Address() {
+		t.Fatalf("both devices have address %s", ds[0].Address())
+	}
+	if _, err := NewDevice(LnxDeviceID(0, true)); err == nil {
+		t.Fatal("hci0 opened twice")
+	}
+
+	for _, d := range ds {
+		d.Scan(nil, false)
+	}
+	time.Sleep(2 * time.Second)
+	for _, d := range ds {
+		d.StopScanning()
+	}
+
+	// Reopen hci1 by address.
+	a := ds[1].Address()
+	ds[1].(*device).Stop()
+	ds[1] = nil
+	d, err := NewDevice(LnxDeviceAddress(a.String(), true))
+	if err != nil {
+		t.Fatalf("%s: %v", a, err)
+	}
+	defer d.(*device).Stop()
+	if got := d.Address(); got != a {
+		t.Errorf("opened %s, want %s", got, a)
+	}
+}
@@ -0,0 +1,110 @@
+package linux
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/PayRange/gatt/linux/cmd"
+)
+
+// ErrAcceptListFull is returned by AddToAcceptList when the Filter Accept
+// List of the controller has no room left.
+var ErrAcceptListFull = errors.New("hci: accept list full")
+
+// An acceptEntry is a device of the Filter Accept List.
+type acceptEntry struct {
+	typ  uint8
+	addr [6]byte
+}
+
+// AcceptListSize returns the number of devices the Filter Accept List of
+// the controller holds at most.
+func (h *HCI) AcceptListSize() (int, error) {
+	b, err := h.c.Send(cmd.LEReadWhiteListSize{})
+	if err != nil {
+		return 0, err
+	}
+	var rp cmd.LEReadWhiteListSizeRP
+	if err := rp.Unmarshal(b); err != nil {
+		return 0, err
+	}
+	if rp.Status != 0x00 {
+		return 0, fmt.Errorf("hci: read accept list size failed with status 0x%02X", rp.Status)
+	}
+	return int(rp.WhiteListSize), nil
+}
+
+// AddToAcceptList adds the device of address addr, most significant octet
+// first, and type typ, 0x00 public or 0x01 random, to the Filter Accept
+// List of the controller. If the list is full, the error is
+// ErrAcceptListFull.
+func (h *HCI) AddToAcceptList(typ uint8, addr [6]byte) error {
+	e := acceptEntry{typ, addr}
+	return h.changeAcceptList(cmd.LEAddDeviceToWhiteList{AddressType: typ, Address: addr}, func() {
+		h.accept[e] = true
+	})
+}
+
+// RemoveFromAcceptList removes the device of address addr and type typ
+// from the Filter Accept List of the controller.
+func (h *HCI) RemoveFromAcceptList(typ uint8, addr [6]byte) error {
+	e := acceptEntry{typ, addr}
+	return h.changeAcceptList(cmd.LERemoveDeviceFromWhiteList{AddressType: typ, Address: addr}, func() {
+		delete(h.accept, e)
+	})
+}
+
+// ClearAcceptList removes all the devices from the Filter Accept List of
+// the controller.
+func (h *HCI) ClearAcceptList() error {
+	return h.changeAcceptList(cmd.LEClearWhiteList{}, func() {
+		h.accept = make(map[acceptEntry]bool)
+	})
+}
+
+// changeAcceptList sends c, which changes the Filter Accept List, and
+// calls update, with connsmu held, if the controller accepts it. The
+// controller rejects changes while the list is in use: scanning is
+// paused around them if it uses the list, and while ConnectAcceptList is
+// connecting, the error is ErrBusy. Advertising using the list must be
+// stopped by the caller.
+func (h *HCI) changeAcceptList(c cmd.CmdParam, update func()) error {
+	h.addrmu.Lock()
+	defer h.addrmu.Unlock()
+	h.connsmu.Lock()
+	busy := h.connecting > 0 && h.pendingAcc
+	h.connsmu.Unlock()
+	if busy {
+		return ErrBusy
+	}
+
+	h.scanmu.Lock()
+	defer h.scanmu.Unlock()
+	pause := h.scan && h.scanAccept
+	if pause {
+		if err := h.setScanEnable(false, h.scanDup); err != nil {
+			return err
+		}
+	}
+	rsp, err := h.c.Send(c)
+	switch {
+	case err != nil:
+	case len(rsp) == 0:
+		err = errors.New("hci: empty response to accept list change")
+	case rsp[0] == 0x07:
+		// Memory Capacity Exceeded
+		err = ErrAcceptListFull
+	case rsp[0] != 0x00:
+		err = fmt.Errorf("hci: accept list change rejected with status 0x%02X", rsp[0])
+	default:
+		h.connsmu.Lock()
+		update()
+		h.connsmu.Unlock()
+	}
+	if pause {
+		if err := h.setScanEnable(true, h.scanDup); err != nil {
+			return err
+		}
+	}
+	return err
+}
@@ -0,0 +1,71 @@
+package linux
+
+import (
+	"errors"
+
+	"github.com/PayRange/gatt/linux/cmd"
+)
+
+// ErrBusy is returned by SetRandomAddress while connections are up or
+// being made.
+var ErrBusy = errors.New("hci: connections up or being made")
+
+// SetRandomAddress sets the random address of the controller to addr, most
+// significant octet first, and has Connect use it as own address from
+// then on. Scanning and advertising use it if their parameters have the
+// random own address type. They are paused around the change, which the
+// controller rejects otherwise. As it would disturb them, the address is
+// not changed while connections are up or being made: the error is then
+// ErrBusy.
+func (h *HCI) SetRandomAddress(addr [6]byte) error {
+	h.addrmu.Lock()
+	defer h.addrmu.Unlock()
+	h.connsmu.Lock()
+	busy := len(h.conns) > 0 || h.connecting > 0
+	h.connsmu.Unlock()
+	if busy {
+		return ErrBusy
+	}
+
+	h.scanmu.Lock()
+	defer h.scanmu.Unlock()
+	h.advmu.Lock()
+	adv := h.adv
+	h.advmu.Unlock()
+	if h.scan {
+		if err := h.setScanEnable(false, h.scanDup); err != nil {
+			return err
+		}
+	}
+	if adv {
+		if err := h.setAdvertiseEnable(false); err != nil {
+			return err
+		}
+	}
+	err := h.c.SendAndCheckResp(cmd.LESetRandomAddress{RandomAddress: addr}, []byte{0x00})
+	if err == nil {
+		h.randAddr, h.ownAddrType = addr, 0x01
+	}
+	if adv {
+		if err := h.setAdvertiseEnable(true); err != nil {
+			return err
+		}
+	}
+	if h.scan {
+		if err := h.setScanEnable(true, h.scanDup); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// Address returns the own address of the controller, most significant
+// octet first, and its type: 0x00 public, 0x01 random.
+func (h *HCI) Address() ([6]byte, uint8) {
+	h.addrmu.Lock()
+	defer h.addrmu.Unlock()
+	if h.ownAddrType == 0x01 {
+		return h.randAddr, 0x01
+	}
+	return h.addr, 0x00
+}
@@ -2,10 +2,12 @@ package cmd
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"log"
+	"sync"
 
 	"github.com/PayRange/gatt/linux/evt"
 	"github.com/PayRange/gatt/linux/util"
@@ -45,13 +47,17 @@ func (c cmdPkt) Marshal() []byte {
 }
 
 type Cmd struct {
-	dev     io.Writer
+	dev io.Writer
+
+	// sent holds the commands waiting for a reply, in the order sent.
+	// Commands may be sent from several goroutines at once.
+	sentmu  sync.Mutex
 	sent    []*cmdPkt
 	compc   chan evt.CommandCompleteEP
 	statusc chan evt.CommandStatusEP
 }
 
-func (c Cmd) trace(fmt string, v ...interface{}) {}
+func (c *Cmd) trace(fmt string, v ...interface{}) {}
 
 func (c *Cmd) HandleComplete(b []byte) error {
 	var e evt.CommandCompleteEP
@@ -76,8 +82,14 @@ func (c *Cmd) Send(cp CmdParam) ([]byte, error) {
 	p := &cmdPkt{op: op, cp: cp, done: make(chan []byte)}
 	raw := p.Marshal()
 
+	c.sentmu.Lock()
 	c.sent = append(c.sent, p)
-	if n, err := c.dev.Write(raw); err != nil {
+	n, err := c.dev.Write(raw)
+	if err != nil || n != len(raw) {
+		c.sent = c.sent[:len(c.sent)-1]
+	}
+	c.sentmu.Unlock()
+	if err != nil {
 		return nil, err
 	} else if n != len(raw) {
 		return nil, errors.New("Failed to send whole Cmd pkt to HCI socket")
@@ -85,6 +97,19 @@ func (c *Cmd) Send(cp CmdParam) ([]byte, error) {
 	return <-p.done, nil
 }
 
+// take removes and returns the oldest command sent with opcode op.
+func (c *Cmd) take(op uint16) *cmdPkt {
+	c.sentmu.Lock()
+	defer c.sentmu.Unlock()
+	for i, p := range c.sent {
+		if uint16(p.op) == op {
+			c.sent = append(c.sent[:i], c.sent[i+1:]...)
+			return p
+		}
+	}
+	return nil
+}
+
 func (c *Cmd) SendAndCheckResp(cp CmdParam, exp []byte) error {
 	rsp, err := c.Send(cp)
 	if err != nil {
@@ -105,29 +130,15 @@ func (c *Cmd) processCmdEvents() {
 	for {
 		select {
 		case status := <-c.statusc:
-			found := false
-			for i, p := range c.sent {
-				if uint16(p.op) == status.CommandOpcode {
-					found = true
-					c.sent = append(c.sent[:i], c.sent[i+1:]...)
-					close(p.done)
-					break
-				}
-			}
-			if !found {
+			if p := c.take(status.CommandOpcode); p != nil {
+				p.done <- []byte{status.Status}
+			} else {
 				log.Printf("Can't find the cmdPkt for this CommandStatusEP: %v", status)
 			}
 		case comp := <-c.compc:
-			found := false
-			for i, p := range c.sent {
-				if uint16(p.op) == comp.CommandOPCode {
-					found = true
-					c.sent = append(c.sent[:i], c.sent[i+1:]...)
-					p.done <- comp.ReturnParameters
-					break
-				}
-			}
-			if !found {
+			if p := c.take(comp.CommandOPCode); p != nil {
+				p.done <- comp.ReturnParameters
+			} else {
 				log.Printf("Can't find the cmdPkt for this CommandCompleteEP: %v", comp)
 			}
 		}
@@ -305,6 +316,9 @@ const (
 	opReadDataBlockSize           = infoParam<<10 | 0x000A // Read Data Block Size
 	opReadLocalSupportedCodecs    = infoParam<<10 | 0x000B // Read Local Supported Codecs
 )
+const (
+	opReadRSSI = statusParam<<10 | 0x0005 // Read RSSI
+)
 const (
 	opLESetEventMask                      = leCtl<<10 | 0x0001 // LE Set Event Mask
 	opLEReadBufferSize                    = leCtl<<10 | 0x0002 // LE Read Buffer Size
@@ -512,6 +526,48 @@ func (c WriteLEHostSupported) Marshal(b []byte) { b[0], b[1] = c.LESupportedHost
 
 type WriteLeHostSupportedRP struct{ Status uint8 }
 
+// Informational Parameters Commands
+
+// Read BD_ADDR (0x0009)
+type ReadBDADDR struct{}
+
+func (c ReadBDADDR) Opcode() int      { return opReadBDADDR }
+func (c ReadBDADDR) Len() int         { return 0 }
+func (c ReadBDADDR) Marshal(b []byte) {}
+
+type ReadBDADDRRP struct {
+	Status uint8
+	BDADDR [6]byte
+}
+
+func (r *ReadBDADDRRP) Unmarshal(b []byte) error {
+	if len(b) != 7 {
+		return errors.New("malformed Read BD_ADDR response")
+	}
+	r.Status = b[0]
+	r.BDADDR = o.MAC(b[1:])
+	return nil
+}
+
+// Status Parameters Commands
+
+// Read RSSI (0x0005)
+type ReadRSSI struct{ Handle uint16 }
+
+func (c ReadRSSI) Opcode() int      { return opReadRSSI }
+func (c ReadRSSI) Len() int         { return 2 }
+func (c ReadRSSI) Marshal(b []byte) { o.PutUint16(b, c.Handle) }
+
+type ReadRSSIRP struct {
+	Status           uint8
+	ConnectionHandle uint16
+	RSSI             int8
+}
+
+func (r *ReadRSSIRP) Unmarshal(b []byte) error {
+	return binary.Read(bytes.NewBuffer(b), binary.LittleEndian, r)
+}
+
 // LE Controller Commands
 
 // LE Set Event Mask (0x0001)
@@ -724,6 +780,10 @@ type LEReadWhiteListSizeRP struct {
 	WhiteListSize uint8
 }
 
+func (r *LEReadWhiteListSizeRP) Unmarshal(b []byte) error {
+	return binary.Read(bytes.NewBuffer(b), binary.LittleEndian, r)
+}
+
 // LE Clear White List (0x0010)
 type LEClearWhiteList struct{}
 
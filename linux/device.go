@@ -2,6 +2,7 @@ package linux
 
 import (
 	"errors"
+	"fmt"
 	"log"
 	"sync"
 	"syscall"
@@ -19,29 +20,107 @@ type device struct {
 	wmu  *sync.Mutex
 }
 
+// inUse holds the HCI devices opened in the process. Probing skips them,
+// as bringing one down and up again would take it from its user.
+var (
+	inUsemu sync.Mutex
+	inUse   = map[int]bool{}
+)
+
+// claim marks the HCI device n in use, and reports whether it was not.
+func claim(n int) bool {
+	inUsemu.Lock()
+	defer inUsemu.Unlock()
+	if inUse[n] {
+		return false
+	}
+	inUse[n] = true
+	return true
+}
+
+func release(n int) {
+	inUsemu.Lock()
+	delete(inUse, n)
+	inUsemu.Unlock()
+}
+
 func newDevice(n int, chk bool) (*device, error) {
 	fd, err := socket.Socket(socket.AF_BLUETOOTH, syscall.SOCK_RAW, socket.BTPROTO_HCI)
 	if err != nil {
 		return nil, err
 	}
 	if n != -1 {
-		return newSocket(fd, n, chk)
+		d, err := newSocket(fd, n, chk)
+		if err != nil {
+			syscall.Close(fd)
+		}
+		return d, err
 	}
 
-	req := devListRequest{devNum: hciMaxDevices}
-	if err := gioctl.Ioctl(uintptr(fd), hciGetDeviceList, uintptr(unsafe.Pointer(&req))); err != nil {
+	ids, err := deviceIDs(fd)
+	if err != nil {
+		syscall.Close(fd)
 		return nil, err
 	}
-	for i := 0; i < int(req.devNum); i++ {
-		d, err := newSocket(fd, i, chk)
+	for _, id := range ids {
+		d, err := newSocket(fd, id, chk)
 		if err == nil {
 			return d, err
 		}
 	}
+	syscall.Close(fd)
 	return nil, errors.New("no supported devices available")
 }
 
-func newSocket(fd, n int, chk bool) (*device, error) {
+// deviceIDs lists the ids of the HCI devices, which need not be
+// contiguous once adapters were unplugged.
+func deviceIDs(fd int) ([]int, error) {
+	req := devListRequest{devNum: hciMaxDevices}
+	if err := gioctl.Ioctl(uintptr(fd), hciGetDeviceList, uintptr(unsafe.Pointer(&req))); err != nil {
+		return nil, err
+	}
+	ids := make([]int, req.devNum)
+	for i := range ids {
+		ids[i] = int(req.devRequest[i].id)
+	}
+	return ids, nil
+}
+
+// FindDevice returns the id of the HCI device of the controller of public
+// address addr, most significant octet first, for NewHCI.
+func FindDevice(addr [6]byte) (int, error) {
+	fd, err := socket.Socket(socket.AF_BLUETOOTH, syscall.SOCK_RAW, socket.BTPROTO_HCI)
+	if err != nil {
+		return 0, err
+	}
+	defer syscall.Close(fd)
+	ids, err := deviceIDs(fd)
+	if err != nil {
+		return 0, err
+	}
+	for _, id := range ids {
+		i := hciDevInfo{id: uint16(id)}
+		if err := gioctl.Ioctl(uintptr(fd), hciGetDeviceInfo, uintptr(unsafe.Pointer(&i))); err != nil {
+			continue
+		}
+		// bdaddr is least significant octet first.
+		a := i.bdaddr
+		if [6]byte{a[5], a[4], a[3], a[2], a[1], a[0]} == addr {
+			return id, nil
+		}
+	}
+	return 0, fmt.Errorf("no HCI device of address % X", addr)
+}
+
+func newSocket(fd, n int, chk bool) (d *device, err error) {
+	if !claim(n) {
+		return nil, fmt.Errorf("hci%d already in use", n)
+	}
+	defer func() {
+		if err != nil {
+			release(n)
+		}
+	}()
 	i := hciDevInfo{id: uint16(n)}
 	if err := gioctl.Ioctl(uintptr(fd), hciGetDeviceInfo, uintptr(unsafe.Pointer(&i))); err != nil {
 		return nil, err
@@ -101,5 +180,6 @@ func (d device) Write(b []byte) (int, error) {
 }
 
 func (d device) Close() error {
+	defer release(d.dev)
 	return syscall.Close(d.fd)
 }
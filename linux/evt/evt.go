@@ -198,6 +198,25 @@ func (e *DisconnectionCompleteEP) Unmarshal(b []byte) error {
 	return binary.Read(buf, binary.LittleEndian, &e.Reason)
 }
 
+type EncryptionChangeEP struct {
+	Status            uint8
+	ConnectionHandle  uint16
+	EncryptionEnabled uint8
+}
+
+func (e *EncryptionChangeEP) Unmarshal(b []byte) error {
+	return binary.Read(bytes.NewBuffer(b), binary.LittleEndian, e)
+}
+
+type EncryptionKeyRefreshCompleteEP struct {
+	Status           uint8
+	ConnectionHandle uint16
+}
+
+func (e *EncryptionKeyRefreshCompleteEP) Unmarshal(b []byte) error {
+	return binary.Read(bytes.NewBuffer(b), binary.LittleEndian, e)
+}
+
 type CommandCompleteEP struct {
 	NumHCICommandPackets uint8
 	CommandOPCode        uint16
@@ -14,23 +14,49 @@ type HCI struct {
 	AcceptMasterHandler  func(pd *PlatData)
 	AcceptSlaveHandler   func(pd *PlatData)
 	AdvertisementHandler func(pd *PlatData)
+	ConnectFailedHandler func(pd *PlatData, status uint8)
+
+	// ConnParamsRequestHandler is called when a connected peripheral asks
+	// for other connection parameters. It returns the parameters to apply,
+	// or false to reject the request. If it is nil, requests are granted.
+	ConnParamsRequestHandler func(pd *PlatData, req ConnParams) (ConnParams, bool)
 
 	d io.ReadWriteCloser
 	c *cmd.Cmd
 	e *evt.Evt
 
-	plist   map[bdaddr]*PlatData
-	plistmu *sync.Mutex
+	plist       map[bdaddr]*PlatData
+	plistmu     *sync.Mutex
+	scanPassive bool // no scan requests are sent, guarded by plistmu
 
 	bufCnt  chan struct{}
 	bufSize int
 
+	addr [6]byte // public address of the controller
+
+	addrmu      sync.Mutex // serializes own address changes with connecting
+	ownAddrType uint8      // of connecting: 0x00 public, 0x01 random
+	randAddr    [6]byte
+	connecting  int // connections being made, guarded by connsmu
+
+	// The last connection attempt of Connect, guarded by connsmu.
+	pending    *PlatData // the peripheral connected to
+	pendingAcc bool      // through the accept list
+	cancelled  bool      // CancelConnection cancelled it
+
+	accept     map[acceptEntry]bool // Filter Accept List, guarded by connsmu
+	scanAccept bool                 // scanning uses the accept list, guarded by scanmu
+
 	maxConn int
 	connsmu *sync.Mutex
 	conns   map[uint16]*conn
 
 	adv   bool
 	advmu *sync.Mutex
+
+	scan    bool // scanning is enabled
+	scanDup bool // duplicate advertisements are reported
+	scanmu  *sync.Mutex
 }
 
 type bdaddr [6]byte
@@ -51,7 +77,7 @@ func (pd *PlatData) ParseName() {
 
 	for len(b) > 1 {
 		l, t := b[0], b[1]
-		if len(b) < int(1+l) {
+		if l == 0 || len(b) < int(1+l) {
 			break
 		}
 		if t == 8 || t == 9 {
@@ -61,6 +87,19 @@ func (pd *PlatData) ParseName() {
 	}
 }
 
+// significantPart returns the AD structures at the start of b, up to a
+// zero length or a structure running past the end of b. Some controllers,
+// CSR ones among them, report the whole 31-byte buffer of a packet, with
+// garbage in the padding after the last structure. The result cannot be
+// appended to in place.
+func significantPart(b []byte) []byte {
+	n := 0
+	for n+1 < len(b) && b[n] != 0 && n+1+int(b[n]) <= len(b) {
+		n += 1 + int(b[n])
+	}
+	return b[:n:n]
+}
+
 func NewHCI(devID int, chk bool, maxConn int) (*HCI, error) {
 	d, err := newDevice(devID, chk)
 	if err != nil {
@@ -83,18 +122,25 @@ func NewHCI(devID int, chk bool, maxConn int) (*HCI, error) {
 		maxConn: maxConn,
 		connsmu: &sync.Mutex{},
 		conns:   map[uint16]*conn{},
+		accept:  map[acceptEntry]bool{},
 
-		advmu: &sync.Mutex{},
+		advmu:  &sync.Mutex{},
+		scanmu: &sync.Mutex{},
 	}
 
 	e.HandleEvent(evt.LEMeta, evt.HandlerFunc(h.handleLEMeta))
 	e.HandleEvent(evt.DisconnectionComplete, evt.HandlerFunc(h.handleDisconnectionComplete))
 	e.HandleEvent(evt.NumberOfCompletedPkts, evt.HandlerFunc(h.handleNumberOfCompletedPkts))
+	e.HandleEvent(evt.EncryptionChange, evt.HandlerFunc(h.handleEncryptionChange))
+	e.HandleEvent(evt.EncryptionKeyRefreshComplete, evt.HandlerFunc(h.handleEncryptionKeyRefreshComplete))
 	e.HandleEvent(evt.CommandComplete, evt.HandlerFunc(c.HandleComplete))
 	e.HandleEvent(evt.CommandStatus, evt.HandlerFunc(c.HandleStatus))
 
 	go h.mainLoop()
 	h.resetDevice()
+	if err := h.readAddress(); err != nil {
+		log.Printf("hci: %s", err)
+	}
 	return h, nil
 }
 
@@ -134,6 +180,38 @@ func (h *HCI) SendCmdWithAdvOff(c cmd.CmdParam) error {
 }
 
 func (h *HCI) SetScanEnable(en bool, dup bool) error {
+	h.scanmu.Lock()
+	defer h.scanmu.Unlock()
+	h.scan, h.scanDup = en, dup
+	return h.setScanEnable(en, dup)
+}
+
+// SetScanParameters sets the scan parameters. The controller rejects them
+// while scanning, so scanning is paused around the change if enabled.
+func (h *HCI) SetScanParameters(c cmd.LESetScanParameters) error {
+	h.scanmu.Lock()
+	defer h.scanmu.Unlock()
+	if h.scan {
+		if err := h.setScanEnable(false, h.scanDup); err != nil {
+			return err
+		}
+	}
+	err := h.c.SendAndCheckResp(c, []byte{0x00})
+	if err == nil {
+		h.scanAccept = c.ScanningFilterPolicy&0x01 != 0
+		h.plistmu.Lock()
+		h.scanPassive = c.LEScanType == 0x00
+		h.plistmu.Unlock()
+	}
+	if h.scan {
+		if err := h.setScanEnable(true, h.scanDup); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func (h *HCI) setScanEnable(en bool, dup bool) error {
 	return h.c.SendAndCheckResp(
 		cmd.LESetScanEnable{
 			LEScanEnable:     btoi(en),
@@ -142,14 +220,32 @@ func (h *HCI) SetScanEnable(en bool, dup bool) error {
 }
 
 func (h *HCI) Connect(pd *PlatData) error {
+	return h.connect(pd, false)
+}
+
+// ConnectAcceptList connects to the first device of the Filter Accept
+// List the controller hears from, rather than to pd. A failure of the
+// attempt is reported for pd.
+func (h *HCI) ConnectAcceptList(pd *PlatData) error {
+	return h.connect(pd, true)
+}
+
+func (h *HCI) connect(pd *PlatData, accept bool) error {
+	h.addrmu.Lock()
+	h.connsmu.Lock()
+	h.connecting++
+	h.pending, h.pendingAcc, h.cancelled = pd, accept, false
+	h.connsmu.Unlock()
+	own := h.ownAddrType
+	h.addrmu.Unlock()
 	h.c.Send(
 		cmd.LECreateConn{
 			LEScanInterval:        0x0004,         // N x 0.625ms
 			LEScanWindow:          0x0004,         // N x 0.625ms
-			InitiatorFilterPolicy: 0x00,           // white list not used
+			InitiatorFilterPolicy: btoi(accept),   // white list used or not
 			PeerAddressType:       pd.AddressType, // public or random
 			PeerAddress:           pd.Address,     //
-			OwnAddressType:        0x00,           // public
+			OwnAddressType:        own,            // public or random
 			ConnIntervalMin:       0x0006,         // N x 0.125ms
 			ConnIntervalMax:       0x0006,         // N x 0.125ms
 			ConnLatency:           0x0000,         //
@@ -160,8 +256,28 @@ func (h *HCI) Connect(pd *PlatData) error {
 	return nil
 }
 
+// CancelConnection disconnects pd, or cancels the connection attempt to
+// it: that of Connect with pd, or that of ConnectAcceptList if pd is on
+// the accept list. The attempts to other devices are left alone. If the
+// connection gets established before the controller cancels the attempt,
+// it is closed, and reported as failed.
 func (h *HCI) CancelConnection(pd *PlatData) error {
-	return pd.Conn.Close()
+	h.connsmu.Lock()
+	// pd.Conn stays set once disconnected, while reconnecting.
+	if c, ok := pd.Conn.(*conn); ok && h.conns[c.attr] == c {
+		h.connsmu.Unlock()
+		return c.Close()
+	}
+	ours := h.connecting > 0 && (h.pending == pd || h.pendingAcc && h.accept[acceptEntry{pd.AddressType, pd.Address}])
+	if ours {
+		h.cancelled = true
+	}
+	h.connsmu.Unlock()
+	if !ours {
+		return nil
+	}
+	// Command Disallowed: the attempt has just ended.
+	return h.c.SendAndCheckResp(cmd.LECreateConnCancel{}, []byte{0x00, 0x0C})
 }
 
 func (h *HCI) SendRawCommand(c cmd.CmdParam) ([]byte, error) {
@@ -273,7 +389,7 @@ func (h *HCI) handleAdvertisement(b []byte) {
 			pd, ok := h.plist[addr]
 			h.plistmu.Unlock()
 			if ok {
-				pd.Data = append(pd.Data, ep.Data[i]...)
+				pd.Data = append(pd.Data, significantPart(ep.Data[i])...)
 				h.AdvertisementHandler(pd)
 			}
 			continue
@@ -282,14 +398,17 @@ func (h *HCI) handleAdvertisement(b []byte) {
 		pd := &PlatData{
 			AddressType: ep.AddressType[i],
 			Address:     ep.Address[i],
-			Data:        ep.Data[i],
+			Data:        significantPart(ep.Data[i]),
 			Connectable: connectable,
 			RSSI:        ep.RSSI[i],
 		}
 		h.plistmu.Lock()
 		h.plist[addr] = pd
+		passive := h.scanPassive
 		h.plistmu.Unlock()
-		if scannable {
+		if scannable && !passive {
+			// Reported with the scan response, which a passive scan
+			// does not ask for.
 			continue
 		}
 		h.AdvertisementHandler(pd)
@@ -302,8 +421,11 @@ func (h *HCI) handleNumberOfCompletedPkts(b []byte) error {
 		return err
 	}
 	for _, r := range ep.Packets {
-		for i := 0; i < int(r.NumOfCompletedPkts); i++ {
-			<-h.bufCnt
+		h.connsmu.Lock()
+		c, found := h.conns[r.ConnectionHandle]
+		h.connsmu.Unlock()
+		if found {
+			c.completed(int(r.NumOfCompletedPkts))
 		}
 	}
 	return nil
@@ -314,11 +436,43 @@ func (h *HCI) handleConnection(b []byte) {
 	if err := ep.Unmarshal(b); err != nil {
 		return // FIXME
 	}
+	if ep.Status != 0x00 {
+		// The connection attempt failed, or was cancelled. The peer
+		// address is not that of the attempt if it used the accept list.
+		h.connsmu.Lock()
+		pd := h.pending
+		h.connected()
+		h.connsmu.Unlock()
+		if pd == nil {
+			h.plistmu.Lock()
+			pd = h.plist[ep.PeerAddress]
+			h.plistmu.Unlock()
+		}
+		if pd != nil && h.ConnectFailedHandler != nil {
+			h.ConnectFailedHandler(pd, ep.Status)
+		}
+		return
+	}
 	hh := ep.ConnectionHandle
 	c := newConn(h, hh)
 	h.connsmu.Lock()
 	h.conns[hh] = c
+	var cancelled *PlatData
+	if ep.Role == 0x00 {
+		if h.cancelled {
+			cancelled = h.pending
+		}
+		h.connected()
+	}
 	h.connsmu.Unlock()
+	if cancelled != nil {
+		// Established before CancelConnection could cancel it.
+		c.Close()
+		if h.ConnectFailedHandler != nil {
+			h.ConnectFailedHandler(cancelled, 0x02)
+		}
+		return
+	}
 	h.setAdvertiseEnable(true)
 
 	// FIXME: sloppiness. This call should be called by the package user once we
@@ -338,11 +492,79 @@ func (h *HCI) handleConnection(b []byte) {
 	}
 	h.plistmu.Lock()
 	pd := h.plist[ep.PeerAddress]
+	if pd == nil {
+		// Connected through the accept list, without scanning.
+		pd = &PlatData{AddressType: ep.PeerAddressType, Address: ep.PeerAddress}
+		h.plist[ep.PeerAddress] = pd
+	}
 	h.plistmu.Unlock()
 	pd.Conn = c
+	c.pd = pd
 	h.AcceptSlaveHandler(pd)
 }
 
+// connected accounts for the end of a connection attempt of Connect.
+// connsmu must be held.
+func (h *HCI) connected() {
+	if h.connecting > 0 {
+		h.connecting--
+	}
+	if h.connecting == 0 {
+		h.pending, h.pendingAcc, h.cancelled = nil, false, false
+	}
+}
+
+func (h *HCI) handleConnectionUpdate(b []byte) {
+	ep := &evt.LEConnectionUpdateCompleteEP{}
+	if err := ep.Unmarshal(b); err != nil {
+		return
+	}
+	h.connsmu.Lock()
+	c, found := h.conns[ep.ConnectionHandle]
+	h.connsmu.Unlock()
+	if !found {
+		return
+	}
+	select {
+	case c.updatec <- *ep:
+	default:
+	}
+}
+
+// UpdateConnParams changes the parameters of the connection to the
+// peripheral pd, which must be connected, and waits for the controller to
+// report the change done.
+func (h *HCI) UpdateConnParams(pd *PlatData, p ConnParams) error {
+	c, ok := pd.Conn.(*conn)
+	if !ok {
+		return fmt.Errorf("l2conn: not connected")
+	}
+	return c.updateParams(p)
+}
+
+// ReadRSSI reads the RSSI of the connection to pd, in dBm.
+func (h *HCI) ReadRSSI(pd *PlatData) (int, error) {
+	c, ok := pd.Conn.(*conn)
+	if !ok {
+		return 0, fmt.Errorf("l2conn: not connected")
+	}
+	b, err := h.c.Send(cmd.ReadRSSI{Handle: c.attr})
+	if err != nil {
+		return 0, err
+	}
+	if len(b) > 0 && b[0] != 0x00 {
+		return 0, fmt.Errorf("l2conn: read RSSI failed with status 0x%02X", b[0])
+	}
+	var rp cmd.ReadRSSIRP
+	if err := rp.Unmarshal(b); err != nil {
+		return 0, err
+	}
+	if rp.RSSI == 127 {
+		return 0, fmt.Errorf("l2conn: RSSI not available")
+	}
+	return int(rp.RSSI), nil
+}
+
 func (h *HCI) handleDisconnectionComplete(b []byte) error {
 	ep := &evt.DisconnectionCompleteEP{}
 	if err := ep.Unmarshal(b); err != nil {
@@ -358,7 +580,11 @@ func (h *HCI) handleDisconnectionComplete(b []byte) error {
 		return nil
 	}
 	delete(h.conns, hh)
+	c.reason = ep.Reason
 	close(c.aclc)
+	close(c.smpc)
+	close(c.done)
+	c.release()
 	h.setAdvertiseEnable(true)
 	return nil
 }
@@ -369,7 +595,7 @@ func (h *HCI) handleLEMeta(b []byte) error {
 	case evt.LEConnectionComplete:
 		go h.handleConnection(b)
 	case evt.LEConnectionUpdateComplete:
-		// anything to do here?
+		go h.handleConnectionUpdate(b)
 	case evt.LEAdvertisingReport:
 		go h.handleAdvertisement(b)
 	// case evt.LEReadRemoteUsedFeaturesComplete:
@@ -394,14 +620,24 @@ func (h *HCI) handleL2CAP(b []byte) error {
 		log.Printf("l2conn: got data for disconnected handle: 0x%04x", a.attr)
 		return nil
 	}
+	if a.flags&0x1 != 0 {
+		// Continuation fragment, which carries no L2CAP header; the
+		// reader reassembles it with the fragments before.
+		c.aclc <- a
+		return nil
+	}
 	if len(a.b) < 4 {
 		log.Printf("l2conn: l2cap packet is too short/corrupt, length is %d", len(a.b))
 		return nil
 	}
 	cid := uint16(a.b[2]) | (uint16(a.b[3]) << 8)
-	if cid == 5 {
+	switch cid {
+	case 5:
 		c.handleSignal(a)
 		return nil
+	case cidSMP:
+		c.handleSMP(a)
+		return nil
 	}
 	c.aclc <- a
 	return nil
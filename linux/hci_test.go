@@ -0,0 +1,61 @@
+package linux
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/PayRange/gatt/linux/cmd"
+)
+
+// completer is a controller which completes every command successfully.
+type completer struct{ c *cmd.Cmd }
+
+func (d *completer) Write(b []byte) (int, error) {
+	go d.c.HandleComplete([]byte{0x01, b[1], b[2], 0x00})
+	return len(b), nil
+}
+
+// advReport returns an LE Advertising Report event of a single report.
+func advReport(et uint8, addr [6]byte, data []byte) []byte {
+	b := []byte{0x02, 0x01, et, 0x00}
+	b = append(b, addr[:]...)
+	b = append(b, byte(len(data)))
+	b = append(b, data...)
+	return append(b, 0xC4) // RSSI -60
+}
+
+func TestPassiveScanAdvertisement(t *testing.T) {
+	d := &completer{}
+	d.c = cmd.NewCmd(d)
+	h := &HCI{
+		c:       d.c,
+		plist:   make(map[bdaddr]*PlatData),
+		plistmu: &sync.Mutex{},
+		scanmu:  &sync.Mutex{},
+	}
+	var got []*PlatData
+	h.AdvertisementHandler = func(pd *PlatData) { got = append(got, pd) }
+
+	addr := [6]byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06}
+	name := []byte{0x03, 0x09, 'P', 'R'}
+	for _, tt := range []struct {
+		scanType uint8
+		want     int
+	}{
+		{0x01, 0}, // reported with the scan response
+		{0x00, 1},
+	} {
+		got = nil
+		c := cmd.LESetScanParameters{LEScanType: tt.scanType, LEScanInterval: 0x0010, LEScanWindow: 0x0010}
+		if err := h.SetScanParameters(c); err != nil {
+			t.Fatalf("SetScanParameters: %s", err)
+		}
+		h.handleAdvertisement(advReport(advInd, addr, name))
+		if len(got) != tt.want {
+			t.Fatalf("scan type 0x%02X: %d advertisements reported, want %d", tt.scanType, len(got), tt.want)
+		}
+		if tt.want > 0 && (!got[0].Connectable || string(got[0].Data) != string(name)) {
+			t.Errorf("scan type 0x%02X: got %+v", tt.scanType, got[0])
+		}
+	}
+}
@@ -4,8 +4,10 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"sync"
 
 	"github.com/PayRange/gatt/linux/cmd"
+	"github.com/PayRange/gatt/linux/evt"
 )
 
 type aclData struct {
@@ -34,13 +36,79 @@ type conn struct {
 	hci  *HCI
 	attr uint16
 	aclc chan *aclData
+	pd   *PlatData // of the peripheral, if the connection is to one
+
+	updatec chan evt.LEConnectionUpdateCompleteEP
+	smpc    chan []byte   // Security Manager PDUs received
+	encc    chan uint8    // status of the encryption changes
+	done    chan struct{} // closed on disconnection
+	reason  uint8         // of the disconnection, set before done is closed
+
+	wmu sync.Mutex // serializes writes, so that their segments do not interleave
+
+	// pending counts the packets written that the controller has not yet
+	// reported completed, and so hold one of the buffers of hci.bufCnt.
+	pendmu  sync.Mutex
+	pending int
+	closed  bool
 }
 
 func newConn(hci *HCI, hh uint16) *conn {
 	return &conn{
-		hci:  hci,
-		attr: hh,
-		aclc: make(chan *aclData),
+		hci:     hci,
+		attr:    hh,
+		aclc:    make(chan *aclData),
+		updatec: make(chan evt.LEConnectionUpdateCompleteEP, 1),
+		smpc:    make(chan []byte, 8),
+		encc:    make(chan uint8, 1),
+		done:    make(chan struct{}),
+	}
+}
+
+// ConnParams are the parameters of an LE connection, in the units of the
+// controller.
+type ConnParams struct {
+	IntervalMin        uint16 // N x 1.25ms
+	IntervalMax        uint16 // N x 1.25ms
+	Latency            uint16 // connection events the slave may skip
+	SupervisionTimeout uint16 // N x 10ms
+}
+
+// updateCmd returns the LE Connection Update command applying p to the
+// connection with handle hh.
+func (p ConnParams) updateCmd(hh uint16) cmd.LEConnUpdate {
+	return cmd.LEConnUpdate{
+		ConnectionHandle:   hh,
+		ConnIntervalMin:    p.IntervalMin,
+		ConnIntervalMax:    p.IntervalMax,
+		ConnLatency:        p.Latency,
+		SupervisionTimeout: p.SupervisionTimeout,
+	}
+}
+
+// updateParams sends LE Connection Update, as master, and waits for the
+// LE Connection Update Complete event.
+func (c *conn) updateParams(p ConnParams) error {
+	// Drop the report of an earlier update.
+	select {
+	case <-c.updatec:
+	default:
+	}
+	rsp, err := c.hci.c.Send(p.updateCmd(c.attr))
+	if err != nil {
+		return err
+	}
+	if len(rsp) > 0 && rsp[0] != 0x00 {
+		return fmt.Errorf("l2conn: connection update rejected with status 0x%02X", rsp[0])
+	}
+	select {
+	case ep := <-c.updatec:
+		if ep.Status != 0x00 {
+			return fmt.Errorf("l2conn: connection update failed with status 0x%02X", ep.Status)
+		}
+		return nil
+	case <-c.done:
+		return io.EOF
 	}
 }
 
@@ -60,6 +128,9 @@ func (c *conn) updateConnection() (int, error) {
 // It first prepend the l2cap header (4-bytes), and diassemble the payload
 // if it is larger than the HCI LE buffer size that the conntroller can support.
 func (c *conn) write(cid int, b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
 	flag := uint8(0) // ACL data continuation flag
 	tlen := len(b)   // Total length of the l2cap payload
 
@@ -87,6 +158,10 @@ func (c *conn) write(cid int, b []byte) (int, error) {
 
 		// make sure we don't send more buffers than the controller can handdle
 		c.hci.bufCnt <- struct{}{}
+		if !c.sent() {
+			<-c.hci.bufCnt
+			return 0, io.EOF
+		}
 
 		c.hci.d.Write(w[:5+dlen])
 		w = w[dlen:] // advance the pointer to the next segment, if any.
@@ -97,6 +172,45 @@ func (c *conn) write(cid int, b []byte) (int, error) {
 	return len(b), nil
 }
 
+// sent accounts for a packet about to be written, unless the connection
+// is closed.
+func (c *conn) sent() bool {
+	c.pendmu.Lock()
+	defer c.pendmu.Unlock()
+	if c.closed {
+		return false
+	}
+	c.pending++
+	return true
+}
+
+// completed frees the buffers of n packets the controller reports
+// completed.
+func (c *conn) completed(n int) {
+	c.pendmu.Lock()
+	if n > c.pending {
+		n = c.pending
+	}
+	c.pending -= n
+	c.pendmu.Unlock()
+	for i := 0; i < n; i++ {
+		<-c.hci.bufCnt
+	}
+}
+
+// release frees the buffers of the packets pending on disconnection, as
+// the controller drops them without reporting them completed.
+func (c *conn) release() {
+	c.pendmu.Lock()
+	c.closed = true
+	n := c.pending
+	c.pending = 0
+	c.pendmu.Unlock()
+	for i := 0; i < n; i++ {
+		<-c.hci.bufCnt
+	}
+}
+
 func (c *conn) Read(b []byte) (int, error) {
 	a, ok := <-c.aclc
 	if !ok {
@@ -126,6 +240,10 @@ func (c *conn) Write(b []byte) (int, error) {
 	return c.write(0x04, b)
 }
 
+// DisconnectReason returns the reason code of the Disconnection Complete
+// event, once Read has returned io.EOF.
+func (c *conn) DisconnectReason() uint8 { return c.reason }
+
 // Close disconnects the connection by sending HCI disconnect command to the device.
 func (c *conn) Close() error {
 	h := c.hci
@@ -137,7 +255,7 @@ func (c *conn) Close() error {
 		// log.Printf("l2conn: 0x%04x already disconnected", hh)
 		return nil
 	}
-	if err, _ := h.c.Send(cmd.Disconnect{ConnectionHandle: hh, Reason: 0x13}); err != nil {
+	if _, err := h.c.Send(cmd.Disconnect{ConnectionHandle: hh, Reason: 0x13}); err != nil {
 		return fmt.Errorf("l2conn: failed to disconnect, %s", err)
 	}
 	return nil
@@ -168,7 +286,41 @@ func (c *conn) Close() error {
 // 0x15 LE Credit Based Connection response		0x0005
 // 0x16 LE Flow Control Credit					0x0005
 func (c *conn) handleSignal(a *aclData) error {
+	s := a.b[4:] // skip l2cap header
+	if len(s) == 12 && s[0] == 0x12 && c.pd != nil {
+		go c.handleParamsRequest(s[1], ConnParams{
+			IntervalMin:        uint16(s[4]) | uint16(s[5])<<8,
+			IntervalMax:        uint16(s[6]) | uint16(s[7])<<8,
+			Latency:            uint16(s[8]) | uint16(s[9])<<8,
+			SupervisionTimeout: uint16(s[10]) | uint16(s[11])<<8,
+		})
+		return nil
+	}
 	log.Printf("ignore l2cap signal:[ % X ]", a.b)
-	// FIXME: handle LE signaling channel (CID: 5)
+	// FIXME: handle the rest of LE signaling channel (CID: 5)
 	return nil
 }
+
+// handleParamsRequest answers the Connection Parameter Update request
+// with the given identifier that the peripheral sent, and applies the
+// parameters granted.
+func (c *conn) handleParamsRequest(id uint8, req ConnParams) {
+	p, ok := req, true
+	if f := c.hci.ConnParamsRequestHandler; f != nil {
+		p, ok = f(c.pd, req)
+	}
+	result := uint8(0x00) // accepted
+	if !ok {
+		result = 0x01 // rejected
+	}
+	c.write(0x05, []byte{
+		0x13,       // Code (Connection Param Update Response)
+		id,         // ID
+		0x02, 0x00, // DataLength
+		result, 0x00})
+	if ok {
+		if err := c.updateParams(p); err != nil {
+			log.Printf("l2conn: %s", err)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package linux
+
+import (
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/PayRange/gatt/linux/cmd"
+	"github.com/PayRange/gatt/linux/evt"
+)
+
+// cidSMP is the L2CAP channel of the Security Manager Protocol.
+const cidSMP = 0x0006
+
+// handleSMP queues the Security Manager PDU in a for SMP. Nothing reads
+// them between pairings, so PDUs that do not fit are dropped rather than
+// blocking the other channels.
+func (c *conn) handleSMP(a *aclData) {
+	b := append([]byte(nil), a.b[4:]...)
+	select {
+	case c.smpc <- b:
+	default:
+		log.Printf("l2conn: dropping SMP PDU [ % X ]", b)
+	}
+}
+
+// SMP returns the channel of the Security Manager PDUs received, which is
+// closed on disconnection.
+func (c *conn) SMP() <-chan []byte { return c.smpc }
+
+// WriteSMP sends the Security Manager PDU b.
+func (c *conn) WriteSMP(b []byte) error {
+	_, err := c.write(cidSMP, b)
+	return err
+}
+
+// Addresses returns the addresses of the initiator, the local device, and
+// of the responder, the peripheral, with their types, as pairing needs
+// them. The own address does not change while connected.
+func (c *conn) Addresses() (ia, ra [6]byte, iat, rat uint8) {
+	if c.pd != nil {
+		ra, rat = c.pd.Address, c.pd.AddressType
+	}
+	ia, iat = c.hci.Address()
+	return ia, ra, iat, rat
+}
+
+// StartEncryption encrypts the connection, as master, with the long term
+// key ltk identified by ediv and rand, and waits for the controller to
+// report the encryption on, or the key refreshed if it already was.
+func (c *conn) StartEncryption(ediv uint16, rand uint64, ltk [16]byte) error {
+	// Drop the report of an earlier change.
+	select {
+	case <-c.encc:
+	default:
+	}
+	rsp, err := c.hci.c.Send(cmd.LEStartEncryption{
+		ConnectionHandle:     c.attr,
+		RandomNumber:         rand,
+		EncryptedDiversifier: ediv,
+		LongTermKey:          ltk,
+	})
+	if err != nil {
+		return err
+	}
+	if len(rsp) > 0 && rsp[0] != 0x00 {
+		return fmt.Errorf("l2conn: start encryption rejected with status 0x%02X", rsp[0])
+	}
+	select {
+	case status := <-c.encc:
+		if status != 0x00 {
+			return fmt.Errorf("l2conn: encryption failed with status 0x%02X", status)
+		}
+		return nil
+	case <-c.done:
+		return io.EOF
+	}
+}
+
+func (h *HCI) handleEncryptionChange(b []byte) error {
+	ep := &evt.EncryptionChangeEP{}
+	if err := ep.Unmarshal(b); err != nil {
+		return err
+	}
+	if ep.Status == 0x00 && ep.EncryptionEnabled == 0x00 {
+		// Encryption turned off, which StartEncryption does not wait for.
+		return nil
+	}
+	h.encryptionChanged(ep.ConnectionHandle, ep.Status)
+	return nil
+}
+
+func (h *HCI) handleEncryptionKeyRefreshComplete(b []byte) error {
+	ep := &evt.EncryptionKeyRefreshCompleteEP{}
+	if err := ep.Unmarshal(b); err != nil {
+		return err
+	}
+	h.encryptionChanged(ep.ConnectionHandle, ep.Status)
+	return nil
+}
+
+// encryptionChanged reports the status of an encryption change to the
+// connection with handle hh.
+func (h *HCI) encryptionChanged(hh uint16, status uint8) {
+	h.connsmu.Lock()
+	c, found := h.conns[hh]
+	h.connsmu.Unlock()
+	if !found {
+		return
+	}
+	select {
+	case c.encc <- status:
+	default:
+	}
+}
+
+// readAddress reads the public address of the controller.
+func (h *HCI) readAddress() error {
+	b, err := h.c.Send(cmd.ReadBDADDR{})
+	if err != nil {
+		return err
+	}
+	var rp cmd.ReadBDADDRRP
+	if err := rp.Unmarshal(b); err != nil {
+		return err
+	}
+	if rp.Status != 0x00 {
+		return fmt.Errorf("hci: read BD_ADDR failed with status 0x%02X", rp.Status)
+	}
+	h.addr = rp.BDADDR
+	return nil
+}
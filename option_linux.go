@@ -2,13 +2,16 @@ package gatt
 
 import (
 	"errors"
+	"fmt"
 	"io"
+	"time"
 
 	"github.com/PayRange/gatt/linux/cmd"
 )
 
 // LnxDeviceID specifies which HCI device to use.
-// If n is set to -1, all the available HCI devices will be probed.
+// If n is set to -1, all the available HCI devices will be probed, but
+// those already used by other Devices of the process.
 // If chk is set to true, LnxDeviceID checks the LE support in the feature list of the HCI device.
 // This is to filter devices that does not support LE. In case some LE driver that doesn't correctly
 // set the LE support in its feature list, user can turn off the check.
@@ -21,6 +24,19 @@ func LnxDeviceID(n int, chk bool) Option {
 	}
 }
 
+// LnxDeviceAddress specifies the HCI device to use by the public address
+// of its controller, such as "00:1A:7D:DA:71:13", rather than by id,
+// which changes as adapters are plugged in. chk is as for LnxDeviceID.
+// Several devices can be used at once, each by its own Device.
+// This option can only be used with NewDevice on Linux implementation.
+func LnxDeviceAddress(addr string, chk bool) Option {
+	return func(d Device) error {
+		d.(*device).devAddr = addr
+		d.(*device).chkLE = chk
+		return nil
+	}
+}
+
 // LnxMaxConnections is an optional parameter.
 // If set, it overrides the default max connections supported.
 // This option can only be used with NewDevice on Linux implementation.
@@ -31,6 +47,85 @@ func LnxMaxConnections(n int) Option {
 	}
 }
 
+// LnxDiscoveryCache has the peripherals connected use c to skip the
+// discovery of their services, characteristics and descriptors when
+// reconnecting. See DiscoveryCache.
+// This option can be used with NewDevice or Option on Linux implementation.
+func LnxDiscoveryCache(c DiscoveryCache) Option {
+	return func(d Device) error {
+		d.(*device).discoveryCache = c
+		return nil
+	}
+}
+
+// LnxPairing has the peripherals connected pair when a read or write needs
+// an encrypted or authenticated link, then retry it. The agent a enters or
+// shows passkeys; if nil, pairing is just works. With ks, pairing bonds:
+// the keys of the peripherals are kept in ks, and the links to them are
+// encrypted with those on reconnection. See Peripheral.Pair.
+// This option can be used with NewDevice or Option on Linux implementation.
+func LnxPairing(a PairingAgent, ks KeyStore) Option {
+	return func(d Device) error {
+		dd := d.(*device)
+		dd.pairing = true
+		dd.pairingAgent = a
+		dd.keyStore = ks
+		return nil
+	}
+}
+
+// LnxDefaultSecurityLevel has the links to the peripherals connected
+// brought to the security level l, as by Peripheral.SetSecurityLevel,
+// before PeripheralConnected handlers are called. Those are called with
+// the error, a *SecurityError, for peripherals that cannot reach l, which
+// are disconnected. Pairing uses the agent and KeyStore of LnxPairing.
+// This option can be used with NewDevice or Option on Linux implementation.
+func LnxDefaultSecurityLevel(l SecurityLevel) Option {
+	return func(d Device) error {
+		d.(*device).securityLevel = l
+		return nil
+	}
+}
+
+// LnxOwnAddress has the device scan, advertise and connect with an own
+// address of type t, rather than the public address of the controller.
+// For StaticRandomAddress and ResolvablePrivateAddress, the device
+// generates a random address, the latter with an identity resolving key
+// of its own, and sets it before scanning. Every rotate, if not zero, it
+// sets a new one, once no connection is up or being made. The
+// specification expects static addresses to change only on power cycles.
+// See Device.Address.
+// This option can only be used with NewDevice on Linux implementation.
+func LnxOwnAddress(t AddressType, rotate time.Duration) Option {
+	return func(d Device) error {
+		if t < PublicAddress || t > ResolvablePrivateAddress {
+			return fmt.Errorf("unknown own address type %d", t)
+		}
+		dd := d.(*device)
+		dd.ownAddr, dd.addrRotation = t, rotate
+		return nil
+	}
+}
+
+// LnxReconnectPolicy has the device reconnect the peripherals which
+// disconnect unexpectedly, as rp tells: the link was lost, rather than
+// closed locally, and CancelConnection was not called for them since
+// Connect. The PeripheralConnected handler is called again once a
+// peripheral is connected, where sessions such as BRSP can Reattach; the
+// failed attempts are not reported. With a
+// nil rp, peripherals are not reconnected.
+// This option can only be used with NewDevice on Linux implementation.
+func LnxReconnectPolicy(rp *ReconnectPolicy) Option {
+	return func(d Device) error {
+		dd := d.(*device)
+		dd.reconnect = nil
+		if rp != nil {
+			dd.reconnect = newReconnector(*rp, dd.connect, dd.abort)
+		}
+		return nil
+	}
+}
+
 // LnxSetAdvertisingEnable sets the advertising data to the HCI device.
 // This option can be used with Option on Linux implementation.
 func LnxSetAdvertisingEnable(en bool) Option {
@@ -73,6 +168,79 @@ func LnxSetAdvertisingParameters(c *cmd.LESetAdvertisingParameters) Option {
 	}
 }
 
+// LnxSetScanParameters sets the scan parameters of the HCI device: the
+// scan type, passive or active, the interval and window, and the own
+// address type. Values outside the ranges of the specification are
+// rejected. The parameters apply from the next scan; if the device is
+// scanning, scanning is paused while they are changed.
+// This option can be used with NewDevice or Option on Linux implementation.
+func LnxSetScanParameters(c *cmd.LESetScanParameters) Option {
+	return func(d Device) error {
+		if err := checkScanParameters(c); err != nil {
+			return err
+		}
+		dd := d.(*device)
+		dd.scanParam = c
+		if dd.hci == nil {
+			return nil // set by NewDevice
+		}
+		return dd.hci.SetScanParameters(*c)
+	}
+}
+
+// LnxScanAcceptList has scanning report only the advertisements of the
+// devices of the Filter Accept List, if on, or of all devices otherwise.
+// It sets the scanning filter policy of the scan parameters, as
+// LnxSetScanParameters does. See Device.AddToAcceptList.
+// This option can be used with NewDevice or Option on Linux implementation.
+func LnxScanAcceptList(on bool) Option {
+	return func(d Device) error {
+		dd := d.(*device)
+		if dd.scanParam == nil {
+			return errors.New("scan parameters not set")
+		}
+		c := *dd.scanParam
+		c.ScanningFilterPolicy &^= 0x01
+		if on {
+			c.ScanningFilterPolicy |= 0x01
+		}
+		return LnxSetScanParameters(&c)(d)
+	}
+}
+
+// LnxConnectAcceptList has Connect, if on, connect to the first device of
+// the Filter Accept List the controller hears from, rather than to the
+// peripheral passed, without scanning. The PeripheralConnected handler is
+// called with the peripheral connected to; a failure is reported for the
+// peripheral passed. CancelConnection of any device of the list cancels
+// the attempt. The list cannot change while it is made. See
+// Device.AddToAcceptList.
+// This option can be used with NewDevice or Option on Linux implementation.
+func LnxConnectAcceptList(on bool) Option {
+	return func(d Device) error {
+		d.(*device).connectAccept = on
+		return nil
+	}
+}
+
+// checkScanParameters checks c against the ranges of LE Set Scan
+// Parameters.
+func checkScanParameters(c *cmd.LESetScanParameters) error {
+	switch {
+	case c.LEScanType > 0x01:
+		return fmt.Errorf("scan type 0x%02X is neither passive nor active", c.LEScanType)
+	case c.LEScanInterval < 0x0004 || c.LEScanInterval > 0x4000:
+		return fmt.Errorf("scan interval 0x%04X out of range [0x0004, 0x4000]", c.LEScanInterval)
+	case c.LEScanWindow < 0x0004 || c.LEScanWindow > c.LEScanInterval:
+		return fmt.Errorf("scan window 0x%04X out of range [0x0004, interval 0x%04X]", c.LEScanWindow, c.LEScanInterval)
+	case c.OwnAddressType > 0x03:
+		return fmt.Errorf("own address type 0x%02X out of range [0x00, 0x03]", c.OwnAddressType)
+	case c.ScanningFilterPolicy > 0x03:
+		return fmt.Errorf("scanning filter policy 0x%02X out of range [0x00, 0x03]", c.ScanningFilterPolicy)
+	}
+	return nil
+}
+
 // LnxSendHCIRawCommand sends a raw command to the HCI device
 // This option can be used with NewDevice or Option on Linux implementation.
 func LnxSendHCIRawCommand(c cmd.CmdParam, rsp io.Writer) Option {
@@ -2,6 +2,7 @@ package gatt
 
 import (
 	"bytes"
+	"testing"
 
 	"github.com/PayRange/gatt/linux/cmd"
 )
@@ -97,3 +98,105 @@ func ExampleLnxSendHCIRawCommand_customCommand() {
 	d, _ := NewDevice()
 	d.Option(LnxSendHCIRawCommand(c, nil)) // Can only be used with Option
 }
+
+func ExampleLnxSetScanParameters() {
+	o := LnxSetScanParameters(&cmd.LESetScanParameters{
+		LEScanType:           0x00,   // [0x01]: active, 0x00: passive
+		LEScanInterval:       0x0640, // [0x0010]: 0.625 ms * 0x0640 = 1000.0 ms
+		LEScanWindow:         0x0050, // [0x0010]: 0.625 ms * 0x0050 = 50.0 ms
+		OwnAddressType:       0x00,   // [0x00]: public, 0x01: random
+		ScanningFilterPolicy: 0x00,   // [0x00]: accept all, 0x01: ignore non-white-listed
+	})
+	d, _ := NewDevice(o) // Can be used with NewDevice.
+	d.Option(o)          // Or dynamically with Option, even while scanning.
+}
+
+func TestLnxSetScanParameters(t *testing.T) {
+	for _, tt := range []struct {
+		c    cmd.LESetScanParameters
+		want []byte // the command parameters, nil if invalid
+	}{
+		{cmd.LESetScanParameters{LEScanType: 0x01, LEScanInterval: 0x0010, LEScanWindow: 0x0010},
+			[]byte{0x01, 0x10, 0x00, 0x10, 0x00, 0x00, 0x00}},
+		{cmd.LESetScanParameters{LEScanType: 0x00, LEScanInterval: 0x0640, LEScanWindow: 0x0050, OwnAddressType: 0x01},
+			[]byte{0x00, 0x40, 0x06, 0x50, 0x00, 0x01, 0x00}},
+		{cmd.LESetScanParameters{LEScanType: 0x01, LEScanInterval: 0x4000, LEScanWindow: 0x0004, ScanningFilterPolicy: 0x01},
+			[]byte{0x01, 0x00, 0x40, 0x04, 0x00, 0x00, 0x01}},
+		{cmd.LESetScanParameters{LEScanType: 0x02, LEScanInterval: 0x0010, LEScanWindow: 0x0010}, nil},
+		{cmd.LESetScanParameters{LEScanInterval: 0x0003, LEScanWindow: 0x0003}, nil},
+		{cmd.LESetScanParameters{LEScanInterval: 0x4001, LEScanWindow: 0x0010}, nil},
+		{cmd.LESetScanParameters{LEScanInterval: 0x0010, LEScanWindow: 0x0020}, nil},
+		{cmd.LESetScanParameters{LEScanInterval: 0x0010, LEScanWindow: 0x0010, OwnAddressType: 0x04}, nil},
+		{cmd.LESetScanParameters{LEScanInterval: 0x0010, LEScanWindow: 0x0010, ScanningFilterPolicy: 0x04}, nil},
+	} {
+		c := tt.c
+		d := &device{}
+		err := d.Option(LnxSetScanParameters(&c))
+		if tt.want == nil {
+			if err == nil || d.scanParam != nil {
+				t.Errorf("LnxSetScanParameters(%+v): got nil error", c)
+			}
+			continue
+		}
+		if err != nil || d.scanParam != &c {
+			t.Errorf("LnxSetScanParameters(%+v): %v", c, err)
+		}
+		b := make([]byte, c.Len())
+		c.Marshal(b)
+		if c.Opcode() != 0x200B || !bytes.Equal(b, tt.want) {
+			t.Errorf("LnxSetScanParameters(%+v): command 0x%04X % X want 0x200B % X", c, c.Opcode(), b, tt.want)
+		}
+	}
+}
+
+func TestLnxScanAcceptList(t *testing.T) {
+	for _, tt := range []struct {
+		policy uint8
+		on     bool
+		want   uint8
+	}{
+		{0x00, true, 0x01},
+		{0x02, true, 0x03},
+		{0x01, false, 0x00},
+		{0x03, false, 0x02},
+		{0x01, true, 0x01},
+	} {
+		c := &cmd.LESetScanParameters{LEScanInterval: 0x0010, LEScanWindow: 0x0010, ScanningFilterPolicy: tt.policy}
+		d := &device{scanParam: c}
+		if err := d.Option(LnxScanAcceptList(tt.on)); err != nil {
+			t.Fatalf("LnxScanAcceptList(%t): %v", tt.on, err)
+		}
+		if got := d.scanParam.ScanningFilterPolicy; got != tt.want || c.ScanningFilterPolicy != tt.policy {
+			t.Errorf("LnxScanAcceptList(%t) of policy 0x%02X: got 0x%02X, want 0x%02X", tt.on, tt.policy, got, tt.want)
+		}
+	}
+	if err := (&device{}).Option(LnxScanAcceptList(true)); err == nil {
+		t.Error("LnxScanAcceptList without scan parameters: got nil error")
+	}
+}
+
+func TestNewDeviceOptions(t *testing.T) {
+	d0 := newDevice(LnxDeviceID(0, true), LnxMaxConnections(2))
+	d1 := newDevice(LnxDeviceAddress("00:1a:7d:da:71:13", false), LnxScanAcceptList(true))
+	if d0.devID != 0 || d0.devAddr != "" || !d0.chkLE || d0.maxConn != 2 {
+		t.Errorf("device 0: id %d, address %q, check LE %t, %d connections", d0.devID, d0.devAddr, d0.chkLE, d0.maxConn)
+	}
+	if d1.devID != -1 || d1.devAddr != "00:1a:7d:da:71:13" || d1.chkLE || d1.maxConn != 1 {
+		t.Errorf("device 1: id %d, address %q, check LE %t, %d connections", d1.devID, d1.devAddr, d1.chkLE, d1.maxConn)
+	}
+	if d0.scanParam == d1.scanParam || d0.advParam == d1.advParam {
+		t.Fatal("devices share their parameters")
+	}
+	if d0.scanParam.ScanningFilterPolicy != 0x00 || d1.scanParam.ScanningFilterPolicy != 0x01 {
+		t.Errorf("scanning filter policies 0x%02X and 0x%02X", d0.scanParam.ScanningFilterPolicy, d1.scanParam.ScanningFilterPolicy)
+	}
+
+	if id, err := d0.deviceID(); id != 0 || err != nil {
+		t.Errorf("device 0: got id %d, %v", id, err)
+	}
+	for _, addr := range []string{"00:1a:7d:da:71", "kiosk"} {
+		if _, err := newDevice(LnxDeviceAddress(addr, true)).deviceID(); err == nil {
+			t.Errorf("address %q: got nil error", addr)
+		}
+	}
+}
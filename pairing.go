@@ -0,0 +1,184 @@
+package gatt
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// An IOCapability is what the user of a device can do while pairing,
+// which decides how pairing protects against man-in-the-middle attacks.
+type IOCapability byte
+
+const (
+	IODisplayOnly     IOCapability = 0x00 // shows a passkey
+	IODisplayYesNo    IOCapability = 0x01 // shows a passkey, and has yes and no buttons
+	IOKeyboardOnly    IOCapability = 0x02 // enters a passkey
+	IONoInputNoOutput IOCapability = 0x03 // neither, so pairing is just works
+	IOKeyboardDisplay IOCapability = 0x04 // shows or enters a passkey
+)
+
+// A PairingAgent stands for the user of the device while pairing with a
+// peripheral. With a passkey, pairing is authenticated: protected against
+// man-in-the-middle attacks. Otherwise, or without an agent, it is just
+// works, encrypted but unauthenticated.
+type PairingAgent interface {
+	// IOCapability returns what the user can do.
+	IOCapability() IOCapability
+
+	// DisplayPasskey shows the user passkey, six decimal digits, to enter
+	// on the peripheral p. It must not block.
+	DisplayPasskey(p Peripheral, passkey uint32)
+
+	// RequestPasskey asks the user for the passkey the peripheral p
+	// shows. An error aborts pairing.
+	RequestPasskey(p Peripheral) (uint32, error)
+}
+
+// A LongTermKey is the key a peripheral distributes when bonding, to
+// encrypt later connections without pairing again.
+type LongTermKey struct {
+	Key  [16]byte // least significant octet first
+	EDIV uint16
+	Rand uint64
+
+	// Size is the size of the key agreed, in bytes, from 7 to 16.
+	Size int
+
+	// Authenticated reports whether pairing was protected against
+	// man-in-the-middle attacks.
+	Authenticated bool
+}
+
+// A KeyStore keeps the long term keys of bonded peripherals, by
+// peripheral ID. See LnxPairing.
+type KeyStore interface {
+	// Get returns the key of the peripheral with the ID.
+	Get(id string) (*LongTermKey, bool)
+
+	// Put keeps k for the peripheral with the ID, replacing any.
+	Put(id string, k *LongTermKey) error
+
+	// Delete drops the key of the peripheral with the ID.
+	Delete(id string) error
+}
+
+// MemoryKeyStore is a KeyStore keeping the keys in memory, so bonds last
+// as long as the process. The zero value is ready to use.
+type MemoryKeyStore struct {
+	mu   sync.Mutex
+	keys map[string]LongTermKey
+}
+
+// Get returns the key of the peripheral with the ID.
+func (ks *MemoryKeyStore) Get(id string) (*LongTermKey, bool) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	k, ok := ks.keys[id]
+	if !ok {
+		return nil, false
+	}
+	return &k, true
+}
+
+// Put keeps a copy of k for the peripheral with the ID.
+func (ks *MemoryKeyStore) Put(id string, k *LongTermKey) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	if ks.keys == nil {
+		ks.keys = make(map[string]LongTermKey)
+	}
+	ks.keys[id] = *k
+	return nil
+}
+
+// Delete drops the key of the peripheral with the ID, if any.
+func (ks *MemoryKeyStore) Delete(id string) error {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+	delete(ks.keys, id)
+	return nil
+}
+
+// A PairingError is the reason pairing failed, as the Pairing Failed PDU
+// sent or received carries it.
+type PairingError byte
+
+const (
+	PairingPasskeyEntryFailed         PairingError = 0x01
+	PairingOOBNotAvailable            PairingError = 0x02
+	PairingAuthenticationRequirements PairingError = 0x03
+	PairingConfirmValueFailed         PairingError = 0x04
+	PairingNotSupported               PairingError = 0x05
+	PairingEncryptionKeySize          PairingError = 0x06
+	PairingCommandNotSupported        PairingError = 0x07
+	PairingUnspecifiedReason          PairingError = 0x08
+	PairingRepeatedAttempts           PairingError = 0x09
+	PairingInvalidParameters          PairingError = 0x0a
+)
+
+var pairingErrorName = map[PairingError]string{
+	PairingPasskeyEntryFailed:         "passkey entry failed",
+	PairingOOBNotAvailable:            "OOB not available",
+	PairingAuthenticationRequirements: "authentication requirements",
+	PairingConfirmValueFailed:         "confirm value failed",
+	PairingNotSupported:               "pairing not supported",
+	PairingEncryptionKeySize:          "encryption key size",
+	PairingCommandNotSupported:        "command not supported",
+	PairingUnspecifiedReason:          "unspecified reason",
+	PairingRepeatedAttempts:           "repeated attempts",
+	PairingInvalidParameters:          "invalid parameters",
+}
+
+func (e PairingError) Error() string {
+	if s, ok := pairingErrorName[e]; ok {
+		return "pairing failed: " + s
+	}
+	return fmt.Sprintf("pairing failed: reason 0x%02X", byte(e))
+}
+
+// ErrPairingTimeout is returned when the peripheral stops answering while
+// pairing.
+var ErrPairingTimeout = errors.New("pairing timed out")
+
+// A SecurityLevel is how well the link to a peripheral is protected.
+type SecurityLevel int
+
+const (
+	SecurityNone          SecurityLevel = iota // not encrypted
+	SecurityEncrypted                          // encrypted, unauthenticated
+	SecurityAuthenticated                      // encrypted, authenticated
+)
+
+func (l SecurityLevel) String() string {
+	switch l {
+	case SecurityNone:
+		return "none"
+	case SecurityEncrypted:
+		return "encrypted"
+	case SecurityAuthenticated:
+		return "authenticated"
+	}
+	return fmt.Sprintf("SecurityLevel(%d)", int(l))
+}
+
+// A SecurityError is returned when the link to a peripheral cannot reach
+// the security level required.
+type SecurityError struct {
+	Required SecurityLevel
+	Reached  SecurityLevel
+
+	// Err is the reason pairing failed, if it did.
+	Err error
+}
+
+func (e *SecurityError) Error() string {
+	s := fmt.Sprintf("security level %s required, link is %s", e.Required, e.Reached)
+	if e.Err != nil {
+		s += ": " + e.Err.Error()
+	}
+	return s
+}
+
+// Unwrap returns the reason pairing failed.
+func (e *SecurityError) Unwrap() error { return e.Err }
@@ -0,0 +1,149 @@
+package gatt
+
+import (
+	"errors"
+	"log"
+)
+
+// errPairingUnsupported is returned by Pair on connections without a
+// Security Manager channel.
+var errPairingUnsupported = errors.New("pairing not supported on this connection")
+
+func (p *peripheral) Pair() error {
+	link, ok := p.l2c.(smpLink)
+	if !ok {
+		return errPairingUnsupported
+	}
+	p.pairmu.Lock()
+	defer p.pairmu.Unlock()
+	if !p.encrypted && p.encryptBonded(link) {
+		return nil
+	}
+	return p.pair(link, false)
+}
+
+// pair pairs with the peripheral, authenticated if mitm, and keeps the
+// key distributed. pairmu must be held.
+func (p *peripheral) pair(link smpLink, mitm bool) error {
+	ks := p.d.keyStore
+	s := &smpPairing{link: link, p: p, agent: p.d.pairingAgent, bond: ks != nil, mitm: mitm, timeout: smpTimeout}
+	k, authenticated, err := s.run()
+	if err != nil {
+		return err
+	}
+	p.encrypted, p.authenticated = true, authenticated
+	if k != nil && ks != nil {
+		if err := ks.Put(p.ID(), k); err != nil {
+			log.Printf("gatt: failed to keep the key of %s: %s", p.ID(), err)
+		}
+	}
+	return nil
+}
+
+func (p *peripheral) SecurityLevel() (SecurityLevel, error) {
+	select {
+	case <-p.quitc:
+		return SecurityNone, p.disconnectErr
+	default:
+	}
+	p.pairmu.Lock()
+	defer p.pairmu.Unlock()
+	return p.securityLevel(), nil
+}
+
+// securityLevel returns the security level of the link. pairmu must be
+// held.
+func (p *peripheral) securityLevel() SecurityLevel {
+	switch {
+	case p.authenticated:
+		return SecurityAuthenticated
+	case p.encrypted:
+		return SecurityEncrypted
+	}
+	return SecurityNone
+}
+
+func (p *peripheral) SetSecurityLevel(l SecurityLevel) error {
+	link, ok := p.l2c.(smpLink)
+	if !ok {
+		return errPairingUnsupported
+	}
+	p.pairmu.Lock()
+	defer p.pairmu.Unlock()
+	if p.securityLevel() >= l {
+		return nil
+	}
+	if !p.encrypted && p.encryptBonded(link) && p.securityLevel() >= l {
+		return nil
+	}
+	mitm := l >= SecurityAuthenticated
+	if mitm && (p.d.pairingAgent == nil || p.d.pairingAgent.IOCapability() == IONoInputNoOutput) {
+		// Without passkeys, pairing is just works.
+		return &SecurityError{Required: l, Reached: p.securityLevel()}
+	}
+	if err := p.pair(link, mitm); err != nil {
+		return &SecurityError{Required: l, Reached: p.securityLevel(), Err: err}
+	}
+	return nil
+}
+
+// connected secures the link to a peripheral just connected: it encrypts
+// it with the key of an earlier bond, if any, and brings it to the
+// default security level of the device. If the level cannot be reached,
+// it disconnects.
+func (p *peripheral) connected() error {
+	if p.d.securityLevel == SecurityNone {
+		p.reencrypt()
+		return nil
+	}
+	if err := p.SetSecurityLevel(p.d.securityLevel); err != nil {
+		p.l2c.Close()
+		return err
+	}
+	return nil
+}
+
+// encryptBonded encrypts the link with the key of an earlier bond, if the
+// KeyStore has one, and reports whether it did. pairmu must be held.
+func (p *peripheral) encryptBonded(link smpLink) bool {
+	ks := p.d.keyStore
+	if ks == nil {
+		return false
+	}
+	k, ok := ks.Get(p.ID())
+	if !ok {
+		return false
+	}
+	if err := link.StartEncryption(k.EDIV, k.Rand, k.Key); err != nil {
+		// The peripheral may have lost the bond; Pair pairs again.
+		log.Printf("gatt: failed to encrypt the link to %s: %s", p.ID(), err)
+		return false
+	}
+	p.encrypted, p.authenticated = true, k.Authenticated
+	return true
+}
+
+// reencrypt encrypts the link to a bonded peripheral, on connection.
+func (p *peripheral) reencrypt() {
+	link, ok := p.l2c.(smpLink)
+	if !ok {
+		return
+	}
+	p.pairmu.Lock()
+	defer p.pairmu.Unlock()
+	p.encryptBonded(link)
+}
+
+// secure calls f, which sends an ATT request, and calls it again after
+// pairing if the peripheral answers that the link must be encrypted or
+// authenticated first, on devices set up with LnxPairing.
+func (p *peripheral) secure(f func() error) error {
+	err := f()
+	if err != attEcodeAuthentication && err != attEcodeInsuffEnc || !p.d.pairing {
+		return err
+	}
+	if err := p.Pair(); err != nil {
+		return err
+	}
+	return f()
+}
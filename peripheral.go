@@ -3,6 +3,7 @@ package gatt
 import (
 	"errors"
 	"sync"
+	"time"
 )
 
 // Peripheral is the interface that represent a remote peripheral device.
@@ -36,20 +37,26 @@ type Peripheral interface {
 	// If the specified descriptors is set to nil, all the descriptors of the characteristic are returned.
 	DiscoverDescriptors(d []UUID, c *Characteristic) ([]*Descriptor, error)
 
-	// ReadCharacteristic retrieves the value of a specified characteristic.
+	// ReadCharacteristic retrieves the value of a specified characteristic,
+	// in full, even if longer than the MTU allows in one response.
 	ReadCharacteristic(c *Characteristic) ([]byte, error)
 
 	// ReadLongCharacteristic retrieves the value of a specified characteristic that is longer than the
-	// MTU.
+	// MTU. It is ReadCharacteristic, for values known to be long.
 	ReadLongCharacteristic(c *Characteristic) ([]byte, error)
 
-	// ReadDescriptor retrieves the value of a specified characteristic descriptor.
+	// ReadDescriptor retrieves the value of a specified characteristic
+	// descriptor, in full. See ReadClientConfig for the CCCD.
 	ReadDescriptor(d *Descriptor) ([]byte, error)
 
-	// WriteCharacteristic writes the value of a characteristic.
+	// WriteCharacteristic writes the value of a characteristic. Values
+	// longer than MTU-3 bytes are written with prepare write requests,
+	// which needs a response: with noRsp, they fail with ErrValueTooLong.
 	WriteCharacteristic(c *Characteristic, b []byte, noRsp bool) error
 
-	// WriteDescriptor writes the value of a characteristic descriptor.
+	// WriteDescriptor writes the value of a characteristic descriptor. It
+	// fails with the ATT error of the peripheral, such as a write not
+	// permitted, or ErrValueTooLong for more than MTU-3 bytes.
 	WriteDescriptor(d *Descriptor, b []byte) error
 
 	// SetNotifyValue sets notifications for the value of a specified characteristic.
@@ -58,13 +65,94 @@ type Peripheral interface {
 	// SetIndicateValue sets indications for the value of a specified characteristic.
 	SetIndicateValue(c *Characteristic, f func(*Characteristic, []byte, error)) error
 
-	// ReadRSSI retrieves the current RSSI value for the remote peripheral.
-	ReadRSSI() int
-
-	// SetMTU sets the mtu for the remote peripheral.
+	// Subscribe subscribes to the notifications or indications of c. A
+	// characteristic may have several subscriptions, each receiving all
+	// its values; it stays configured until the last one is closed.
+	// SetNotifyValue and SetIndicateValue hold one subscription each.
+	Subscribe(c *Characteristic, kind NotifyKind) (*Subscription, error)
+
+	// OnServicesChanged registers f to be called when the peripheral
+	// indicates Service Changed: the attributes from handle start to end
+	// may have been added, removed or modified, so handles discovered
+	// there are stale. The services in the range are dropped from
+	// Services before f is called; discover them again. The function
+	// returned unregisters f.
+	//
+	// On Linux, DiscoverServices subscribes to Service Changed once it
+	// finds the GATT service. On Darwin, Core Bluetooth does, but the
+	// changes are not reported yet.
+	OnServicesChanged(f func(start, end uint16)) (remove func())
+
+	// Pair encrypts the link to the peripheral, with the key of an earlier
+	// bond if the KeyStore of LnxPairing has one, or else by pairing,
+	// which asks the agent of LnxPairing for passkeys. On a link already
+	// encrypted, it pairs again. Pairing fails with a PairingError, or
+	// ErrPairingTimeout. On Darwin, Core Bluetooth pairs by itself when
+	// needed, and Pair is not implemented.
+	Pair() error
+
+	// SecurityLevel returns the security level of the link to the
+	// peripheral. Once the peripheral has disconnected, the error is a
+	// *DisconnectError, which errors.Is takes for io.EOF.
+	SecurityLevel() (SecurityLevel, error)
+
+	// SetSecurityLevel brings the link to the peripheral to the security
+	// level l, if below: it encrypts the link with the key of an earlier
+	// bond, or pairs, authenticated if l requires it. If the level cannot
+	// be reached, the error is a *SecurityError. See
+	// LnxDefaultSecurityLevel to require a level on connection.
+	SetSecurityLevel(l SecurityLevel) error
+
+	// ReadRSSI retrieves the current RSSI value for the remote peripheral,
+	// in dBm. Once the peripheral has disconnected, the error is a
+	// *DisconnectError, which errors.Is takes for io.EOF.
+	ReadRSSI() (int, error)
+
+	// SetMTU sets the mtu for the remote peripheral. It is ExchangeMTU,
+	// without the MTU agreed.
 	SetMTU(mtu uint16) error
+
+	// ExchangeMTU offers the peripheral an ATT MTU of requested, between
+	// 23 and 517, and returns the MTU agreed, the smaller of requested and
+	// the one the peripheral can receive. The MTU is exchanged once per
+	// connection; later calls return the MTU agreed the first time.
+	ExchangeMTU(requested uint16) (uint16, error)
+
+	// MTU returns the ATT MTU of the connection, 23 until exchanged.
+	MTU() uint16
+
+	// WriteCommand queues a write without response of b, at most MTU-3
+	// bytes, to c. The writes queued are sent in order with the requests,
+	// as fast as the controller takes them; WriteCommand waits while the
+	// queue is full. Once the peripheral has disconnected, it returns a
+	// *DisconnectError, which errors.Is takes for io.EOF.
+	WriteCommand(c *Characteristic, b []byte) error
+
+	// WritableWithoutResponse returns a channel that is closed once
+	// WriteCommand can queue a write without waiting.
+	WritableWithoutResponse() <-chan struct{}
+
+	// ReliableWrite calls f to queue characteristic writes, then sends
+	// them with prepare write requests, checking each against the echo of
+	// the peripheral, and has the peripheral apply them all at once. If f
+	// fails, nothing is sent; if a write or check fails, the writes are
+	// cancelled. The MTU cannot change during the transaction:
+	// ExchangeMTU waits for it to end.
+	ReliableWrite(f func(tx *WriteTx) error) error
+
+	// UpdateConnectionParams asks the controller to apply new connection
+	// parameters to the connection with the peripheral, and waits until
+	// it has. See ConnParams for the ranges allowed.
+	UpdateConnectionParams(minInterval, maxInterval time.Duration, latency uint16, supervisionTimeout time.Duration) error
 }
 
+// closedc is a closed channel, for WritableWithoutResponse.
+var closedc = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
 type subscriber struct {
 	sub map[uint16]subscribefn
 	mu  *sync.Mutex
@@ -91,6 +179,18 @@ func (s *subscriber) unsubscribe(h uint16) {
 	s.mu.Unlock()
 }
 
+// disconnect drops all subscriptions and reports err to each of them, so
+// that users of notifications learn that no more values will arrive.
+func (s *subscriber) disconnect(err error) {
+	s.mu.Lock()
+	sub := s.sub
+	s.sub = make(map[uint16]subscribefn)
+	s.mu.Unlock()
+	for _, f := range sub {
+		go f(nil, err)
+	}
+}
+
 func (s *subscriber) fn(h uint16) subscribefn {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -99,4 +199,12 @@ func (s *subscriber) fn(h uint16) subscribefn {
 
 var (
 	ErrInvalidLength = errors.New("invalid length")
+
+	// ErrValueTooLong is returned for writes of more than MTU-3 bytes.
+	ErrValueTooLong = errors.New("value too long for the MTU")
+
+	// ErrNoClientConfig is returned for characteristics without a client
+	// characteristic configuration descriptor, which cannot be
+	// subscribed to.
+	ErrNoClientConfig = errors.New("no client characteristic configuration")
 )
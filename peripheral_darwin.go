@@ -3,6 +3,7 @@ package gatt
 import (
 	"errors"
 	"log"
+	"time"
 
 	"github.com/PayRange/gatt/xpc"
 )
@@ -18,7 +19,10 @@ type peripheral struct {
 	d    *device
 	svcs []*Service
 
-	sub *subscriber
+	sub  *subscriber
+	subs *Subscribers
+
+	changed servicesChanged
 
 	id   xpc.UUID
 	name string
@@ -104,6 +108,9 @@ func (p *peripheral) DiscoverDescriptors(ds []UUID, c *Characteristic) ([]*Descr
 		h := uint16(xd.MustGetInt("kCBMsgArgDescriptorHandle"))
 		d := &Descriptor{uuid: u, char: c, h: h}
 		c.descs = append(c.descs, d)
+		if u.Equal(attrClientCharacteristicConfigUUID) {
+			c.cccd = d
+		}
 	}
 	return c.descs, nil
 }
@@ -121,8 +128,10 @@ func (p *peripheral) ReadCharacteristic(c *Characteristic) ([]byte, error) {
 	return b, nil
 }
 
+// ReadLongCharacteristic is ReadCharacteristic, as Core Bluetooth reads
+// long values in full.
 func (p *peripheral) ReadLongCharacteristic(c *Characteristic) ([]byte, error) {
-	return nil, errors.New("Not implemented")
+	return p.ReadCharacteristic(c)
 }
 
 func (p *peripheral) WriteCharacteristic(c *Characteristic, b []byte, noRsp bool) error {
@@ -168,15 +177,22 @@ func (p *peripheral) WriteDescriptor(d *Descriptor, b []byte) error {
 	return nil
 }
 
-func (p *peripheral) SetNotifyValue(c *Characteristic, f func(*Characteristic, []byte, error)) error {
+// setNotifyValue has Core Bluetooth deliver the values of c to the
+// subscriptions, or stop if kinds is 0. Core Bluetooth picks between
+// notifications and indications itself.
+func (p *peripheral) setNotifyValue(c *Characteristic, kinds NotifyKind) error {
 	set := 1
-	if f == nil {
+	if kinds == 0 {
 		set = 0
 	}
 	// To avoid race condition, registeration is handled before requesting the server.
-	if f != nil {
+	if kinds != 0 {
 		// Note: when notified, core bluetooth reports characteristic handle, not value's handle.
-		p.sub.subscribe(c.h, func(b []byte, err error) { f(c, b, err) })
+		p.sub.subscribe(c.h, func(b []byte, err error) {
+			if err == nil {
+				p.subs.Deliver(c, b)
+			}
+		})
 	}
 	rsp := p.sendReq(68, xpc.Dict{
 		"kCBMsgArgDeviceUUID":                p.id,
@@ -188,27 +204,76 @@ func (p *peripheral) SetNotifyValue(c *Characteristic, f func(*Characteristic, [
 		return attEcode(res)
 	}
 	// To avoid race condition, unregisteration is handled after server responses.
-	if f == nil {
+	if kinds == 0 {
 		p.sub.unsubscribe(c.h)
 	}
 	return nil
 }
 
+func (p *peripheral) Subscribe(c *Characteristic, kind NotifyKind) (*Subscription, error) {
+	return p.subs.Subscribe(c, kind)
+}
+
+// OnServicesChanged registers f, which is not called yet: the event of
+// Core Bluetooth reporting the changes is not handled.
+func (p *peripheral) OnServicesChanged(f func(start, end uint16)) (remove func()) {
+	return p.changed.add(f)
+}
+
+func (p *peripheral) SetNotifyValue(c *Characteristic, f func(*Characteristic, []byte, error)) error {
+	return p.subs.setFunc(c, Notification, f)
+}
+
 func (p *peripheral) SetIndicateValue(c *Characteristic,
 	f func(*Characteristic, []byte, error)) error {
-	// TODO: Implement set indications logic for darwin (https://github.com/PayRange/gatt/issues/32)
-	return nil
+	return p.subs.setFunc(c, Indication, f)
+}
+
+// Pair is not implemented, as Core Bluetooth pairs by itself when a
+// request needs it.
+func (p *peripheral) Pair() error {
+	return errors.New("Not implemented")
+}
+
+func (p *peripheral) SecurityLevel() (SecurityLevel, error) {
+	return SecurityNone, errors.New("Not implemented")
+}
+
+func (p *peripheral) SetSecurityLevel(l SecurityLevel) error {
+	return errors.New("Not implemented")
 }
 
-func (p *peripheral) ReadRSSI() int {
+func (p *peripheral) ReadRSSI() (int, error) {
 	rsp := p.sendReq(43, xpc.Dict{"kCBMsgArgDeviceUUID": p.id})
-	return rsp.MustGetInt("kCBMsgArgData")
+	return rsp.MustGetInt("kCBMsgArgData"), nil
 }
 
 func (p *peripheral) SetMTU(mtu uint16) error {
 	return errors.New("Not implemented")
 }
 
+func (p *peripheral) ExchangeMTU(requested uint16) (uint16, error) {
+	return attDefaultMTU, errors.New("Not implemented")
+}
+
+func (p *peripheral) MTU() uint16 { return attDefaultMTU }
+
+func (p *peripheral) WriteCommand(c *Characteristic, b []byte) error {
+	return p.WriteCharacteristic(c, b, true)
+}
+
+// WritableWithoutResponse returns a closed channel, as Core Bluetooth
+// queues writes without response itself.
+func (p *peripheral) WritableWithoutResponse() <-chan struct{} { return closedc }
+
+func (p *peripheral) ReliableWrite(f func(tx *WriteTx) error) error {
+	return errors.New("Not implemented")
+}
+
+func (p *peripheral) UpdateConnectionParams(minInterval, maxInterval time.Duration, latency uint16, supervisionTimeout time.Duration) error {
+	return errors.New("Not implemented")
+}
+
 func uuidSlice(uu []UUID) [][]byte {
 	us := [][]byte{}
 	for _, u := range uu {
@@ -3,12 +3,14 @@ package gatt
 import (
 	"bytes"
 	"encoding/binary"
-	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/PayRange/gatt/linux"
 )
@@ -21,24 +23,52 @@ type peripheral struct {
 	// A list of invalid service is provided in the parameter.
 	ServicesModified func(*peripheral, []*Service)
 
-	d    *device
-	svcs []*Service
+	d      *device
+	svcs   []*Service
+	svcsmu sync.Mutex
 
-	sub *subscriber
+	changed servicesChanged
+	scmu    sync.Mutex // serializes watchServiceChanged
+	scdone  bool       // watchServiceChanged found the GATT service
+	scvh    uint32     // Service Changed value handle, accessed atomically
 
-	mtu uint16
-	l2c io.ReadWriteCloser
+	cache     DiscoveryCache
+	cachemu   sync.Mutex // serializes updates of the cache, guards hash
+	fromCache int32      // discovery is served from the cache, accessed atomically
+	hashRead  bool
+	hash      []byte // Database Hash, nil if the peripheral has none
 
-	reqc  chan message
-	quitc chan struct{}
+	sub  *subscriber
+	subs *Subscribers
+
+	pairmu        sync.Mutex // serializes pairing, guards encrypted and authenticated
+	encrypted     bool
+	authenticated bool
+
+	mtu      uint32     // accessed atomically, 0 until exchanged
+	mtumu    sync.Mutex // serializes ExchangeMTU and prepared writes
+	mtuxchgd bool
+	l2c      io.ReadWriteCloser
+
+	reqc          chan message
+	quitc         chan struct{}
+	disconnectErr *DisconnectError // set before quitc is closed
+
+	readymu sync.Mutex
+	ready   chan struct{} // closed when reqc has room, if waited for
 
 	pd *linux.PlatData // platform specific data
 }
 
-func (p *peripheral) Device() Device       { return p.d }
-func (p *peripheral) ID() string           { return strings.ToUpper(net.HardwareAddr(p.pd.Address[:]).String()) }
-func (p *peripheral) Name() string         { return p.pd.Name }
-func (p *peripheral) Services() []*Service { return p.svcs }
+func (p *peripheral) Device() Device { return p.d }
+func (p *peripheral) ID() string     { return strings.ToUpper(net.HardwareAddr(p.pd.Address[:]).String()) }
+func (p *peripheral) Name() string   { return p.pd.Name }
+
+func (p *peripheral) Services() []*Service {
+	p.svcsmu.Lock()
+	defer p.svcsmu.Unlock()
+	return p.svcs
+}
 
 func finish(op byte, h uint16, b []byte) bool {
 	done := b[0] == attOpError && b[1] == op && b[2] == byte(h) && b[3] == byte(h>>8)
@@ -53,6 +83,11 @@ func finish(op byte, h uint16, b []byte) bool {
 func (p *peripheral) DiscoverServices(s []UUID) ([]*Service, error) {
 	// TODO: implement the UUID filters
 	// p.pd.Conn.Write([]byte{0x02, 0x87, 0x00}) // MTU
+	if svcs, ok := p.cachedServices(); ok {
+		p.setServices(svcs)
+		return svcs, nil
+	}
+	var svcs []*Service
 	done := false
 	start := uint16(0x0001)
 	for !done {
@@ -63,7 +98,10 @@ func (p *peripheral) DiscoverServices(s []UUID) ([]*Service, error) {
 		binary.LittleEndian.PutUint16(b[3:5], 0xFFFF)
 		binary.LittleEndian.PutUint16(b[5:7], 0x2800)
 
-		b = p.sendReq(op, b)
+		b, err := p.sendReq(op, b)
+		if err != nil {
+			return nil, err
+		}
 		if finish(op, start, b) {
 			break
 		}
@@ -84,13 +122,150 @@ func (p *peripheral) DiscoverServices(s []UUID) ([]*Service, error) {
 				h:    h,
 				endh: endh,
 			}
-			p.svcs = append(p.svcs, s)
+			svcs = append(svcs, s)
 			b = b[l:]
 			done = endh == 0xFFFF
 			start = endh + 1
 		}
 	}
-	return p.svcs, nil
+	p.setServices(svcs)
+	p.updateCache()
+	return svcs, nil
+}
+
+// setServices makes svcs the services of p, and subscribes to Service
+// Changed if they include the GATT service.
+func (p *peripheral) setServices(svcs []*Service) {
+	p.svcsmu.Lock()
+	p.svcs = svcs
+	p.svcsmu.Unlock()
+
+	for _, s := range svcs {
+		if s.uuid.Equal(attrGATTUUID) {
+			p.watchServiceChanged(s)
+			break
+		}
+	}
+}
+
+// cachedServices returns the services cached for p, if the cache has
+// them and they are still valid, and has the discovery of their
+// characteristics and descriptors served from the cache as far as it
+// knows them.
+func (p *peripheral) cachedServices() ([]*Service, bool) {
+	if p.cache == nil {
+		return nil, false
+	}
+	p.cachemu.Lock()
+	defer p.cachemu.Unlock()
+	db, ok := p.cache.Get(p.ID())
+	if !ok {
+		return nil, false
+	}
+	if db.Hash != nil && !bytes.Equal(db.Hash, p.databaseHash()) {
+		p.cache.Delete(p.ID())
+		return nil, false
+	}
+	atomic.StoreInt32(&p.fromCache, 1)
+	return db.services(), true
+}
+
+// servedFromCache reports whether discovery is served from the cache.
+func (p *peripheral) servedFromCache() bool {
+	return atomic.LoadInt32(&p.fromCache) != 0
+}
+
+// updateCache puts the services discovered so far in the cache.
+func (p *peripheral) updateCache() {
+	if p.cache == nil {
+		return
+	}
+	p.cachemu.Lock()
+	defer p.cachemu.Unlock()
+	p.cache.Put(p.ID(), newGATTDatabase(p.databaseHash(), p.Services()))
+}
+
+// dropCache deletes the services cached for p, which may be stale, and
+// has discovery query the peripheral again.
+func (p *peripheral) dropCache() {
+	if p.cache == nil {
+		return
+	}
+	atomic.StoreInt32(&p.fromCache, 0)
+	p.cache.Delete(p.ID())
+}
+
+// databaseHash returns the Database Hash of the peripheral, read once per
+// connection, or nil if it has none. p.cachemu must be held.
+func (p *peripheral) databaseHash() []byte {
+	if p.hashRead {
+		return p.hash
+	}
+	p.hashRead = true
+
+	b := make([]byte, 7)
+	op := byte(attOpReadByTypeReq)
+	b[0] = op
+	binary.LittleEndian.PutUint16(b[1:3], 0x0001)
+	binary.LittleEndian.PutUint16(b[3:5], 0xFFFF)
+	copy(b[5:7], attrDatabaseHashUUID.b)
+
+	b, err := p.sendReq(op, b)
+	// The response holds the handle and the 16 bytes of the hash.
+	if err == nil && b[0] == attOpReadByTypeRsp && len(b) == 20 && b[1] == 18 {
+		p.hash = append([]byte(nil), b[4:]...)
+	}
+	return p.hash
+}
+
+// watchServiceChanged subscribes to the Service Changed characteristic of
+// the GATT service s, once per connection. Peripherals need not have one,
+// so failing is not an error; changes just go unnoticed.
+func (p *peripheral) watchServiceChanged(s *Service) {
+	p.scmu.Lock()
+	defer p.scmu.Unlock()
+	if p.scdone {
+		return
+	}
+	p.scdone = true
+
+	cs, err := p.DiscoverCharacteristics([]UUID{attrServiceChangedUUID}, s)
+	if err != nil {
+		return
+	}
+	for _, c := range cs {
+		if !c.uuid.Equal(attrServiceChangedUUID) || c.props&CharIndicate == 0 {
+			continue
+		}
+		if _, err := p.DiscoverDescriptors(nil, c); err != nil || c.cccd == nil {
+			return
+		}
+		// The peripheral may indicate as soon as the CCCD is written.
+		atomic.StoreUint32(&p.scvh, uint32(c.vh))
+		if err := p.WriteDescriptor(c.cccd, CCCDIndicate.Bytes()); err != nil {
+			atomic.StoreUint32(&p.scvh, 0)
+		}
+		return
+	}
+}
+
+// servicesChanged handles the Service Changed value b: it drops the
+// services affected, then calls the OnServicesChanged functions.
+func (p *peripheral) servicesChanged(b []byte) {
+	start, end, ok := parseServiceChanged(b)
+	if !ok {
+		return
+	}
+	p.svcsmu.Lock()
+	p.svcs = dropServices(p.svcs, start, end)
+	p.svcsmu.Unlock()
+	p.dropCache()
+	// The functions may send requests, answered by the loop calling this.
+	go p.changed.call(start, end)
+}
+
+func (p *peripheral) OnServicesChanged(f func(start, end uint16)) (remove func()) {
+	return p.changed.add(f)
 }
 
 func (p *peripheral) DiscoverIncludedServices(ss []UUID, s *Service) ([]*Service, error) {
@@ -100,6 +275,10 @@ func (p *peripheral) DiscoverIncludedServices(ss []UUID, s *Service) ([]*Service
 
 func (p *peripheral) DiscoverCharacteristics(cs []UUID, s *Service) ([]*Characteristic, error) {
 	// TODO: implement the UUID filters
+	if s.discovered && p.servedFromCache() {
+		return s.chars, nil
+	}
+	s.chars = nil
 	done := false
 	start := s.h
 	var prev *Characteristic
@@ -111,7 +290,10 @@ func (p *peripheral) DiscoverCharacteristics(cs []UUID, s *Service) ([]*Characte
 		binary.LittleEndian.PutUint16(b[3:5], s.endh)
 		binary.LittleEndian.PutUint16(b[5:7], 0x2803)
 
-		b = p.sendReq(op, b)
+		b, err := p.sendReq(op, b)
+		if err != nil {
+			return nil, err
+		}
 		if finish(op, start, b) {
 			break
 		}
@@ -130,7 +312,7 @@ func (p *peripheral) DiscoverCharacteristics(cs []UUID, s *Service) ([]*Characte
 			props := Property(b[2])
 			vh := binary.LittleEndian.Uint16(b[3:5])
 			u := UUID{b[5:l]}
-			s := searchService(p.svcs, h, vh)
+			s := searchService(p.Services(), h, vh)
 			if s == nil {
 				log.Printf("Can't find service range that contains 0x%04X - 0x%04X", h, vh)
 				return nil, fmt.Errorf("Can't find service range that contains 0x%04X - 0x%04X", h, vh)
@@ -155,11 +337,17 @@ func (p *peripheral) DiscoverCharacteristics(cs []UUID, s *Service) ([]*Characte
 	if len(s.chars) > 1 {
 		s.chars[len(s.chars)-1].endh = s.endh
 	}
+	s.discovered = true
+	p.updateCache()
 	return s.chars, nil
 }
 
 func (p *peripheral) DiscoverDescriptors(ds []UUID, c *Characteristic) ([]*Descriptor, error) {
 	// TODO: implement the UUID filters
+	if c.discovered && p.servedFromCache() {
+		return c.descs, nil
+	}
+	c.descs, c.cccd = nil, nil
 	done := false
 	start := c.vh + 1
 	for !done {
@@ -172,7 +360,10 @@ func (p *peripheral) DiscoverDescriptors(ds []UUID, c *Characteristic) ([]*Descr
 		binary.LittleEndian.PutUint16(b[1:3], start)
 		binary.LittleEndian.PutUint16(b[3:5], c.endh)
 
-		b = p.sendReq(op, b)
+		b, err := p.sendReq(op, b)
+		if err != nil {
+			return nil, err
+		}
 		if finish(attOpFindInfoReq, start, b) {
 			break
 		}
@@ -202,139 +393,258 @@ func (p *peripheral) DiscoverDescriptors(ds []UUID, c *Characteristic) ([]*Descr
 			start = h + 1
 		}
 	}
+	c.discovered = true
+	p.updateCache()
 	return c.descs, nil
 }
 
 func (p *peripheral) ReadCharacteristic(c *Characteristic) ([]byte, error) {
+	return p.ReadLongCharacteristic(c)
+}
+
+func (p *peripheral) ReadLongCharacteristic(c *Characteristic) ([]byte, error) {
+	var b []byte
+	err := p.secure(func() (err error) {
+		b, err = p.readLong(c.vh)
+		return err
+	})
+	return b, err
+}
+
+// readLong reads the value of the attribute at handle h in full.
+func (p *peripheral) readLong(h uint16) ([]byte, error) {
+	// The first read is a regular read request, as a read blob request
+	// may fail for values that fit. If the value received fills the
+	// response, MTU-1 bytes, the rest is read with read blob requests.
 	b := make([]byte, 3)
 	op := byte(attOpReadReq)
 	b[0] = op
-	binary.LittleEndian.PutUint16(b[1:3], c.vh)
+	binary.LittleEndian.PutUint16(b[1:3], h)
 
-	b = p.sendReq(op, b)
-	b = b[1:]
-	return b, nil
-}
-
-func (p *peripheral) ReadLongCharacteristic(c *Characteristic) ([]byte, error) {
-	// The spec says that a read blob request should fail if the characteristic
-	// is smaller than mtu - 1.  To simplify the API, the first read is done
-	// with a regular read request.  If the buffer received is equal to mtu -1,
-	// then we read the rest of the data using read blob.
-	firstRead, err := p.ReadCharacteristic(c)
+	b, err := p.sendReq(op, b)
 	if err != nil {
 		return nil, err
 	}
-	if len(firstRead) < int(p.mtu)-1 {
+	if b[0] == attOpError {
+		return nil, attRspError(b)
+	}
+	firstRead := b[1:]
+	mtu := int(p.MTU())
+	if len(firstRead) < mtu-1 {
 		return firstRead, nil
 	}
 
 	var buf bytes.Buffer
 	buf.Write(firstRead)
-	off := uint16(len(firstRead))
-	for {
+	// Values are at most 512 bytes; stop there if the server keeps going.
+	for buf.Len() < 512 {
 		b := make([]byte, 5)
 		op := byte(attOpReadBlobReq)
 		b[0] = op
-		binary.LittleEndian.PutUint16(b[1:3], c.vh)
-		binary.LittleEndian.PutUint16(b[3:5], off)
+		binary.LittleEndian.PutUint16(b[1:3], h)
+		binary.LittleEndian.PutUint16(b[3:5], uint16(buf.Len()))
 
-		b = p.sendReq(op, b)
-		b = b[1:]
-		if len(b) == 0 {
-			break
+		b, err := p.sendReq(op, b)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] == attOpError {
+			switch err := attRspError(b); err {
+			case attEcodeAttrNotLong, attEcodeInvalidOffset:
+				// The value was exactly MTU-1 bytes long.
+				return buf.Bytes(), nil
+			default:
+				return nil, err
+			}
 		}
+		b = b[1:]
 		buf.Write(b)
-		off += uint16(len(b))
-		if len(b) < int(p.mtu)-1 {
+		if len(b) < mtu-1 {
 			break
 		}
 	}
 	return buf.Bytes(), nil
 }
 
+// attRspError returns the error in the ATT Error Response b.
+func attRspError(b []byte) error {
+	if len(b) != 5 {
+		return ErrInvalidLength
+	}
+	return attEcode(b[4])
+}
+
 func (p *peripheral) WriteCharacteristic(c *Characteristic, value []byte, noRsp bool) error {
+	if noRsp {
+		return p.WriteCommand(c, value)
+	}
+	return p.secure(func() error {
+		if len(value) > int(p.MTU())-3 {
+			return p.executeWrites([]TxWrite{{c, value}})
+		}
+		return p.writeReq(c.vh, value)
+	})
+}
+
+// writeReq writes value, at most MTU-3 bytes, to the attribute at handle
+// h with a write request.
+func (p *peripheral) writeReq(h uint16, value []byte) error {
 	b := make([]byte, 3+len(value))
 	op := byte(attOpWriteReq)
 	b[0] = op
-	if noRsp {
-		b[0] = attOpWriteCmd
+	binary.LittleEndian.PutUint16(b[1:3], h)
+	copy(b[3:], value)
+
+	b, err := p.sendReq(op, b)
+	if err != nil {
+		return err
+	}
+	if b[0] == attOpError {
+		return attRspError(b)
+	}
+	return nil
+}
+
+func (p *peripheral) WriteCommand(c *Characteristic, value []byte) error {
+	if len(value) > int(p.MTU())-3 {
+		return ErrValueTooLong
 	}
+	b := make([]byte, 3+len(value))
+	op := byte(attOpWriteCmd)
+	b[0] = op
 	binary.LittleEndian.PutUint16(b[1:3], c.vh)
 	copy(b[3:], value)
+	return p.sendCmd(op, b)
+}
 
-	if noRsp {
-		p.sendCmd(op, b)
+func (p *peripheral) ReliableWrite(f func(tx *WriteTx) error) error {
+	var tx WriteTx
+	if err := f(&tx); err != nil {
+		return err
+	}
+	if len(tx.writes) == 0 {
 		return nil
 	}
-	b = p.sendReq(op, b)
-	// TODO: error handling
-	b = b[1:]
+	return p.executeWrites(tx.writes)
+}
+
+// executeWrites queues ws on the peripheral with prepare write requests,
+// checking the echo of each, and executes them together. If a request
+// fails or is echoed back altered, the queue is cancelled.
+func (p *peripheral) executeWrites(ws []TxWrite) error {
+	// The peripheral keeps a single queue of prepared writes, which must
+	// not mix writes of several transactions, or of two MTUs.
+	p.mtumu.Lock()
+	defer p.mtumu.Unlock()
+
+	n := int(p.MTU()) - 5
+	for _, w := range ws {
+		for off := 0; off == 0 || off < len(w.Value); off += n {
+			end := off + n
+			if end > len(w.Value) {
+				end = len(w.Value)
+			}
+			b := make([]byte, 5+end-off)
+			op := byte(attOpPrepWriteReq)
+			b[0] = op
+			binary.LittleEndian.PutUint16(b[1:3], w.Characteristic.vh)
+			binary.LittleEndian.PutUint16(b[3:5], uint16(off))
+			copy(b[5:], w.Value[off:end])
+
+			rsp, err := p.sendReq(op, b)
+			if err != nil {
+				return err
+			}
+			switch {
+			case rsp[0] == attOpError:
+				err = attRspError(rsp)
+			case !bytes.Equal(rsp[1:], b[1:]):
+				err = ErrWriteVerify
+			}
+			if err != nil {
+				p.executeWrite(0x00) // cancel
+				return err
+			}
+		}
+	}
+	return p.executeWrite(0x01) // write
+}
+
+// executeWrite sends an execute write request with the given flags.
+func (p *peripheral) executeWrite(flags byte) error {
+	op := byte(attOpExecWriteReq)
+	b, err := p.sendReq(op, []byte{op, flags})
+	if err != nil {
+		return err
+	}
+	if b[0] == attOpError {
+		return attRspError(b)
+	}
 	return nil
 }
 
 func (p *peripheral) ReadDescriptor(d *Descriptor) ([]byte, error) {
-	b := make([]byte, 3)
-	op := byte(attOpReadReq)
-	b[0] = op
-	binary.LittleEndian.PutUint16(b[1:3], d.h)
-
-	b = p.sendReq(op, b)
-	b = b[1:]
-	// TODO: error handling
-	return b, nil
+	var b []byte
+	err := p.secure(func() (err error) {
+		b, err = p.readLong(d.h)
+		return err
+	})
+	return b, err
 }
 
 func (p *peripheral) WriteDescriptor(d *Descriptor, value []byte) error {
-	b := make([]byte, 3+len(value))
-	op := byte(attOpWriteReq)
-	b[0] = op
-	binary.LittleEndian.PutUint16(b[1:3], d.h)
-	copy(b[3:], value)
-
-	b = p.sendReq(op, b)
-	b = b[1:]
-	// TODO: error handling
-	return nil
+	if len(value) > int(p.MTU())-3 {
+		return ErrValueTooLong
+	}
+	return p.secure(func() error { return p.writeReq(d.h, value) })
 }
 
-func (p *peripheral) setNotifyValue(c *Characteristic, flag uint16, f func(*Characteristic, []byte, error)) error {
+// setNotifyValue writes the client characteristic configuration of c,
+// for the kinds of values the subscriptions want.
+func (p *peripheral) setNotifyValue(c *Characteristic, kinds NotifyKind) error {
 	if c.cccd == nil {
-		return errors.New("no cccd") // FIXME
+		return ErrNoClientConfig
 	}
-	ccc := uint16(0)
-	if f != nil {
-		ccc = flag
-		p.sub.subscribe(c.vh, func(b []byte, err error) { f(c, b, err) })
+	if kinds != 0 {
+		p.sub.subscribe(c.vh, func(b []byte, err error) {
+			if err == nil {
+				p.subs.Deliver(c, b)
+			}
+		})
 	}
-	b := make([]byte, 5)
-	op := byte(attOpWriteReq)
-	b[0] = op
-	binary.LittleEndian.PutUint16(b[1:3], c.cccd.h)
-	binary.LittleEndian.PutUint16(b[3:5], ccc)
-
-	b = p.sendReq(op, b)
-	b = b[1:]
-	// TODO: error handling
-	if f == nil {
+	v := CCCDValue(kinds).Bytes()
+	if err := p.secure(func() error { return p.writeReq(c.cccd.h, v) }); err != nil {
+		return err
+	}
+	if kinds == 0 {
 		p.sub.unsubscribe(c.vh)
 	}
 	return nil
 }
 
+func (p *peripheral) Subscribe(c *Characteristic, kind NotifyKind) (*Subscription, error) {
+	return p.subs.Subscribe(c, kind)
+}
+
 func (p *peripheral) SetNotifyValue(c *Characteristic,
 	f func(*Characteristic, []byte, error)) error {
-	return p.setNotifyValue(c, gattCCCNotifyFlag, f)
+	return p.subs.setFunc(c, Notification, f)
 }
 
 func (p *peripheral) SetIndicateValue(c *Characteristic,
 	f func(*Characteristic, []byte, error)) error {
-	return p.setNotifyValue(c, gattCCCIndicateFlag, f)
+	return p.subs.setFunc(c, Indication, f)
 }
 
-func (p *peripheral) ReadRSSI() int {
-	// TODO: implement
-	return -1
+// ReadRSSI reads the RSSI with an HCI command rather than over the ATT
+// bearer, so it neither waits for nor disturbs the ATT requests in flight.
+func (p *peripheral) ReadRSSI() (int, error) {
+	select {
+	case <-p.quitc:
+		return 0, p.disconnectErr
+	default:
+	}
+	return p.d.hci.ReadRSSI(p.pd)
 }
 
 func searchService(ss []*Service, start, end uint16) *Service {
@@ -353,14 +663,92 @@ type message struct {
 	rspc chan []byte
 }
 
-func (p *peripheral) sendCmd(op byte, b []byte) {
-	p.reqc <- message{op: op, b: b}
+// reqQueueLen is how many requests and write commands may wait to be sent.
+const reqQueueLen = 16
+
+func (p *peripheral) sendCmd(op byte, b []byte) error {
+	select {
+	case <-p.quitc:
+		return p.disconnectErr
+	default:
+	}
+	select {
+	case p.reqc <- message{op: op, b: b}:
+		return nil
+	case <-p.quitc:
+		return p.disconnectErr
+	}
 }
 
-func (p *peripheral) sendReq(op byte, b []byte) []byte {
-	m := message{op: op, b: b, rspc: make(chan []byte)}
-	p.reqc <- m
-	return <-m.rspc
+func (p *peripheral) WritableWithoutResponse() <-chan struct{} {
+	p.readymu.Lock()
+	defer p.readymu.Unlock()
+	select {
+	case <-p.quitc:
+		return closedc
+	default:
+	}
+	if len(p.reqc) < cap(p.reqc) {
+		return closedc
+	}
+	if p.ready == nil {
+		p.ready = make(chan struct{})
+	}
+	return p.ready
+}
+
+// writable wakes up the waiters of WritableWithoutResponse.
+func (p *peripheral) writable() {
+	p.readymu.Lock()
+	if p.ready != nil {
+		close(p.ready)
+		p.ready = nil
+	}
+	p.readymu.Unlock()
+}
+
+// sendReq sends the request b and returns the response. If the peripheral
+// disconnects first, the error is a *DisconnectError.
+func (p *peripheral) sendReq(op byte, b []byte) ([]byte, error) {
+	m := message{op: op, b: b, rspc: make(chan []byte, 1)}
+	select {
+	case p.reqc <- m:
+	case <-p.quitc:
+		return nil, p.disconnectErr
+	}
+	select {
+	case b = <-m.rspc:
+	case <-p.quitc:
+		return nil, p.disconnectErr
+	}
+	if b[0] == attOpError && len(b) == 5 && attEcode(b[4]) == attEcodeInvalidHandle {
+		// The handles cached, if any, are stale.
+		p.dropCache()
+	}
+	return b, nil
+}
+
+// disconnectReasoner is implemented by the connections which tell why
+// they ended.
+type disconnectReasoner interface {
+	DisconnectReason() uint8
+}
+
+// newDisconnectError returns the error reporting that the connection,
+// whose reads failed, has ended.
+func (p *peripheral) newDisconnectError() *DisconnectError {
+	e := &DisconnectError{ID: p.ID()}
+	if r, ok := p.l2c.(disconnectReasoner); ok {
+		e.reason = DisconnectReason(r.DisconnectReason())
+	}
+	return e
+}
+
+// A notification is a value notified or indicated, with the function
+// subscribed to it.
+type notification struct {
+	f subscribefn
+	b []byte
 }
 
 func (p *peripheral) loop() {
@@ -372,11 +760,18 @@ func (p *peripheral) loop() {
 		for {
 			select {
 			case req := <-p.reqc:
+				p.writable()
 				p.l2c.Write(req.b)
 				if req.rspc == nil {
 					break
 				}
-				r := <-rspc
+				var r []byte
+				select {
+				case r = <-rspc:
+				case <-p.quitc:
+					p.writable()
+					return
+				}
 				switch reqOp, rspOp := req.b[0], r[0]; {
 				case rspOp == attRspFor[reqOp]:
 				case rspOp == attOpError && r[1] == reqOp:
@@ -386,11 +781,24 @@ func (p *peripheral) loop() {
 				}
 				req.rspc <- r
 			case <-p.quitc:
+				p.writable()
 				return
 			}
 		}
 	}()
 
+	// Deliver the values notified or indicated in order, apart from the
+	// reading so that the functions may make requests. Once notec is
+	// full, reading waits.
+	notec := make(chan notification, subscriptionLen)
+	go func() {
+		for n := range notec {
+			n.f(n.b, nil)
+		}
+		p.sub.disconnect(p.disconnectErr)
+		p.subs.End(p.disconnectErr)
+	}()
+
 	// L2CAP implementations shall support a minimum MTU size of 48 bytes.
 	// The default value is 672 bytes
 	buf := make([]byte, 672)
@@ -399,7 +807,9 @@ func (p *peripheral) loop() {
 	for {
 		n, err := p.l2c.Read(buf)
 		if n == 0 || err != nil {
+			p.disconnectErr = p.newDisconnectError()
 			close(p.quitc)
+			close(notec)
 			return
 		}
 
@@ -413,11 +823,15 @@ func (p *peripheral) loop() {
 
 		h := binary.LittleEndian.Uint16(b[1:3])
 		f := p.sub.fn(h)
-		if f == nil {
+		sc := uint32(h) == atomic.LoadUint32(&p.scvh)
+		if sc {
+			p.servicesChanged(b[3:])
+		}
+		if f != nil {
+			notec <- notification{f, b[3:]}
+		} else if !sc {
 			log.Printf("notified by unsubscribed handle")
 			// FIXME: terminate the connection?
-		} else {
-			go f(b[3:], nil)
 		}
 
 		if b[0] == attOpHandleInd {
@@ -429,16 +843,69 @@ func (p *peripheral) loop() {
 }
 
 func (p *peripheral) SetMTU(mtu uint16) error {
+	_, err := p.ExchangeMTU(mtu)
+	return err
+}
+
+func (p *peripheral) ExchangeMTU(requested uint16) (uint16, error) {
+	if requested < attDefaultMTU || requested > attMaxMTU {
+		return p.MTU(), fmt.Errorf("MTU %d out of range [%d, %d]", requested, attDefaultMTU, attMaxMTU)
+	}
+	p.mtumu.Lock()
+	defer p.mtumu.Unlock()
+	// The client may exchange the MTU only once per connection.
+	if p.mtuxchgd {
+		return p.MTU(), nil
+	}
+
 	b := make([]byte, 3)
 	op := byte(attOpMtuReq)
 	b[0] = op
-	binary.LittleEndian.PutUint16(b[1:3], uint16(mtu))
+	binary.LittleEndian.PutUint16(b[1:3], requested)
 
-	b = p.sendReq(op, b)
-	serverMTU := binary.LittleEndian.Uint16(b[1:3])
-	if serverMTU < mtu {
-		mtu = serverMTU
+	b, err := p.sendReq(op, b)
+	if err != nil {
+		return p.MTU(), err
+	}
+	p.mtuxchgd = true
+	switch {
+	case b[0] == attOpError:
+		return attDefaultMTU, attRspError(b)
+	case len(b) != 3:
+		return attDefaultMTU, ErrInvalidLength
+	}
+	mtu := binary.LittleEndian.Uint16(b[1:3])
+	if mtu > requested {
+		mtu = requested
+	}
+	if mtu < attDefaultMTU {
+		mtu = attDefaultMTU
+	}
+	atomic.StoreUint32(&p.mtu, uint32(mtu))
+	return mtu, nil
+}
+
+func (p *peripheral) MTU() uint16 {
+	if mtu := atomic.LoadUint32(&p.mtu); mtu != 0 {
+		return uint16(mtu)
+	}
+	return attDefaultMTU
+}
+
+func (p *peripheral) UpdateConnectionParams(minInterval, maxInterval time.Duration, latency uint16, supervisionTimeout time.Duration) error {
+	u, err := ConnParams{minInterval, maxInterval, latency, supervisionTimeout}.units()
+	if err != nil {
+		return err
+	}
+	return p.d.hci.UpdateConnParams(p.pd, u.linux())
+}
+
+// linux returns u as the linux package takes it.
+func (u connParamUnits) linux() linux.ConnParams {
+	return linux.ConnParams{
+		IntervalMin:        u.intervalMin,
+		IntervalMax:        u.intervalMax,
+		Latency:            u.latency,
+		SupervisionTimeout: u.timeout,
 	}
-	p.mtu = mtu
-	return nil
 }
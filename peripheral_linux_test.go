@@ -0,0 +1,1009 @@
+package gatt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/PayRange/gatt/linux"
+)
+
+// newTestPeripheral returns a peripheral serving its requests over h,
+// stopped at the end of the test.
+func newTestPeripheral(t *testing.T, h *testHandler) *peripheral {
+	p := &peripheral{
+		pd:    &linux.PlatData{Address: testRA},
+		l2c:   h,
+		reqc:  make(chan message, reqQueueLen),
+		quitc: make(chan struct{}),
+		sub:   newSubscriber(),
+	}
+	p.subs = NewSubscribers(p.setNotifyValue)
+	go p.loop()
+	t.Cleanup(func() {
+		select {
+		case h.readc <- nil:
+		case <-p.quitc:
+		}
+	})
+	return p
+}
+
+// expect reads the next PDU written to h, checks that it is want, and
+// answers it with rsp, unless rsp is nil.
+func (h *testHandler) expect(t *testing.T, want, rsp []byte) {
+	t.Helper()
+	select {
+	case got := <-h.writec:
+		if !bytes.Equal(got, want) {
+			t.Fatalf("got request [% X], want [% X]", got, want)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for request [% X]", want)
+	}
+	if rsp != nil {
+		h.readc <- rsp
+	}
+}
+
+func TestExchangeMTU(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		requested uint16
+		rsp       []byte
+		want      uint16
+		err       error
+	}{
+		{"server larger", 185, []byte{attOpMtuRsp, 0x00, 0x02}, 185, nil},
+		{"server smaller", 517, []byte{attOpMtuRsp, 0x9e, 0x00}, 158, nil},
+		{"server below minimum", 185, []byte{attOpMtuRsp, 0x10, 0x00}, 23, nil},
+		{"not supported", 185, []byte{attOpError, attOpMtuReq, 0x00, 0x00, byte(attEcodeReqNotSupp)}, 23, attEcodeReqNotSupp},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &testHandler{readc: make(chan []byte), writec: make(chan []byte)}
+			p := newTestPeripheral(t, h)
+			if mtu := p.MTU(); mtu != 23 {
+				t.Fatalf("MTU before exchange: got %d, want 23", mtu)
+			}
+
+			type result struct {
+				mtu uint16
+				err error
+			}
+			done := make(chan result)
+			go func() {
+				mtu, err := p.ExchangeMTU(tt.requested)
+				done <- result{mtu, err}
+			}()
+			h.expect(t, []byte{attOpMtuReq, byte(tt.requested), byte(tt.requested >> 8)}, tt.rsp)
+			if r := <-done; r.mtu != tt.want || r.err != tt.err {
+				t.Errorf("ExchangeMTU: got %d, %v, want %d, %v", r.mtu, r.err, tt.want, tt.err)
+			}
+			if mtu := p.MTU(); mtu != tt.want {
+				t.Errorf("MTU: got %d, want %d", mtu, tt.want)
+			}
+
+			// A second exchange is not sent.
+			if mtu, err := p.ExchangeMTU(64); mtu != tt.want || err != nil {
+				t.Errorf("second ExchangeMTU: got %d, %v, want %d, nil", mtu, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestExchangeMTURange(t *testing.T) {
+	p := &peripheral{}
+	for _, mtu := range []uint16{0, 22, 518} {
+		if _, err := p.ExchangeMTU(mtu); err == nil {
+			t.Errorf("ExchangeMTU(%d): no error", mtu)
+		}
+	}
+}
+
+func TestWriteCharacteristicMTU(t *testing.T) {
+	h := &testHandler{readc: make(chan []byte), writec: make(chan []byte)}
+	p := newTestPeripheral(t, h)
+	c := &Characteristic{vh: 0x0010}
+
+	if err := p.WriteCharacteristic(c, make([]byte, 21), true); err != ErrValueTooLong {
+		t.Errorf("21 bytes at MTU 23: got %v, want ErrValueTooLong", err)
+	}
+
+	go p.ExchangeMTU(100)
+	h.expect(t, []byte{attOpMtuReq, 100, 0}, []byte{attOpMtuRsp, 100, 0})
+	for p.MTU() != 100 {
+		time.Sleep(time.Millisecond)
+	}
+
+	value := bytes.Repeat([]byte{0xaa}, 97)
+	done := make(chan error)
+	go func() { done <- p.WriteCharacteristic(c, value, false) }()
+	h.expect(t, append([]byte{attOpWriteReq, 0x10, 0x00}, value...), []byte{attOpWriteRsp})
+	if err := <-done; err != nil {
+		t.Errorf("97 bytes at MTU 100: %v", err)
+	}
+	if err := p.WriteCharacteristic(c, append(value, 0), true); err != ErrValueTooLong {
+		t.Errorf("98 bytes without response at MTU 100: got %v, want ErrValueTooLong", err)
+	}
+}
+
+// serveValue answers the read and read blob requests written to h with
+// value, in responses of up to mtu-1 bytes, until the test ends. If
+// notLong, read blob requests fail with Attribute Not Long.
+func serveValue(t *testing.T, h *testHandler, value []byte, mtu int, notLong bool) {
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	go func() {
+		for {
+			var req []byte
+			select {
+			case req = <-h.writec:
+			case <-done:
+				return
+			}
+			var off int
+			switch req[0] {
+			case attOpReadReq:
+			case attOpReadBlobReq:
+				off = int(req[3]) | int(req[4])<<8
+				if notLong {
+					h.readc <- attErrorRsp(req[0], 0x0010, attEcodeAttrNotLong)
+					continue
+				}
+			default:
+				h.readc <- attErrorRsp(req[0], 0x0010, attEcodeReqNotSupp)
+				continue
+			}
+			if off > len(value) {
+				h.readc <- attErrorRsp(req[0], 0x0010, attEcodeInvalidOffset)
+				continue
+			}
+			b := value[off:]
+			if len(b) > mtu-1 {
+				b = b[:mtu-1]
+			}
+			h.readc <- append([]byte{attRspFor[req[0]]}, b...)
+		}
+	}()
+}
+
+func TestReadCharacteristicLong(t *testing.T) {
+	value := make([]byte, 300)
+	for i := range value {
+		value[i] = byte(i)
+	}
+	c := &Characteristic{vh: 0x0010}
+	for _, tt := range []struct {
+		name    string
+		value   []byte
+		mtu     int
+		notLong bool
+	}{
+		{"300 bytes", value, 23, false},
+		{"300 bytes at MTU 185", value, 185, false},
+		{"short", value[:21], 23, false},
+		{"exactly MTU-1", value[:22], 23, false},
+		{"exactly MTU-1, not long", value[:22], 23, true},
+		{"multiple of MTU-1", value[:44], 23, false},
+		{"empty", value[:0], 23, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &testHandler{readc: make(chan []byte), writec: make(chan []byte)}
+			p := newTestPeripheral(t, h)
+			atomic.StoreUint32(&p.mtu, uint32(tt.mtu))
+			serveValue(t, h, tt.value, tt.mtu, tt.notLong)
+
+			for _, read := range []func(*Characteristic) ([]byte, error){p.ReadCharacteristic, p.ReadLongCharacteristic} {
+				b, err := read(c)
+				if err != nil || !bytes.Equal(b, tt.value) {
+					t.Errorf("got %d bytes, %v, want %d bytes", len(b), err, len(tt.value))
+				}
+			}
+		})
+	}
+}
+
+func TestReadCharacteristicError(t *testing.T) {
+	h := &testHandler{readc: make(chan []byte), writec: make(chan []byte)}
+	p := newTestPeripheral(t, h)
+	c := &Characteristic{vh: 0x0010}
+
+	done := make(chan error)
+	go func() {
+		_, err := p.ReadCharacteristic(c)
+		done <- err
+	}()
+	h.expect(t, []byte{attOpReadReq, 0x10, 0x00}, attErrorRsp(attOpReadReq, 0x0010, attEcodeReadNotPerm))
+	if err := <-done; err != attEcodeReadNotPerm {
+		t.Errorf("got %v, want %v", err, attEcodeReadNotPerm)
+	}
+}
+
+// prepWrite returns the prepare write request of b at offset off to the
+// characteristic value handle 0x0010.
+func prepWrite(off int, b []byte) []byte {
+	return append([]byte{attOpPrepWriteReq, 0x10, 0x00, byte(off), byte(off >> 8)}, b...)
+}
+
+// echo returns the prepare write response echoing req.
+func echo(req []byte) []byte {
+	return append([]byte{attOpPrepWriteRsp}, req[1:]...)
+}
+
+func TestWriteCharacteristicLong(t *testing.T) {
+	h := &testHandler{readc: make(chan []byte), writec: make(chan []byte)}
+	p := newTestPeripheral(t, h)
+	c := &Characteristic{vh: 0x0010}
+	value := bytes.Repeat([]byte("0123456789"), 5)
+
+	done := make(chan error)
+	go func() { done <- p.WriteCharacteristic(c, value, false) }()
+	for _, off := range []int{0, 18, 36} {
+		end := off + 18
+		if end > len(value) {
+			end = len(value)
+		}
+		req := prepWrite(off, value[off:end])
+		h.expect(t, req, echo(req))
+	}
+	h.expect(t, []byte{attOpExecWriteReq, 0x01}, []byte{attOpExecWriteRsp})
+	if err := <-done; err != nil {
+		t.Errorf("WriteCharacteristic: %v", err)
+	}
+}
+
+func TestReliableWrite(t *testing.T) {
+	c := &Characteristic{vh: 0x0010}
+	first, second := []byte("first"), []byte("second")
+	queue := func(tx *WriteTx) error {
+		tx.WriteCharacteristic(c, first)
+		tx.WriteCharacteristic(c, second)
+		return nil
+	}
+
+	t.Run("commit", func(t *testing.T) {
+		h := &testHandler{readc: make(chan []byte), writec: make(chan []byte)}
+		p := newTestPeripheral(t, h)
+		done := make(chan error)
+		go func() { done <- p.ReliableWrite(queue) }()
+		h.expect(t, prepWrite(0, first), echo(prepWrite(0, first)))
+		h.expect(t, prepWrite(0, second), echo(prepWrite(0, second)))
+		h.expect(t, []byte{attOpExecWriteReq, 0x01}, []byte{attOpExecWriteRsp})
+		if err := <-done; err != nil {
+			t.Errorf("ReliableWrite: %v", err)
+		}
+	})
+
+	t.Run("altered echo", func(t *testing.T) {
+		h := &testHandler{readc: make(chan []byte), writec: make(chan []byte)}
+		p := newTestPeripheral(t, h)
+		done := make(chan error)
+		go func() { done <- p.ReliableWrite(queue) }()
+		h.expect(t, prepWrite(0, first), echo(prepWrite(0, first)))
+		h.expect(t, prepWrite(0, second), echo(prepWrite(0, []byte("secant"))))
+		h.expect(t, []byte{attOpExecWriteReq, 0x00}, []byte{attOpExecWriteRsp})
+		if err := <-done; err != ErrWriteVerify {
+			t.Errorf("ReliableWrite: got %v, want ErrWriteVerify", err)
+		}
+	})
+
+	t.Run("prepare error", func(t *testing.T) {
+		h := &testHandler{readc: make(chan []byte), writec: make(chan []byte)}
+		p := newTestPeripheral(t, h)
+		done := make(chan error)
+		go func() { done <- p.ReliableWrite(queue) }()
+		h.expect(t, prepWrite(0, first), attErrorRsp(attOpPrepWriteReq, 0x0010, attEcodePrepQueueFull))
+		h.expect(t, []byte{attOpExecWriteReq, 0x00}, []byte{attOpExecWriteRsp})
+		if err := <-done; err != attEcodePrepQueueFull {
+			t.Errorf("ReliableWrite: got %v, want %v", err, attEcodePrepQueueFull)
+		}
+	})
+
+	t.Run("queue error", func(t *testing.T) {
+		h := &testHandler{readc: make(chan []byte), writec: make(chan []byte)}
+		p := newTestPeripheral(t, h)
+		errQueue := errors.New("queue")
+		err := p.ReliableWrite(func(tx *WriteTx) error {
+			tx.WriteCharacteristic(c, first)
+			return errQueue
+		})
+		if err != errQueue {
+			t.Errorf("ReliableWrite: got %v, want %v", err, errQueue)
+		}
+		select {
+		case b := <-h.writec:
+			t.Errorf("sent [% X]", b)
+		default:
+		}
+	})
+
+	t.Run("MTU exchange waits", func(t *testing.T) {
+		h := &testHandler{readc: make(chan []byte), writec: make(chan []byte)}
+		p := newTestPeripheral(t, h)
+		done := make(chan error)
+		go func() { done <- p.ReliableWrite(queue) }()
+		h.expect(t, prepWrite(0, first), nil)
+		go p.ExchangeMTU(100)
+		time.Sleep(10 * time.Millisecond)
+		h.readc <- echo(prepWrite(0, first))
+		h.expect(t, prepWrite(0, second), echo(prepWrite(0, second)))
+		h.expect(t, []byte{attOpExecWriteReq, 0x01}, []byte{attOpExecWriteRsp})
+		if err := <-done; err != nil {
+			t.Errorf("ReliableWrite: %v", err)
+		}
+		h.expect(t, []byte{attOpMtuReq, 100, 0}, []byte{attOpMtuRsp, 100, 0})
+	})
+}
+
+func TestWriteCommandQueue(t *testing.T) {
+	h := &testHandler{readc: make(chan []byte), writec: make(chan []byte)}
+	p := newTestPeripheral(t, h)
+	c := &Characteristic{vh: 0x0010}
+
+	// A request in flight holds up the queue.
+	go p.ReadCharacteristic(c)
+	h.expect(t, []byte{attOpReadReq, 0x10, 0x00}, nil)
+	for i := 0; i < reqQueueLen; i++ {
+		if err := p.WriteCommand(c, []byte{byte(i)}); err != nil {
+			t.Fatalf("WriteCommand %d: %v", i, err)
+		}
+	}
+	ready := p.WritableWithoutResponse()
+	select {
+	case <-ready:
+		t.Fatal("writable with a full queue")
+	default:
+	}
+	if err := p.WriteCommand(c, make([]byte, 21)); err != ErrValueTooLong {
+		t.Errorf("21 bytes at MTU 23: got %v, want ErrValueTooLong", err)
+	}
+
+	h.readc <- []byte{attOpReadRsp}
+	// The writes go out in order, and free the queue.
+	for i := 0; i < reqQueueLen; i++ {
+		h.expect(t, []byte{attOpWriteCmd, 0x10, 0x00, byte(i)}, nil)
+	}
+	select {
+	case <-ready:
+	case <-time.After(time.Second):
+		t.Fatal("not writable with an empty queue")
+	}
+	select {
+	case <-p.WritableWithoutResponse():
+	default:
+		t.Error("WritableWithoutResponse not ready with an empty queue")
+	}
+
+	// Once disconnected, writes fail instead of waiting.
+	h.readc <- nil
+	<-p.quitc
+	<-p.WritableWithoutResponse()
+	if err := p.WriteCommand(c, []byte{0}); !errors.Is(err, io.EOF) {
+		t.Errorf("WriteCommand after the disconnect: got %v, want io.EOF", err)
+	}
+}
+
+func TestSubscribeFanOut(t *testing.T) {
+	h := &testHandler{readc: make(chan []byte), writec: make(chan []byte)}
+	p := newTestPeripheral(t, h)
+	c := &Characteristic{vh: 0x0010}
+	c.cccd = &Descriptor{char: c, h: 0x0011}
+
+	subscribe := func(kind NotifyKind) *Subscription {
+		t.Helper()
+		type result struct {
+			s   *Subscription
+			err error
+		}
+		done := make(chan result)
+		go func() {
+			s, err := p.Subscribe(c, kind)
+			done <- result{s, err}
+		}()
+		select {
+		case r := <-done:
+			return r.s
+		case b := <-h.writec:
+			h.readc <- []byte{attOpWriteRsp}
+			r := <-done
+			if r.err != nil || !bytes.Equal(b, []byte{attOpWriteReq, 0x11, 0x00, byte(kind), 0x00}) {
+				t.Fatalf("Subscribe: wrote [% X], %v", b, r.err)
+			}
+			return r.s
+		}
+	}
+
+	// The second subscription shares the configuration of the first.
+	a := subscribe(Notification)
+	b := subscribe(Notification)
+	h.readc <- []byte{attOpHandleNotify, 0x10, 0x00, 'h', 'i'}
+	for _, s := range []*Subscription{a, b} {
+		select {
+		case v := <-s.C:
+			if string(v) != "hi" {
+				t.Errorf("got %q, want hi", v)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for the notification")
+		}
+	}
+
+	a.Close()
+	done := make(chan error)
+	go func() { done <- b.Close() }()
+	h.expect(t, []byte{attOpWriteReq, 0x11, 0x00, 0x00, 0x00}, []byte{attOpWriteRsp})
+	if err := <-done; err != nil {
+		t.Errorf("Close: %v", err)
+	}
+}
+
+// newServedPeripheral returns a peripheral connected back to back to a
+// server of svcs, and a function returning the PDUs it sent so far.
+func newServedPeripheral(t *testing.T, svcs ...*Service) (*peripheral, func() [][]byte) {
+	srv := &testHandler{readc: make(chan []byte), writec: make(chan []byte)}
+	go newCentral(generateAttributes(svcs, 1), net.HardwareAddr{}, srv).loop()
+
+	h := &testHandler{readc: srv.writec, writec: make(chan []byte)}
+	var mu sync.Mutex
+	var sent [][]byte
+	go func() {
+		for b := range h.writec {
+			mu.Lock()
+			sent = append(sent, b)
+			mu.Unlock()
+			srv.readc <- b
+		}
+	}()
+	return newTestPeripheral(t, h), func() [][]byte {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([][]byte(nil), sent...)
+	}
+}
+
+func TestSubscribeOrder(t *testing.T) {
+	h := &testHandler{readc: make(chan []byte), writec: make(chan []byte)}
+	p := newTestPeripheral(t, h)
+	c := &Characteristic{vh: 0x0010}
+	c.cccd = &Descriptor{char: c, h: 0x0011}
+
+	go func() {
+		<-h.writec
+		h.readc <- []byte{attOpWriteRsp}
+	}()
+	s, err := p.Subscribe(c, Notification)
+	if err != nil {
+		t.Fatalf("Subscribe: %s", err)
+	}
+
+	// More values than C holds, so that some wait for the reader.
+	const n = 200
+	go func() {
+		for i := 0; i < n; i++ {
+			h.readc <- []byte{attOpHandleNotify, 0x10, 0x00, byte(i)}
+		}
+	}()
+	for i := 0; i < n; i++ {
+		select {
+		case v := <-s.C:
+			if len(v) != 1 || v[0] != byte(i) {
+				t.Fatalf("value %d: got [% X]", i, v)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for value %d", i)
+		}
+	}
+}
+
+func TestDescriptorRoundTrip(t *testing.T) {
+	svc := NewService(MustParseUUID("09fc95c0-c111-11e3-9904-0002a5d5c51b"))
+	sc := svc.AddCharacteristic(MustParseUUID("1c927b50-c116-11e3-8a33-0800200c9a66"))
+	sc.HandleNotifyFunc(func(r Request, n Notifier) {})
+	sc.AddDescriptor(UUID16(0x2901)).SetValue([]byte("counter"))
+	var wrote []byte
+	sc.AddDescriptor(MustParseUUID("16fe0d80-c111-11e3-b8c8-0002a5d5c51b")).HandleWriteFunc(
+		func(r Request, data []byte) byte {
+			wrote = data
+			return StatusSuccess
+		})
+
+	p, _ := newServedPeripheral(t, svc)
+
+	ss, err := p.DiscoverServices(nil)
+	if err != nil || len(ss) != 1 {
+		t.Fatalf("DiscoverServices: got %d, %v", len(ss), err)
+	}
+	cs, err := p.DiscoverCharacteristics(nil, ss[0])
+	if err != nil || len(cs) != 1 {
+		t.Fatalf("DiscoverCharacteristics: got %d, %v", len(cs), err)
+	}
+	c := cs[0]
+	ds, err := p.DiscoverDescriptors(nil, c)
+	if err != nil || len(ds) != 3 {
+		t.Fatalf("DiscoverDescriptors: got %d, %v", len(ds), err)
+	}
+	desc, protected, writable := ds[0], ds[1], ds[2]
+	if d, ok := c.ClientConfig(); !ok || d != desc {
+		t.Fatalf("ClientConfig: got %v, %t", d, ok)
+	}
+
+	checkConfig := func(want CCCDValue) {
+		t.Helper()
+		if v, err := ReadClientConfig(p, c); v != want || err != nil {
+			t.Errorf("ReadClientConfig: got %v, %v, want %v", v, err, want)
+		}
+	}
+	checkConfig(0)
+	s, err := p.Subscribe(c, Indication)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkConfig(CCCDIndicate)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	checkConfig(0)
+
+	if b, err := p.ReadDescriptor(protected); string(b) != "counter" || err != nil {
+		t.Errorf("ReadDescriptor: got %q, %v, want counter", b, err)
+	}
+	if err := p.WriteDescriptor(protected, []byte("x")); err != attEcodeWriteNotPerm {
+		t.Errorf("WriteDescriptor to a protected descriptor: got %v, want %v", err, attEcodeWriteNotPerm)
+	}
+	if err := p.WriteDescriptor(writable, []byte("x")); err != nil || string(wrote) != "x" {
+		t.Errorf("WriteDescriptor: got %v, wrote %q", err, wrote)
+	}
+	if _, err := p.ReadDescriptor(writable); err != attEcodeReadNotPerm {
+		t.Errorf("ReadDescriptor of a write-only descriptor: got %v, want %v", err, attEcodeReadNotPerm)
+	}
+}
+
+func TestServiceChanged(t *testing.T) {
+	gattSvc := NewService(attrGATTUUID)
+	notifiers := make(chan Notifier, 1)
+	gattSvc.AddCharacteristic(attrServiceChangedUUID).HandleNotifyFunc(
+		func(r Request, n Notifier) { notifiers <- n })
+	svc := NewService(MustParseUUID("09fc95c0-c111-11e3-9904-0002a5d5c51b"))
+	svc.AddCharacteristic(MustParseUUID("11fac9e0-c111-11e3-9246-0002a5d5c51b")).SetValue([]byte("v1"))
+
+	p, _ := newServedPeripheral(t, gattSvc, svc)
+
+	// Discovering the GATT service subscribes to Service Changed.
+	if ss, err := p.DiscoverServices(nil); err != nil || len(ss) != 2 {
+		t.Fatalf("DiscoverServices: got %d, %v", len(ss), err)
+	}
+	var n Notifier
+	select {
+	case n = <-notifiers:
+	case <-time.After(time.Second):
+		t.Fatal("Service Changed not subscribed to")
+	}
+
+	type change struct{ start, end uint16 }
+	changes := make(chan change, 1)
+	removed := make(chan change, 1)
+	p.OnServicesChanged(func(start, end uint16) { changes <- change{start, end} })
+	remove := p.OnServicesChanged(func(start, end uint16) { removed <- change{start, end} })
+	remove()
+
+	b := make([]byte, 4)
+	binary.LittleEndian.PutUint16(b[0:2], svc.h)
+	binary.LittleEndian.PutUint16(b[2:4], svc.endh)
+	if _, err := n.Write(b); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case c := <-changes:
+		if c.start != svc.h || c.end != svc.endh {
+			t.Errorf("got change [%#04x, %#04x], want [%#04x, %#04x]", c.start, c.end, svc.h, svc.endh)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the change")
+	}
+	select {
+	case <-removed:
+		t.Error("removed function called")
+	default:
+	}
+
+	// The services changed are dropped, until discovered again.
+	if ss := p.Services(); len(ss) != 1 || !ss[0].UUID().Equal(attrGATTUUID) {
+		t.Errorf("Services after the change: got %v", ss)
+	}
+	if ss, err := p.DiscoverServices(nil); err != nil || len(ss) != 2 {
+		t.Errorf("DiscoverServices after the change: got %d, %v", len(ss), err)
+	}
+}
+
+func TestDiscoveryCache(t *testing.T) {
+	hash := bytes.Repeat([]byte{0x01}, 16)
+	notifiers := make(chan Notifier, 1)
+	server := func() []*Service {
+		gattSvc := NewService(attrGATTUUID)
+		gattSvc.AddCharacteristic(attrServiceChangedUUID).HandleNotifyFunc(
+			func(r Request, n Notifier) { notifiers <- n })
+		gattSvc.AddCharacteristic(attrDatabaseHashUUID).SetValue(hash)
+		svc := NewService(MustParseUUID("09fc95c0-c111-11e3-9904-0002a5d5c51b"))
+		svc.AddCharacteristic(MustParseUUID("11fac9e0-c111-11e3-9246-0002a5d5c51b")).SetValue([]byte("v1"))
+		c := svc.AddCharacteristic(MustParseUUID("1c927b50-c116-11e3-8a33-0800200c9a66"))
+		c.HandleNotifyFunc(func(r Request, n Notifier) {})
+		c.AddDescriptor(UUID16(0x2901)).SetValue([]byte("counter"))
+		return []*Service{gattSvc, svc}
+	}
+	cache, err := NewFileDiscoveryCache(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	connect := func() (*peripheral, func() [][]byte) {
+		p, sent := newServedPeripheral(t, server()...)
+		p.pd = &linux.PlatData{Address: [6]byte{1, 2, 3, 4, 5, 6}}
+		p.cache = cache
+		return p, sent
+	}
+	// discover discovers everything, and returns it as a string.
+	discover := func(p *peripheral) string {
+		t.Helper()
+		var b strings.Builder
+		ss, err := p.DiscoverServices(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range ss {
+			fmt.Fprintf(&b, "%s [%d, %d]\n", s.UUID(), s.Handle(), s.EndHandle())
+			cs, err := p.DiscoverCharacteristics(nil, s)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, c := range cs {
+				fmt.Fprintf(&b, "  %s %d %d %v\n", c.UUID(), c.Handle(), c.VHandle(), c.Properties())
+				ds, err := p.DiscoverDescriptors(nil, c)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, d := range ds {
+					fmt.Fprintf(&b, "    %s %d\n", d.UUID(), d.Handle())
+				}
+			}
+		}
+		return b.String()
+	}
+	// discoveries counts the discovery PDUs in sent.
+	discoveries := func(sent [][]byte) int {
+		n := 0
+		for _, b := range sent {
+			switch b[0] {
+			case attOpReadByGroupReq, attOpFindInfoReq:
+				n++
+			case attOpReadByTypeReq:
+				if bytes.Equal(b[5:], attrCharacteristicUUID.b) {
+					n++
+				}
+			}
+		}
+		return n
+	}
+	subscribed := func() Notifier {
+		t.Helper()
+		select {
+		case n := <-notifiers:
+			return n
+		case <-time.After(time.Second):
+			t.Fatal("Service Changed not subscribed to")
+		}
+		return nil
+	}
+
+	p, sent := connect()
+	cold := discover(p)
+	subscribed()
+	if discoveries(sent()) == 0 {
+		t.Fatal("no discovery on the first connection")
+	}
+	if _, ok := cache.Get(p.ID()); !ok {
+		t.Fatal("nothing cached")
+	}
+
+	// A warm reconnect only checks the hash, and subscribes to Service
+	// Changed again.
+	p, sent = connect()
+	if warm := discover(p); warm != cold {
+		t.Errorf("discovered from the cache:\n%s\nwant:\n%s", warm, cold)
+	}
+	n := subscribed()
+	if d := discoveries(sent()); d != 0 {
+		t.Errorf("warm reconnect: %d discovery PDUs", d)
+	}
+
+	// Service Changed drops the entry.
+	changed := make(chan struct{})
+	p.OnServicesChanged(func(start, end uint16) { close(changed) })
+	n.Write([]byte{0x01, 0x00, 0xff, 0xff})
+	select {
+	case <-changed:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for Service Changed")
+	}
+	if _, ok := cache.Get(p.ID()); ok {
+		t.Error("cached after Service Changed")
+	}
+
+	// A hash changed drops the entry too.
+	discover(p)
+	hash = bytes.Repeat([]byte{0x02}, 16)
+	p, sent = connect()
+	discover(p)
+	subscribed()
+	if discoveries(sent()) == 0 {
+		t.Error("no discovery after the hash changed")
+	}
+
+	// So does an Invalid Handle error.
+	p, _ = connect()
+	discover(p)
+	subscribed()
+	if _, err := p.ReadCharacteristic(&Characteristic{vh: 0x0fff}); err != attEcodeInvalidHandle {
+		t.Fatalf("ReadCharacteristic: got %v, want %v", err, attEcodeInvalidHandle)
+	}
+	if _, ok := cache.Get(p.ID()); ok {
+		t.Error("cached after an Invalid Handle error")
+	}
+}
+
+// securedHandler is the link of a peripheral: a testHandler for the ATT
+// channel, with the Security Manager of a responder.
+type securedHandler struct {
+	*testHandler
+	*smpResponder
+}
+
+func (h securedHandler) Close() error {
+	h.smpResponder.mu.Lock()
+	h.smpResponder.closed = true
+	h.smpResponder.mu.Unlock()
+	return h.testHandler.Close()
+}
+
+// newPairingPeripheral returns a peripheral at testRA, over the link to
+// r, on a device set up with LnxPairing(nil, ks).
+func newPairingPeripheral(t *testing.T, r *smpResponder, ks KeyStore) (*peripheral, *testHandler) {
+	h := &testHandler{readc: make(chan []byte), writec: make(chan []byte)}
+	p := &peripheral{
+		d:     &device{pairing: true, keyStore: ks},
+		pd:    &linux.PlatData{Address: testRA, AddressType: 0x01},
+		l2c:   securedHandler{h, r},
+		reqc:  make(chan message, reqQueueLen),
+		quitc: make(chan struct{}),
+		sub:   newSubscriber(),
+	}
+	p.subs = NewSubscribers(p.setNotifyValue)
+	go p.loop()
+	t.Cleanup(func() {
+		select {
+		case h.readc <- nil:
+		case <-p.quitc:
+		}
+	})
+	return p, h
+}
+
+func TestPairOnInsufficientSecurity(t *testing.T) {
+	r := newSMPResponder(IONoInputNoOutput, smpAuthBonding)
+	ks := &MemoryKeyStore{}
+	p, h := newPairingPeripheral(t, r, ks)
+	c := &Characteristic{vh: 0x0003}
+
+	errc := make(chan error, 1)
+	go func() { errc <- p.WriteCharacteristic(c, []byte{0x01}, false) }()
+	req := []byte{attOpWriteReq, 0x03, 0x00, 0x01}
+	h.expect(t, req, []byte{attOpError, attOpWriteReq, 0x03, 0x00, byte(attEcodeAuthentication)})
+	h.expect(t, req, []byte{attOpWriteRsp})
+	if err := <-errc; err != nil {
+		t.Fatalf("WriteCharacteristic: %v", err)
+	}
+	if !r.encryptedWith(r.stk) {
+		t.Error("link not encrypted after pairing")
+	}
+	if k, ok := ks.Get(p.ID()); !ok || k.Key != r.ltk.Key {
+		t.Errorf("key kept: got %+v, %t, want %+v", k, ok, r.ltk)
+	}
+
+	// A read needing more than the link has pairs again.
+	go func() {
+		_, err := p.ReadCharacteristic(c)
+		errc <- err
+	}()
+	req = []byte{attOpReadReq, 0x03, 0x00}
+	h.expect(t, req, []byte{attOpError, attOpReadReq, 0x03, 0x00, byte(attEcodeInsuffEnc)})
+	h.expect(t, req, []byte{attOpReadRsp, 0x2a})
+	if err := <-errc; err != nil {
+		t.Fatalf("ReadCharacteristic: %v", err)
+	}
+
+	// Without LnxPairing, the error is returned.
+	p.d.pairing = false
+	go func() { errc <- p.WriteCharacteristic(c, []byte{0x01}, false) }()
+	h.expect(t, []byte{attOpWriteReq, 0x03, 0x00, 0x01}, []byte{attOpError, attOpWriteReq, 0x03, 0x00, byte(attEcodeAuthentication)})
+	if err := <-errc; err != attEcodeAuthentication {
+		t.Errorf("WriteCharacteristic: got %v, want %v", err, attEcodeAuthentication)
+	}
+}
+
+func TestReencryptBonded(t *testing.T) {
+	r := newSMPResponder(IONoInputNoOutput, smpAuthBonding)
+	ks := &MemoryKeyStore{}
+	p, _ := newPairingPeripheral(t, r, ks)
+	ks.Put(p.ID(), &r.ltk)
+
+	p.reencrypt()
+	if !r.encryptedWith(r.ltk.Key) || r.pdus != 0 {
+		t.Errorf("link not encrypted with the key of the bond, %d SMP PDUs sent", r.pdus)
+	}
+
+	// A peripheral that lost the bond pairs again, for a new key.
+	r = newSMPResponder(IONoInputNoOutput, smpAuthBonding)
+	p, _ = newPairingPeripheral(t, r, ks)
+	p.reencrypt()
+	if p.encrypted {
+		t.Fatal("encrypted with a key the peripheral lost")
+	}
+	if err := p.Pair(); err != nil {
+		t.Fatalf("Pair: %v", err)
+	}
+	if k, _ := ks.Get(p.ID()); k.Key != r.ltk.Key {
+		t.Error("key of the new bond not kept")
+	}
+}
+
+func TestSetSecurityLevel(t *testing.T) {
+	level := func(p *peripheral) SecurityLevel {
+		t.Helper()
+		l, err := p.SecurityLevel()
+		if err != nil {
+			t.Fatalf("SecurityLevel: %v", err)
+		}
+		return l
+	}
+
+	r := newSMPResponder(IODisplayOnly, smpAuthMITM)
+	r.passkey = 246810
+	p, _ := newPairingPeripheral(t, r, nil)
+	if l := level(p); l != SecurityNone {
+		t.Fatalf("got %s before pairing, want none", l)
+	}
+	if err := p.SetSecurityLevel(SecurityEncrypted); err != nil {
+		t.Fatalf("SetSecurityLevel(encrypted): %v", err)
+	}
+	if l := level(p); l != SecurityEncrypted {
+		t.Errorf("got %s after just works, want encrypted", l)
+	}
+
+	// Without passkeys, authentication is out of reach.
+	n := r.pdus
+	err := p.SetSecurityLevel(SecurityAuthenticated)
+	if se, ok := err.(*SecurityError); !ok || se.Required != SecurityAuthenticated || se.Reached != SecurityEncrypted {
+		t.Fatalf("SetSecurityLevel(authenticated) without agent: got %v", err)
+	}
+	if r.pdus != n {
+		t.Error("paired without passkeys")
+	}
+
+	p.d.pairingAgent = &testAgent{io: IOKeyboardOnly, passkey: 246810}
+	if err := p.SetSecurityLevel(SecurityAuthenticated); err != nil {
+		t.Fatalf("SetSecurityLevel(authenticated): %v", err)
+	}
+	if l := level(p); l != SecurityAuthenticated {
+		t.Errorf("got %s after passkey entry, want authenticated", l)
+	}
+	n = r.pdus
+	if err := p.SetSecurityLevel(SecurityEncrypted); err != nil || r.pdus != n || level(p) != SecurityAuthenticated {
+		t.Errorf("SetSecurityLevel below the level: %v, %d PDUs sent", err, r.pdus-n)
+	}
+
+	// A peripheral that cannot authenticate fails pairing.
+	p, _ = newPairingPeripheral(t, newSMPResponder(IONoInputNoOutput, 0), nil)
+	p.d.pairingAgent = &testAgent{io: IOKeyboardDisplay}
+	err = p.SetSecurityLevel(SecurityAuthenticated)
+	if se, ok := err.(*SecurityError); !ok || se.Err != PairingAuthenticationRequirements || se.Reached != SecurityNone {
+		t.Errorf("SetSecurityLevel(authenticated) of a peripheral without IO: got %v", err)
+	}
+}
+
+func TestDefaultSecurityLevel(t *testing.T) {
+	// A bonded peripheral reaches the level with its key.
+	r := newSMPResponder(IONoInputNoOutput, smpAuthBonding)
+	ks := &MemoryKeyStore{}
+	p, _ := newPairingPeripheral(t, r, ks)
+	ks.Put(p.ID(), &r.ltk)
+	p.d.securityLevel = SecurityEncrypted
+	if err := p.connected(); err != nil {
+		t.Fatalf("connected: %v", err)
+	}
+	if !r.encryptedWith(r.ltk.Key) || r.pdus != 0 {
+		t.Error("link not encrypted with the key of the bond")
+	}
+
+	// One that cannot is reported and disconnected.
+	r = newSMPResponder(IONoInputNoOutput, 0)
+	p, _ = newPairingPeripheral(t, r, nil)
+	p.d.securityLevel = SecurityAuthenticated
+	if err := p.connected(); !errors.As(err, new(*SecurityError)) {
+		t.Fatalf("connected: got %v, want a SecurityError", err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.closed {
+		t.Error("not disconnected")
+	}
+}
+
+// reasonHandler is a testHandler telling the reason of the disconnection.
+type reasonHandler struct {
+	*testHandler
+	reason uint8
+}
+
+func (h reasonHandler) DisconnectReason() uint8 { return h.reason }
+
+func TestDisconnectError(t *testing.T) {
+	h := &testHandler{readc: make(chan []byte), writec: make(chan []byte)}
+	p := &peripheral{
+		pd:    &linux.PlatData{Address: testRA},
+		l2c:   reasonHandler{h, 0x08},
+		reqc:  make(chan message, reqQueueLen),
+		quitc: make(chan struct{}),
+		sub:   newSubscriber(),
+	}
+	p.subs = NewSubscribers(p.setNotifyValue)
+	go p.loop()
+	c := &Characteristic{vh: 0x0010}
+	notified := make(chan error, 1)
+	p.sub.subscribe(0x0010, func(b []byte, err error) { notified <- err })
+
+	// A read in flight when the link is lost.
+	done := make(chan error)
+	go func() {
+		_, err := p.ReadCharacteristic(c)
+		done <- err
+	}()
+	h.expect(t, []byte{attOpReadReq, 0x10, 0x00}, nil)
+	h.readc <- nil
+
+	var err error
+	select {
+	case err = <-done:
+	case <-time.After(time.Second):
+		t.Fatal("ReadCharacteristic still blocked after the disconnection")
+	}
+	var de *DisconnectError
+	if !errors.As(err, &de) || de.Reason() != ReasonConnectionTimeout || de.ID != "C0:26:DF:00:10:01" {
+		t.Fatalf("ReadCharacteristic: got %v", err)
+	}
+	if !errors.Is(err, io.EOF) {
+		t.Errorf("%v is not io.EOF", err)
+	}
+	if got := <-notified; got != err {
+		t.Errorf("notification handler: got %v, want %v", got, err)
+	}
+
+	// Later requests fail with the same error.
+	if got := p.WriteCharacteristic(c, []byte{1}, false); got != err {
+		t.Errorf("WriteCharacteristic: got %v, want %v", got, err)
+	}
+	if got := p.WriteCommand(c, []byte{1}); got != err {
+		t.Errorf("WriteCommand: got %v, want %v", got, err)
+	}
+	if _, got := p.SecurityLevel(); got != err {
+		t.Errorf("SecurityLevel: got %v, want %v", got, err)
+	}
+	if _, got := p.Subscribe(c, Notification); got != err {
+		t.Errorf("Subscribe: got %v, want %v", got, err)
+	}
+}
@@ -0,0 +1,243 @@
+package gatt
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// A ReconnectPolicy has a device connect again to the peripherals that
+// disconnected unexpectedly, rather than through Close or
+// CancelConnection. See LnxReconnectPolicy.
+//
+// Each peripheral is reconnected on its own, so that many disconnecting
+// at once do not wait for one another's backoff. The controller makes one
+// connection at a time though: the attempts take turns, each for at most
+// Timeout.
+type ReconnectPolicy struct {
+	// MaxAttempts is how many times to try, 0 for no limit.
+	MaxAttempts int
+
+	// Backoff returns the delay before the attempt n, from 1. If nil, it
+	// is ExponentialBackoff(time.Second, time.Minute).
+	Backoff func(n int) time.Duration
+
+	// Jitter randomizes the delays by up to that fraction of them, more
+	// or less, so that peripherals lost together do not retry together.
+	Jitter float64
+
+	// Timeout is how long an attempt waits for the peripheral, 10s if 0.
+	Timeout time.Duration
+
+	// GiveUp, if not nil, is called with the peripheral and the error of
+	// the last attempt once MaxAttempts failed.
+	GiveUp func(p Peripheral, err error)
+}
+
+// ExponentialBackoff returns a backoff function for ReconnectPolicy
+// waiting base before the first attempt, and twice as long before each of
+// the next ones, up to max.
+func ExponentialBackoff(base, max time.Duration) func(n int) time.Duration {
+	return func(n int) time.Duration {
+		d := base
+		for i := 1; i < n && d < max; i++ {
+			d *= 2
+		}
+		if d > max {
+			d = max
+		}
+		return d
+	}
+}
+
+// errReconnectTimeout is the error of the attempts which timed out.
+var errReconnectTimeout = errors.New("gatt: reconnection timed out")
+
+// delay returns the delay before the attempt n.
+func (rp *ReconnectPolicy) delay(n int) time.Duration {
+	backoff := rp.Backoff
+	if backoff == nil {
+		backoff = ExponentialBackoff(time.Second, time.Minute)
+	}
+	d := backoff(n)
+	if rp.Jitter > 0 {
+		d += time.Duration((2*rand.Float64() - 1) * rp.Jitter * float64(d))
+	}
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+func (rp *ReconnectPolicy) timeout() time.Duration {
+	if rp.Timeout > 0 {
+		return rp.Timeout
+	}
+	return 10 * time.Second
+}
+
+// A reconnector applies a ReconnectPolicy for a device. Its methods do
+// nothing on a nil reconnector.
+type reconnector struct {
+	policy  ReconnectPolicy
+	connect func(p Peripheral) // starts a connection attempt
+	abort   func(p Peripheral) // cancels it, synchronously
+
+	turn chan struct{} // held by the attempt in progress
+
+	mu        sync.Mutex
+	peers     map[string]*reconnection // by ID
+	cancelled map[string]bool          // by CancelConnection, by ID
+}
+
+// A reconnection reconnects a peripheral.
+type reconnection struct {
+	p      Peripheral
+	stop   chan struct{} // closed by CancelConnection
+	result chan error    // of the attempt in progress
+}
+
+func newReconnector(rp ReconnectPolicy, connect, abort func(p Peripheral)) *reconnector {
+	return &reconnector{
+		policy:    rp,
+		connect:   connect,
+		abort:     abort,
+		turn:      make(chan struct{}, 1),
+		peers:     make(map[string]*reconnection),
+		cancelled: make(map[string]bool),
+	}
+}
+
+// disconnected starts reconnecting p, unless err tells that the
+// connection was closed locally, CancelConnection was called for p, or p
+// is already being reconnected.
+func (r *reconnector) disconnected(p Peripheral, err error) {
+	if r == nil {
+		return
+	}
+	var de *DisconnectError
+	if errors.As(err, &de) && de.Reason() == ReasonLocalHostTerminated {
+		return
+	}
+	id := p.ID()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cancelled[id] || r.peers[id] != nil {
+		return
+	}
+	rc := &reconnection{p: p, stop: make(chan struct{}), result: make(chan error, 1)}
+	r.peers[id] = rc
+	go r.run(rc)
+}
+
+// connected reports the result of a connection to p, and whether it was
+// that of a failed attempt of the reconnector, which the
+// PeripheralConnected handler need not hear about.
+func (r *reconnector) connected(p Peripheral, err error) bool {
+	if r == nil {
+		return false
+	}
+	r.mu.Lock()
+	rc := r.peers[p.ID()]
+	r.mu.Unlock()
+	if rc == nil {
+		return false
+	}
+	select {
+	case rc.result <- err:
+	default:
+	}
+	return err != nil
+}
+
+// cancel stops reconnecting p, now and after later disconnections, until
+// resume.
+func (r *reconnector) cancel(p Peripheral) {
+	if r == nil {
+		return
+	}
+	id := p.ID()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cancelled[id] = true
+	if rc := r.peers[id]; rc != nil {
+		close(rc.stop)
+		delete(r.peers, id)
+	}
+}
+
+// resume has p reconnected again after later disconnections, once
+// connected anew.
+func (r *reconnector) resume(p Peripheral) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	delete(r.cancelled, p.ID())
+	r.mu.Unlock()
+}
+
+func (r *reconnector) run(rc *reconnection) {
+	var err error
+	for n := 1; r.policy.MaxAttempts == 0 || n <= r.policy.MaxAttempts; n++ {
+		t := time.NewTimer(r.policy.delay(n))
+		select {
+		case <-t.C:
+		case <-rc.stop:
+			t.Stop()
+			return
+		}
+		if err = r.attempt(rc); err == nil {
+			r.done(rc)
+			return
+		}
+		select {
+		case <-rc.stop:
+			return
+		default:
+		}
+	}
+	if r.done(rc) && r.policy.GiveUp != nil {
+		r.policy.GiveUp(rc.p, err)
+	}
+}
+
+// attempt connects to the peripheral of rc once, waiting its turn.
+func (r *reconnector) attempt(rc *reconnection) error {
+	select {
+	case r.turn <- struct{}{}:
+	case <-rc.stop:
+		return nil
+	}
+	defer func() { <-r.turn }()
+	select {
+	case <-rc.result: // of an attempt aborted
+	default:
+	}
+	r.connect(rc.p)
+	t := time.NewTimer(r.policy.timeout())
+	defer t.Stop()
+	select {
+	case err := <-rc.result:
+		return err
+	case <-t.C:
+		r.abort(rc.p)
+		return errReconnectTimeout
+	case <-rc.stop:
+		r.abort(rc.p)
+		return nil
+	}
+}
+
+// done forgets rc, and reports whether cancel had not already.
+func (r *reconnector) done(rc *reconnection) bool {
+	id := rc.p.ID()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.peers[id] != rc {
+		return false
+	}
+	delete(r.peers, id)
+	return true
+}
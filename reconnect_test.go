@@ -0,0 +1,234 @@
+package gatt
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// idPeripheral is a Peripheral of its own ID.
+type idPeripheral struct {
+	Peripheral
+	id string
+}
+
+func (p idPeripheral) ID() string { return p.id }
+
+// reconnectDevice answers the connection attempts of a reconnector: with
+// the errors of fail for the first ones, then with success, unless mute.
+type reconnectDevice struct {
+	r    *reconnector
+	mute bool
+
+	mu       sync.Mutex
+	fail     map[string][]error
+	attempts map[string]int
+	aborted  map[string]int
+	busy     bool // an attempt is in progress
+	overlap  bool // attempts were made at once
+}
+
+func newReconnectDevice(rp ReconnectPolicy) *reconnectDevice {
+	d := &reconnectDevice{fail: map[string][]error{}, attempts: map[string]int{}, aborted: map[string]int{}}
+	d.r = newReconnector(rp, d.connect, d.abort)
+	return d
+}
+
+func (d *reconnectDevice) connect(p Peripheral) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.attempts[p.ID()]++
+	d.overlap = d.overlap || d.busy
+	d.busy = true
+	if d.mute {
+		return
+	}
+	var err error
+	if errs := d.fail[p.ID()]; len(errs) > 0 {
+		err, d.fail[p.ID()] = errs[0], errs[1:]
+	}
+	go func() {
+		d.mu.Lock()
+		d.busy = false
+		d.mu.Unlock()
+		d.r.connected(p, err)
+	}()
+}
+
+func (d *reconnectDevice) abort(p Peripheral) {
+	d.mu.Lock()
+	d.aborted[p.ID()]++
+	d.busy = false
+	d.mu.Unlock()
+}
+
+func (d *reconnectDevice) counts(id string) (attempts, aborted int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.attempts[id], d.aborted[id]
+}
+
+// waitIdle waits for the reconnector to be done with all peripherals.
+func (d *reconnectDevice) waitIdle(t *testing.T) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		d.r.mu.Lock()
+		n := len(d.r.peers)
+		d.r.mu.Unlock()
+		if n == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d peripherals still reconnecting", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func lostLink(id string) error {
+	return &DisconnectError{ID: id, reason: ReasonConnectionTimeout}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	b := ExponentialBackoff(100*time.Millisecond, time.Second)
+	for n, want := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		if got := b(n + 1); got != want*time.Millisecond {
+			t.Errorf("attempt %d: got %s, want %s", n+1, got, want*time.Millisecond)
+		}
+	}
+	rp := &ReconnectPolicy{Backoff: b, Jitter: 0.5}
+	for i := 0; i < 100; i++ {
+		if d := rp.delay(2); d < 100*time.Millisecond || d > 300*time.Millisecond {
+			t.Fatalf("delay with jitter: got %s", d)
+		}
+	}
+}
+
+func TestReconnect(t *testing.T) {
+	errFailed := errors.New("LE connection failed with status 0x3E")
+	var gaveUp []error
+	var mu sync.Mutex
+	d := newReconnectDevice(ReconnectPolicy{
+		MaxAttempts: 3,
+		Backoff:     func(int) time.Duration { return time.Millisecond },
+		GiveUp: func(p Peripheral, err error) {
+			mu.Lock()
+			gaveUp = append(gaveUp, fmt.Errorf("%s: %w", p.ID(), err))
+			mu.Unlock()
+		},
+	})
+	back := idPeripheral{id: "back"}
+	gone := idPeripheral{id: "gone"}
+	d.fail["back"] = []error{errFailed}
+	d.fail["gone"] = []error{errFailed, errFailed, errFailed}
+
+	d.r.disconnected(back, lostLink("back"))
+	d.r.disconnected(gone, lostLink("gone"))
+	d.r.disconnected(gone, lostLink("gone")) // already reconnecting
+	d.waitIdle(t)
+
+	if n, _ := d.counts("back"); n != 2 {
+		t.Errorf("reconnected after %d attempts, want 2", n)
+	}
+	if n, _ := d.counts("gone"); n != 3 {
+		t.Errorf("gave up after %d attempts, want 3", n)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(gaveUp) != 1 || !errors.Is(gaveUp[0], errFailed) || gaveUp[0].Error() != "gone: "+errFailed.Error() {
+		t.Errorf("gave up: %v", gaveUp)
+	}
+}
+
+func TestReconnectDisabled(t *testing.T) {
+	d := newReconnectDevice(ReconnectPolicy{Backoff: func(int) time.Duration { return 20 * time.Millisecond }})
+
+	// Closed locally.
+	closed := idPeripheral{id: "closed"}
+	d.r.disconnected(closed, &DisconnectError{ID: "closed", reason: ReasonLocalHostTerminated})
+
+	// CancelConnection while waiting to reconnect, then after the next
+	// disconnection.
+	cancelled := idPeripheral{id: "cancelled"}
+	d.r.disconnected(cancelled, lostLink("cancelled"))
+	d.r.cancel(cancelled)
+	d.r.disconnected(cancelled, lostLink("cancelled"))
+	time.Sleep(50 * time.Millisecond)
+	d.waitIdle(t)
+	for _, id := range []string{"closed", "cancelled"} {
+		if n, _ := d.counts(id); n != 0 {
+			t.Errorf("%s: %d attempts", id, n)
+		}
+	}
+
+	// Connect enables reconnection again.
+	d.r.resume(cancelled)
+	d.r.disconnected(cancelled, lostLink("cancelled"))
+	d.waitIdle(t)
+	if n, _ := d.counts("cancelled"); n != 1 {
+		t.Errorf("cancelled then connected: %d attempts, want 1", n)
+	}
+}
+
+func TestReconnectTimeout(t *testing.T) {
+	d := newReconnectDevice(ReconnectPolicy{
+		MaxAttempts: 2,
+		Backoff:     func(int) time.Duration { return time.Millisecond },
+		Timeout:     10 * time.Millisecond,
+	})
+	d.mute = true
+	gaveUp := make(chan error, 1)
+	d.r.policy.GiveUp = func(p Peripheral, err error) { gaveUp <- err }
+	p := idPeripheral{id: "away"}
+	d.r.disconnected(p, lostLink("away"))
+	select {
+	case err := <-gaveUp:
+		if err != errReconnectTimeout {
+			t.Errorf("gave up with %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("did not give up")
+	}
+	if attempts, aborted := d.counts("away"); attempts != 2 || aborted != 2 {
+		t.Errorf("%d attempts, %d aborted, want 2 and 2", attempts, aborted)
+	}
+
+	// CancelConnection aborts the attempt in progress.
+	d.r.policy.Timeout = time.Minute
+	d.r.disconnected(p, lostLink("away"))
+	for n, _ := d.counts("away"); n != 3; n, _ = d.counts("away") {
+		time.Sleep(time.Millisecond)
+	}
+	d.r.cancel(p)
+	d.waitIdle(t)
+	for _, aborted := d.counts("away"); aborted != 3; _, aborted = d.counts("away") {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestReconnectStorm(t *testing.T) {
+	const n = 20
+	backoff := 50 * time.Millisecond
+	d := newReconnectDevice(ReconnectPolicy{Backoff: func(int) time.Duration { return backoff }})
+	start := time.Now()
+	for i := 0; i < n; i++ {
+		id := fmt.Sprintf("kiosk-%d", i)
+		d.r.disconnected(idPeripheral{id: id}, lostLink(id))
+	}
+	d.waitIdle(t)
+	// The backoffs run at once, rather than one after another.
+	if elapsed := time.Since(start); elapsed > n*backoff/2 {
+		t.Errorf("%d peripherals reconnected in %s", n, elapsed)
+	}
+	for i := 0; i < n; i++ {
+		if got, _ := d.counts(fmt.Sprintf("kiosk-%d", i)); got != 1 {
+			t.Errorf("kiosk-%d: %d attempts", i, got)
+		}
+	}
+	if d.overlap {
+		t.Error("connection attempts overlapped")
+	}
+}
@@ -0,0 +1,41 @@
+package gatt
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// MonitorRSSI reads the RSSI of the connected peripheral p every interval
+// and calls f with it, until stop is called or p disconnects. Other read
+// errors skip the reading. stop does not wait for a call of f in progress.
+func MonitorRSSI(p Peripheral, interval time.Duration, f func(rssi int)) (stop func()) {
+	quit := make(chan struct{})
+	var once sync.Once
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+			case <-quit:
+				return
+			}
+			rssi, err := p.ReadRSSI()
+			if errors.Is(err, io.EOF) {
+				return
+			}
+			if err != nil {
+				continue
+			}
+			select {
+			case <-quit:
+				return
+			default:
+				f(rssi)
+			}
+		}
+	}()
+	return func() { once.Do(func() { close(quit) }) }
+}
@@ -0,0 +1,65 @@
+package gatt
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// rssiPeripheral reports the readings in order, then io.EOF, closing
+// disconnected.
+type rssiPeripheral struct {
+	Peripheral
+	readings     []int
+	errs         []error
+	disconnected chan struct{}
+}
+
+func (p *rssiPeripheral) ReadRSSI() (int, error) {
+	if len(p.readings) == 0 {
+		close(p.disconnected)
+		return 0, io.EOF
+	}
+	rssi, err := p.readings[0], p.errs[0]
+	p.readings, p.errs = p.readings[1:], p.errs[1:]
+	return rssi, err
+}
+
+func TestMonitorRSSI(t *testing.T) {
+	p := &rssiPeripheral{
+		readings:     []int{-40, 0, -55},
+		errs:         []error{nil, errors.New("RSSI not available"), nil},
+		disconnected: make(chan struct{}),
+	}
+	var got []int
+	stop := MonitorRSSI(p, time.Millisecond, func(rssi int) { got = append(got, rssi) })
+	defer stop()
+
+	select {
+	case <-p.disconnected:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for the disconnect")
+	}
+	if len(got) != 2 || got[0] != -40 || got[1] != -55 {
+		t.Errorf("got readings %v, want [-40 -55]", got)
+	}
+}
+
+func TestMonitorRSSIStop(t *testing.T) {
+	p := &brspPeripheral{}
+	calls := make(chan int, 100)
+	stop := MonitorRSSI(p, time.Millisecond, func(rssi int) { calls <- rssi })
+	time.Sleep(10 * time.Millisecond)
+	stop()
+	stop()
+	time.Sleep(5 * time.Millisecond)
+	n := len(calls)
+	if n == 0 {
+		t.Fatal("no readings before stop")
+	}
+	time.Sleep(10 * time.Millisecond)
+	if len(calls) != n {
+		t.Errorf("got %d readings after stop", len(calls)-n)
+	}
+}
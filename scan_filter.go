@@ -0,0 +1,95 @@
+package gatt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+)
+
+// A ScanFilter selects the advertisements reported while scanning, see
+// Device.SetScanFilter. Any func(*Advertisement) bool can serve as one;
+// the functions below build the common ones.
+type ScanFilter func(a *Advertisement) bool
+
+// MatchManufacturerData returns a ScanFilter accepting advertisements
+// whose manufacturer specific data has the given company ID, followed by
+// prefix.
+func MatchManufacturerData(companyID uint16, prefix []byte) ScanFilter {
+	return func(a *Advertisement) bool {
+		d := a.ManufacturerData
+		return len(d) >= 2 && binary.LittleEndian.Uint16(d) == companyID && bytes.HasPrefix(d[2:], prefix)
+	}
+}
+
+// MatchService returns a ScanFilter accepting advertisements listing any
+// of the service UUIDs in ss.
+func MatchService(ss ...UUID) ScanFilter {
+	return func(a *Advertisement) bool {
+		for _, u := range a.Services {
+			for _, s := range ss {
+				if u.Equal(s) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+}
+
+// MatchServiceData returns a ScanFilter accepting advertisements with
+// service data for u that starts with prefix.
+func MatchServiceData(u UUID, prefix []byte) ScanFilter {
+	return func(a *Advertisement) bool {
+		for _, sd := range a.ServiceData {
+			if sd.UUID.Equal(u) && bytes.HasPrefix(sd.Data, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// MatchNamePrefix returns a ScanFilter accepting advertisements whose
+// local name starts with prefix.
+func MatchNamePrefix(prefix string) ScanFilter {
+	return func(a *Advertisement) bool {
+		return strings.HasPrefix(a.LocalName, prefix)
+	}
+}
+
+// MatchAny returns a ScanFilter accepting the advertisements that any of
+// fs accepts. With no filters it accepts nothing.
+func MatchAny(fs ...ScanFilter) ScanFilter {
+	return func(a *Advertisement) bool {
+		for _, f := range fs {
+			if f(a) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// MatchAll returns a ScanFilter accepting the advertisements that all of
+// fs accept. With no filters it accepts everything.
+func MatchAll(fs ...ScanFilter) ScanFilter {
+	return func(a *Advertisement) bool {
+		for _, f := range fs {
+			if !f(a) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// SetScanFilter makes d drop the advertisements f does not accept before
+// they reach the PeripheralDiscovered, PeripheralDiscoveredRaw and
+// BlukeyDiscovered handlers. A nil f reports all advertisements again.
+//
+// The controller cannot filter on advertising data, so on Linux the
+// advertisements are still received, but dropped before the handlers
+// parse them further.
+func (d *device) SetScanFilter(f ScanFilter) {
+	d.scanFilter = f
+}
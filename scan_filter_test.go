@@ -0,0 +1,50 @@
+package gatt
+
+import "testing"
+
+func TestScanFilters(t *testing.T) {
+	parse := func(b []byte) *Advertisement {
+		a := &Advertisement{}
+		a.unmarshall(b)
+		return a
+	}
+	payrange := parse([]byte{
+		0x03, typeCompleteName, 'P', 'R',
+		0x06, typeManufacturerData, 0xc9, 0x02, 0x00, 0x78, 0x56,
+	})
+	beacon := parse([]byte{
+		0x02, typeFlags, 0x06,
+		0x05, typeShortName, 'b', 'e', 'a', 'c',
+		0x03, typeAllUUID16, 0x0f, 0x18,
+		0x05, typeServiceData16, 0x0f, 0x18, 0x64, 0x01,
+	})
+	empty := parse(nil)
+
+	battery := UUID16(0x180f)
+	for _, tt := range []struct {
+		name string
+		f    ScanFilter
+		want [3]bool // payrange, beacon, empty
+	}{
+		{"manufacturer", MatchManufacturerData(0x02c9, nil), [3]bool{true, false, false}},
+		{"manufacturer prefix", MatchManufacturerData(0x02c9, []byte{0x00, 0x78}), [3]bool{true, false, false}},
+		{"other manufacturer prefix", MatchManufacturerData(0x02c9, []byte{0x01}), [3]bool{false, false, false}},
+		{"service", MatchService(UUID16(0x1800), battery), [3]bool{false, true, false}},
+		{"no services", MatchService(), [3]bool{false, false, false}},
+		{"service data", MatchServiceData(battery, []byte{0x64}), [3]bool{false, true, false}},
+		{"other service data", MatchServiceData(battery, []byte{0x32}), [3]bool{false, false, false}},
+		{"name prefix", MatchNamePrefix("PR"), [3]bool{true, false, false}},
+		{"empty name prefix", MatchNamePrefix(""), [3]bool{true, true, true}},
+		{"any", MatchAny(MatchNamePrefix("PR"), MatchService(battery)), [3]bool{true, true, false}},
+		{"any of none", MatchAny(), [3]bool{false, false, false}},
+		{"all", MatchAll(MatchNamePrefix("PR"), MatchManufacturerData(0x02c9, nil)), [3]bool{true, false, false}},
+		{"all of none", MatchAll(), [3]bool{true, true, true}},
+		{"custom", func(a *Advertisement) bool { return len(a.ServiceData) > 0 }, [3]bool{false, true, false}},
+	} {
+		for i, a := range []*Advertisement{payrange, beacon, empty} {
+			if got := tt.f(a); got != tt.want[i] {
+				t.Errorf("%s: got %t for %+v", tt.name, got, a)
+			}
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package gatt
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+// servicesChanged holds the functions registered with
+// Peripheral.OnServicesChanged. The zero value is ready to use.
+type servicesChanged struct {
+	mu   sync.Mutex
+	fs   map[int]func(start, end uint16)
+	next int
+}
+
+// add registers f, and returns the function unregistering it.
+func (sc *servicesChanged) add(f func(start, end uint16)) (remove func()) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sc.fs == nil {
+		sc.fs = make(map[int]func(start, end uint16))
+	}
+	id := sc.next
+	sc.next++
+	sc.fs[id] = f
+	return func() {
+		sc.mu.Lock()
+		delete(sc.fs, id)
+		sc.mu.Unlock()
+	}
+}
+
+// call calls the functions registered with the range changed.
+func (sc *servicesChanged) call(start, end uint16) {
+	sc.mu.Lock()
+	fs := make([]func(start, end uint16), 0, len(sc.fs))
+	for _, f := range sc.fs {
+		fs = append(fs, f)
+	}
+	sc.mu.Unlock()
+	for _, f := range fs {
+		f(start, end)
+	}
+}
+
+// parseServiceChanged parses b, a value of the Service Changed
+// characteristic, into the range of handles affected.
+func parseServiceChanged(b []byte) (start, end uint16, ok bool) {
+	if len(b) != 4 {
+		return 0, 0, false
+	}
+	return binary.LittleEndian.Uint16(b[0:2]), binary.LittleEndian.Uint16(b[2:4]), true
+}
+
+// dropServices returns svcs without the services overlapping the handles
+// from start to end.
+func dropServices(svcs []*Service, start, end uint16) []*Service {
+	var kept []*Service
+	for _, s := range svcs {
+		if s.h > end || s.endh < start {
+			kept = append(kept, s)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,340 @@
+package gatt
+
+import (
+	"crypto/aes"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// Security Manager Protocol PDUs
+const (
+	smpPairingRequest          = 0x01
+	smpPairingResponse         = 0x02
+	smpPairingConfirm          = 0x03
+	smpPairingRandom           = 0x04
+	smpPairingFailed           = 0x05
+	smpEncryptionInformation   = 0x06
+	smpMasterIdentification    = 0x07
+	smpIdentityInformation     = 0x08
+	smpIdentityAddrInformation = 0x09
+	smpSigningInformation      = 0x0a
+	smpSecurityRequest         = 0x0b
+)
+
+// smpLen is the length of the PDUs the initiator receives.
+var smpLen = map[byte]int{
+	smpPairingResponse:       7,
+	smpPairingConfirm:        17,
+	smpPairingRandom:         17,
+	smpPairingFailed:         2,
+	smpEncryptionInformation: 17,
+	smpMasterIdentification:  11,
+}
+
+// AuthReq flags, and key distribution flags.
+const (
+	smpAuthBonding = 0x01
+	smpAuthMITM    = 0x04
+
+	smpDistEncKey = 0x01
+)
+
+// smpTimeout is how long pairing waits for the next PDU of the peer.
+const smpTimeout = 30 * time.Second
+
+// smpLink is the link of a connection as pairing needs it: the Security
+// Manager channel, and the encryption of the link. On Linux, the
+// connections of the HCI layer implement it.
+type smpLink interface {
+	// WriteSMP sends a Security Manager PDU.
+	WriteSMP(b []byte) error
+
+	// SMP returns the channel of the Security Manager PDUs received,
+	// closed on disconnection.
+	SMP() <-chan []byte
+
+	// StartEncryption encrypts the link with ltk, identified by ediv and
+	// rand, and waits until it is.
+	StartEncryption(ediv uint16, rand uint64, ltk [16]byte) error
+
+	// Addresses returns the addresses of the initiator and responder,
+	// most significant octet first, with their types.
+	Addresses() (ia, ra [6]byte, iat, rat uint8)
+}
+
+// smpPairing is LE legacy pairing with a peripheral, as initiator.
+type smpPairing struct {
+	link    smpLink
+	p       Peripheral   // for the agent
+	agent   PairingAgent // nil for just works
+	bond    bool         // ask the peripheral for a long term key
+	mitm    bool         // fail unless pairing can be authenticated
+	timeout time.Duration
+}
+
+// run pairs, and leaves the link encrypted. It returns the long term key
+// the peripheral distributed, nil if none, and whether pairing was
+// authenticated.
+func (s *smpPairing) run() (*LongTermKey, bool, error) {
+	ioc := IONoInputNoOutput
+	if s.agent != nil {
+		ioc = s.agent.IOCapability()
+	}
+	var auth, dist byte
+	if s.bond {
+		auth |= smpAuthBonding
+		dist |= smpDistEncKey
+	}
+	if ioc != IONoInputNoOutput {
+		auth |= smpAuthMITM
+	}
+	preq := [7]byte{smpPairingRequest, byte(ioc), 0x00, auth, 16, 0x00, dist}
+	s.drain()
+	if err := s.link.WriteSMP(preq[:]); err != nil {
+		return nil, false, err
+	}
+	b, err := s.recv(smpPairingResponse)
+	if err != nil {
+		return nil, false, err
+	}
+	var pres [7]byte
+	copy(pres[:], b)
+	size := int(pres[4])
+	if size < 7 || size > 16 {
+		return nil, false, s.fail(PairingEncryptionKeySize)
+	}
+
+	// The temporary key is zero for just works, the passkey otherwise.
+	method := justWorks
+	if (auth|pres[3])&smpAuthMITM != 0 {
+		method = pairingMethod(ioc, IOCapability(pres[1]))
+	}
+	if s.mitm && method == justWorks {
+		return nil, false, s.fail(PairingAuthenticationRequirements)
+	}
+	authenticated := method != justWorks
+	var tk [16]byte
+	switch method {
+	case passkeyDisplay:
+		pk, err := newPasskey()
+		if err != nil {
+			return nil, false, err
+		}
+		s.agent.DisplayPasskey(s.p, pk)
+		binary.LittleEndian.PutUint32(tk[:], pk)
+	case passkeyInput:
+		pk, err := s.agent.RequestPasskey(s.p)
+		if err != nil || pk > 999999 {
+			s.fail(PairingPasskeyEntryFailed)
+			if err == nil {
+				err = PairingPasskeyEntryFailed
+			}
+			return nil, false, err
+		}
+		binary.LittleEndian.PutUint32(tk[:], pk)
+	}
+
+	ia, ra, iat, rat := s.link.Addresses()
+	var mrand [16]byte
+	if _, err := rand.Read(mrand[:]); err != nil {
+		return nil, false, err
+	}
+	mconfirm := smpC1(tk, mrand, preq, pres, iat, rat, ia, ra)
+	if err := s.send(smpPairingConfirm, mconfirm[:]); err != nil {
+		return nil, false, err
+	}
+	if b, err = s.recv(smpPairingConfirm); err != nil {
+		return nil, false, err
+	}
+	var sconfirm, srand [16]byte
+	copy(sconfirm[:], b[1:])
+	if err := s.send(smpPairingRandom, mrand[:]); err != nil {
+		return nil, false, err
+	}
+	if b, err = s.recv(smpPairingRandom); err != nil {
+		return nil, false, err
+	}
+	copy(srand[:], b[1:])
+	if smpC1(tk, srand, preq, pres, iat, rat, ia, ra) != sconfirm {
+		return nil, false, s.fail(PairingConfirmValueFailed)
+	}
+
+	stk := smpS1(tk, srand, mrand)
+	for i := size; i < len(stk); i++ {
+		stk[i] = 0
+	}
+	if err := s.link.StartEncryption(0, 0, stk); err != nil {
+		return nil, false, err
+	}
+	if pres[6]&smpDistEncKey == 0 {
+		return nil, authenticated, nil
+	}
+
+	// The peripheral distributes its keys once the link is encrypted.
+	k := &LongTermKey{Size: size, Authenticated: authenticated}
+	if b, err = s.recv(smpEncryptionInformation); err != nil {
+		return nil, false, err
+	}
+	copy(k.Key[:], b[1:])
+	if b, err = s.recv(smpMasterIdentification); err != nil {
+		return nil, false, err
+	}
+	k.EDIV = binary.LittleEndian.Uint16(b[1:3])
+	k.Rand = binary.LittleEndian.Uint64(b[3:11])
+	return k, authenticated, nil
+}
+
+// send sends the PDU of code with the value b.
+func (s *smpPairing) send(code byte, b []byte) error {
+	return s.link.WriteSMP(append([]byte{code}, b...))
+}
+
+// fail sends Pairing Failed for the reason e, and returns e.
+func (s *smpPairing) fail(e PairingError) error {
+	s.link.WriteSMP([]byte{smpPairingFailed, byte(e)})
+	return e
+}
+
+// drain discards the PDUs received since the last pairing, such as the
+// late answers of one that failed, which would be taken for answers to
+// this one.
+func (s *smpPairing) drain() {
+	for {
+		select {
+		case _, ok := <-s.link.SMP():
+			if !ok {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+// recv returns the next PDU of the peripheral, which must be of code.
+// Security requests are skipped, as pairing is what they ask for.
+func (s *smpPairing) recv(code byte) ([]byte, error) {
+	t := time.NewTimer(s.timeout)
+	defer t.Stop()
+	for {
+		var b []byte
+		var ok bool
+		select {
+		case b, ok = <-s.link.SMP():
+			if !ok {
+				return nil, io.EOF
+			}
+		case <-t.C:
+			return nil, ErrPairingTimeout
+		}
+		switch {
+		case len(b) == 0 || b[0] == smpSecurityRequest:
+			continue
+		case b[0] == smpPairingFailed && len(b) == smpLen[smpPairingFailed]:
+			return nil, PairingError(b[1])
+		case b[0] != code:
+			return nil, s.fail(PairingUnspecifiedReason)
+		case len(b) != smpLen[code]:
+			return nil, s.fail(PairingInvalidParameters)
+		}
+		return b, nil
+	}
+}
+
+// A pairing method of LE legacy pairing, as the initiator sees it.
+type smpMethod int
+
+const (
+	justWorks      smpMethod = iota
+	passkeyDisplay           // the initiator shows the passkey
+	passkeyInput             // the user enters the passkey on the initiator
+)
+
+// pairingMethod returns the method of pairing with MITM protection for an
+// initiator with the IO capability i and a responder with r.
+func pairingMethod(i, r IOCapability) smpMethod {
+	if i > IOKeyboardDisplay || r > IOKeyboardDisplay || i == IONoInputNoOutput || r == IONoInputNoOutput {
+		return justWorks
+	}
+	rKeyboard := r == IOKeyboardOnly || r == IOKeyboardDisplay
+	switch i {
+	case IODisplayOnly, IODisplayYesNo:
+		if rKeyboard {
+			return passkeyDisplay
+		}
+		return justWorks
+	case IOKeyboardOnly:
+		return passkeyInput
+	default: // IOKeyboardDisplay
+		if rKeyboard {
+			return passkeyDisplay
+		}
+		return passkeyInput
+	}
+}
+
+// newPasskey returns a random passkey, from 0 to 999999.
+func newPasskey() (uint32, error) {
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint32(b[:]) % 1000000, nil
+}
+
+// smpE is the security function e, AES-128 of b with the key k. As the
+// values of the protocol, the key, b and the result are least significant
+// octet first.
+func smpE(k, b [16]byte) [16]byte {
+	k, b = reverse16(k), reverse16(b)
+	c, err := aes.NewCipher(k[:])
+	if err != nil {
+		panic(err) // the key is 16 bytes long
+	}
+	c.Encrypt(b[:], b[:])
+	return reverse16(b)
+}
+
+// smpC1 is the confirm value generation function c1 of LE legacy pairing,
+// for the random value r. The pairing request and response are as sent.
+func smpC1(k, r [16]byte, preq, pres [7]byte, iat, rat uint8, ia, ra [6]byte) [16]byte {
+	// p1 = pres || preq || rat || iat, and p2 = padding || ia || ra,
+	// least significant octet first.
+	var p1, p2 [16]byte
+	p1[0], p1[1] = iat&0x01, rat&0x01
+	copy(p1[2:9], preq[:])
+	copy(p1[9:16], pres[:])
+	for i := 0; i < 6; i++ {
+		p2[i] = ra[5-i]
+		p2[6+i] = ia[5-i]
+	}
+	b := smpE(k, xor16(r, p1))
+	return smpE(k, xor16(b, p2))
+}
+
+// smpS1 is the key generation function s1 of LE legacy pairing, giving
+// the short term key from the random values of the responder, r1, and of
+// the initiator, r2.
+func smpS1(k, r1, r2 [16]byte) [16]byte {
+	// The 64 least significant bits of each, r1 first.
+	var r [16]byte
+	copy(r[:8], r2[:8])
+	copy(r[8:], r1[:8])
+	return smpE(k, r)
+}
+
+func reverse16(b [16]byte) [16]byte {
+	for i := 0; i < 8; i++ {
+		b[i], b[15-i] = b[15-i], b[i]
+	}
+	return b
+}
+
+func xor16(a, b [16]byte) [16]byte {
+	for i := range a {
+		a[i] ^= b[i]
+	}
+	return a
+}
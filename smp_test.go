@@ -0,0 +1,291 @@
+package gatt
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lsb parses s, hex most significant octet first as the specification
+// writes values, into bytes least significant octet first.
+func lsb(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return b
+}
+
+func TestSMPFunctions(t *testing.T) {
+	// The sample data of the specification.
+	var k, r, r1, r2 [16]byte
+	var preq, pres [7]byte
+	copy(r[:], lsb(t, "5783D52156AD6F0E6388274EC6702EE0"))
+	copy(preq[:], lsb(t, "07071000000101"))
+	copy(pres[:], lsb(t, "05000800000302"))
+	ia := [6]byte{0xA1, 0xA2, 0xA3, 0xA4, 0xA5, 0xA6}
+	ra := [6]byte{0xB1, 0xB2, 0xB3, 0xB4, 0xB5, 0xB6}
+	got := smpC1(k, r, preq, pres, 0x01, 0x00, ia, ra)
+	if want := lsb(t, "1e1e3fef878988ead2a74dc5bef13b86"); string(got[:]) != string(want) {
+		t.Errorf("c1: got % X, want % X", got, want)
+	}
+
+	copy(r1[:], lsb(t, "000F0E0D0C0B0A091122334455667788"))
+	copy(r2[:], lsb(t, "010203040506070899AABBCCDDEEFF00"))
+	got = smpS1(k, r1, r2)
+	if want := lsb(t, "9a1fe1f0e8b0f49b5b4216ae796da062"); string(got[:]) != string(want) {
+		t.Errorf("s1: got % X, want % X", got, want)
+	}
+}
+
+func TestPairingMethod(t *testing.T) {
+	for _, tt := range []struct {
+		i, r IOCapability
+		want smpMethod
+	}{
+		{IONoInputNoOutput, IOKeyboardDisplay, justWorks},
+		{IOKeyboardDisplay, IONoInputNoOutput, justWorks},
+		{IODisplayOnly, IODisplayYesNo, justWorks},
+		{IODisplayYesNo, IOKeyboardOnly, passkeyDisplay},
+		{IOKeyboardOnly, IOKeyboardOnly, passkeyInput},
+		{IOKeyboardOnly, IODisplayOnly, passkeyInput},
+		{IOKeyboardDisplay, IODisplayYesNo, passkeyInput},
+		{IOKeyboardDisplay, IOKeyboardDisplay, passkeyDisplay},
+	} {
+		if got := pairingMethod(tt.i, tt.r); got != tt.want {
+			t.Errorf("pairingMethod(%d, %d): got %d, want %d", tt.i, tt.r, got, tt.want)
+		}
+	}
+}
+
+// smpResponder is the Security Manager of a peripheral, scripted for
+// tests: it is the smpLink of the initiator under test, and answers as an
+// LE legacy pairing responder.
+type smpResponder struct {
+	io      IOCapability
+	auth    byte         // AuthReq of the Pairing Response
+	dist    byte         // keys distributed, of those asked for
+	passkey uint32       // entered or shown by the user of the peripheral
+	reject  PairingError // if set, the answer to Pairing Requests
+	mute    bool         // never answers
+	ltk     LongTermKey  // distributed, then accepted for encryption
+
+	rxc chan []byte
+
+	mu        sync.Mutex
+	preq      [7]byte
+	pres      [7]byte
+	tk        [16]byte
+	mconfirm  [16]byte
+	srand     [16]byte
+	stk       [16]byte
+	encrypted *[16]byte // key the link is encrypted with
+	pdus      int       // PDUs received
+	closed    bool      // the link was closed
+}
+
+// newSMPResponder returns a responder distributing a random key.
+func newSMPResponder(io IOCapability, auth byte) *smpResponder {
+	r := &smpResponder{io: io, auth: auth, dist: smpDistEncKey, rxc: make(chan []byte, 16)}
+	rand.Read(r.ltk.Key[:])
+	r.ltk.EDIV = 0x1234
+	r.ltk.Rand = 0x0102030405060708
+	r.ltk.Size = 16
+	return r
+}
+
+var (
+	testIA = [6]byte{0x00, 0x1A, 0x7D, 0xDA, 0x71, 0x13}
+	testRA = [6]byte{0xC0, 0x26, 0xDF, 0x00, 0x10, 0x01}
+)
+
+func (r *smpResponder) Addresses() (ia, ra [6]byte, iat, rat uint8) {
+	return testIA, testRA, 0x00, 0x01
+}
+
+func (r *smpResponder) SMP() <-chan []byte { return r.rxc }
+
+func (r *smpResponder) WriteSMP(b []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.pdus++
+	if r.mute {
+		return nil
+	}
+	switch b[0] {
+	case smpPairingRequest:
+		if r.reject != 0 {
+			r.rxc <- []byte{smpPairingFailed, byte(r.reject)}
+			return nil
+		}
+		copy(r.preq[:], b)
+		r.pres = [7]byte{smpPairingResponse, byte(r.io), 0x00, r.auth, 16, 0x00, b[6] & r.dist}
+		r.rxc <- r.pres[:]
+	case smpPairingConfirm:
+		copy(r.mconfirm[:], b[1:])
+		r.tk = [16]byte{}
+		if (r.preq[3]|r.auth)&smpAuthMITM != 0 && pairingMethod(IOCapability(r.preq[1]), r.io) != justWorks {
+			binary.LittleEndian.PutUint32(r.tk[:], r.passkey)
+		}
+		rand.Read(r.srand[:])
+		c := smpC1(r.tk, r.srand, r.preq, r.pres, 0x00, 0x01, testIA, testRA)
+		r.rxc <- append([]byte{smpPairingConfirm}, c[:]...)
+	case smpPairingRandom:
+		var mrand [16]byte
+		copy(mrand[:], b[1:])
+		if smpC1(r.tk, mrand, r.preq, r.pres, 0x00, 0x01, testIA, testRA) != r.mconfirm {
+			r.rxc <- []byte{smpPairingFailed, byte(PairingConfirmValueFailed)}
+			return nil
+		}
+		r.stk = smpS1(r.tk, r.srand, mrand)
+		r.rxc <- append([]byte{smpPairingRandom}, r.srand[:]...)
+	}
+	return nil
+}
+
+func (r *smpResponder) StartEncryption(ediv uint16, rnd uint64, ltk [16]byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch {
+	case ediv == 0 && rnd == 0 && ltk == r.stk:
+		r.encrypted = &r.stk
+		if r.pres[6]&smpDistEncKey != 0 {
+			r.rxc <- append([]byte{smpEncryptionInformation}, r.ltk.Key[:]...)
+			b := make([]byte, 11)
+			b[0] = smpMasterIdentification
+			binary.LittleEndian.PutUint16(b[1:3], r.ltk.EDIV)
+			binary.LittleEndian.PutUint64(b[3:11], r.ltk.Rand)
+			r.rxc <- b
+		}
+		return nil
+	case ediv == r.ltk.EDIV && rnd == r.ltk.Rand && ltk == r.ltk.Key:
+		r.encrypted = &r.ltk.Key
+		return nil
+	}
+	return errors.New("encryption failed with status 0x06")
+}
+
+// encryptedWith reports whether the link is encrypted with k.
+func (r *smpResponder) encryptedWith(k [16]byte) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.encrypted != nil && *r.encrypted == k
+}
+
+type testAgent struct {
+	io      IOCapability
+	shown   func(passkey uint32)
+	passkey uint32
+	err     error
+}
+
+func (a *testAgent) IOCapability() IOCapability                  { return a.io }
+func (a *testAgent) DisplayPasskey(p Peripheral, passkey uint32) { a.shown(passkey) }
+func (a *testAgent) RequestPasskey(p Peripheral) (uint32, error) { return a.passkey, a.err }
+
+func TestSMPPairing(t *testing.T) {
+	errCancelled := errors.New("cancelled")
+	for _, tt := range []struct {
+		name  string
+		r     *smpResponder
+		agent func(r *smpResponder) PairingAgent
+		bond  bool
+		mitm  bool
+		auth  bool
+		stale []byte // received before pairing
+		err   error
+	}{
+		{name: "just works", r: newSMPResponder(IONoInputNoOutput, 0)},
+		{name: "just works bonding", r: newSMPResponder(IONoInputNoOutput, smpAuthBonding), bond: true},
+		{
+			name:  "PDU left from an earlier pairing",
+			r:     newSMPResponder(IONoInputNoOutput, 0),
+			stale: []byte{smpPairingFailed, byte(PairingUnspecifiedReason)},
+		},
+		{
+			name: "passkey shown by the peripheral",
+			r:    newSMPResponder(IODisplayOnly, smpAuthBonding|smpAuthMITM),
+			agent: func(r *smpResponder) PairingAgent {
+				r.passkey = 123456
+				return &testAgent{io: IOKeyboardOnly, passkey: 123456}
+			},
+			bond: true,
+			auth: true,
+		},
+		{
+			name: "passkey entered on the peripheral",
+			r:    newSMPResponder(IOKeyboardOnly, smpAuthMITM),
+			agent: func(r *smpResponder) PairingAgent {
+				return &testAgent{io: IODisplayYesNo, shown: func(pk uint32) { r.passkey = pk }}
+			},
+			auth: true,
+		},
+		{
+			name: "wrong passkey",
+			r:    newSMPResponder(IODisplayOnly, smpAuthMITM),
+			agent: func(r *smpResponder) PairingAgent {
+				r.passkey = 123456
+				return &testAgent{io: IOKeyboardOnly, passkey: 654321}
+			},
+			err: PairingConfirmValueFailed,
+		},
+		{
+			name: "passkey entry cancelled",
+			r:    newSMPResponder(IODisplayOnly, smpAuthMITM),
+			agent: func(r *smpResponder) PairingAgent {
+				return &testAgent{io: IOKeyboardOnly, err: errCancelled}
+			},
+			err: errCancelled,
+		},
+		{
+			name: "authentication required of a peripheral without IO",
+			r:    newSMPResponder(IONoInputNoOutput, 0),
+			agent: func(r *smpResponder) PairingAgent {
+				return &testAgent{io: IOKeyboardDisplay}
+			},
+			mitm: true,
+			err:  PairingAuthenticationRequirements,
+		},
+		{name: "rejected", r: &smpResponder{reject: PairingNotSupported, rxc: make(chan []byte, 1)}, err: PairingNotSupported},
+		{name: "timeout", r: &smpResponder{mute: true}, err: ErrPairingTimeout},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &smpPairing{link: tt.r, bond: tt.bond, mitm: tt.mitm, timeout: 50 * time.Millisecond}
+			if tt.agent != nil {
+				s.agent = tt.agent(tt.r)
+			}
+			if tt.stale != nil {
+				tt.r.rxc <- tt.stale
+			}
+			k, auth, err := s.run()
+			if err != tt.err {
+				t.Fatalf("got error %v, want %v", err, tt.err)
+			}
+			if err != nil {
+				return
+			}
+			if auth != tt.auth {
+				t.Errorf("got authenticated %t, want %t", auth, tt.auth)
+			}
+			if !tt.r.encryptedWith(tt.r.stk) {
+				t.Error("link not encrypted with the STK")
+			}
+			switch {
+			case !tt.bond && k != nil:
+				t.Errorf("got key %+v without bonding", k)
+			case tt.bond && (k == nil || k.Key != tt.r.ltk.Key || k.EDIV != tt.r.ltk.EDIV || k.Rand != tt.r.ltk.Rand):
+				t.Errorf("got key %+v, want %+v", k, tt.r.ltk)
+			case tt.bond && (k.Size != 16 || k.Authenticated != tt.auth):
+				t.Errorf("got key size %d, authenticated %t", k.Size, k.Authenticated)
+			}
+		})
+	}
+}
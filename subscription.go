@@ -0,0 +1,252 @@
+package gatt
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// NotifyKind selects notifications or indications of a characteristic
+// value, see Peripheral.Subscribe. Its values are the bits of the client
+// characteristic configuration, and may be combined.
+type NotifyKind uint16
+
+const (
+	Notification NotifyKind = gattCCCNotifyFlag
+	Indication   NotifyKind = gattCCCIndicateFlag
+)
+
+// subscriptionLen is the capacity of Subscription.C.
+const subscriptionLen = 16
+
+// A Subscription receives the values a peripheral notifies or indicates
+// for a characteristic, see Peripheral.Subscribe.
+type Subscription struct {
+	// C receives the values, in order. Values not received hold up the
+	// connection once C is full. C is closed by Close, or when the
+	// peripheral disconnects.
+	C <-chan []byte
+
+	s    *Subscribers
+	char *Characteristic
+	kind NotifyKind
+	c    chan []byte
+	done chan struct{} // closed by Close, to abandon a delivery
+	once sync.Once
+
+	mu    sync.Mutex // held while delivering
+	ended bool
+	err   error
+}
+
+// deliver sends b on C, unless the subscription ends first.
+func (s *Subscription) deliver(b []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.ended {
+		return
+	}
+	select {
+	case s.c <- b:
+	case <-s.done:
+	}
+}
+
+// end closes C, and records err as the reason, unless already ended.
+func (s *Subscription) end(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.ended {
+		s.ended = true
+		s.err = err
+		close(s.c)
+	}
+}
+
+// Close ends the subscription, and stops the peripheral sending the values
+// if it was the last one for the characteristic. It may be called while a
+// value is delivered: once Close returns, C is closed and yields no more
+// values. Values not received yet are dropped.
+func (s *Subscription) Close() error {
+	s.once.Do(func() { close(s.done) })
+	s.end(nil)
+	for range s.c {
+	}
+	return s.s.remove(s)
+}
+
+// Err returns the error that ended the subscription, other than Close,
+// such as a *DisconnectError when the peripheral disconnected.
+func (s *Subscription) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// Subscribers fans out the values notified or indicated for the
+// characteristics of a peripheral to its Subscriptions, for
+// implementations of Peripheral.
+type Subscribers struct {
+	// set configures the peripheral to send the kinds of values given for
+	// a characteristic, none if 0. Calls are serialized by setmu.
+	set   func(c *Characteristic, kinds NotifyKind) error
+	setmu sync.Mutex
+
+	mu    sync.Mutex
+	subs  map[*Characteristic][]*Subscription
+	funcs map[*Characteristic]*Subscription // see setFunc
+	ended bool
+	err   error // of End
+}
+
+// NewSubscribers returns Subscribers configuring the peripheral with set,
+// called with the kinds of values subscribed to for a characteristic
+// whenever they change, and with 0 once none are.
+func NewSubscribers(set func(c *Characteristic, kinds NotifyKind) error) *Subscribers {
+	return &Subscribers{
+		set:   set,
+		subs:  make(map[*Characteristic][]*Subscription),
+		funcs: make(map[*Characteristic]*Subscription),
+	}
+}
+
+// kinds returns the kinds of values subscribed to for c.
+func (ss *Subscribers) kinds(c *Characteristic) NotifyKind {
+	var k NotifyKind
+	for _, s := range ss.subs[c] {
+		k |= s.kind
+	}
+	return k
+}
+
+// Subscribe adds a Subscription to the values of kind for c.
+func (ss *Subscribers) Subscribe(c *Characteristic, kind NotifyKind) (*Subscription, error) {
+	if kind != Notification && kind != Indication {
+		return nil, errors.New("gatt: subscribe to notifications or indications")
+	}
+	ch := make(chan []byte, subscriptionLen)
+	s := &Subscription{C: ch, s: ss, char: c, kind: kind, c: ch, done: make(chan struct{})}
+
+	ss.setmu.Lock()
+	defer ss.setmu.Unlock()
+	ss.mu.Lock()
+	if ss.ended {
+		err := ss.err
+		ss.mu.Unlock()
+		if err == nil {
+			err = io.EOF
+		}
+		return nil, err
+	}
+	before := ss.kinds(c)
+	ss.subs[c] = append(ss.subs[c], s)
+	ss.mu.Unlock()
+
+	if after := before | kind; after != before {
+		if err := ss.set(c, after); err != nil {
+			ss.mu.Lock()
+			ss.drop(s)
+			ss.mu.Unlock()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// drop removes s from the subscriptions.
+func (ss *Subscribers) drop(s *Subscription) {
+	subs := ss.subs[s.char]
+	for i, t := range subs {
+		if t == s {
+			subs = append(subs[:i:i], subs[i+1:]...)
+			break
+		}
+	}
+	if len(subs) == 0 {
+		delete(ss.subs, s.char)
+	} else {
+		ss.subs[s.char] = subs
+	}
+}
+
+// remove drops s, and reconfigures the peripheral if the kinds of values
+// subscribed to changed.
+func (ss *Subscribers) remove(s *Subscription) error {
+	ss.setmu.Lock()
+	defer ss.setmu.Unlock()
+	ss.mu.Lock()
+	before := ss.kinds(s.char)
+	ss.drop(s)
+	after := ss.kinds(s.char)
+	ended := ss.ended
+	ss.mu.Unlock()
+
+	if after == before || ended {
+		return nil
+	}
+	return ss.set(s.char, after)
+}
+
+// Deliver delivers b, a value of c, to its subscriptions, and reports
+// whether there were any.
+func (ss *Subscribers) Deliver(c *Characteristic, b []byte) bool {
+	ss.mu.Lock()
+	subs := ss.subs[c]
+	ss.mu.Unlock()
+	for _, s := range subs {
+		s.deliver(b)
+	}
+	return len(subs) > 0
+}
+
+// End ends all the subscriptions with err, once the peripheral has
+// disconnected. Later calls of Subscribe fail with err, or io.EOF if nil.
+func (ss *Subscribers) End(err error) {
+	ss.mu.Lock()
+	ss.ended = true
+	ss.err = err
+	var subs []*Subscription
+	for _, cs := range ss.subs {
+		subs = append(subs, cs...)
+	}
+	ss.mu.Unlock()
+	for _, s := range subs {
+		s.end(err)
+	}
+}
+
+// setFunc has f called with the values of kind for c, or stops calling
+// the function set earlier if f is nil. It implements SetNotifyValue and
+// SetIndicateValue on top of the subscriptions.
+func (ss *Subscribers) setFunc(c *Characteristic, kind NotifyKind, f func(*Characteristic, []byte, error)) error {
+	// Subscribe before closing the subscription replaced, so that the
+	// peripheral does not stop sending the values in between.
+	var s *Subscription
+	if f != nil {
+		var err error
+		if s, err = ss.Subscribe(c, kind); err != nil {
+			return err
+		}
+		go func() {
+			for b := range s.C {
+				f(c, b, nil)
+			}
+			if err := s.Err(); err != nil {
+				f(c, nil, err)
+			}
+		}()
+	}
+
+	ss.mu.Lock()
+	old := ss.funcs[c]
+	if s != nil {
+		ss.funcs[c] = s
+	} else {
+		delete(ss.funcs, c)
+	}
+	ss.mu.Unlock()
+	if old != nil {
+		return old.Close()
+	}
+	return nil
+}
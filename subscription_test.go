@@ -0,0 +1,173 @@
+package gatt
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordSet returns a set function for NewSubscribers recording the
+// kinds it is called with.
+func recordSet() (func(*Characteristic, NotifyKind) error, func() []NotifyKind) {
+	var mu sync.Mutex
+	var calls []NotifyKind
+	set := func(c *Characteristic, kinds NotifyKind) error {
+		mu.Lock()
+		calls = append(calls, kinds)
+		mu.Unlock()
+		return nil
+	}
+	return set, func() []NotifyKind {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]NotifyKind(nil), calls...)
+	}
+}
+
+func TestSubscriptionsFanOut(t *testing.T) {
+	set, calls := recordSet()
+	ss := NewSubscribers(set)
+	c, other := &Characteristic{}, &Characteristic{}
+
+	a, err := ss.Subscribe(c, Notification)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ss.Subscribe(c, Notification)
+	i, _ := ss.Subscribe(c, Indication)
+	if !ss.Deliver(c, []byte("v1")) {
+		t.Error("Deliver: no subscribers")
+	}
+	if ss.Deliver(other, []byte("v2")) {
+		t.Error("Deliver to other: subscribers")
+	}
+	for _, s := range []*Subscription{a, b, i} {
+		if v := <-s.C; string(v) != "v1" {
+			t.Errorf("got %q, want v1", v)
+		}
+	}
+
+	a.Close()
+	i.Close()
+	b.Close()
+	want := []NotifyKind{Notification, Notification | Indication, Notification, 0}
+	if got := calls(); !reflect.DeepEqual(got, want) {
+		t.Errorf("set calls: got %v, want %v", got, want)
+	}
+	if ss.Deliver(c, []byte("v3")) {
+		t.Error("Deliver after Close: subscribers")
+	}
+}
+
+func TestSubscriptionCloseWhileDelivering(t *testing.T) {
+	set, _ := recordSet()
+	ss := NewSubscribers(set)
+	c := &Characteristic{}
+
+	for i := 0; i < 20; i++ {
+		s, _ := ss.Subscribe(c, Notification)
+		stop := make(chan struct{})
+		delivered := make(chan struct{})
+		go func() {
+			defer close(delivered)
+			// More values than C holds, so that a delivery is blocked.
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					ss.Deliver(c, []byte{0})
+				}
+			}
+		}()
+		time.Sleep(time.Millisecond)
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if v, ok := <-s.C; ok {
+			t.Fatalf("received %v after Close", v)
+		}
+		close(stop)
+		<-delivered
+	}
+}
+
+func TestSubscriptionsEnd(t *testing.T) {
+	set, calls := recordSet()
+	ss := NewSubscribers(set)
+	c := &Characteristic{}
+
+	s, _ := ss.Subscribe(c, Indication)
+	var got []error
+	done := make(chan struct{})
+	ss.setFunc(c, Notification, func(_ *Characteristic, b []byte, err error) {
+		if err != nil {
+			got = append(got, err)
+			close(done)
+		}
+	})
+	ss.End(io.EOF)
+	if _, ok := <-s.C; ok {
+		t.Error("C not closed")
+	}
+	if err := s.Err(); err != io.EOF {
+		t.Errorf("Err: got %v, want io.EOF", err)
+	}
+	<-done
+	if len(got) != 1 || got[0] != io.EOF {
+		t.Errorf("callback errors: got %v, want [EOF]", got)
+	}
+	if _, err := ss.Subscribe(c, Notification); err != io.EOF {
+		t.Errorf("Subscribe after End: got %v, want io.EOF", err)
+	}
+	// Closing after the disconnect does not configure the peripheral.
+	n := len(calls())
+	s.Close()
+	if len(calls()) != n {
+		t.Error("set called after End")
+	}
+}
+
+func TestSubscriptionsSetFunc(t *testing.T) {
+	set, calls := recordSet()
+	ss := NewSubscribers(set)
+	c := &Characteristic{}
+
+	values := make(chan string, 2)
+	f := func(_ *Characteristic, b []byte, err error) { values <- string(b) }
+	if err := ss.setFunc(c, Notification, f); err != nil {
+		t.Fatal(err)
+	}
+	ss.Deliver(c, []byte("v1"))
+	if v := <-values; v != "v1" {
+		t.Errorf("got %q, want v1", v)
+	}
+	// Replacing the function keeps the characteristic configured.
+	if err := ss.setFunc(c, Notification, f); err != nil {
+		t.Fatal(err)
+	}
+	if err := ss.setFunc(c, Notification, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := calls(), []NotifyKind{Notification, 0}; !reflect.DeepEqual(got, want) {
+		t.Errorf("set calls: got %v, want %v", got, want)
+	}
+}
+
+func TestSubscribeSetError(t *testing.T) {
+	errSet := errors.New("set")
+	ss := NewSubscribers(func(*Characteristic, NotifyKind) error { return errSet })
+	c := &Characteristic{}
+	if _, err := ss.Subscribe(c, Notification); err != errSet {
+		t.Errorf("got %v, want %v", err, errSet)
+	}
+	if ss.Deliver(c, []byte{0}) {
+		t.Error("failed subscription kept")
+	}
+	if _, err := ss.Subscribe(c, 0); err == nil {
+		t.Error("Subscribe to no kind: no error")
+	}
+}
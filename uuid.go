@@ -71,6 +71,21 @@ func (u UUID) Equal(v UUID) bool {
 	return bytes.Equal(u.b, v.b)
 }
 
+// MarshalText encodes u as String does.
+func (u UUID) MarshalText() ([]byte, error) {
+	return []byte(u.String()), nil
+}
+
+// UnmarshalText decodes b as ParseUUID does.
+func (u *UUID) UnmarshalText(b []byte) error {
+	v, err := ParseUUID(string(b))
+	if err != nil {
+		return err
+	}
+	*u = v
+	return nil
+}
+
 // reverse returns a reversed copy of u.
 func reverse(u []byte) []byte {
 	// Special-case 16 bit UUIDS for speed.
@@ -52,3 +52,20 @@ func BenchmarkReverseBytes128(b *testing.B) {
 		reverse(u.b)
 	}
 }
+
+func TestUUIDText(t *testing.T) {
+	for _, u := range []UUID{UUID16(0x2902), MustParseUUID("34DA3AD1-7110-41A1-B1EF-4430F509CDE7")} {
+		b, err := u.MarshalText()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var v UUID
+		if err := v.UnmarshalText(b); err != nil || !v.Equal(u) {
+			t.Errorf("UnmarshalText(%s): got %v, %v", b, v, err)
+		}
+	}
+	var v UUID
+	if err := v.UnmarshalText([]byte("123")); err == nil {
+		t.Error("UnmarshalText of a bad UUID: no error")
+	}
+}
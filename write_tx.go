@@ -0,0 +1,31 @@
+package gatt
+
+import "errors"
+
+// ErrWriteVerify is returned by ReliableWrite when the peripheral echoes a
+// prepared write back altered. The transaction is then cancelled.
+var ErrWriteVerify = errors.New("prepared write echoed back altered")
+
+// A WriteTx collects the characteristic writes of a reliable write, see
+// Peripheral.ReliableWrite.
+type WriteTx struct {
+	writes []TxWrite
+}
+
+// A TxWrite is a write queued in a WriteTx.
+type TxWrite struct {
+	Characteristic *Characteristic
+	Value          []byte
+}
+
+// WriteCharacteristic queues a write of value to c. Nothing is sent until
+// the function passed to ReliableWrite returns.
+func (tx *WriteTx) WriteCharacteristic(c *Characteristic, value []byte) {
+	tx.writes = append(tx.writes, TxWrite{c, append([]byte(nil), value...)})
+}
+
+// Writes returns the writes queued, in order, for implementations of
+// Peripheral.
+func (tx *WriteTx) Writes() []TxWrite {
+	return tx.writes
+}